@@ -13,3 +13,28 @@ Helm can't merge maps of different types. Need to manually create a `transformat
     {{ $lowDataDefault := .Files.Get "static/lowdatamodedefaults.yaml" | fromYaml }}
     {{- $lowDataDefault.transformations | toYaml | nindent 4 -}}
 {{- end -}}
+
+{{/*
+Returns the namespace of the ConfigMap keeping the delta state of the telemetry emitter, which is
+either "name" or "namespace/name". It defaults to the namespace of the release, where the pod runs.
+*/}}
+{{- define "nri-prometheus.deltaStateConfigMap.namespace" -}}
+    {{- $configMap := .Values.config.telemetry_emitter_delta_state_configmap -}}
+    {{- if contains "/" $configMap -}}
+        {{- (split "/" $configMap)._0 -}}
+    {{- else -}}
+        {{- .Release.Namespace -}}
+    {{- end -}}
+{{- end -}}
+
+{{/*
+Returns the name of the ConfigMap keeping the delta state of the telemetry emitter.
+*/}}
+{{- define "nri-prometheus.deltaStateConfigMap.name" -}}
+    {{- $configMap := .Values.config.telemetry_emitter_delta_state_configmap -}}
+    {{- if contains "/" $configMap -}}
+        {{- (split "/" $configMap)._1 -}}
+    {{- else -}}
+        {{- $configMap -}}
+    {{- end -}}
+{{- end -}}
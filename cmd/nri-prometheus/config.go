@@ -12,6 +12,7 @@ import (
 
 	"github.com/newrelic/nri-prometheus/internal/integration"
 
+	"github.com/mitchellh/mapstructure"
 	"github.com/newrelic/infra-integrations-sdk/v4/args"
 	"github.com/newrelic/nri-prometheus/internal/cmd/scraper"
 	"github.com/pkg/errors"
@@ -62,7 +63,12 @@ func loadConfig() (*scraper.Config, error) {
 
 	var scraperCfg scraper.Config
 	bindViperEnv(cfg, scraperCfg)
-	err = cfg.Unmarshal(&scraperCfg)
+	err = cfg.Unmarshal(&scraperCfg, viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
+		mapstructure.StringToTimeDurationHookFunc(),
+		mapstructure.StringToSliceHookFunc(","),
+		// The emitters can be configured with just their names.
+		scraper.EmitterConfigHookFunc(),
+	)))
 
 	if err != nil {
 		return nil, errors.Wrap(err, "could not parse configuration file")
@@ -71,16 +77,28 @@ func loadConfig() (*scraper.Config, error) {
 	// Set emitter default according to standalone mode.
 	if len(scraperCfg.Emitters) == 0 {
 		if scraperCfg.Standalone {
-			scraperCfg.Emitters = append(scraperCfg.Emitters, "telemetry")
+			scraperCfg.Emitters = append(scraperCfg.Emitters, scraper.EmitterConfig{Name: "telemetry"})
 		} else {
-			scraperCfg.Emitters = append(scraperCfg.Emitters, "infra-sdk")
+			scraperCfg.Emitters = append(scraperCfg.Emitters, scraper.EmitterConfig{Name: "infra-sdk"})
 		}
 	}
 
 	if scraperCfg.MetricAPIURL == "" {
 		scraperCfg.MetricAPIURL = determineMetricAPIURL(string(scraperCfg.LicenseKey))
 	}
+	if scraperCfg.EventAPIURL == "" {
+		scraperCfg.EventAPIURL = determineEventAPIURL(string(scraperCfg.LicenseKey))
+	}
+	for i, account := range scraperCfg.TelemetryAccounts {
+		if account.MetricAPIURL == "" {
+			scraperCfg.TelemetryAccounts[i].MetricAPIURL = determineMetricAPIURL(string(account.LicenseKey))
+		}
+		if account.EventAPIURL == "" {
+			scraperCfg.TelemetryAccounts[i].EventAPIURL = determineEventAPIURL(string(account.LicenseKey))
+		}
+	}
 	scraperCfg.HostID = c.NriHostID
+	scraperCfg.ConfigFile = cfg.ConfigFileUsed()
 
 	return &scraperCfg, nil
 }
@@ -107,7 +125,10 @@ func setViperDefaults(viper *viper.Viper) {
 	viper.SetDefault("scrape_endpoints", false)
 	viper.SetDefault("percentiles", []float64{50.0, 95.0, 99.0})
 	viper.SetDefault("worker_threads", 4)
+	viper.SetDefault("processing_workers", 1)
 	viper.SetDefault("self_metrics_listening_address", ":8080")
+	viper.SetDefault("reload_transformations", false)
+	viper.SetDefault("redact_query_params", []string{"access_token", "api_key", "apikey", "password", "secret", "token"})
 }
 
 // bindViperEnv automatically binds the variables in given configuration struct to environment variables.
@@ -139,6 +160,8 @@ var (
 	metricAPIRegionURL = "https://metric-api.%s.newrelic.com/metric/v1/infra"
 	// for historical reasons the US datacenter is the default Metric API
 	defaultMetricAPIURL = "https://metric-api.newrelic.com/metric/v1/infra"
+	eventAPIRegionURL   = "https://insights-collector.%s01.nr-data.net/v1/accounts/events"
+	defaultEventAPIURL  = "https://insights-collector.newrelic.com/v1/accounts/events"
 )
 
 // determineMetricAPIURL determines the Metric API URL based on the license key.
@@ -151,3 +174,14 @@ func determineMetricAPIURL(license string) string {
 
 	return defaultMetricAPIURL
 }
+
+// determineEventAPIURL determines the Event API URL based on the license key,
+// like determineMetricAPIURL.
+func determineEventAPIURL(license string) string {
+	m := regionLicenseRegex.FindStringSubmatch(license)
+	if len(m) > 1 {
+		return fmt.Sprintf(eventAPIRegionURL, m[1])
+	}
+
+	return defaultEventAPIURL
+}
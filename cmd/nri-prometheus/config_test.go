@@ -4,6 +4,7 @@ package main
 
 import (
 	"fmt"
+	"path/filepath"
 	"reflect"
 	"testing"
 	"time"
@@ -35,11 +36,33 @@ func TestDetermineMetricAPIURL(t *testing.T) {
 	}
 }
 
+func TestDetermineEventAPIURL(t *testing.T) {
+	testCases := []struct {
+		license     string
+		expectedURL string
+	}{
+		// empty license
+		{license: "", expectedURL: defaultEventAPIURL},
+		// non-region license
+		{license: "0123456789012345678901234567890123456789", expectedURL: defaultEventAPIURL},
+		// region license
+		{license: "eu01xx6789012345678901234567890123456789", expectedURL: "https://insights-collector.eu01.nr-data.net/v1/accounts/events"},
+	}
+
+	for _, tt := range testCases {
+		actualURL := determineEventAPIURL(tt.license)
+		if actualURL != tt.expectedURL {
+			t.Fatalf("URL does not match expected URL, got=%s, expected=%s", actualURL, tt.expectedURL)
+		}
+	}
+}
+
 func TestLoadConfig(t *testing.T) {
 	expectedScrapper := scraper.Config{
 		MetricAPIURL:                      "https://metric-api.newrelic.com/metric/v1/infra",
+		EventAPIURL:                       "https://insights-collector.newrelic.com/v1/accounts/events",
 		Verbose:                           true,
-		Emitters:                          []string{"infra-sdk"},
+		Emitters:                          []scraper.EmitterConfig{{Name: "infra-sdk"}},
 		ScrapeEnabledLabel:                "prometheus.io/scrape",
 		RequireScrapeEnabledLabelForNodes: true,
 		ScrapeTimeout:                     5 * time.Second,
@@ -60,8 +83,15 @@ func TestLoadConfig(t *testing.T) {
 		},
 		InsecureSkipVerify: true,
 		WorkerThreads:      4,
+		ProcessingWorkers:  1,
+		RedactQueryParams:  []string{"access_token", "api_key", "apikey", "password", "secret", "token"},
 		HostID:             "awesome-host",
 	}
+	configFile, err := filepath.Abs("testdata/config-with-legacy-entity-definitions.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedScrapper.ConfigFile = configFile
 	t.Setenv("CONFIG_PATH", "testdata/config-with-legacy-entity-definitions.yaml")
 	t.Setenv("NRI_HOST_ID", "awesome-host")
 	scraperCfg, err := loadConfig()
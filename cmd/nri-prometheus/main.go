@@ -3,12 +3,21 @@
 package main
 
 import (
+	"os"
+
 	"github.com/newrelic/nri-prometheus/internal/cmd/scraper"
 	"github.com/newrelic/nri-prometheus/internal/integration"
 	"github.com/sirupsen/logrus"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == testRulesCommand {
+		if err := runTestRules(os.Args[2:], os.Stdout); err != nil {
+			logrus.WithError(err).Fatal("while testing transformations")
+		}
+		return
+	}
+
 	cfg, err := loadConfig()
 	if err != nil {
 		logrus.WithError(err).Fatal("while loading configuration")
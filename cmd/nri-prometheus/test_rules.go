@@ -0,0 +1,132 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/prometheus/common/expfmt"
+	"github.com/spf13/viper"
+
+	"github.com/newrelic/nri-prometheus/internal/cmd/ruletester"
+	"github.com/newrelic/nri-prometheus/internal/cmd/scraper"
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+	"github.com/newrelic/nri-prometheus/internal/pkg/prometheus"
+)
+
+const testRulesCommand = "test-rules"
+
+// inputContentTypes are the content types of the formats of the input
+// metrics, as returned by the targets.
+var inputContentTypes = map[string]string{
+	"text":        "",
+	"openmetrics": prometheus.OpenMetricsContentType,
+	"protobuf":    string(expfmt.FmtProtoDelim),
+}
+
+// labelFlags collects the repeatable `-label key=value` flags.
+type labelFlags labels.Set
+
+func (l labelFlags) String() string {
+	return fmt.Sprint(labels.Set(l))
+}
+
+func (l labelFlags) Set(value string) error {
+	k, v, ok := strings.Cut(value, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("labels must be in the key=value form, got %q", value)
+	}
+	l[k] = v
+	return nil
+}
+
+// runTestRules runs the test-rules subcommand, which applies the
+// transformations of a config file to the metrics of a saved exposition
+// payload and prints the result.
+func runTestRules(arguments []string, out io.Writer) error {
+	fs := flag.NewFlagSet(testRulesCommand, flag.ContinueOnError)
+	fs.SetOutput(out)
+	configPath := fs.String("config", "", "Path to the config file with the transformations to test")
+	inputPath := fs.String("input", "", "Path to the metrics in the exposition format given by -format. Use - to read from stdin")
+	format := fs.String("format", "text", "Exposition format of the input metrics: text, openmetrics or protobuf")
+	clusterName := fs.String("cluster-name", "", "Cluster name added by the default transformations. Defaults to the cluster_name of the config file")
+	targetURL := fs.String("target-url", "http://localhost:9090/metrics", "URL of the fake target the metrics are scraped from")
+	targetKind := fs.String("target-kind", "user_provided", "Kind of the object exposing the fake target, e.g. pod or service")
+	diff := fs.Bool("diff", false, "Print what was dropped, renamed or decorated instead of the resulting metrics")
+	objectLabels := labelFlags{}
+	fs.Var(objectLabels, "label", "Label of the object exposing the fake target, as key=value. Can be repeated")
+	if err := fs.Parse(arguments); err != nil {
+		return err
+	}
+
+	if *configPath == "" || *inputPath == "" {
+		fs.Usage()
+		return fmt.Errorf("-config and -input are required")
+	}
+
+	contentType, ok := inputContentTypes[*format]
+	if !ok {
+		return fmt.Errorf("unknown input format %q, must be text, openmetrics or protobuf", *format)
+	}
+
+	rules, err := scraper.LoadTransformations(*configPath)
+	if err != nil {
+		return err
+	}
+	if *clusterName == "" {
+		*clusterName, err = configClusterName(*configPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	u, err := url.Parse(*targetURL)
+	if err != nil {
+		return fmt.Errorf("parsing target URL: %w", err)
+	}
+
+	input := os.Stdin
+	if *inputPath != "-" {
+		input, err = os.Open(*inputPath)
+		if err != nil {
+			return fmt.Errorf("opening input metrics: %w", err)
+		}
+		defer input.Close()
+	}
+
+	return ruletester.Run(ruletester.Config{
+		ProcessingRules: rules,
+		ClusterName:     *clusterName,
+		ContentType:     contentType,
+		Target: endpoints.Target{
+			Name: u.Host,
+			URL:  *u,
+			Object: endpoints.Object{
+				Name:   u.Host,
+				Kind:   *targetKind,
+				Labels: labels.Set(objectLabels),
+			},
+		},
+		Diff: *diff,
+	}, input, out)
+}
+
+// configClusterName returns the cluster name of the config file, which can be
+// overridden by the CLUSTER_NAME environment variable like when running the
+// integration.
+func configClusterName(configPath string) (string, error) {
+	cfg := viper.New()
+	cfg.SetConfigType("yaml")
+	cfg.SetConfigFile(configPath)
+	if err := cfg.ReadInConfig(); err != nil {
+		return "", fmt.Errorf("reading configuration file: %w", err)
+	}
+	_ = cfg.BindEnv("cluster_name")
+	return cfg.GetString("cluster_name"), nil
+}
@@ -0,0 +1,208 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package ruletester runs the processing rules against a saved exposition
+// payload, so they can be tested without scraping real targets.
+package ruletester
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/newrelic/nri-prometheus/internal/cmd/scraper"
+	"github.com/newrelic/nri-prometheus/internal/integration"
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+	"github.com/newrelic/nri-prometheus/internal/pkg/prometheus"
+)
+
+// Config is the config struct for the rule tester.
+type Config struct {
+	// ProcessingRules are the transformations to test. The default
+	// transformations of the scraper are applied after them.
+	ProcessingRules []integration.ProcessingRule
+	// ClusterName is the cluster name added by the default transformations.
+	ClusterName string
+	// ContentType is the content type of the input, as returned by the
+	// targets, e.g. prometheus.OpenMetricsContentType. Defaults to the text
+	// format.
+	ContentType string
+	// Target is the fake target the input metrics are attributed to.
+	Target endpoints.Target
+	// Diff prints the changes made by the rules instead of the resulting
+	// metrics.
+	Diff bool
+}
+
+// series is a snapshot of a metric before being processed.
+type series struct {
+	name       string
+	attributes labels.Set
+}
+
+// Run parses the exposition payload from input, applies the processing rules
+// to its metrics like the scraper does, and writes the result to out.
+func Run(cfg Config, input io.Reader, out io.Writer) error {
+	payload, err := io.ReadAll(input)
+	if err != nil {
+		return fmt.Errorf("reading input metrics: %w", err)
+	}
+	mfs, err := prometheus.DecodeContent(payload, cfg.ContentType)
+	if err != nil {
+		return fmt.Errorf("parsing input metrics: %w", err)
+	}
+
+	rules := scraper.WithDefaultTransformations(cfg.ProcessingRules, cfg.ClusterName)
+	ruleSet, err := integration.NewRuleSet(rules)
+	if err != nil {
+		return fmt.Errorf("invalid transformations: %w", err)
+	}
+
+	targetMetrics := integration.NewTargetMetrics(cfg.Target, mfs)
+	sortMetrics(targetMetrics.Metrics)
+
+	// The processing rules modify the attributes in place, so they are copied
+	// before processing for the diff.
+	original := make([]series, 0, len(targetMetrics.Metrics))
+	for _, m := range targetMetrics.Metrics {
+		attrs := labels.Set{}
+		labels.Accumulate(attrs, m.Attributes())
+		original = append(original, series{name: m.Name(), attributes: attrs})
+	}
+
+	pairs := make(chan integration.TargetMetrics, 1)
+	pairs <- targetMetrics
+	close(pairs)
+	processed := <-integration.RuleSetProcessor(ruleSet, 1, 1)(pairs)
+
+	if cfg.Diff {
+		return writeDiff(out, rules, original, processed.Metrics)
+	}
+
+	for _, m := range processed.Metrics {
+		if _, err := fmt.Fprintf(out, "%s%s %s\n", m.Name(), formatAttributes(m.Attributes()), formatValue(m)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeDiff writes which series were dropped, and which attributes were
+// renamed, added or modified in the ones that were kept.
+func writeDiff(out io.Writer, rules []integration.ProcessingRule, original []series, processed []integration.Metric) error {
+	var dropped, modified, unchanged int
+
+	// The processing rules never reorder the metrics, and they drop all the
+	// series of a metric name at once, so the processed metrics can be
+	// matched with the original ones by walking both lists in order.
+	j := 0
+	for _, o := range original {
+		if j >= len(processed) || processed[j].Name() != o.name {
+			dropped++
+			fmt.Fprintf(out, "- %s%s\n", o.name, formatAttributes(o.attributes))
+			continue
+		}
+
+		attrs := processed[j].Attributes()
+		j++
+
+		changes := attributeChanges(rules, o, attrs)
+		if len(changes) == 0 {
+			unchanged++
+			continue
+		}
+		modified++
+		fmt.Fprintf(out, "~ %s%s\n", o.name, formatAttributes(o.attributes))
+		for _, c := range changes {
+			fmt.Fprintf(out, "    %s\n", c)
+		}
+	}
+
+	_, err := fmt.Fprintf(out, "\n%d series: %d dropped, %d modified, %d unchanged\n", len(original), dropped, modified, unchanged)
+	return err
+}
+
+// attributeChanges describes the differences between the attributes of a
+// series before and after being processed.
+func attributeChanges(rules []integration.ProcessingRule, o series, attrs labels.Set) []string {
+	renamed := renamedAttributes(rules, o.name)
+
+	var changes []string
+	for _, k := range sortedKeys(attrs) {
+		v := attrs[k]
+		ov, existed := o.attributes[k]
+		switch {
+		case !existed:
+			if from, ok := renamed[k]; ok && o.attributes[from] == v {
+				changes = append(changes, fmt.Sprintf("> %s renamed to %s", from, k))
+				continue
+			}
+			changes = append(changes, fmt.Sprintf("+ %s=%q", k, fmt.Sprint(v)))
+		case ov != v:
+			changes = append(changes, fmt.Sprintf("~ %s=%q -> %q", k, fmt.Sprint(ov), fmt.Sprint(v)))
+		}
+	}
+	return changes
+}
+
+// renamedAttributes returns the attributes that the rename rules would
+// create for the metric, mapped to the attributes they come from.
+func renamedAttributes(rules []integration.ProcessingRule, name string) map[string]string {
+	renamed := map[string]string{}
+	for _, pr := range rules {
+		for _, rr := range pr.RenameAttributes {
+			if !strings.HasPrefix(name, rr.MetricPrefix) {
+				continue
+			}
+			for current, updated := range rr.Attributes {
+				if u, ok := updated.(string); ok {
+					renamed[u] = current
+				}
+			}
+		}
+	}
+	return renamed
+}
+
+// sortMetrics sorts the metrics by name and attributes, so the output is
+// stable between runs.
+func sortMetrics(metrics []integration.Metric) {
+	sort.SliceStable(metrics, func(i, j int) bool {
+		if metrics[i].Name() != metrics[j].Name() {
+			return metrics[i].Name() < metrics[j].Name()
+		}
+		return formatAttributes(metrics[i].Attributes()) < formatAttributes(metrics[j].Attributes())
+	})
+}
+
+func sortedKeys(attrs labels.Set) []string {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatAttributes(attrs labels.Set) string {
+	pairs := make([]string, 0, len(attrs))
+	for _, k := range sortedKeys(attrs) {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", k, fmt.Sprint(attrs[k])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(m integration.Metric) string {
+	switch v := m.Value().(type) {
+	case *dto.Histogram:
+		return fmt.Sprintf("histogram(count=%d,sum=%g,buckets=%d)", v.GetSampleCount(), v.GetSampleSum(), len(v.GetBucket()))
+	case *dto.Summary:
+		return fmt.Sprintf("summary(count=%d,sum=%g,quantiles=%d)", v.GetSampleCount(), v.GetSampleSum(), len(v.GetQuantile()))
+	default:
+		return fmt.Sprintf("%v (%s)", v, m.Type())
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package ruletester
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/integration"
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+	"github.com/newrelic/nri-prometheus/internal/pkg/prometheus"
+)
+
+const input = `# TYPE go_goroutines gauge
+go_goroutines 12
+# TYPE redis_build_info gauge
+redis_build_info{version="4.0.10"} 1
+# TYPE redis_connected_clients gauge
+redis_connected_clients{addr="redis:6379"} 3
+`
+
+var rules = []integration.ProcessingRule{
+	{
+		IgnoreMetrics: []integration.IgnoreRule{{Prefixes: []string{"go_"}}},
+		RenameAttributes: []integration.RenameRule{
+			{MetricPrefix: "redis_", Attributes: map[string]interface{}{"addr": "address"}},
+		},
+		CopyAttributes: []integration.CopyAttributesRule{
+			{FromMetric: "redis_build_info", ToMetrics: []string{"redis_connected_"}, Attributes: []string{"version"}},
+		},
+	},
+}
+
+func testTarget(t *testing.T) endpoints.Target {
+	t.Helper()
+
+	u, err := url.Parse("http://redis:9121/metrics")
+	require.NoError(t, err)
+	return endpoints.Target{
+		Name: u.Host,
+		URL:  *u,
+		Object: endpoints.Object{
+			Name:   "redis",
+			Kind:   "pod",
+			Labels: labels.Set{"namespace": "cache"},
+		},
+	}
+}
+
+func TestRun(t *testing.T) {
+	out := &bytes.Buffer{}
+	err := Run(Config{ProcessingRules: rules, Target: testTarget(t)}, strings.NewReader(input), out)
+	require.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.True(t, strings.HasPrefix(lines[0], "redis_build_info{"))
+	assert.True(t, strings.HasPrefix(lines[1], "redis_connected_clients{"))
+	assert.Contains(t, lines[1], `address="redis:6379"`)
+	assert.Contains(t, lines[1], `namespace="cache"`)
+	assert.Contains(t, lines[1], `version="4.0.10"`)
+	assert.True(t, strings.HasSuffix(lines[1], " 3 (gauge)"))
+}
+
+func TestRun_Diff(t *testing.T) {
+	out := &bytes.Buffer{}
+	err := Run(Config{ProcessingRules: rules, Target: testTarget(t), Diff: true}, strings.NewReader(input), out)
+	require.NoError(t, err)
+
+	diff := out.String()
+	assert.Contains(t, diff, "- go_goroutines{")
+	assert.Contains(t, diff, "~ redis_connected_clients{")
+	assert.Contains(t, diff, "    > addr renamed to address\n")
+	assert.Contains(t, diff, `    + version="4.0.10"`)
+	assert.Contains(t, diff, `    + scrapedTargetKind="pod"`)
+	assert.Contains(t, diff, "3 series: 1 dropped, 2 modified, 0 unchanged")
+}
+
+func TestRun_DefaultTransformations(t *testing.T) {
+	out := &bytes.Buffer{}
+	err := Run(Config{ClusterName: "staging", Target: testTarget(t)}, strings.NewReader(input), out)
+	require.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 3)
+	for _, line := range lines {
+		assert.Contains(t, line, `clusterName="staging"`)
+		assert.Contains(t, line, `instrumentation.provider="newRelic"`)
+	}
+}
+
+func TestRun_OpenMetrics(t *testing.T) {
+	openMetricsInput := `# TYPE redis_commands counter
+redis_commands_total{cmd="get"} 5 # {trace_id="0af7651916cd43dd"} 1
+redis_commands_created{cmd="get"} 1520430000
+# EOF
+`
+	out := &bytes.Buffer{}
+	err := Run(Config{Target: testTarget(t), ContentType: prometheus.OpenMetricsContentType}, strings.NewReader(openMetricsInput), out)
+	require.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 1)
+	assert.True(t, strings.HasPrefix(lines[0], "redis_commands_total{"))
+	assert.True(t, strings.HasSuffix(lines[0], " 5 (count)"))
+}
+
+func TestRun_InvalidRules(t *testing.T) {
+	invalid := []integration.ProcessingRule{
+		{RenameAttributes: []integration.RenameRule{{Attributes: map[string]interface{}{"a": 1}}}},
+	}
+	err := Run(Config{ProcessingRules: invalid, Target: testTarget(t)}, strings.NewReader(input), &bytes.Buffer{})
+	assert.Error(t, err)
+}
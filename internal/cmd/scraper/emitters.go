@@ -0,0 +1,389 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package scraper
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	"github.com/newrelic/nri-prometheus/internal/integration"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// EmitterConfig is the configuration of an emitter. The emitters without
+// options can be configured with just their names.
+type EmitterConfig struct {
+	Name string `mapstructure:"name"`
+	// Instance is the unique name of the emitter, labelling its
+	// self-metrics. Defaults to its name, suffixed with its position among
+	// the emitters of the same type if there are several of them.
+	Instance string `mapstructure:"instance"`
+	// EmitterFilter selects the metrics sent to the emitter, all of them if
+	// it's empty.
+	integration.EmitterFilter `mapstructure:",squash"`
+	// Queue of the metrics waiting to be emitted by the emitter.
+	Queue integration.EmitterQueueConfig `mapstructure:"queue"`
+	// Options are the rest of the settings of the emitter, specific to its
+	// type, e.g. the url of a webhook emitter. They are decoded when the
+	// emitter is created. The telemetry emitter is configured by the
+	// top-level settings instead.
+	Options map[string]interface{} `mapstructure:",remain"`
+}
+
+// EmitterConfigHookFunc returns a mapstructure decode hook decoding the
+// emitters configured with just their names, e.g. `emitters: [telemetry]`.
+func EmitterConfigHookFunc() mapstructure.DecodeHookFuncType {
+	return func(f reflect.Type, t reflect.Type, data interface{}) (interface{}, error) {
+		if f.Kind() != reflect.String || t != reflect.TypeOf(EmitterConfig{}) {
+			return data, nil
+		}
+		return map[string]interface{}{"name": data}, nil
+	}
+}
+
+// decodeOptions decodes the options of the emitter. Unknown options, e.g.
+// the ones of another type of emitter, are an error.
+func (e EmitterConfig) decodeOptions(options interface{}) error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToSliceHookFunc(","),
+		),
+		ErrorUnused:      true,
+		WeaklyTypedInput: true,
+		Result:           options,
+	})
+	if err != nil {
+		return err
+	}
+	if err := decoder.Decode(e.Options); err != nil {
+		return fmt.Errorf("invalid options of the %s emitter: %w", e.Instance, err)
+	}
+	return nil
+}
+
+// setEmitterInstances defaults the instance names of the emitters, e.g.
+// webhook and webhook-2 for two webhook emitters, and checks they are unique.
+func setEmitterInstances(emitters []EmitterConfig) error {
+	instances := map[string]bool{}
+	for _, e := range emitters {
+		if e.Instance == "" {
+			continue
+		}
+		if instances[e.Instance] {
+			return fmt.Errorf("duplicated emitter instance %q", e.Instance)
+		}
+		instances[e.Instance] = true
+	}
+	count := map[string]int{}
+	for i, e := range emitters {
+		count[e.Name]++
+		if e.Instance != "" {
+			continue
+		}
+		instance := e.Name
+		for n := count[e.Name]; n > 1 && instance == e.Name || instances[instance]; n++ {
+			instance = fmt.Sprintf("%s-%d", e.Name, n)
+		}
+		emitters[i].Instance = instance
+		instances[instance] = true
+	}
+	return nil
+}
+
+type stdoutEmitterOptions struct {
+	Format string `mapstructure:"format"`
+}
+
+type eventEmitterOptions struct {
+	EventType string   `mapstructure:"event_type"`
+	Selectors []string `mapstructure:"selectors"`
+}
+
+type otlpEmitterOptions struct {
+	Endpoint           string            `mapstructure:"endpoint"`
+	Headers            map[string]string `mapstructure:"headers"`
+	ResourceAttributes map[string]string `mapstructure:"resource_attributes"`
+	Temporality        string            `mapstructure:"temporality"`
+	DisableCompression bool              `mapstructure:"disable_compression"`
+	BatchSize          int               `mapstructure:"batch_size"`
+	Timeout            time.Duration     `mapstructure:"timeout"`
+	MaxRetries         int               `mapstructure:"max_retries"`
+	CAFile             string            `mapstructure:"ca_file"`
+	InsecureSkipVerify bool              `mapstructure:"insecure_skip_verify"`
+}
+
+type federateEmitterOptions struct {
+	Expiration time.Duration `mapstructure:"expiration"`
+}
+
+type remoteWriteEmitterOptions struct {
+	URL                string            `mapstructure:"url"`
+	Headers            map[string]string `mapstructure:"headers"`
+	Username           string            `mapstructure:"username"`
+	Password           string            `mapstructure:"password"`
+	BearerToken        string            `mapstructure:"bearer_token"`
+	BearerTokenFile    string            `mapstructure:"bearer_token_file"`
+	Shards             int               `mapstructure:"shards"`
+	MaxSamplesPerSend  int               `mapstructure:"max_samples_per_send"`
+	QueueCapacity      int               `mapstructure:"queue_capacity"`
+	Timeout            time.Duration     `mapstructure:"timeout"`
+	MaxRetries         int               `mapstructure:"max_retries"`
+	CAFile             string            `mapstructure:"ca_file"`
+	InsecureSkipVerify bool              `mapstructure:"insecure_skip_verify"`
+}
+
+type fileEmitterOptions struct {
+	Path             string        `mapstructure:"path"`
+	MaxSizeMB        int           `mapstructure:"max_size_mb"`
+	RotationInterval time.Duration `mapstructure:"rotation_interval"`
+	Compress         bool          `mapstructure:"compress"`
+	MaxFiles         int           `mapstructure:"max_files"`
+}
+
+type webhookEmitterOptions struct {
+	URL                string            `mapstructure:"url"`
+	Headers            map[string]string `mapstructure:"headers"`
+	Template           string            `mapstructure:"template"`
+	TemplateFile       string            `mapstructure:"template_file"`
+	ContentType        string            `mapstructure:"content_type"`
+	BatchSize          int               `mapstructure:"batch_size"`
+	MaxBatchBytes      int               `mapstructure:"max_batch_bytes"`
+	DisableCompression bool              `mapstructure:"disable_compression"`
+	Timeout            time.Duration     `mapstructure:"timeout"`
+	MaxRetries         int               `mapstructure:"max_retries"`
+	CAFile             string            `mapstructure:"ca_file"`
+	InsecureSkipVerify bool              `mapstructure:"insecure_skip_verify"`
+}
+
+type statsDEmitterOptions struct {
+	Address       string   `mapstructure:"address"`
+	Network       string   `mapstructure:"network"`
+	Prefix        string   `mapstructure:"prefix"`
+	DogStatsD     bool     `mapstructure:"dogstatsd"`
+	MaxPacketSize int      `mapstructure:"max_packet_size"`
+	Aggregates    []string `mapstructure:"aggregates"`
+}
+
+type influxDBEmitterOptions struct {
+	URL                string        `mapstructure:"url"`
+	Org                string        `mapstructure:"org"`
+	Bucket             string        `mapstructure:"bucket"`
+	Token              string        `mapstructure:"token"`
+	Precision          string        `mapstructure:"precision"`
+	Encoding           string        `mapstructure:"encoding"`
+	BatchSize          int           `mapstructure:"batch_size"`
+	DisableCompression bool          `mapstructure:"disable_compression"`
+	Timeout            time.Duration `mapstructure:"timeout"`
+	MaxRetries         int           `mapstructure:"max_retries"`
+	CAFile             string        `mapstructure:"ca_file"`
+	InsecureSkipVerify bool          `mapstructure:"insecure_skip_verify"`
+}
+
+// newEmitter returns the configured emitter, or nil if its name is unknown.
+func newEmitter(cfg *Config, e EmitterConfig) (integration.Emitter, error) {
+	switch e.Name {
+	case "stdout":
+		var opts stdoutEmitterOptions
+		if err := e.decodeOptions(&opts); err != nil {
+			return nil, err
+		}
+		emitter, err := integration.NewStdoutEmitter(opts.Format)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not create new StdoutEmitter")
+		}
+		return emitter, nil
+	case "telemetry":
+		if err := e.decodeOptions(&struct{}{}); err != nil {
+			return nil, err
+		}
+		return newTelemetryEmitters(cfg)
+	case "events":
+		var opts eventEmitterOptions
+		if err := e.decodeOptions(&opts); err != nil {
+			return nil, err
+		}
+		harvesterOpts, err := telemetryHarvesterOpts(cfg, e.Instance, cfg.LicenseKey, telemetry.ConfigEventsURLOverride(cfg.EventAPIURL))
+		if err != nil {
+			return nil, err
+		}
+
+		emitter, err := integration.NewEventEmitter(integration.EventEmitterConfig{
+			HarvesterOpts: harvesterOpts,
+			EventType:     opts.EventType,
+			Selectors:     opts.Selectors,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "could not create new EventEmitter")
+		}
+		return emitter, nil
+	case "otlp":
+		var opts otlpEmitterOptions
+		if err := e.decodeOptions(&opts); err != nil {
+			return nil, err
+		}
+		tlsConfig, err := integration.NewTLSConfig(opts.CAFile, opts.InsecureSkipVerify)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OTLP emitter TLS configuration: %w", err)
+		}
+
+		emitter, err := integration.NewOTLPEmitter(integration.OTLPEmitterConfig{
+			Endpoint:           opts.Endpoint,
+			Headers:            opts.Headers,
+			ResourceAttributes: opts.ResourceAttributes,
+			Temporality:        opts.Temporality,
+			DisableCompression: opts.DisableCompression,
+			BatchSize:          opts.BatchSize,
+			Timeout:            opts.Timeout,
+			MaxRetries:         opts.MaxRetries,
+			TLSConfig:          tlsConfig,
+			ProxyURL:           cfg.EmitterProxyURL,
+			DeltaExpirationAge: cfg.TelemetryEmitterDeltaExpirationAge,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "could not create new OTLPEmitter")
+		}
+		return emitter, nil
+	case "federate":
+		var opts federateEmitterOptions
+		if err := e.decodeOptions(&opts); err != nil {
+			return nil, err
+		}
+		return integration.NewFederateEmitter(opts.Expiration), nil
+	case "remote_write":
+		var opts remoteWriteEmitterOptions
+		if err := e.decodeOptions(&opts); err != nil {
+			return nil, err
+		}
+		tlsConfig, err := integration.NewTLSConfig(opts.CAFile, opts.InsecureSkipVerify)
+		if err != nil {
+			return nil, fmt.Errorf("invalid remote write emitter TLS configuration: %w", err)
+		}
+
+		emitter, err := integration.NewRemoteWriteEmitter(integration.RemoteWriteEmitterConfig{
+			URL:               opts.URL,
+			Headers:           opts.Headers,
+			Username:          opts.Username,
+			Password:          opts.Password,
+			BearerToken:       opts.BearerToken,
+			BearerTokenFile:   opts.BearerTokenFile,
+			Shards:            opts.Shards,
+			MaxSamplesPerSend: opts.MaxSamplesPerSend,
+			QueueCapacity:     opts.QueueCapacity,
+			Timeout:           opts.Timeout,
+			MaxRetries:        opts.MaxRetries,
+			TLSConfig:         tlsConfig,
+			ProxyURL:          cfg.EmitterProxyURL,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "could not create new RemoteWriteEmitter")
+		}
+		return emitter, nil
+	case "file":
+		var opts fileEmitterOptions
+		if err := e.decodeOptions(&opts); err != nil {
+			return nil, err
+		}
+		emitter, err := integration.NewFileEmitter(integration.FileEmitterConfig{
+			Path:             opts.Path,
+			MaxSize:          int64(opts.MaxSizeMB) * 1024 * 1024,
+			RotationInterval: opts.RotationInterval,
+			Compress:         opts.Compress,
+			MaxFiles:         opts.MaxFiles,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "could not create new FileEmitter")
+		}
+		return emitter, nil
+	case "webhook":
+		var opts webhookEmitterOptions
+		if err := e.decodeOptions(&opts); err != nil {
+			return nil, err
+		}
+		tlsConfig, err := integration.NewTLSConfig(opts.CAFile, opts.InsecureSkipVerify)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not create new WebhookEmitter")
+		}
+
+		emitter, err := integration.NewWebhookEmitter(integration.WebhookEmitterConfig{
+			URL:                opts.URL,
+			Headers:            opts.Headers,
+			Template:           opts.Template,
+			TemplateFile:       opts.TemplateFile,
+			ContentType:        opts.ContentType,
+			BatchSize:          opts.BatchSize,
+			MaxBatchBytes:      opts.MaxBatchBytes,
+			DisableCompression: opts.DisableCompression,
+			Timeout:            opts.Timeout,
+			MaxRetries:         opts.MaxRetries,
+			TLSConfig:          tlsConfig,
+			ProxyURL:           cfg.EmitterProxyURL,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "could not create new WebhookEmitter")
+		}
+		return emitter, nil
+	case "statsd":
+		var opts statsDEmitterOptions
+		if err := e.decodeOptions(&opts); err != nil {
+			return nil, err
+		}
+		emitter, err := integration.NewStatsDEmitter(integration.StatsDEmitterConfig{
+			Address:            opts.Address,
+			Network:            opts.Network,
+			Prefix:             opts.Prefix,
+			DogStatsD:          opts.DogStatsD,
+			MaxPacketSize:      opts.MaxPacketSize,
+			Aggregates:         opts.Aggregates,
+			DeltaExpirationAge: cfg.TelemetryEmitterDeltaExpirationAge,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "could not create new StatsDEmitter")
+		}
+		return emitter, nil
+	case "influxdb":
+		var opts influxDBEmitterOptions
+		if err := e.decodeOptions(&opts); err != nil {
+			return nil, err
+		}
+		tlsConfig, err := integration.NewTLSConfig(opts.CAFile, opts.InsecureSkipVerify)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not create new InfluxDBEmitter")
+		}
+
+		emitter, err := integration.NewInfluxDBEmitter(integration.InfluxDBEmitterConfig{
+			URL:                opts.URL,
+			Org:                opts.Org,
+			Bucket:             opts.Bucket,
+			Token:              opts.Token,
+			Precision:          opts.Precision,
+			Encoding:           opts.Encoding,
+			BatchSize:          opts.BatchSize,
+			DisableCompression: opts.DisableCompression,
+			Timeout:            opts.Timeout,
+			MaxRetries:         opts.MaxRetries,
+			TLSConfig:          tlsConfig,
+			ProxyURL:           cfg.EmitterProxyURL,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "could not create new InfluxDBEmitter")
+		}
+		return emitter, nil
+	case "infra-sdk":
+		if err := e.decodeOptions(&struct{}{}); err != nil {
+			return nil, err
+		}
+		emitter := integration.NewInfraSdkEmitter(cfg.HostID)
+		if err := emitter.SetIntegrationMetadata(cfg.IntegrationMetadata); err != nil {
+			logrus.WithError(err).Debugf("could not set emitter metadata: %v", cfg.IntegrationMetadata)
+		}
+		return emitter, nil
+	default:
+		logrus.Debugf("unknown emitter: %s", e.Name)
+		return nil, nil
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package scraper
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/newrelic/nri-prometheus/internal/integration"
+)
+
+// reloadDebounce is the time to wait for the configuration file to stop
+// changing before reloading it. Editors and Kubernetes ConfigMap updates
+// usually generate several events for a single change.
+const reloadDebounce = time.Second
+
+var reloadLog = logrus.WithField("component", "scraper.TransformationsReloader")
+
+// LoadTransformations reads the transformations from the given configuration
+// file.
+func LoadTransformations(configFile string) ([]integration.ProcessingRule, error) {
+	cfg := viper.New()
+	cfg.SetConfigType("yaml")
+	cfg.SetConfigFile(configFile)
+	if err := cfg.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("reading configuration file: %w", err)
+	}
+
+	var rules []integration.ProcessingRule
+	if err := cfg.UnmarshalKey("transformations", &rules); err != nil {
+		return nil, fmt.Errorf("parsing transformations: %w", err)
+	}
+	return rules, nil
+}
+
+// transformationsReloader reloads the transformations of the configuration
+// file into a RuleSet.
+type transformationsReloader struct {
+	configFile string
+	ruleSet    *integration.RuleSet
+	defaults   integration.ProcessingRule
+	// lastContent avoids reloading the rules when the file has been touched
+	// but its content is the same.
+	lastContent []byte
+}
+
+func (r *transformationsReloader) reload(force bool) {
+	content, err := os.ReadFile(r.configFile)
+	if err != nil {
+		r.ruleSet.ReloadFailed(fmt.Errorf("reading configuration file: %w", err))
+		return
+	}
+	if !force && bytes.Equal(content, r.lastContent) {
+		return
+	}
+	r.lastContent = content
+
+	rules, err := LoadTransformations(r.configFile)
+	if err != nil {
+		r.ruleSet.ReloadFailed(err)
+		return
+	}
+	// Reload records the outcome in the self-metrics and logs.
+	_ = r.ruleSet.Reload(append(rules, r.defaults))
+}
+
+// watchTransformations reloads the transformations of the configuration file
+// into the RuleSet when the file changes or when a SIGHUP signal is received.
+// The default transformations are always appended to the loaded ones.
+func watchTransformations(configFile string, ruleSet *integration.RuleSet, defaults integration.ProcessingRule) error {
+	if configFile == "" {
+		return fmt.Errorf("no configuration file has been loaded")
+	}
+	configFile, err := filepath.Abs(configFile)
+	if err != nil {
+		return fmt.Errorf("getting absolute path of %q: %w", configFile, err)
+	}
+
+	content, err := os.ReadFile(configFile)
+	if err != nil {
+		return fmt.Errorf("reading configuration file: %w", err)
+	}
+
+	// The directory is watched instead of the file, so the changes are still
+	// detected when the file is replaced, e.g. when a Kubernetes ConfigMap is
+	// updated by swapping the symlinks of the mounted volume.
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("creating file watcher: %w", err)
+	}
+	if err := watcher.Add(filepath.Dir(configFile)); err != nil {
+		_ = watcher.Close()
+		return fmt.Errorf("watching %q: %w", filepath.Dir(configFile), err)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	r := &transformationsReloader{
+		configFile:  configFile,
+		ruleSet:     ruleSet,
+		defaults:    defaults,
+		lastContent: content,
+	}
+	go func() {
+		defer watcher.Close()
+
+		var debounce <-chan time.Time
+		for {
+			select {
+			case <-hup:
+				reloadLog.Info("SIGHUP received, reloading transformations")
+				r.reload(true)
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) != 0 {
+					debounce = time.After(reloadDebounce)
+				}
+			case <-debounce:
+				debounce = nil
+				r.reload(false)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				reloadLog.WithError(err).Warn("watching configuration file")
+			}
+		}
+	}()
+
+	reloadLog.WithField("file", configFile).Info("transformations will be reloaded when the configuration file changes or on SIGHUP")
+	return nil
+}
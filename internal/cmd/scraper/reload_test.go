@@ -0,0 +1,121 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package scraper
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/integration"
+)
+
+func reloadsTotal(t *testing.T, result string) float64 {
+	t.Helper()
+
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	for _, mf := range mfs {
+		if mf.GetName() != "nr_stats_integration_rules_reloads_total" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "result" && l.GetValue() == result {
+					return m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestLoadTransformations(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(configFile, []byte(`
+cluster_name: test
+transformations:
+  - description: "drop"
+    ignore_metrics:
+      - prefixes:
+        - go_
+    sample_metrics:
+      - prefixes:
+        - build_info
+        min_interval: 2m
+    target_selector:
+      kinds:
+        - pod
+      labels:
+        namespaceName: cache
+`), 0o600))
+
+	rules, err := LoadTransformations(configFile)
+	require.NoError(t, err)
+	require.Len(t, rules, 1)
+	assert.Equal(t, []string{"go_"}, rules[0].IgnoreMetrics[0].Prefixes)
+	assert.Equal(t, 2*time.Minute, rules[0].SampleMetrics[0].MinInterval)
+	require.NotNil(t, rules[0].TargetSelector)
+	assert.Equal(t, []string{"pod"}, rules[0].TargetSelector.Kinds)
+	assert.Equal(t, map[string]string{"namespacename": "cache"}, rules[0].TargetSelector.Labels)
+}
+
+func TestWatchTransformations(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(configFile, []byte("transformations: []\n"), 0o600))
+
+	rs, err := integration.NewRuleSet(nil)
+	require.NoError(t, err)
+	require.NoError(t, watchTransformations(configFile, rs, integration.ProcessingRule{}))
+
+	successes := reloadsTotal(t, "success")
+	failures := reloadsTotal(t, "failure")
+
+	require.NoError(t, os.WriteFile(configFile, []byte(`
+transformations:
+  - ignore_metrics:
+      - prefixes:
+        - go_
+`), 0o600))
+	assert.Eventually(t, func() bool {
+		return reloadsTotal(t, "success") == successes+1
+	}, 5*time.Second, 50*time.Millisecond)
+
+	require.NoError(t, os.WriteFile(configFile, []byte(`
+transformations:
+  - sample_metrics:
+      - prefixes:
+        - go_
+`), 0o600))
+	assert.Eventually(t, func() bool {
+		return reloadsTotal(t, "failure") == failures+1
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestTransformationsReloader_Failures(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	rs, err := integration.NewRuleSet(nil)
+	require.NoError(t, err)
+	r := &transformationsReloader{configFile: configFile, ruleSet: rs}
+	failures := reloadsTotal(t, "failure")
+
+	// The file can't be read.
+	r.reload(true)
+	assert.Equal(t, failures+1, reloadsTotal(t, "failure"))
+
+	// The transformations can't be parsed.
+	require.NoError(t, os.WriteFile(configFile, []byte("transformations: {ignore_metrics: 1}\n"), 0o600))
+	r.reload(false)
+	assert.Equal(t, failures+2, reloadsTotal(t, "failure"))
+}
+
+func TestWatchTransformationsWithoutConfigFile(t *testing.T) {
+	rs, err := integration.NewRuleSet(nil)
+	require.NoError(t, err)
+	assert.Error(t, watchTransformations("", rs, integration.ProcessingRule{}))
+}
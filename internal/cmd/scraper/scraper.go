@@ -4,12 +4,17 @@
 package scraper
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/pprof"
 	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
@@ -18,17 +23,39 @@ import (
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 )
 
+// TelemetryAccount is a New Relic account the telemetry emitter sends the
+// metrics matching its routes to. The metrics not matching the routes of any
+// account are sent to the account of the license_key.
+type TelemetryAccount struct {
+	Name       string     `mapstructure:"name"`
+	LicenseKey LicenseKey `mapstructure:"license_key"`
+	// MetricAPIURL and EventAPIURL are determined from the region of the
+	// license key if empty. The events are the exemplars, if enabled.
+	MetricAPIURL string `mapstructure:"metric_api_url"`
+	EventAPIURL  string `mapstructure:"event_api_url"`
+	// EmitterHarvestPeriod and MaxStoredMetrics default to the ones of the
+	// default account.
+	EmitterHarvestPeriod string `mapstructure:"emitter_harvest_period"`
+	MaxStoredMetrics     int    `mapstructure:"max_stored_metrics"`
+	// Routes select the metrics sent to the account. The accounts are
+	// matched in order.
+	Routes []integration.EmitterSelector `mapstructure:"routes"`
+}
+
 // Config is the config struct for the scraper.
 type Config struct {
 	MetricAPIURL                      string                       `mapstructure:"metric_api_url"`
+	EventAPIURL                       string                       `mapstructure:"event_api_url"`
 	LicenseKey                        LicenseKey                   `mapstructure:"license_key"`
 	ClusterName                       string                       `mapstructure:"cluster_name"`
 	Debug                             bool                         `mapstructure:"debug"`
 	Verbose                           bool                         `mapstructure:"verbose"`
 	Audit                             bool                         `mapstructure:"audit"`
-	Emitters                          []string                     `mapstructure:"emitters"`
+	Emitters                          []EmitterConfig              `mapstructure:"emitters"`
 	ScrapeEnabledLabel                string                       `mapstructure:"scrape_enabled_label"`
 	RequireScrapeEnabledLabelForNodes bool                         `mapstructure:"require_scrape_enabled_label_for_nodes"`
 	ScrapeTimeout                     time.Duration                `mapstructure:"scrape_timeout"`
@@ -47,6 +74,8 @@ type Config struct {
 	BearerTokenFile                   string                       `mapstructure:"bearer_token_file"`
 	InsecureSkipVerify                bool                         `mapstructure:"insecure_skip_verify" default:"false"`
 	ProcessingRules                   []integration.ProcessingRule `mapstructure:"transformations"`
+	ReloadTransformations             bool                         `mapstructure:"reload_transformations"`
+	RedactQueryParams                 []string                     `mapstructure:"redact_query_params"`
 	SelfMetricsListeningAddress       string                       `mapstructure:"self_metrics_listening_address"`
 	DecorateFile                      bool
 	EmitterProxy                      string `mapstructure:"emitter_proxy"`
@@ -56,10 +85,21 @@ type Config struct {
 	EmitterInsecureSkipVerify                    bool                 `mapstructure:"emitter_insecure_skip_verify" default:"false"`
 	TelemetryEmitterDeltaExpirationAge           time.Duration        `mapstructure:"telemetry_emitter_delta_expiration_age"`
 	TelemetryEmitterDeltaExpirationCheckInterval time.Duration        `mapstructure:"telemetry_emitter_delta_expiration_check_interval"`
+	TelemetryEmitterExemplars                    bool                 `mapstructure:"telemetry_emitter_exemplars"`
+	TelemetryEmitterBufferPath                   string               `mapstructure:"telemetry_emitter_buffer_path"`
+	TelemetryEmitterBufferMaxSizeMB              int                  `mapstructure:"telemetry_emitter_buffer_max_size_mb"`
+	TelemetryEmitterDeltaStatePath               string               `mapstructure:"telemetry_emitter_delta_state_path"`
+	TelemetryEmitterDeltaStateConfigMap          string               `mapstructure:"telemetry_emitter_delta_state_configmap"`
+	TelemetryEmitterDeltaStateInterval           time.Duration        `mapstructure:"telemetry_emitter_delta_state_interval"`
+	TelemetryEmitterDeltaStateMaxAge             time.Duration        `mapstructure:"telemetry_emitter_delta_state_max_age"`
+	TelemetryAccounts                            []TelemetryAccount   `mapstructure:"telemetry_accounts"`
 	WorkerThreads                                int                  `mapstructure:"worker_threads"`
+	ProcessingWorkers                            int                  `mapstructure:"processing_workers"`
 	IntegrationMetadata                          integration.Metadata `mapstructure:"integration_metadata"`
 	// Coming from main.ArgumentList NriHostID
 	HostID string
+	// Path of the configuration file that has been loaded, if any
+	ConfigFile string
 }
 
 const maskedLicenseKey = "****"
@@ -80,6 +120,12 @@ func (l LicenseKey) GoString() string {
 // channel length for entities
 const queueLength = 100
 
+const defaultTelemetryEmitterBufferMaxSizeMB = 100
+
+// serviceAccountNamespaceFile has the namespace of the pod, where the delta
+// state ConfigMap is kept unless another namespace is configured.
+const serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
 func validateConfig(cfg *Config) error {
 	requiredMsg := "%s is required and can't be empty"
 	if cfg.ClusterName == "" && cfg.Standalone {
@@ -88,6 +134,35 @@ func validateConfig(cfg *Config) error {
 	if cfg.LicenseKey == "" && cfg.Standalone {
 		return fmt.Errorf(requiredMsg, "license_key")
 	}
+	for i, account := range cfg.TelemetryAccounts {
+		if account.Name == "" {
+			return fmt.Errorf(requiredMsg, fmt.Sprintf("telemetry_accounts[%d].name", i))
+		}
+		if account.LicenseKey == "" {
+			return fmt.Errorf(requiredMsg, fmt.Sprintf("license_key of the %s telemetry account", account.Name))
+		}
+		if len(account.Routes) == 0 {
+			return fmt.Errorf(requiredMsg, fmt.Sprintf("routes of the %s telemetry account", account.Name))
+		}
+	}
+
+	if err := setEmitterInstances(cfg.Emitters); err != nil {
+		return err
+	}
+	federate := 0
+	for _, e := range cfg.Emitters {
+		if e.Name == "federate" {
+			federate++
+		}
+	}
+	if federate > 1 {
+		// They would be served at the same path.
+		return fmt.Errorf("only one federate emitter can be configured")
+	}
+
+	if cfg.TelemetryEmitterDeltaStatePath != "" && cfg.TelemetryEmitterDeltaStateConfigMap != "" {
+		return fmt.Errorf("telemetry_emitter_delta_state_path and telemetry_emitter_delta_state_configmap can't be used together")
+	}
 
 	if cfg.EmitterProxy != "" {
 		proxyURL, err := url.Parse(cfg.EmitterProxy)
@@ -118,6 +193,8 @@ func RunWithEmitters(cfg *Config, emitters []integration.Emitter) error {
 		return fmt.Errorf("you need to configure at least one valid emitter")
 	}
 
+	endpoints.SetSensitiveQueryParams(cfg.RedactQueryParams)
+
 	selfRetriever, err := endpoints.SelfRetriever()
 	if err != nil {
 		return fmt.Errorf("while parsing provided endpoints: %w", err)
@@ -137,44 +214,47 @@ func RunWithEmitters(cfg *Config, emitters []integration.Emitter) error {
 			retrievers = append(retrievers, kubernetesRetriever)
 		}
 	}
-	defaultTransformations := integration.ProcessingRule{
-		Description: "Default transformation rules",
-		AddAttributes: []integration.AddAttributesRule{
-			{
-				MetricPrefix: "",
-				Attributes: map[string]interface{}{
-					"k8s.cluster.name": cfg.ClusterName,
-					"clusterName":      cfg.ClusterName,
-					// Keeping these for backward compatibility
-					"integrationVersion": integration.Version,
-					"integrationName":    integration.Name,
-					// Since the agent is not used we add the attributes manually
-					"collector.name":           integration.Name,
-					"collector.version":        integration.Version,
-					"instrumentation.name":     integration.Name,
-					"instrumentation.version":  integration.Version,
-					"instrumentation.provider": "newRelic",
-				},
-			},
-		},
+	defaultTransformations := DefaultTransformations(cfg.ClusterName)
+	processingRules := WithDefaultTransformations(cfg.ProcessingRules, cfg.ClusterName)
+	ruleSet, err := integration.NewRuleSet(processingRules)
+	if err != nil {
+		return fmt.Errorf("invalid transformations: %w", err)
+	}
+
+	if cfg.ReloadTransformations {
+		if err := watchTransformations(cfg.ConfigFile, ruleSet, defaultTransformations); err != nil {
+			logrus.WithError(err).Error("transformations won't be reloaded when the configuration changes")
+		}
 	}
-	processingRules := append(cfg.ProcessingRules, defaultTransformations)
 
 	scrapeDuration, err := time.ParseDuration(cfg.ScrapeDuration)
 	if err != nil {
 		return fmt.Errorf("parsing scrape_duration value (%v): %w", cfg.ScrapeDuration, err)
 	}
 
-	go integration.Execute(
-		scrapeDuration,
-		selfRetriever,
-		retrievers,
-		integration.NewFetcher(scrapeDuration, cfg.ScrapeTimeout, cfg.ScrapeAcceptHeader, cfg.WorkerThreads, cfg.BearerTokenFile, cfg.CaFile, cfg.InsecureSkipVerify, queueLength),
-		integration.RuleProcessor(processingRules, queueLength),
-		emitters)
+	ctx, stop := context.WithCancel(context.Background())
+	executed := make(chan struct{})
+	go closeEmittersOnShutdown(stop, executed, emitters)
+
+	go func() {
+		defer close(executed)
+		integration.Execute(
+			ctx,
+			scrapeDuration,
+			selfRetriever,
+			retrievers,
+			integration.NewFetcher(scrapeDuration, cfg.ScrapeTimeout, cfg.ScrapeAcceptHeader, cfg.WorkerThreads, cfg.BearerTokenFile, cfg.CaFile, cfg.InsecureSkipVerify, queueLength),
+			integration.RuleSetProcessor(ruleSet, queueLength, cfg.ProcessingWorkers),
+			emitters)
+	}()
 
 	r := http.NewServeMux()
 	r.Handle("/metrics", promhttp.Handler())
+	for _, e := range emitters {
+		if fe, ok := integration.UnwrapEmitter(e).(*integration.FederateEmitter); ok {
+			r.Handle(integration.FederatePath, fe)
+		}
+	}
 	if cfg.Debug {
 		r.HandleFunc("/debug/pprof/", pprof.Index)
 		r.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
@@ -196,6 +276,14 @@ func RunOnceWithEmitters(cfg *Config, emitters []integration.Emitter) error {
 		return fmt.Errorf("you need to configure at least one valid emitter")
 	}
 
+	endpoints.SetSensitiveQueryParams(cfg.RedactQueryParams)
+
+	for _, e := range emitters {
+		if _, ok := integration.UnwrapEmitter(e).(*integration.FederateEmitter); ok {
+			logrus.Warn("the federate emitter is only served in standalone mode")
+		}
+	}
+
 	var retrievers []endpoints.TargetRetriever
 	fixedRetriever, err := endpoints.FixedRetriever(cfg.TargetConfigs...)
 	if err != nil {
@@ -212,16 +300,77 @@ func RunOnceWithEmitters(cfg *Config, emitters []integration.Emitter) error {
 		)
 	}
 
+	ruleSet, err := integration.NewRuleSet(cfg.ProcessingRules)
+	if err != nil {
+		return fmt.Errorf("invalid transformations: %w", err)
+	}
+
 	// Fetch duration is hardcoded to 1 since the target is scraped only once
 	integration.ExecuteOnce(
 		retrievers,
 		integration.NewFetcher(scrapeDuration, cfg.ScrapeTimeout, cfg.ScrapeAcceptHeader, cfg.WorkerThreads, cfg.BearerTokenFile, cfg.CaFile, cfg.InsecureSkipVerify, queueLength),
-		integration.RuleProcessor(cfg.ProcessingRules, queueLength),
+		integration.RuleSetProcessor(ruleSet, queueLength, cfg.ProcessingWorkers),
 		emitters)
 
+	if err := integration.CloseEmitters(emitters); err != nil {
+		logrus.WithError(err).Warn("error closing the emitters")
+	}
 	return nil
 }
 
+// DefaultTransformations returns the transformations applied to all the
+// metrics after the configured ones, which add the cluster name and the
+// collector attributes.
+func DefaultTransformations(clusterName string) integration.ProcessingRule {
+	return integration.ProcessingRule{
+		Description: "Default transformation rules",
+		AddAttributes: []integration.AddAttributesRule{
+			{
+				MetricPrefix: "",
+				Attributes: map[string]interface{}{
+					"k8s.cluster.name": clusterName,
+					"clusterName":      clusterName,
+					// Keeping these for backward compatibility
+					"integrationVersion": integration.Version,
+					"integrationName":    integration.Name,
+					// Since the agent is not used we add the attributes manually
+					"collector.name":           integration.Name,
+					"collector.version":        integration.Version,
+					"instrumentation.name":     integration.Name,
+					"instrumentation.version":  integration.Version,
+					"instrumentation.provider": "newRelic",
+				},
+			},
+		},
+	}
+}
+
+// WithDefaultTransformations returns the configured transformations followed
+// by the default ones, as they are applied to the scraped metrics.
+func WithDefaultTransformations(transformations []integration.ProcessingRule, clusterName string) []integration.ProcessingRule {
+	rules := make([]integration.ProcessingRule, 0, len(transformations)+1)
+	rules = append(rules, transformations...)
+	return append(rules, DefaultTransformations(clusterName))
+}
+
+// closeEmittersOnShutdown closes the emitters and exits when a SIGTERM or
+// SIGINT signal is received, so they can save their state. The integration
+// is stopped first, and the emitters are closed once it returns, so no
+// metric is emitted after their state is saved.
+func closeEmittersOnShutdown(stop context.CancelFunc, executed <-chan struct{}, emitters []integration.Emitter) {
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, syscall.SIGTERM, os.Interrupt)
+	sig := <-shutdown
+	logrus.Infof("%s received, stopping the integration", sig)
+	stop()
+	<-executed
+	logrus.Info("closing the emitters")
+	if err := integration.CloseEmitters(emitters); err != nil {
+		logrus.WithError(err).Warn("error closing the emitters")
+	}
+	os.Exit(0)
+}
+
 // Run runs the scraper. If Standalone=true it keeps running otherwise runs once and exits
 func Run(cfg *Config) error {
 	err := validateConfig(cfg)
@@ -234,96 +383,24 @@ func Run(cfg *Config) error {
 
 	var emitters []integration.Emitter
 	for _, e := range cfg.Emitters {
-		switch e {
-		case "stdout":
-			emitters = append(emitters, integration.NewStdoutEmitter())
-		case "telemetry":
-			harvesterOpts := []func(*telemetry.Config){
-				telemetry.ConfigAPIKey(string(cfg.LicenseKey)),
-				telemetry.ConfigBasicErrorLogger(os.Stdout),
-				integration.TelemetryHarvesterWithMetricsURL(cfg.MetricAPIURL),
-			}
-
-			if cfg.EmitterProxyURL != nil {
-				harvesterOpts = append(
-					harvesterOpts,
-					integration.TelemetryHarvesterWithProxy(cfg.EmitterProxyURL),
-				)
-			}
-
-			if cfg.EmitterCAFile != "" {
-				tlsConfig, err := integration.NewTLSConfig(
-					cfg.EmitterCAFile,
-					cfg.EmitterInsecureSkipVerify,
-				)
-				if err != nil {
-					return fmt.Errorf("invalid TLS configuration: %w", err)
-				}
-				harvesterOpts = append(
-					harvesterOpts,
-					integration.TelemetryHarvesterWithTLSConfig(tlsConfig),
-				)
-			}
-
-			// Options that rely on modifying the emitter Client Transport
-			// should go before this one, as this changes the type of the
-			// Transport to `integration.licenseKeyRoundTripper`.
-			harvesterOpts = append(
-				harvesterOpts,
-				integration.TelemetryHarvesterWithLicenseKeyRoundTripper(string(cfg.LicenseKey)),
-			)
-
-			if cfg.Verbose {
-				harvesterOpts = append(harvesterOpts, telemetry.ConfigBasicDebugLogger(os.Stdout))
-			}
-
-			if cfg.Audit {
-				harvesterOpts = append(harvesterOpts, telemetry.ConfigBasicAuditLogger(os.Stdout))
-			}
-
-			hTime, err := time.ParseDuration(cfg.EmitterHarvestPeriod)
-			if err != nil {
-				return fmt.Errorf(
-					"invalid telemetry emitter harvest period %s: %w",
-					cfg.EmitterHarvestPeriod,
-					err,
-				)
-			}
-			mhTime, err := time.ParseDuration(cfg.MinEmitterHarvestPeriod)
-			if err != nil {
-				return fmt.Errorf(
-					"invalid minimum telemetry emitter harvest period %s: %w",
-					cfg.MinEmitterHarvestPeriod,
-					err,
-				)
-			}
-
-			c := integration.TelemetryEmitterConfig{
-				HarvesterOpts:                 harvesterOpts,
-				DeltaExpirationAge:            cfg.TelemetryEmitterDeltaExpirationAge,
-				DeltaExpirationCheckInternval: cfg.TelemetryEmitterDeltaExpirationCheckInterval,
-				BoundedHarvesterCfg: integration.BoundedHarvesterCfg{
-					HarvestPeriod:     hTime,
-					MinReportInterval: mhTime,
-					MetricCap:         cfg.MaxStoredMetrics,
-				},
-			}
-
-			emitter, err := integration.NewTelemetryEmitter(c)
-			if err != nil {
-				return errors.Wrap(err, "could not create new TelemetryEmitter")
-			}
-			emitters = append(emitters, emitter)
-		case "infra-sdk":
-			emitter := integration.NewInfraSdkEmitter(cfg.HostID)
-			if err := emitter.SetIntegrationMetadata(cfg.IntegrationMetadata); err != nil {
-				logrus.WithError(err).Debugf("could not set emitter metadata: %v", cfg.IntegrationMetadata)
-			}
-			emitters = append(emitters, emitter)
-		default:
-			logrus.Debugf("unknown emitter: %s", e)
+		emitter, err := newEmitter(cfg, e)
+		if err != nil {
+			return err
+		}
+		if emitter == nil {
 			continue
 		}
+
+		// The metrics are filtered before being queued.
+		queued, err := integration.NewQueuedEmitter(emitter, e.Instance, e.Queue)
+		if err != nil {
+			return err
+		}
+		filtered, err := integration.NewFilteredEmitter(queued, e.EmitterFilter)
+		if err != nil {
+			return err
+		}
+		emitters = append(emitters, filtered)
 	}
 
 	if cfg.Standalone {
@@ -335,3 +412,224 @@ func Run(cfg *Config) error {
 	}
 	return err
 }
+
+// telemetryHarvesterOpts returns the options of the harvesters sending data
+// to New Relic with the license key, the emitter proxy and TLS
+// configuration, along with the option setting the URL they send it to. The
+// outcome of their requests is recorded in self-metrics labeled with the
+// emitter.
+func telemetryHarvesterOpts(cfg *Config, emitter string, licenseKey LicenseKey, urlOpts ...integration.TelemetryHarvesterOpt) ([]integration.TelemetryHarvesterOpt, error) {
+	harvesterOpts := []integration.TelemetryHarvesterOpt{
+		telemetry.ConfigAPIKey(string(licenseKey)),
+		telemetry.ConfigBasicErrorLogger(os.Stdout),
+	}
+	harvesterOpts = append(harvesterOpts, urlOpts...)
+
+	if cfg.EmitterProxyURL != nil {
+		harvesterOpts = append(
+			harvesterOpts,
+			integration.TelemetryHarvesterWithProxy(cfg.EmitterProxyURL),
+		)
+	}
+
+	if cfg.EmitterCAFile != "" {
+		tlsConfig, err := integration.NewTLSConfig(
+			cfg.EmitterCAFile,
+			cfg.EmitterInsecureSkipVerify,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLS configuration: %w", err)
+		}
+		harvesterOpts = append(
+			harvesterOpts,
+			integration.TelemetryHarvesterWithTLSConfig(tlsConfig),
+		)
+	}
+
+	// Options that rely on modifying the emitter Client Transport
+	// should go before these ones, as they change the type of the
+	// Transport.
+	harvesterOpts = append(
+		harvesterOpts,
+		integration.TelemetryHarvesterWithHarvestMetrics(emitter),
+		integration.TelemetryHarvesterWithLicenseKeyRoundTripper(string(licenseKey)),
+	)
+
+	if cfg.Verbose {
+		harvesterOpts = append(harvesterOpts, telemetry.ConfigBasicDebugLogger(os.Stdout))
+	}
+
+	if cfg.Audit {
+		harvesterOpts = append(harvesterOpts, telemetry.ConfigBasicAuditLogger(os.Stdout))
+	}
+	return harvesterOpts, nil
+}
+
+// newTelemetryEmitters returns the TelemetryEmitter of the default account,
+// or a RoutingEmitter sending the metrics to the telemetry_accounts, if any,
+// and to the default account.
+func newTelemetryEmitters(cfg *Config) (integration.Emitter, error) {
+	emitter, err := newTelemetryEmitter(cfg, TelemetryAccount{
+		LicenseKey:           cfg.LicenseKey,
+		MetricAPIURL:         cfg.MetricAPIURL,
+		EventAPIURL:          cfg.EventAPIURL,
+		EmitterHarvestPeriod: cfg.EmitterHarvestPeriod,
+		MaxStoredMetrics:     cfg.MaxStoredMetrics,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.TelemetryAccounts) == 0 {
+		return emitter, nil
+	}
+
+	routes := make([]integration.EmitterRoute, 0, len(cfg.TelemetryAccounts))
+	for _, account := range cfg.TelemetryAccounts {
+		accountEmitter, err := newTelemetryEmitter(cfg, account)
+		if err != nil {
+			return nil, fmt.Errorf("telemetry account %s: %w", account.Name, err)
+		}
+		routes = append(routes, integration.EmitterRoute{
+			Name:      account.Name,
+			Emitter:   accountEmitter,
+			Selectors: account.Routes,
+		})
+	}
+	router, err := integration.NewRoutingEmitter(emitter.Name(), routes, emitter)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not route the telemetry accounts")
+	}
+	return router, nil
+}
+
+// newTelemetryEmitter returns a TelemetryEmitter sending the metrics to the
+// account, or to the default account if it has no name. The payloads that
+// can't be sent are buffered on disk if telemetry_emitter_buffer_path is
+// set, in a subdirectory named after the account.
+func newTelemetryEmitter(cfg *Config, account TelemetryAccount) (*integration.TelemetryEmitter, error) {
+	name, bufferPath := "telemetry", cfg.TelemetryEmitterBufferPath
+	if account.Name != "" {
+		name += "/" + account.Name
+		if bufferPath != "" {
+			bufferPath = filepath.Join(bufferPath, account.Name)
+		}
+	}
+	harvestPeriod := account.EmitterHarvestPeriod
+	if harvestPeriod == "" {
+		harvestPeriod = cfg.EmitterHarvestPeriod
+	}
+	metricCap := account.MaxStoredMetrics
+	if metricCap == 0 {
+		metricCap = cfg.MaxStoredMetrics
+	}
+
+	harvesterOpts, err := telemetryHarvesterOpts(
+		cfg,
+		name,
+		account.LicenseKey,
+		integration.TelemetryHarvesterWithMetricsURL(account.MetricAPIURL),
+		telemetry.ConfigEventsURLOverride(account.EventAPIURL),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if bufferPath != "" {
+		maxSize := cfg.TelemetryEmitterBufferMaxSizeMB
+		if maxSize <= 0 {
+			maxSize = defaultTelemetryEmitterBufferMaxSizeMB
+		}
+		// It wraps the license key round tripper, so it goes after it.
+		bufferOpt, err := integration.TelemetryHarvesterWithDiskBuffer(bufferPath, int64(maxSize)*1024*1024)
+		if err != nil {
+			return nil, fmt.Errorf("invalid telemetry emitter buffer: %w", err)
+		}
+		harvesterOpts = append(harvesterOpts, bufferOpt)
+	}
+
+	hTime, err := time.ParseDuration(harvestPeriod)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"invalid telemetry emitter harvest period %s: %w",
+			harvestPeriod,
+			err,
+		)
+	}
+	mhTime, err := time.ParseDuration(cfg.MinEmitterHarvestPeriod)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"invalid minimum telemetry emitter harvest period %s: %w",
+			cfg.MinEmitterHarvestPeriod,
+			err,
+		)
+	}
+
+	deltaStateStore, err := telemetryDeltaStateStore(cfg, account.Name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid telemetry emitter delta state: %w", err)
+	}
+
+	c := integration.TelemetryEmitterConfig{
+		HarvesterOpts:                 harvesterOpts,
+		DeltaExpirationAge:            cfg.TelemetryEmitterDeltaExpirationAge,
+		DeltaExpirationCheckInternval: cfg.TelemetryEmitterDeltaExpirationCheckInterval,
+		Exemplars:                     cfg.TelemetryEmitterExemplars,
+		DeltaStateStore:               deltaStateStore,
+		DeltaStateInterval:            cfg.TelemetryEmitterDeltaStateInterval,
+		DeltaStateMaxAge:              cfg.TelemetryEmitterDeltaStateMaxAge,
+		BoundedHarvesterCfg: integration.BoundedHarvesterCfg{
+			HarvestPeriod:     hTime,
+			MinReportInterval: mhTime,
+			MetricCap:         metricCap,
+		},
+	}
+
+	emitter, err := integration.NewTelemetryEmitter(c)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create new TelemetryEmitter")
+	}
+	return emitter, nil
+}
+
+// telemetryDeltaStateStore returns the store of the delta state of the
+// telemetry emitter of the account, or nil if it's not persisted. The state
+// of each account is kept in its own file or ConfigMap key, suffixed with
+// its name.
+func telemetryDeltaStateStore(cfg *Config, account string) (integration.DeltaStateStore, error) {
+	if cfg.TelemetryEmitterDeltaStatePath != "" {
+		path := cfg.TelemetryEmitterDeltaStatePath
+		if account != "" {
+			path += "." + account
+		}
+		return integration.NewFileDeltaStateStore(path), nil
+	}
+	if cfg.TelemetryEmitterDeltaStateConfigMap == "" {
+		return nil, nil
+	}
+
+	// The ConfigMap is either "name" or "namespace/name".
+	namespace, name := "", cfg.TelemetryEmitterDeltaStateConfigMap
+	if i := strings.Index(name, "/"); i >= 0 {
+		namespace, name = name[:i], name[i+1:]
+	}
+	if namespace == "" {
+		ns, err := ioutil.ReadFile(serviceAccountNamespaceFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading the namespace of the pod for the ConfigMap: %w", err)
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+	key := "telemetry"
+	if account != "" {
+		key += "." + account
+	}
+
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return integration.NewConfigMapDeltaStateStore(client, namespace, name, key), nil
+}
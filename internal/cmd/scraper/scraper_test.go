@@ -14,6 +14,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/newrelic/nri-prometheus/internal/integration"
 	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
 	"github.com/stretchr/testify/require"
 
@@ -92,6 +93,170 @@ func TestConfigParseWithCustomType(t *testing.T) {
 	assert.Equal(t, licenseKey, string(cfg.LicenseKey))
 }
 
+func TestConfigParseEmitters(t *testing.T) {
+	cfgStr := []byte(`
+emitters:
+  - telemetry
+  - name: webhook
+    include:
+      metric_names: ["kube_.*"]
+      namespaces: [finops]
+    exclude:
+      labels:
+        label.team: sandbox
+`)
+
+	vip := viper.New()
+	vip.SetConfigType("yaml")
+	err := vip.ReadConfig(bytes.NewBuffer(cfgStr))
+	require.NoError(t, err)
+
+	var cfg Config
+	err = vip.Unmarshal(&cfg, viper.DecodeHook(EmitterConfigHookFunc()))
+	require.NoError(t, err)
+
+	assert.Equal(t, []EmitterConfig{
+		{Name: "telemetry"},
+		{
+			Name: "webhook",
+			EmitterFilter: integration.EmitterFilter{
+				Include: &integration.EmitterSelector{
+					MetricNames: []string{"kube_.*"},
+					Namespaces:  []string{"finops"},
+				},
+				Exclude: &integration.EmitterSelector{
+					TargetSelector: integration.TargetSelector{Labels: map[string]string{"label.team": "sandbox"}},
+				},
+			},
+		},
+	}, cfg.Emitters)
+}
+
+func TestConfigEmitterOptions(t *testing.T) {
+	cfgStr := []byte(`
+emitters:
+  - name: webhook
+    url: https://capacity-planning.example.com/metrics
+    timeout: 5s
+  - name: webhook
+    instance: finops
+    url: https://finops.example.com/metrics
+    headers:
+      x-team: finops
+    include:
+      namespaces: [finops]
+`)
+
+	vip := viper.New()
+	vip.SetConfigType("yaml")
+	err := vip.ReadConfig(bytes.NewBuffer(cfgStr))
+	require.NoError(t, err)
+
+	var cfg Config
+	err = vip.Unmarshal(&cfg, viper.DecodeHook(EmitterConfigHookFunc()))
+	require.NoError(t, err)
+	require.NoError(t, validateConfig(&cfg))
+
+	// Each instance has its own options.
+	var opts webhookEmitterOptions
+	require.NoError(t, cfg.Emitters[0].decodeOptions(&opts))
+	assert.Equal(t, webhookEmitterOptions{URL: "https://capacity-planning.example.com/metrics", Timeout: 5 * time.Second}, opts)
+	opts = webhookEmitterOptions{}
+	require.NoError(t, cfg.Emitters[1].decodeOptions(&opts))
+	assert.Equal(t, webhookEmitterOptions{URL: "https://finops.example.com/metrics", Headers: map[string]string{"x-team": "finops"}}, opts)
+	assert.Equal(t, "finops", cfg.Emitters[1].Instance)
+	assert.Equal(t, []string{"finops"}, cfg.Emitters[1].Include.Namespaces)
+
+	// The options of other emitters are rejected.
+	cfg.Emitters[0].Options["bucket"] = "fleet"
+	assert.Error(t, cfg.Emitters[0].decodeOptions(&webhookEmitterOptions{}))
+	_, err = newEmitter(&cfg, EmitterConfig{Name: "telemetry", Instance: "telemetry", Options: map[string]interface{}{"url": "x"}})
+	assert.Error(t, err)
+}
+
+func TestConfigEmitterInstances(t *testing.T) {
+	cfg := Config{Emitters: []EmitterConfig{
+		{Name: "webhook"},
+		{Name: "telemetry"},
+		{Name: "webhook"},
+		{Name: "webhook", Instance: "finops"},
+	}}
+	require.NoError(t, validateConfig(&cfg))
+
+	var instances []string
+	for _, e := range cfg.Emitters {
+		instances = append(instances, e.Instance)
+	}
+	assert.Equal(t, []string{"webhook", "telemetry", "webhook-2", "finops"}, instances)
+
+	cfg.Emitters[0].Instance = "finops"
+	assert.Error(t, validateConfig(&cfg))
+
+	cfg = Config{Emitters: []EmitterConfig{{Name: "federate"}, {Name: "federate"}}}
+	assert.Error(t, validateConfig(&cfg))
+}
+
+func TestConfigParseTelemetryAccounts(t *testing.T) {
+	cfgStr := []byte(`
+license_key: DEFAULT_LICENSE_KEY
+cluster_name: shared
+telemetry_accounts:
+  - name: team-a
+    license_key: TEAM_A_LICENSE_KEY
+    emitter_harvest_period: 5s
+    routes:
+      - namespaces: [team-a]
+`)
+
+	vip := viper.New()
+	vip.SetConfigType("yaml")
+	err := vip.ReadConfig(bytes.NewBuffer(cfgStr))
+	require.NoError(t, err)
+
+	var cfg Config
+	err = vip.Unmarshal(&cfg)
+	require.NoError(t, err)
+	cfg.Standalone = true
+	require.NoError(t, validateConfig(&cfg))
+
+	assert.Equal(t, []TelemetryAccount{{
+		Name:                 "team-a",
+		LicenseKey:           "TEAM_A_LICENSE_KEY",
+		EmitterHarvestPeriod: "5s",
+		Routes:               []integration.EmitterSelector{{Namespaces: []string{"team-a"}}},
+	}}, cfg.TelemetryAccounts)
+
+	cfg.TelemetryAccounts[0].Routes = nil
+	assert.Error(t, validateConfig(&cfg))
+	cfg.TelemetryAccounts[0].LicenseKey = ""
+	assert.Error(t, validateConfig(&cfg))
+}
+
+func TestConfigTelemetryDeltaState(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Config{
+		ClusterName:                    "cluster",
+		LicenseKey:                     "LICENSE_KEY",
+		Standalone:                     true,
+		TelemetryEmitterDeltaStatePath: path.Join(dir, "delta-state"),
+	}
+	require.NoError(t, validateConfig(&cfg))
+
+	// Each account keeps its own state.
+	store, err := telemetryDeltaStateStore(&cfg, "")
+	require.NoError(t, err)
+	require.NoError(t, store.Save([]byte("default")))
+	accountStore, err := telemetryDeltaStateStore(&cfg, "team-a")
+	require.NoError(t, err)
+	require.NoError(t, accountStore.Save([]byte("team-a")))
+	data, err := ioutil.ReadFile(path.Join(dir, "delta-state.team-a"))
+	require.NoError(t, err)
+	assert.Equal(t, "team-a", string(data))
+
+	cfg.TelemetryEmitterDeltaStateConfigMap = "nri-prometheus-state"
+	assert.Error(t, validateConfig(&cfg))
+}
+
 func TestRunIntegrationOnceNoTokenAttached(t *testing.T) {
 	dat, err := ioutil.ReadFile("./testData/testData.prometheus")
 	require.NoError(t, err)
@@ -112,7 +277,7 @@ func TestRunIntegrationOnceNoTokenAttached(t *testing.T) {
 				URLs: []string{srv.URL, srv.URL},
 			},
 		},
-		Emitters:       []string{"stdout"},
+		Emitters:       []EmitterConfig{{Name: "stdout"}},
 		Standalone:     false,
 		Verbose:        true,
 		ScrapeDuration: "500ms",
@@ -140,7 +305,7 @@ func TestScrapingAnsweringWithError(t *testing.T) {
 				URLs: []string{srv.URL, srv.URL},
 			},
 		},
-		Emitters:       []string{"stdout"},
+		Emitters:       []EmitterConfig{{Name: "stdout"}},
 		Standalone:     false,
 		Verbose:        true,
 		ScrapeDuration: "500ms",
@@ -168,7 +333,7 @@ func TestScrapingAnsweringUnexpectedData(t *testing.T) {
 				URLs: []string{srv.URL, srv.URL},
 			},
 		},
-		Emitters:       []string{"stdout"},
+		Emitters:       []EmitterConfig{{Name: "stdout"}},
 		Standalone:     false,
 		Verbose:        true,
 		ScrapeDuration: "500ms",
@@ -186,7 +351,7 @@ func TestScrapingNotAnswering(t *testing.T) {
 				URLs: []string{"127.1.1.0:9012"},
 			},
 		},
-		Emitters:       []string{"stdout"},
+		Emitters:       []EmitterConfig{{Name: "stdout"}},
 		Standalone:     false,
 		Verbose:        true,
 		ScrapeDuration: "500ms",
@@ -222,7 +387,7 @@ func TestScrapingWithToken(t *testing.T) {
 			},
 		},
 		BearerTokenFile: tokenFile,
-		Emitters:        []string{"stdout"},
+		Emitters:        []EmitterConfig{{Name: "stdout"}},
 		Standalone:      false,
 		Verbose:         true,
 		ScrapeDuration:  "500ms",
@@ -135,11 +135,19 @@ func (h *boundedHarvester) reportIfNeeded(ctx context.Context, force bool) {
 	h.mtx.Lock()
 	defer h.mtx.Unlock()
 
-	if force ||
-		time.Since(h.lastReport) >= h.HarvestPeriod ||
-		(h.storedMetrics > h.MetricCap && time.Since(h.lastReport) > h.MinReportInterval) {
+	var trigger string
+	switch {
+	case force:
+		trigger = "forced"
+	case time.Since(h.lastReport) >= h.HarvestPeriod:
+		trigger = "period"
+	case h.storedMetrics > h.MetricCap && time.Since(h.lastReport) > h.MinReportInterval:
+		trigger = "metric_cap"
+	}
 
+	if trigger != "" {
 		log.Tracef("triggering harvest, last harvest: %v ago", time.Since(h.lastReport))
+		harvestsTotalMetric.WithLabelValues(trigger).Inc()
 
 		h.lastReport = time.Now()
 		h.storedMetrics = 0
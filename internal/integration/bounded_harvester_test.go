@@ -5,10 +5,12 @@ package integration
 
 import (
 	"context"
+	"math"
 	"testing"
 	"time"
 
 	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 type mockHarvester struct {
@@ -156,11 +158,40 @@ func TestHarvestNow(t *testing.T) {
 	}
 	defer bh.Stop()
 
+	forced := testutil.ToFloat64(harvestsTotalMetric.WithLabelValues("forced"))
 	h.HarvestNow(context.Background())
 	time.Sleep(100 * time.Millisecond) // Inner HarvestNow is asynchronous
 	if mock.harvests < 1 {
 		t.Fatalf("HarvestNow did not trigger a harvest")
 	}
+	if testutil.ToFloat64(harvestsTotalMetric.WithLabelValues("forced")) <= forced {
+		t.Fatalf("HarvestNow was not recorded as a forced harvest")
+	}
+}
+
+func TestHarvesterDecoratorDroppedMetrics(t *testing.T) {
+	t.Parallel()
+
+	nan := testutil.ToFloat64(droppedMetricsTotalMetric.WithLabelValues("nan"))
+	inf := testutil.ToFloat64(droppedMetricsTotalMetric.WithLabelValues("inf"))
+
+	mock := &mockHarvester{}
+	h := harvesterDecorator{mock}
+	h.RecordMetric(telemetry.Gauge{Value: math.NaN()})
+	h.RecordMetric(telemetry.Count{Value: math.Inf(1)})
+	h.RecordMetric(telemetry.Summary{Sum: math.Inf(-1)})
+	h.RecordMetric(telemetry.Gauge{Value: 1})
+
+	if mock.metrics != 1 {
+		t.Fatalf("expected 1 recorded metric, got %d", mock.metrics)
+	}
+	// Other tests may drop metrics in parallel.
+	if got := testutil.ToFloat64(droppedMetricsTotalMetric.WithLabelValues("nan")) - nan; got < 1 {
+		t.Fatalf("expected a NaN dropped metric, got %v", got)
+	}
+	if got := testutil.ToFloat64(droppedMetricsTotalMetric.WithLabelValues("inf")) - inf; got < 2 {
+		t.Fatalf("expected 2 infinite dropped metrics, got %v", got)
+	}
 }
 
 func TestMetricCap(t *testing.T) {
@@ -0,0 +1,94 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"sync"
+	"time"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+)
+
+// counterCreations keeps the last created timestamp of the counters, to
+// detect when they are reset.
+type counterCreations struct {
+	lock          sync.Mutex
+	entries       map[string]counterCreation
+	expirationAge time.Duration
+	lastClean     time.Time
+}
+
+type counterCreation struct {
+	created time.Time
+	seen    time.Time
+}
+
+func newCounterCreations(expirationAge time.Duration) *counterCreations {
+	return &counterCreations{entries: map[string]counterCreation{}, expirationAge: expirationAge}
+}
+
+// swap records the created timestamp of the series, and returns the previous
+// one if the series was seen before. The series not seen for longer than the
+// expiration age are forgotten, like in the DeltaCalculator.
+func (cc *counterCreations) swap(key string, created, now time.Time) (time.Time, bool) {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+
+	if now.Sub(cc.lastClean) > cc.expirationAge {
+		cutoff := now.Add(-cc.expirationAge)
+		for k, c := range cc.entries {
+			if c.seen.Before(cutoff) {
+				delete(cc.entries, k)
+			}
+		}
+		cc.lastClean = now
+	}
+
+	previous, ok := cc.entries[key]
+	cc.entries[key] = counterCreation{created: created, seen: now}
+	return previous.created, ok
+}
+
+// countMetric calculates the delta of the counter. When the target exposes
+// the time the counter was created, a change of it tells a real reset apart
+// from a stale value, and the value of the reset counter is its delta, even
+// if it's higher than the previous one. The counters created while the
+// emitter runs also get their first value as their first delta, instead of
+// dropping it.
+func (te *TelemetryEmitter) countMetric(name string, attributes map[string]interface{}, val float64, created, now time.Time) (telemetry.Count, bool) {
+	count, ok := te.deltaCalculator.CountMetric(name, attributes, val, now)
+	if created.IsZero() || created.After(now) {
+		return count, ok
+	}
+	key, err := deltaSeriesKey(name, attributes)
+	if err != nil {
+		return count, ok
+	}
+
+	previous, seen := te.creations.swap(key, created, now)
+	switch {
+	case ok:
+		// The previous value was sampled after the counter was created.
+		if !created.After(count.Timestamp) {
+			return count, ok
+		}
+		counterResetsTotalMetric.Inc()
+	case seen && created.After(previous):
+		counterResetsTotalMetric.Inc()
+	// If the series had been seen since it was created, it hasn't expired
+	// yet, so the increments of the counter haven't been counted.
+	case !seen && created.After(te.started) && now.Sub(created) <= te.creations.expirationAge:
+	default:
+		return count, ok
+	}
+
+	// All the increments happened since the counter was created.
+	return telemetry.Count{
+		Name:       name,
+		Attributes: attributes,
+		Value:      val,
+		Timestamp:  created,
+		Interval:   now.Sub(created),
+	}, true
+}
@@ -0,0 +1,203 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+// defaultCrossTargetCacheTTL is how long the label sets of the source metrics
+// of a cross-target CopyAttributesRule are kept if no CacheTTL is set.
+const defaultCrossTargetCacheTTL = 5 * time.Minute
+
+// crossTargetRule is a DecorateRule whose source metrics can come from any
+// target.
+type crossTargetRule struct {
+	DecorateRule
+	// joinFrom and joinTo are the names of the labels that must have the same
+	// values in the source and the destination metrics, in the same order.
+	joinFrom []string
+	joinTo   []string
+	ttl      time.Duration
+	// selector restricts the targets to decorate.
+	selector *targetSelector
+}
+
+// cachedLabels is a label set of a source metric and its expiration time.
+type cachedLabels struct {
+	labels    labels.Set
+	expiresAt time.Time
+}
+
+// crossTargetDecorator copies attributes between metrics of different
+// targets. As targets are processed as soon as they are fetched, the label
+// sets of the source metrics are cached until they expire, so they can
+// decorate the targets processed after, and the ones processed before in the
+// next cycles.
+type crossTargetDecorator struct {
+	rules []crossTargetRule
+	// lock protects the cache, since targets can be processed in parallel.
+	lock sync.RWMutex
+	// cache holds, for each rule, the source label sets by join key.
+	cache          []map[string]cachedLabels
+	lastExpiration time.Time
+}
+
+// newCrossTargetDecorator returns a decorator for the given rules. The
+// selectors, if any, are the target selectors of each rule.
+func newCrossTargetDecorator(rules []CopyAttributesRule, selectors []*targetSelector) *crossTargetDecorator {
+	d := &crossTargetDecorator{}
+	for i, car := range rules {
+		attrs := labels.Set{}
+		for _, mk := range car.Attributes {
+			attrs[mk] = struct{}{}
+		}
+		joinTo := car.ToMatchBy
+		if len(joinTo) == 0 {
+			joinTo = car.MatchBy
+		}
+		ttl := car.CacheTTL
+		if ttl == 0 {
+			ttl = defaultCrossTargetCacheTTL
+		}
+		rule := crossTargetRule{
+			DecorateRule: DecorateRule{
+				Source:     car.FromMetric,
+				Dest:       car.ToMetrics,
+				Attributes: attrs,
+			},
+			joinFrom: car.MatchBy,
+			joinTo:   joinTo,
+			ttl:      ttl,
+		}
+		if i < len(selectors) {
+			rule.selector = selectors[i]
+		}
+		d.rules = append(d.rules, rule)
+		d.cache = append(d.cache, map[string]cachedLabels{})
+	}
+	return d
+}
+
+// harvest caches the label sets of the source metrics of the target. It must
+// be called before the target metadata is added to the metrics, so the
+// metadata of the source target is not copied to other targets. The cached
+// labels are redacted by redact, with the redact rules of the source
+// metrics, as the destination metrics may not match them. The join labels
+// are matched before being redacted.
+func (d *crossTargetDecorator) harvest(targetMetrics *TargetMetrics, now time.Time, redact func(name string, attributes labels.Set)) {
+	// Fast path, quickly exit if there are no rules defined.
+	if len(d.rules) == 0 {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.expire(now)
+
+	for i, rule := range d.rules {
+		for _, m := range targetMetrics.Metrics {
+			if m.name != rule.Source {
+				continue
+			}
+			key, ok := joinKey(m.attributes, rule.joinFrom)
+			if !ok {
+				continue
+			}
+			// The attributes are copied because the following processing
+			// steps modify them.
+			toCopy := labels.Set{}
+			if len(rule.Attributes) > 0 {
+				labels.AccumulateOnly(toCopy, m.attributes, rule.Attributes)
+			} else {
+				labels.Accumulate(toCopy, m.attributes)
+			}
+			for _, name := range rule.joinFrom {
+				delete(toCopy, name)
+			}
+			if redact != nil {
+				redact(m.name, toCopy)
+			}
+			d.cache[i][key] = cachedLabels{labels: toCopy, expiresAt: now.Add(rule.ttl)}
+		}
+	}
+}
+
+// decorate copies the cached label sets into the destination metrics of the
+// target whose join labels match.
+func (d *crossTargetDecorator) decorate(targetMetrics *TargetMetrics, now time.Time) {
+	// Fast path, quickly exit if there are no rules defined.
+	if len(d.rules) == 0 {
+		return
+	}
+
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	for i, rule := range d.rules {
+		if len(d.cache[i]) == 0 || !rule.selector.matches(&targetMetrics.Target) {
+			continue
+		}
+		for _, m := range targetMetrics.Metrics {
+			if !hasAnyPrefix(m.name, rule.Dest) {
+				continue
+			}
+			key, ok := joinKey(m.attributes, rule.joinTo)
+			if !ok {
+				continue
+			}
+			cached, ok := d.cache[i][key]
+			if !ok || now.After(cached.expiresAt) {
+				continue
+			}
+			labels.Accumulate(m.attributes, cached.labels)
+		}
+	}
+}
+
+// expire removes the expired label sets from the cache.
+func (d *crossTargetDecorator) expire(now time.Time) {
+	if now.Sub(d.lastExpiration) < time.Minute {
+		return
+	}
+	d.lastExpiration = now
+
+	for _, entries := range d.cache {
+		for k, cached := range entries {
+			if now.After(cached.expiresAt) {
+				delete(entries, k)
+			}
+		}
+	}
+}
+
+// joinKey returns a key built from the values of the given labels, or false
+// if any of them is missing.
+func joinKey(attrs labels.Set, names []string) (string, bool) {
+	var sb strings.Builder
+	for _, name := range names {
+		v, ok := attrs[name]
+		if !ok {
+			return "", false
+		}
+		sb.WriteString(fmt.Sprint(v))
+		sb.WriteByte(0)
+	}
+	return sb.String(), true
+}
+
+func hasAnyPrefix(name string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
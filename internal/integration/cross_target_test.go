@@ -0,0 +1,240 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+func ksmTargetMetrics() TargetMetrics {
+	return TargetMetrics{
+		Target: endpoints.Target{
+			Name:   "kube-state-metrics",
+			Object: endpoints.Object{Name: "kube-state-metrics", Kind: "pod"},
+		},
+		Metrics: []Metric{
+			{
+				name:       "kube_pod_labels",
+				metricType: metricType_GAUGE,
+				value:      1.0,
+				attributes: labels.Set{"namespace": "default", "pod": "redis-0", "label_app": "redis", "label_team": "cache"},
+			},
+			{
+				name:       "kube_pod_labels",
+				metricType: metricType_GAUGE,
+				value:      1.0,
+				attributes: labels.Set{"namespace": "default", "pod": "nginx-0", "label_app": "nginx"},
+			},
+		},
+	}
+}
+
+func podTargetMetrics() TargetMetrics {
+	return TargetMetrics{
+		Target: endpoints.Target{
+			Name: "redis-0",
+			Object: endpoints.Object{
+				Name: "redis-0",
+				Kind: "pod",
+				Labels: labels.Set{
+					"namespaceName": "default",
+					"podName":       "redis-0",
+				},
+			},
+		},
+		Metrics: []Metric{
+			{name: "redis_connected_clients", metricType: metricType_GAUGE, value: 3.0, attributes: labels.Set{}},
+			{name: "go_goroutines", metricType: metricType_GAUGE, value: 10.0, attributes: labels.Set{}},
+		},
+	}
+}
+
+func processTargets(processor Processor, targets ...TargetMetrics) []TargetMetrics {
+	pairs := make(chan TargetMetrics, len(targets))
+	for _, t := range targets {
+		pairs <- t
+	}
+	close(pairs)
+
+	var processed []TargetMetrics
+	for p := range processor(pairs) {
+		processed = append(processed, p)
+	}
+	return processed
+}
+
+func TestRuleProcessor_CrossTargetCopyAttributes(t *testing.T) {
+	t.Parallel()
+
+	processor := RuleProcessor([]ProcessingRule{
+		{
+			CopyAttributes: []CopyAttributesRule{
+				{
+					FromMetric:  "kube_pod_labels",
+					ToMetrics:   []string{"redis_"},
+					MatchBy:     []string{"namespace", "pod"},
+					ToMatchBy:   []string{"namespaceName", "podName"},
+					CrossTarget: true,
+				},
+			},
+		},
+	}, queueLength)
+
+	processed := processTargets(processor, ksmTargetMetrics(), podTargetMetrics())
+	require.Len(t, processed, 2)
+
+	pod := processed[1]
+	assert.Equal(t, "redis", pod.Metrics[0].attributes["label_app"])
+	assert.Equal(t, "cache", pod.Metrics[0].attributes["label_team"])
+	// The target metadata of the source target must not be copied.
+	assert.Equal(t, "redis-0", pod.Metrics[0].attributes["scrapedTargetName"])
+	// Nor the labels used to join the metrics.
+	assert.NotContains(t, pod.Metrics[0].attributes, "namespace")
+	assert.NotContains(t, pod.Metrics[0].attributes, "pod")
+	// Metrics not matching the destination prefixes are not modified.
+	assert.NotContains(t, pod.Metrics[1].attributes, "label_app")
+}
+
+func TestRuleProcessor_CrossTargetCopyRedactedAttributes(t *testing.T) {
+	t.Parallel()
+
+	processor := RuleProcessor([]ProcessingRule{
+		{
+			CopyAttributes: []CopyAttributesRule{
+				{
+					FromMetric:  "kube_pod_labels",
+					ToMetrics:   []string{"redis_"},
+					MatchBy:     []string{"namespace", "pod"},
+					ToMatchBy:   []string{"namespaceName", "podName"},
+					CrossTarget: true,
+				},
+			},
+			RedactAttributes: []RedactAttributesRule{
+				// The join labels can be redacted too.
+				{MetricPrefix: "kube_pod_labels", Attributes: []string{"label_team", "pod"}, Hash: true, Salt: "pepper"},
+			},
+		},
+	}, queueLength)
+
+	processed := processTargets(processor, ksmTargetMetrics(), podTargetMetrics())
+	require.Len(t, processed, 2)
+
+	// The labels redacted in the source metric are copied redacted, although
+	// the destination metric doesn't match the redact rule.
+	ksm, pod := processed[0], processed[1]
+	assert.Equal(t, saltedHash("pepper", "cache"), ksm.Metrics[0].attributes["label_team"])
+	assert.Equal(t, saltedHash("pepper", "cache"), pod.Metrics[0].attributes["label_team"])
+	assert.Equal(t, "redis", pod.Metrics[0].attributes["label_app"])
+}
+
+func TestRuleProcessor_CrossTargetCopyAttributesInNextCycle(t *testing.T) {
+	t.Parallel()
+
+	processor := RuleProcessor([]ProcessingRule{
+		{
+			CopyAttributes: []CopyAttributesRule{
+				{
+					FromMetric:  "kube_pod_labels",
+					ToMetrics:   []string{"redis_"},
+					MatchBy:     []string{"namespace", "pod"},
+					ToMatchBy:   []string{"namespaceName", "podName"},
+					Attributes:  []string{"label_app"},
+					CrossTarget: true,
+				},
+			},
+		},
+	}, queueLength)
+
+	// The destination target is processed before the source one, so it can
+	// only be decorated in the next cycle.
+	processed := processTargets(processor, podTargetMetrics(), ksmTargetMetrics())
+	assert.NotContains(t, processed[0].Metrics[0].attributes, "label_app")
+
+	processed = processTargets(processor, podTargetMetrics(), ksmTargetMetrics())
+	assert.Equal(t, "redis", processed[0].Metrics[0].attributes["label_app"])
+	assert.NotContains(t, processed[0].Metrics[0].attributes, "label_team")
+}
+
+func TestCrossTargetDecorator_CachedLabelsExpire(t *testing.T) {
+	t.Parallel()
+
+	d := newCrossTargetDecorator([]CopyAttributesRule{
+		{
+			FromMetric:  "kube_pod_labels",
+			ToMetrics:   []string{"redis_"},
+			MatchBy:     []string{"namespace", "pod"},
+			ToMatchBy:   []string{"namespaceName", "podName"},
+			CrossTarget: true,
+			CacheTTL:    time.Minute,
+		},
+	}, nil)
+	now := time.Now()
+
+	ksm := ksmTargetMetrics()
+	d.harvest(&ksm, now, nil)
+	assert.Len(t, d.cache[0], 2)
+
+	pod := podTargetMetrics()
+	for _, m := range pod.Metrics {
+		labels.Accumulate(m.attributes, pod.Target.Metadata())
+	}
+	d.decorate(&pod, now.Add(2*time.Minute))
+	assert.NotContains(t, pod.Metrics[0].attributes, "label_app")
+
+	other := podTargetMetrics()
+	d.harvest(&other, now.Add(2*time.Minute), nil)
+	assert.Empty(t, d.cache[0])
+}
+
+func TestValidateProcessingRules_CrossTarget(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name  string
+		rule  CopyAttributesRule
+		valid bool
+	}{
+		{
+			name:  "valid",
+			rule:  CopyAttributesRule{FromMetric: "a", MatchBy: []string{"pod"}, ToMatchBy: []string{"podName"}, CrossTarget: true},
+			valid: true,
+		},
+		{
+			name: "without match_by",
+			rule: CopyAttributesRule{FromMetric: "a", CrossTarget: true},
+		},
+		{
+			name: "to_match_by with different length",
+			rule: CopyAttributesRule{FromMetric: "a", MatchBy: []string{"namespace", "pod"}, ToMatchBy: []string{"podName"}, CrossTarget: true},
+		},
+		{
+			name: "to_match_by without cross_target",
+			rule: CopyAttributesRule{FromMetric: "a", MatchBy: []string{"pod"}, ToMatchBy: []string{"podName"}},
+		},
+		{
+			name: "negative cache_ttl",
+			rule: CopyAttributesRule{FromMetric: "a", MatchBy: []string{"pod"}, CrossTarget: true, CacheTTL: -time.Second},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			err := ValidateProcessingRules([]ProcessingRule{{CopyAttributes: []CopyAttributesRule{tc.rule}}})
+			if tc.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
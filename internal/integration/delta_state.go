@@ -0,0 +1,309 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/cumulative"
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+const defaultDeltaStateInterval = time.Minute
+
+// maxConfigMapSize is the maximum size of the data of a ConfigMap, which the
+// API server rejects beyond it.
+const maxConfigMapSize = 1024 * 1024
+
+// deltaCalculator calculates the deltas of the counters from their
+// cumulative values.
+type deltaCalculator interface {
+	CountMetric(name string, attributes map[string]interface{}, val float64, now time.Time) (telemetry.Count, bool)
+}
+
+// DeltaStateStore stores the snapshots of the state of the deltas of the
+// counters.
+type DeltaStateStore interface {
+	// Load returns the stored snapshot, or nil if there is none.
+	Load() ([]byte, error)
+	// Save replaces the stored snapshot.
+	Save(data []byte) error
+}
+
+// deltaStateEntry is the last value of a series.
+type deltaStateEntry struct {
+	Name       string                 `json:"name"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Value      float64                `json:"value"`
+	When       time.Time              `json:"when"`
+}
+
+// deltaStateSnapshot is the format of the snapshots, stored as gzipped JSON.
+type deltaStateSnapshot struct {
+	Timestamp time.Time         `json:"timestamp"`
+	Entries   []deltaStateEntry `json:"entries"`
+}
+
+// persistentDeltaCalculator is a cumulative.DeltaCalculator whose state can
+// be saved to a DeltaStateStore and loaded after a restart. The calculator
+// doesn't expose its state, so the last values of the series are tracked
+// alongside it, replicating how it updates them.
+type persistentDeltaCalculator struct {
+	*cumulative.DeltaCalculator
+	store         DeltaStateStore
+	expirationAge time.Duration
+	lock          sync.Mutex
+	entries       map[string]deltaStateEntry
+}
+
+func newPersistentDeltaCalculator(dc *cumulative.DeltaCalculator, store DeltaStateStore, expirationAge time.Duration) *persistentDeltaCalculator {
+	return &persistentDeltaCalculator{
+		DeltaCalculator: dc,
+		store:           store,
+		expirationAge:   expirationAge,
+		entries:         map[string]deltaStateEntry{},
+	}
+}
+
+// CountMetric calculates the delta of the counter and tracks its last value.
+func (pdc *persistentDeltaCalculator) CountMetric(name string, attributes map[string]interface{}, val float64, now time.Time) (telemetry.Count, bool) {
+	count, ok := pdc.DeltaCalculator.CountMetric(name, attributes, val, now)
+
+	key, err := deltaSeriesKey(name, attributes)
+	if err != nil {
+		return count, ok
+	}
+	pdc.lock.Lock()
+	defer pdc.lock.Unlock()
+	if last, found := pdc.entries[key]; !found || now.After(last.When) {
+		pdc.entries[key] = deltaStateEntry{Name: name, Attributes: attributes, Value: val, When: now}
+	}
+	return count, ok
+}
+
+// deltaSeriesKey returns the key identifying a series by its name and
+// attributes.
+func deltaSeriesKey(name string, attributes map[string]interface{}) (string, error) {
+	attributesJSON, err := json.Marshal(attributes)
+	if err != nil {
+		return "", err
+	}
+	return name + "\xff" + string(attributesJSON), nil
+}
+
+// save stores a snapshot of the last values of the series that haven't
+// expired.
+func (pdc *persistentDeltaCalculator) save(now time.Time) error {
+	pdc.lock.Lock()
+	snapshot := deltaStateSnapshot{Timestamp: now, Entries: make([]deltaStateEntry, 0, len(pdc.entries))}
+	for key, entry := range pdc.entries {
+		if now.Sub(entry.When) > pdc.expirationAge {
+			delete(pdc.entries, key)
+			continue
+		}
+		// They can't be encoded, and the next value has no delta anyway.
+		if math.IsNaN(entry.Value) || math.IsInf(entry.Value, 0) {
+			continue
+		}
+		snapshot.Entries = append(snapshot.Entries, entry)
+	}
+	data, err := encodeDeltaState(snapshot)
+	pdc.lock.Unlock()
+	if err != nil {
+		return fmt.Errorf("encoding delta state: %w", err)
+	}
+	if err := pdc.store.Save(data); err != nil {
+		return fmt.Errorf("saving delta state: %w", err)
+	}
+	return nil
+}
+
+// load restores the last values of the series from the stored snapshot,
+// unless it's older than maxAge, and returns how many were restored. The
+// values older than maxAge are skipped too.
+func (pdc *persistentDeltaCalculator) load(now time.Time, maxAge time.Duration) (int, error) {
+	data, err := pdc.store.Load()
+	if err != nil {
+		return 0, fmt.Errorf("loading delta state: %w", err)
+	}
+	if data == nil {
+		return 0, nil
+	}
+	snapshot, err := decodeDeltaState(data)
+	if err != nil {
+		return 0, fmt.Errorf("decoding delta state: %w", err)
+	}
+	if age := now.Sub(snapshot.Timestamp); age > maxAge {
+		return 0, fmt.Errorf("the delta state is %s old, older than the maximum age %s", age.Round(time.Second), maxAge)
+	}
+
+	var restored int
+	for _, entry := range snapshot.Entries {
+		if now.Sub(entry.When) > maxAge {
+			continue
+		}
+		pdc.CountMetric(entry.Name, entry.Attributes, entry.Value, entry.When)
+		restored++
+	}
+	return restored, nil
+}
+
+func encodeDeltaState(snapshot deltaStateSnapshot) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(snapshot); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeDeltaState(data []byte) (deltaStateSnapshot, error) {
+	var snapshot deltaStateSnapshot
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return snapshot, err
+	}
+	defer zr.Close()
+	err = json.NewDecoder(zr).Decode(&snapshot)
+	return snapshot, err
+}
+
+// fileDeltaStateStore stores the snapshots in a local file.
+type fileDeltaStateStore struct {
+	path string
+}
+
+// NewFileDeltaStateStore returns a DeltaStateStore keeping the snapshots in
+// the file, which is replaced atomically on every save. Its directory is
+// created if it doesn't exist.
+func NewFileDeltaStateStore(path string) DeltaStateStore {
+	return &fileDeltaStateStore{path: path}
+}
+
+func (s *fileDeltaStateStore) Load() ([]byte, error) {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (s *fileDeltaStateStore) Save(data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := writeFileSync(tmp, data); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// configMapDeltaStateStore stores the snapshots in a key of the binary data
+// of a ConfigMap.
+type configMapDeltaStateStore struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+	key       string
+	timeout   time.Duration
+}
+
+// NewConfigMapDeltaStateStore returns a DeltaStateStore keeping the
+// snapshots in the key of the ConfigMap, which is created if it doesn't
+// exist. Several stores can share the ConfigMap using different keys.
+func NewConfigMapDeltaStateStore(client kubernetes.Interface, namespace, name, key string) DeltaStateStore {
+	return &configMapDeltaStateStore{client: client, namespace: namespace, name: name, key: key, timeout: 10 * time.Second}
+}
+
+func (s *configMapDeltaStateStore) Load() ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	cm, err := s.client.CoreV1().ConfigMaps(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cm.BinaryData[s.key], nil
+}
+
+// Save fails without saving the snapshot if the ConfigMap would exceed its
+// maximum size, which happens with a lot of counters series. The state must
+// be stored in a file then.
+func (s *configMapDeltaStateStore) Save(data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	configMaps := s.client.CoreV1().ConfigMaps(s.namespace)
+	// The other stores sharing the ConfigMap may update it concurrently.
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := configMaps.Get(ctx, s.name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			cm = &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: s.name, Namespace: s.namespace},
+				BinaryData: map[string][]byte{s.key: data},
+			}
+			if err := s.checkSize(cm); err != nil {
+				return err
+			}
+			_, err = configMaps.Create(ctx, cm, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				return apierrors.NewConflict(corev1.Resource("configmaps"), s.name, err)
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if cm.BinaryData == nil {
+			cm.BinaryData = map[string][]byte{}
+		}
+		cm.BinaryData[s.key] = data
+		if err := s.checkSize(cm); err != nil {
+			return err
+		}
+		_, err = configMaps.Update(ctx, cm, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// checkSize returns an error if the data of the ConfigMap, including the
+// keys of the other stores sharing it, exceeds the maximum size.
+func (s *configMapDeltaStateStore) checkSize(cm *corev1.ConfigMap) error {
+	var size int
+	for key, value := range cm.Data {
+		size += len(key) + len(value)
+	}
+	for key, value := range cm.BinaryData {
+		size += len(key) + len(value)
+	}
+	if size > maxConfigMapSize {
+		return fmt.Errorf("the ConfigMap %s/%s would have %d bytes with the %d bytes of the %s key, more than the maximum of %d bytes",
+			s.namespace, s.name, size, len(cm.BinaryData[s.key]), s.key, maxConfigMapSize)
+	}
+	return nil
+}
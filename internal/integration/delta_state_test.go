@@ -0,0 +1,99 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestTelemetryEmitter_DeltaState(t *testing.T) {
+	t.Parallel()
+
+	store := NewFileDeltaStateStore(filepath.Join(t.TempDir(), "state", "telemetry"))
+	emitter, h := newRecordingTelemetryEmitter(t, store)
+	emitTestCounter(t, emitter, 10, time.Time{})
+	emitTestCounter(t, emitter, 15, time.Time{})
+	require.NoError(t, emitter.Close())
+	assert.Equal(t, []float64{5}, countValues(h.metrics))
+
+	// The counter keeps its continuity after a restart.
+	emitter, h = newRecordingTelemetryEmitter(t, store)
+	emitTestCounter(t, emitter, 22, time.Time{})
+	assert.Equal(t, []float64{7}, countValues(h.metrics))
+	require.NoError(t, emitter.Close())
+}
+
+func TestTelemetryEmitter_DeltaStateMaxAge(t *testing.T) {
+	t.Parallel()
+
+	store := NewFileDeltaStateStore(filepath.Join(t.TempDir(), "telemetry"))
+	saved := time.Now().Add(-time.Hour)
+	data, err := encodeDeltaState(deltaStateSnapshot{Timestamp: saved, Entries: []deltaStateEntry{
+		{Name: "http_requests_total", Attributes: map[string]interface{}{"code": "200"}, Value: 10, When: saved},
+	}})
+	require.NoError(t, err)
+	require.NoError(t, store.Save(data))
+
+	// The state older than the expiration age is not loaded.
+	emitter, h := newRecordingTelemetryEmitter(t, store)
+	emitTestCounter(t, emitter, 22, time.Time{})
+	assert.Empty(t, countValues(h.metrics))
+	require.NoError(t, emitter.Close())
+}
+
+func TestFileDeltaStateStore_NotFound(t *testing.T) {
+	t.Parallel()
+
+	data, err := NewFileDeltaStateStore(filepath.Join(t.TempDir(), "telemetry")).Load()
+	require.NoError(t, err)
+	assert.Nil(t, data)
+}
+
+func TestConfigMapDeltaStateStore(t *testing.T) {
+	t.Parallel()
+
+	client := fake.NewSimpleClientset()
+	store := NewConfigMapDeltaStateStore(client, "newrelic", "nri-prometheus-state", "telemetry")
+	data, err := store.Load()
+	require.NoError(t, err)
+	assert.Nil(t, data)
+
+	// The stores of the accounts share the ConfigMap.
+	accountStore := NewConfigMapDeltaStateStore(client, "newrelic", "nri-prometheus-state", "telemetry.team-a")
+	require.NoError(t, store.Save([]byte("first")))
+	require.NoError(t, accountStore.Save([]byte("account")))
+	require.NoError(t, store.Save([]byte("second")))
+
+	data, err = store.Load()
+	require.NoError(t, err)
+	assert.Equal(t, []byte("second"), data)
+	data, err = accountStore.Load()
+	require.NoError(t, err)
+	assert.Equal(t, []byte("account"), data)
+}
+
+func TestConfigMapDeltaStateStore_MaxSize(t *testing.T) {
+	t.Parallel()
+
+	client := fake.NewSimpleClientset()
+	store := NewConfigMapDeltaStateStore(client, "newrelic", "nri-prometheus-state", "telemetry")
+	accountStore := NewConfigMapDeltaStateStore(client, "newrelic", "nri-prometheus-state", "telemetry.team-a")
+	assert.Error(t, store.Save(make([]byte, maxConfigMapSize)))
+
+	// The keys of the other stores count too, and the stored state is kept.
+	require.NoError(t, store.Save(make([]byte, maxConfigMapSize/2)))
+	assert.Error(t, accountStore.Save(make([]byte, maxConfigMapSize/2)))
+	data, err := store.Load()
+	require.NoError(t, err)
+	assert.Len(t, data, maxConfigMapSize/2)
+	data, err = accountStore.Load()
+	require.NoError(t, err)
+	assert.Nil(t, data)
+}
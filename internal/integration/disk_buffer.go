@@ -0,0 +1,357 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	diskBufferExtension = ".payload"
+	// diskBufferNameDigits is the width of the sequence numbers of the file
+	// names, so their lexical order is their numeric order.
+	diskBufferNameDigits = 20
+)
+
+// diskBufferSecretHeaders are the headers with the keys of the account,
+// which are not written to disk. They are added again by the round trippers
+// of the harvester when the payload is replayed.
+var diskBufferSecretHeaders = []string{"Api-Key", "X-License-Key", "X-Insert-Key", "Authorization"}
+
+// bufferedPayload is a request written to the disk buffer.
+type bufferedPayload struct {
+	URL    string      `json:"url"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+type bufferedFile struct {
+	seq  uint64
+	size int64
+}
+
+// diskBuffer is an http.RoundTripper that writes the payloads that can't be
+// sent to a directory, and replays them in order before sending the next
+// payloads. The requests that are buffered are answered with a 202 status,
+// so the harvester doesn't retry them. When the size of the buffered
+// payloads exceeds the maximum size the oldest ones are dropped.
+type diskBuffer struct {
+	dir     string
+	maxSize int64
+	rt      http.RoundTripper
+	// lock serializes the requests, which the harvester sends concurrently,
+	// so the payloads are sent in order.
+	lock    sync.Mutex
+	files   []bufferedFile
+	size    int64
+	nextSeq uint64
+}
+
+// newDiskBuffer returns a diskBuffer with the payloads already buffered in
+// the directory, which is created if it doesn't exist.
+func newDiskBuffer(dir string, maxSize int64, rt http.RoundTripper) (*diskBuffer, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("the maximum size of the disk buffer must be positive")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("creating disk buffer directory: %w", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading disk buffer directory: %w", err)
+	}
+
+	db := &diskBuffer{dir: dir, maxSize: maxSize, rt: rt}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			continue
+		}
+		// Partial payloads of a crash while writing them.
+		if strings.HasSuffix(name, diskBufferExtension+".tmp") {
+			_ = os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		if !strings.HasSuffix(name, diskBufferExtension) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, diskBufferExtension), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("reading disk buffer directory: %w", err)
+		}
+		db.files = append(db.files, bufferedFile{seq: seq, size: info.Size()})
+		db.size += info.Size()
+		if seq >= db.nextSeq {
+			db.nextSeq = seq + 1
+		}
+	}
+	sort.Slice(db.files, func(i, j int) bool { return db.files[i].seq < db.files[j].seq })
+	if len(db.files) > 0 {
+		logrus.WithField("dir", dir).Infof("%d payloads buffered on disk will be replayed", len(db.files))
+	}
+	db.evict()
+	return db, nil
+}
+
+// TelemetryHarvesterWithDiskBuffer buffers the payloads that can't be sent
+// because the endpoint is unreachable or failing in the directory, up to
+// maxSize bytes, and replays them once it's reachable again. The payloads
+// are kept across restarts.
+//
+// This option wraps the client Transport, so it must be set after the ones
+// modifying it, including TelemetryHarvesterWithLicenseKeyRoundTripper.
+func TelemetryHarvesterWithDiskBuffer(dir string, maxSize int64) (TelemetryHarvesterOpt, error) {
+	db, err := newDiskBuffer(dir, maxSize, nil)
+	if err != nil {
+		return nil, err
+	}
+	return func(cfg *telemetry.Config) {
+		db.rt = cfg.Client.Transport
+		if db.rt == nil {
+			db.rt = http.DefaultTransport
+		}
+		cfg.Client.Transport = db
+	}, nil
+}
+
+// RoundTrip replays the buffered payloads and sends the request, or buffers
+// it if the buffered payloads can't be sent yet or it fails.
+func (db *diskBuffer) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if db.replay(req) {
+		resp, err := db.rt.RoundTrip(requestWithBody(req, body))
+		if !diskBufferRetryable(resp, err) {
+			return resp, err
+		}
+		if err != nil {
+			logrus.WithError(err).WithField("url", req.URL.String()).Debug("buffering payload on disk")
+		} else {
+			logrus.WithField("status", resp.StatusCode).WithField("url", req.URL.String()).Debug("buffering payload on disk")
+			_ = resp.Body.Close()
+		}
+	}
+
+	if err := db.write(req, body); err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		Status:     http.StatusText(http.StatusAccepted),
+		StatusCode: http.StatusAccepted,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Body:       io.NopCloser(bytes.NewReader(nil)),
+		Request:    req,
+	}, nil
+}
+
+// replay sends the buffered payloads in order, and returns whether all of
+// them were sent. The payloads rejected by the endpoint are dropped, since
+// sending them again would fail again.
+func (db *diskBuffer) replay(req *http.Request) bool {
+	for len(db.files) > 0 {
+		file := db.files[0]
+		payload, err := db.read(file)
+		if err != nil {
+			logrus.WithError(err).Warn("dropping unreadable payload of the disk buffer")
+			db.remove()
+			continue
+		}
+
+		replayReq, err := http.NewRequestWithContext(req.Context(), http.MethodPost, payload.URL, bytes.NewReader(payload.Body))
+		if err != nil {
+			logrus.WithError(err).Warn("dropping invalid payload of the disk buffer")
+			db.remove()
+			continue
+		}
+		for name, values := range payload.Header {
+			replayReq.Header[name] = values
+		}
+		// The keys of the account are added again by the other round
+		// trippers.
+		for _, name := range diskBufferSecretHeaders {
+			if values, ok := req.Header[name]; ok {
+				replayReq.Header[name] = values
+			}
+		}
+
+		resp, err := db.rt.RoundTrip(replayReq)
+		if diskBufferRetryable(resp, err) {
+			if err == nil {
+				_ = resp.Body.Close()
+			}
+			return false
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+			logrus.WithField("status", resp.StatusCode).Warn("dropping payload of the disk buffer rejected by the endpoint")
+		}
+		db.remove()
+	}
+	return true
+}
+
+// diskBufferRetryable returns whether the request should be buffered, using
+// the same criteria of the telemetry harvester to retry the requests.
+func diskBufferRetryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusAccepted,
+		http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound,
+		http.StatusMethodNotAllowed, http.StatusLengthRequired, http.StatusRequestEntityTooLarge:
+		return false
+	}
+	return true
+}
+
+func (db *diskBuffer) path(seq uint64) string {
+	return filepath.Join(db.dir, fmt.Sprintf("%0*d%s", diskBufferNameDigits, seq, diskBufferExtension))
+}
+
+// write buffers the request, dropping the oldest payloads if the buffer is
+// full. The file is written atomically, so a crash doesn't leave partial
+// payloads.
+func (db *diskBuffer) write(req *http.Request, body []byte) error {
+	header := req.Header.Clone()
+	for _, name := range diskBufferSecretHeaders {
+		header.Del(name)
+	}
+	data, err := json.Marshal(bufferedPayload{URL: req.URL.String(), Header: header, Body: body})
+	if err != nil {
+		return fmt.Errorf("encoding payload for the disk buffer: %w", err)
+	}
+	size := int64(len(data))
+	if size > db.maxSize {
+		logrus.WithField("size", size).Warn("dropping payload bigger than the disk buffer")
+		return nil
+	}
+
+	seq := db.nextSeq
+	path := db.path(seq)
+	tmp := path + ".tmp"
+	if err := writeFileSync(tmp, data); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("writing payload to the disk buffer: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("writing payload to the disk buffer: %w", err)
+	}
+
+	db.nextSeq++
+	db.files = append(db.files, bufferedFile{seq: seq, size: size})
+	db.size += size
+	db.evict()
+	return nil
+}
+
+// evict drops the oldest payloads until the buffer fits its maximum size.
+func (db *diskBuffer) evict() {
+	var dropped int
+	for db.size > db.maxSize && len(db.files) > 0 {
+		db.remove()
+		dropped++
+	}
+	if dropped > 0 {
+		logrus.WithField("dir", db.dir).Warnf("the disk buffer is full, dropped the %d oldest payloads", dropped)
+	}
+}
+
+func (db *diskBuffer) read(file bufferedFile) (*bufferedPayload, error) {
+	data, err := os.ReadFile(db.path(file.seq))
+	if err != nil {
+		return nil, err
+	}
+	var payload bufferedPayload
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return nil, err
+	}
+	return &payload, nil
+}
+
+// remove deletes the oldest payload.
+func (db *diskBuffer) remove() {
+	file := db.files[0]
+	if err := os.Remove(db.path(file.seq)); err != nil && !os.IsNotExist(err) {
+		logrus.WithError(err).Warn("removing payload of the disk buffer")
+	}
+	db.files = db.files[1:]
+	db.size -= file.size
+}
+
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readRequestBody returns the body of the request without consuming it.
+func readRequestBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	if req.GetBody != nil {
+		r, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	}
+	body, err := io.ReadAll(req.Body)
+	_ = req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// requestWithBody returns a copy of the request with a fresh body.
+func requestWithBody(req *http.Request, body []byte) *http.Request {
+	r := req.Clone(req.Context())
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	r.ContentLength = int64(len(body))
+	return r
+}
@@ -0,0 +1,186 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyEndpoint fails the requests while it's down.
+type flakyEndpoint struct {
+	lock        sync.Mutex
+	down        bool
+	bodies      []string
+	licenseKeys []string
+}
+
+func newFlakyEndpoint(t *testing.T) (*flakyEndpoint, *httptest.Server) {
+	t.Helper()
+
+	endpoint := &flakyEndpoint{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		endpoint.lock.Lock()
+		defer endpoint.lock.Unlock()
+		if endpoint.down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		endpoint.bodies = append(endpoint.bodies, string(b))
+		endpoint.licenseKeys = append(endpoint.licenseKeys, r.Header.Get("X-License-Key"))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(srv.Close)
+	return endpoint, srv
+}
+
+func (fe *flakyEndpoint) setDown(down bool) {
+	fe.lock.Lock()
+	defer fe.lock.Unlock()
+	fe.down = down
+}
+
+func postPayload(t *testing.T, client *http.Client, url, body string) {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Api-Key", "license key")
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	// The buffered payloads are accepted too.
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+}
+
+func bufferedFiles(t *testing.T, dir string) []string {
+	t.Helper()
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"+diskBufferExtension))
+	require.NoError(t, err)
+	return files
+}
+
+func TestDiskBuffer(t *testing.T) {
+	t.Parallel()
+
+	endpoint, srv := newFlakyEndpoint(t)
+	dir := t.TempDir()
+	client := &http.Client{Transport: newLicenseKeyRoundTripper(nil, "license key")}
+	db, err := newDiskBuffer(dir, 1024*1024, client.Transport)
+	require.NoError(t, err)
+	client.Transport = db
+
+	postPayload(t, client, srv.URL, "first")
+	endpoint.setDown(true)
+	postPayload(t, client, srv.URL, "second")
+	postPayload(t, client, srv.URL, "third")
+	assert.Len(t, bufferedFiles(t, dir), 2)
+
+	// The keys of the account are not written to disk.
+	for _, file := range bufferedFiles(t, dir) {
+		data, err := os.ReadFile(file)
+		require.NoError(t, err)
+		assert.NotContains(t, string(data), "license key")
+	}
+
+	endpoint.setDown(false)
+	postPayload(t, client, srv.URL, "fourth")
+	assert.Empty(t, bufferedFiles(t, dir))
+	assert.Equal(t, []string{"first", "second", "third", "fourth"}, endpoint.bodies)
+	assert.Equal(t, []string{"license key", "license key", "license key", "license key"}, endpoint.licenseKeys)
+}
+
+func TestDiskBuffer_DropsOldest(t *testing.T) {
+	t.Parallel()
+
+	endpoint, srv := newFlakyEndpoint(t)
+	endpoint.setDown(true)
+
+	// Measures the size of a buffered payload.
+	dir := t.TempDir()
+	db, err := newDiskBuffer(dir, 1024*1024, http.DefaultTransport)
+	require.NoError(t, err)
+	postPayload(t, &http.Client{Transport: db}, srv.URL, "payload-0")
+	require.Len(t, db.files, 1)
+	payloadSize := db.files[0].size
+
+	// Room for two payloads.
+	dir = t.TempDir()
+	db, err = newDiskBuffer(dir, 2*payloadSize+payloadSize/2, http.DefaultTransport)
+	require.NoError(t, err)
+	client := &http.Client{Transport: db}
+	for _, body := range []string{"payload-1", "payload-2", "payload-3"} {
+		postPayload(t, client, srv.URL, body)
+	}
+	assert.Len(t, bufferedFiles(t, dir), 2)
+
+	endpoint.setDown(false)
+	postPayload(t, client, srv.URL, "payload-4")
+	assert.Equal(t, []string{"payload-2", "payload-3", "payload-4"}, endpoint.bodies)
+}
+
+func TestDiskBuffer_Restart(t *testing.T) {
+	t.Parallel()
+
+	endpoint, srv := newFlakyEndpoint(t)
+	dir := t.TempDir()
+	db, err := newDiskBuffer(dir, 1024*1024, http.DefaultTransport)
+	require.NoError(t, err)
+
+	endpoint.setDown(true)
+	postPayload(t, &http.Client{Transport: db}, srv.URL, "first")
+	// A partial payload of a crash while it was written.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "00000000000000000007"+diskBufferExtension+".tmp"), []byte("{"), 0o600))
+
+	// The buffered payloads are replayed after a restart.
+	endpoint.setDown(false)
+	db, err = newDiskBuffer(dir, 1024*1024, http.DefaultTransport)
+	require.NoError(t, err)
+	postPayload(t, &http.Client{Transport: db}, srv.URL, "second")
+	assert.Equal(t, []string{"first", "second"}, endpoint.bodies)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestDiskBuffer_NotRetryable(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	db, err := newDiskBuffer(dir, 1024*1024, http.DefaultTransport)
+	require.NoError(t, err)
+
+	// The rejected payloads are not buffered, since they would be rejected
+	// again.
+	req, err := http.NewRequest(http.MethodPost, srv.URL, strings.NewReader("payload"))
+	require.NoError(t, err)
+	resp, err := (&http.Client{Transport: db}).Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Empty(t, bufferedFiles(t, dir))
+}
+
+func TestNewDiskBuffer_InvalidConfig(t *testing.T) {
+	t.Parallel()
+
+	_, err := newDiskBuffer(t.TempDir(), 0, http.DefaultTransport)
+	assert.Error(t, err)
+}
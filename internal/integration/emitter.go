@@ -4,9 +4,19 @@
 package integration
 
 import (
-	"encoding/json"
+	"bytes"
 	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
 	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
 )
 
 const (
@@ -29,16 +39,42 @@ func copyAttrs(attrs map[string]interface{}) map[string]interface{} {
 	return duplicate
 }
 
+// Formats of the StdoutEmitter.
+const (
+	// StdoutFormatJSON writes each metric as a JSON line.
+	StdoutFormatJSON = "json"
+	// StdoutFormatPrometheus writes the metrics in the Prometheus text
+	// exposition format.
+	StdoutFormatPrometheus = "prometheus"
+	// StdoutFormatTable writes the metrics as a human readable table.
+	StdoutFormatTable = "table"
+)
+
 // StdoutEmitter emits metrics to stdout.
 type StdoutEmitter struct {
-	name string
+	name   string
+	format string
+
+	lock sync.Mutex
+	out  io.Writer
 }
 
-// NewStdoutEmitter returns a NewStdoutEmitter.
-func NewStdoutEmitter() *StdoutEmitter {
-	return &StdoutEmitter{
-		name: "stdout",
+// NewStdoutEmitter returns a StdoutEmitter writing the metrics in the format,
+// which defaults to StdoutFormatJSON.
+func NewStdoutEmitter(format string) (*StdoutEmitter, error) {
+	switch format {
+	case "":
+		format = StdoutFormatJSON
+	case StdoutFormatJSON, StdoutFormatPrometheus, StdoutFormatTable:
+	default:
+		return nil, fmt.Errorf("unknown stdout emitter format %q, valid formats are %q, %q and %q",
+			format, StdoutFormatJSON, StdoutFormatPrometheus, StdoutFormatTable)
 	}
+	return &StdoutEmitter{
+		name:   "stdout",
+		format: format,
+		out:    os.Stdout,
+	}, nil
 }
 
 // Name is the StdoutEmitter name.
@@ -46,13 +82,115 @@ func (se *StdoutEmitter) Name() string {
 	return se.name
 }
 
-// Emit prints the metrics into stdout.
-// Note: histograms not supported due json not supporting Inf values which are present in the last bucket
+// Emit prints the metrics into stdout. NaN and infinite values are written
+// as the "NaN", "+Inf" and "-Inf" strings in the JSON format.
 func (se *StdoutEmitter) Emit(metrics []Metric) error {
-	b, err := json.Marshal(metrics)
-	if err != nil {
-		return err
+	// The same timestamp is written for all the metrics of the batch.
+	now := time.Now()
+
+	var buf bytes.Buffer
+	var err error
+	switch se.format {
+	case StdoutFormatPrometheus:
+		err = writePrometheusText(&buf, metrics, now)
+	case StdoutFormatTable:
+		err = writeTable(&buf, metrics)
+	default:
+		err = writeJSONLines(&buf, metrics, now)
+	}
+
+	// The metrics that could be formatted are written even if some failed,
+	// and the output of concurrent emits is not interleaved.
+	se.lock.Lock()
+	defer se.lock.Unlock()
+	if _, werr := se.out.Write(buf.Bytes()); werr != nil {
+		return appendError(err, werr)
+	}
+	return err
+}
+
+func writeJSONLines(w io.Writer, metrics []Metric, now time.Time) error {
+	var results error
+	for i := range metrics {
+		line, err := marshalMetricLine(&metrics[i], now)
+		if err != nil {
+			results = appendError(results, err)
+			continue
+		}
+		_, _ = w.Write(append(line, '\n'))
+	}
+	return results
+}
+
+func writePrometheusText(w io.Writer, metrics []Metric, now time.Time) error {
+	byName := map[string]*dto.MetricFamily{}
+	addMetricFamilies(byName, metrics, nil, now)
+
+	var results error
+	for _, mf := range sortedMetricFamilies(byName) {
+		if _, err := expfmt.MetricFamilyToText(w, mf); err != nil {
+			results = appendError(results, fmt.Errorf("writing %q: %w", mf.GetName(), err))
+		}
+	}
+	return results
+}
+
+func writeTable(w io.Writer, metrics []Metric) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tTYPE\tVALUE\tATTRIBUTES")
+
+	var results error
+	for _, m := range metrics {
+		value, err := tableValue(m)
+		if err != nil {
+			results = appendError(results, err)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", m.name, m.metricType, value, tableAttributes(m.attributes))
+	}
+	return appendError(results, tw.Flush())
+}
+
+// tableValue returns the value of the metric as text. Summaries and
+// histograms are written with their count, sum and quantiles or buckets,
+// e.g. `count=6 sum=2.5 le(0.1)=2 le(+Inf)=6`.
+func tableValue(m Metric) (string, error) {
+	switch value := m.value.(type) {
+	case float64:
+		return formatFloat(value), nil
+	case *dto.Summary:
+		parts := []string{
+			"count=" + strconv.FormatUint(value.GetSampleCount(), 10),
+			"sum=" + formatFloat(value.GetSampleSum()),
+		}
+		for _, q := range value.GetQuantile() {
+			parts = append(parts, fmt.Sprintf("q(%s)=%s", formatFloat(q.GetQuantile()), formatFloat(q.GetValue())))
+		}
+		return strings.Join(parts, " "), nil
+	case *dto.Histogram:
+		parts := []string{
+			"count=" + strconv.FormatUint(value.GetSampleCount(), 10),
+			"sum=" + formatFloat(value.GetSampleSum()),
+		}
+		for _, b := range value.GetBucket() {
+			parts = append(parts, fmt.Sprintf("le(%s)=%d", formatFloat(b.GetUpperBound()), b.GetCumulativeCount()))
+		}
+		return strings.Join(parts, " "), nil
+	}
+	return "", fmt.Errorf("unknown value type for %q: %T", m.name, m.value)
+}
+
+// tableAttributes returns the attributes as `name=value` pairs sorted by name.
+func tableAttributes(attrs map[string]interface{}) string {
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%v", name, attrs[name]))
 	}
-	fmt.Println(string(b))
-	return nil
+	return strings.Join(pairs, ",")
 }
@@ -0,0 +1,180 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+)
+
+// EmitterFilter selects the metrics sent to an emitter. A metric is sent if
+// it matches the Include selector, or there is none, and it doesn't match the
+// Exclude selector.
+type EmitterFilter struct {
+	Include *EmitterSelector `mapstructure:"include"`
+	Exclude *EmitterSelector `mapstructure:"exclude"`
+}
+
+// EmitterSelector matches the metrics that match all its non-empty fields. A
+// field with several values matches if any of them does.
+type EmitterSelector struct {
+	// MetricNames are regular expressions matching the whole name of the
+	// metrics.
+	MetricNames []string `mapstructure:"metric_names"`
+	// Namespaces are the Kubernetes namespaces of the targets.
+	Namespaces []string `mapstructure:"namespaces"`
+	// TargetSelector matches the targets of the metrics by their name, kind,
+	// URL or object labels.
+	TargetSelector `mapstructure:",squash"`
+}
+
+// emitterSelector is the compiled form of an EmitterSelector.
+type emitterSelector struct {
+	metricNames []*regexp.Regexp
+	namespaces  []string
+	// target is nil if the selector has no target fields.
+	target *targetSelector
+}
+
+func compileEmitterSelector(es *EmitterSelector) (*emitterSelector, error) {
+	if es == nil {
+		return nil, nil
+	}
+
+	s := &emitterSelector{namespaces: es.Namespaces}
+	for _, expr := range es.MetricNames {
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid metric name expression %q: %w", expr, err)
+		}
+		s.metricNames = append(s.metricNames, re)
+	}
+	ts := es.TargetSelector
+	if len(ts.Names) > 0 || len(ts.Kinds) > 0 || len(ts.URLs) > 0 || len(ts.Labels) > 0 {
+		var err error
+		if s.target, err = compileTargetSelector(&ts); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// matchesTarget returns whether the target matches the target fields of the
+// selector.
+func (s *emitterSelector) matchesTarget(t *endpoints.Target) bool {
+	if len(s.namespaces) > 0 {
+		namespace, _ := t.Object.Labels["namespaceName"].(string)
+		if !anyEqualFold(s.namespaces, namespace) {
+			return false
+		}
+	}
+	return s.target.matches(t)
+}
+
+func (s *emitterSelector) matchesMetric(name string) bool {
+	return len(s.metricNames) == 0 || anyRegexpMatches(s.metricNames, name)
+}
+
+// FilteredEmitter is an Emitter that only emits the metrics selected by its
+// filter. The filter is applied by EmitTarget, which is used instead of Emit
+// when the metrics are processed, since it needs the target of the metrics.
+// Emit applies it to metrics of an unknown target.
+type FilteredEmitter struct {
+	Emitter
+	include *emitterSelector
+	exclude *emitterSelector
+}
+
+// NewFilteredEmitter returns the emitter wrapped in a FilteredEmitter, or the
+// emitter itself if the filter is empty.
+func NewFilteredEmitter(e Emitter, filter EmitterFilter) (Emitter, error) {
+	if filter.Include == nil && filter.Exclude == nil {
+		return e, nil
+	}
+	include, err := compileEmitterSelector(filter.Include)
+	if err != nil {
+		return nil, fmt.Errorf("invalid include selector of the %s emitter: %w", e.Name(), err)
+	}
+	exclude, err := compileEmitterSelector(filter.Exclude)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exclude selector of the %s emitter: %w", e.Name(), err)
+	}
+	return &FilteredEmitter{Emitter: e, include: include, exclude: exclude}, nil
+}
+
+// Unwrap returns the filtered emitter.
+func (fe *FilteredEmitter) Unwrap() Emitter {
+	return fe.Emitter
+}
+
+// Emit emits the metrics selected by the filter, as metrics of an unknown
+// target, which matches no target field of the selectors. So the include
+// selectors with target fields select none of them, and the exclude ones
+// only exclude them if they have no target fields.
+func (fe *FilteredEmitter) Emit(metrics []Metric) error {
+	selected := fe.selected(TargetMetrics{Metrics: metrics})
+	if len(selected) == 0 {
+		return nil
+	}
+	return fe.Emitter.Emit(selected)
+}
+
+// EmitTarget emits the metrics of the target selected by the filter.
+func (fe *FilteredEmitter) EmitTarget(pair TargetMetrics) error {
+	selected := fe.selected(pair)
+	if len(selected) == 0 {
+		return nil
+	}
+	return emitTarget(fe.Emitter, TargetMetrics{Metrics: selected, Target: pair.Target})
+}
+
+// selected returns the metrics of the target selected by the filter.
+func (fe *FilteredEmitter) selected(pair TargetMetrics) []Metric {
+	includeTarget := fe.include == nil || fe.include.matchesTarget(&pair.Target)
+	excludeTarget := fe.exclude != nil && fe.exclude.matchesTarget(&pair.Target)
+	if !includeTarget {
+		return nil
+	}
+
+	selected := make([]Metric, 0, len(pair.Metrics))
+	for _, m := range pair.Metrics {
+		if fe.include != nil && !fe.include.matchesMetric(m.name) {
+			continue
+		}
+		if excludeTarget && fe.exclude.matchesMetric(m.name) {
+			continue
+		}
+		selected = append(selected, m)
+	}
+	return selected
+}
+
+// targetEmitter is implemented by the emitters that need the target of the
+// metrics, like the FilteredEmitter and the RoutingEmitter.
+type targetEmitter interface {
+	EmitTarget(pair TargetMetrics) error
+}
+
+// emitTarget emits the metrics of the target with the emitter, using
+// EmitTarget if the emitter implements it.
+func emitTarget(e Emitter, pair TargetMetrics) error {
+	if te, ok := e.(targetEmitter); ok {
+		return te.EmitTarget(pair)
+	}
+	return e.Emit(pair.Metrics)
+}
+
+// UnwrapEmitter returns the emitter wrapped by decorators like the
+// FilteredEmitter, or the emitter itself if it isn't wrapped.
+func UnwrapEmitter(e Emitter) Emitter {
+	for {
+		u, ok := e.(interface{ Unwrap() Emitter })
+		if !ok {
+			return e
+		}
+		e = u.Unwrap()
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+// recordingEmitter keeps the names of the emitted metrics.
+type recordingEmitter struct {
+	emits [][]string
+}
+
+func (*recordingEmitter) Name() string {
+	return "recording"
+}
+
+func (re *recordingEmitter) Emit(metrics []Metric) error {
+	var names []string
+	for _, m := range metrics {
+		names = append(names, m.name)
+	}
+	re.emits = append(re.emits, names)
+	return nil
+}
+
+func filterTestMetrics(t *testing.T) TargetMetrics {
+	t.Helper()
+
+	var metrics []Metric
+	for _, name := range []string{"redis_up", "redis_connected_clients", "process_cpu_seconds_total"} {
+		metrics = append(metrics, Metric{name: name, metricType: metricType_GAUGE, value: 1.0, attributes: labels.Set{}})
+	}
+	return TargetMetrics{Metrics: metrics, Target: selectorTarget(t)}
+}
+
+func TestFilteredEmitter(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name     string
+		filter   EmitterFilter
+		expected [][]string
+	}{
+		{
+			name:     "include metric names",
+			filter:   EmitterFilter{Include: &EmitterSelector{MetricNames: []string{"redis_.*"}}},
+			expected: [][]string{{"redis_up", "redis_connected_clients"}},
+		},
+		{
+			name:     "include namespace",
+			filter:   EmitterFilter{Include: &EmitterSelector{Namespaces: []string{"cache"}}},
+			expected: [][]string{{"redis_up", "redis_connected_clients", "process_cpu_seconds_total"}},
+		},
+		{
+			name:   "include other namespace",
+			filter: EmitterFilter{Include: &EmitterSelector{Namespaces: []string{"finops"}}},
+		},
+		{
+			name: "include target labels and metric names",
+			filter: EmitterFilter{Include: &EmitterSelector{
+				MetricNames:    []string{"redis_up"},
+				TargetSelector: TargetSelector{Labels: map[string]string{"label.app": "redis"}},
+			}},
+			expected: [][]string{{"redis_up"}},
+		},
+		{
+			name:     "exclude metric names",
+			filter:   EmitterFilter{Exclude: &EmitterSelector{MetricNames: []string{"process_.*"}}},
+			expected: [][]string{{"redis_up", "redis_connected_clients"}},
+		},
+		{
+			name: "exclude other target",
+			filter: EmitterFilter{Exclude: &EmitterSelector{
+				MetricNames:    []string{"redis_.*"},
+				TargetSelector: TargetSelector{Kinds: []string{"service"}},
+			}},
+			expected: [][]string{{"redis_up", "redis_connected_clients", "process_cpu_seconds_total"}},
+		},
+		{
+			name: "include and exclude",
+			filter: EmitterFilter{
+				Include: &EmitterSelector{MetricNames: []string{"redis_.*"}},
+				Exclude: &EmitterSelector{MetricNames: []string{"redis_up"}, Namespaces: []string{"cache"}},
+			},
+			expected: [][]string{{"redis_connected_clients"}},
+		},
+		{
+			name:   "exclude target",
+			filter: EmitterFilter{Exclude: &EmitterSelector{Namespaces: []string{"cache"}}},
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			re := &recordingEmitter{}
+			e, err := NewFilteredEmitter(re, tc.filter)
+			require.NoError(t, err)
+			require.NoError(t, emitTarget(e, filterTestMetrics(t)))
+			assert.Equal(t, tc.expected, re.emits)
+		})
+	}
+}
+
+func TestFilteredEmitter_Emit(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name     string
+		filter   EmitterFilter
+		expected [][]string
+	}{
+		{
+			name:     "include metric names",
+			filter:   EmitterFilter{Include: &EmitterSelector{MetricNames: []string{"redis_.*"}}},
+			expected: [][]string{{"redis_up", "redis_connected_clients"}},
+		},
+		{
+			name:   "include namespace",
+			filter: EmitterFilter{Include: &EmitterSelector{Namespaces: []string{"cache"}}},
+		},
+		{
+			name:     "exclude metric names",
+			filter:   EmitterFilter{Exclude: &EmitterSelector{MetricNames: []string{"process_.*"}}},
+			expected: [][]string{{"redis_up", "redis_connected_clients"}},
+		},
+		{
+			name:     "exclude target",
+			filter:   EmitterFilter{Exclude: &EmitterSelector{MetricNames: []string{"redis_.*"}, Namespaces: []string{"cache"}}},
+			expected: [][]string{{"redis_up", "redis_connected_clients", "process_cpu_seconds_total"}},
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			// The target of the metrics is unknown.
+			re := &recordingEmitter{}
+			e, err := NewFilteredEmitter(re, tc.filter)
+			require.NoError(t, err)
+			require.NoError(t, e.Emit(filterTestMetrics(t).Metrics))
+			assert.Equal(t, tc.expected, re.emits)
+		})
+	}
+}
+
+func TestNewFilteredEmitter_EmptyFilter(t *testing.T) {
+	t.Parallel()
+
+	re := &recordingEmitter{}
+	e, err := NewFilteredEmitter(re, EmitterFilter{})
+	require.NoError(t, err)
+	assert.Same(t, re, e)
+}
+
+func TestNewFilteredEmitter_InvalidFilter(t *testing.T) {
+	t.Parallel()
+
+	re := &recordingEmitter{}
+	_, err := NewFilteredEmitter(re, EmitterFilter{Include: &EmitterSelector{MetricNames: []string{"redis_("}}})
+	assert.Error(t, err)
+	_, err = NewFilteredEmitter(re, EmitterFilter{Exclude: &EmitterSelector{TargetSelector: TargetSelector{URLs: []string{"("}}}})
+	assert.Error(t, err)
+}
+
+func TestUnwrapEmitter(t *testing.T) {
+	t.Parallel()
+
+	re := &recordingEmitter{}
+	e, err := NewFilteredEmitter(re, EmitterFilter{Include: &EmitterSelector{Namespaces: []string{"cache"}}})
+	require.NoError(t, err)
+	assert.Same(t, re, UnwrapEmitter(e))
+	assert.Same(t, re, UnwrapEmitter(re))
+}
@@ -4,10 +4,18 @@
 package integration
 
 import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strings"
 	"testing"
 
-	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
 )
 
 func Test_EmitterCanEmit(t *testing.T) {
@@ -60,9 +68,90 @@ func Test_EmitterCanEmit(t *testing.T) {
 		},
 	}
 
-	e := NewStdoutEmitter()
+	e, err := NewStdoutEmitter("")
+	assert.NoError(t, err)
 	assert.NotNil(t, e)
 
 	err = e.Emit(metrics)
 	assert.NoError(t, err)
 }
+
+func stdoutTestMetrics() []Metric {
+	return []Metric{
+		{
+			name:       "temperature",
+			metricType: metricType_GAUGE,
+			value:      math.NaN(),
+			attributes: labels.Set{"room": "kitchen", "nrMetricType": "gauge"},
+		},
+		{
+			name:       "http_duration_seconds",
+			metricType: metricType_HISTOGRAM,
+			value: &dto.Histogram{
+				SampleCount: proto.Uint64(6),
+				SampleSum:   proto.Float64(2.5),
+				Bucket: []*dto.Bucket{
+					{UpperBound: proto.Float64(0.1), CumulativeCount: proto.Uint64(2)},
+					{UpperBound: proto.Float64(math.Inf(1)), CumulativeCount: proto.Uint64(6)},
+				},
+			},
+			attributes: labels.Set{"targetName": "api:8080"},
+		},
+	}
+}
+
+func stdoutEmit(t *testing.T, format string) string {
+	t.Helper()
+
+	e, err := NewStdoutEmitter(format)
+	require.NoError(t, err)
+	var out bytes.Buffer
+	e.out = &out
+	require.NoError(t, e.Emit(stdoutTestMetrics()))
+	return out.String()
+}
+
+func TestStdoutEmitter_JSON(t *testing.T) {
+	t.Parallel()
+
+	lines := strings.Split(strings.TrimSuffix(stdoutEmit(t, StdoutFormatJSON), "\n"), "\n")
+	require.Len(t, lines, 2)
+
+	var gauge, hist map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &gauge))
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &hist))
+
+	assert.Equal(t, "temperature", gauge["name"])
+	assert.Equal(t, "NaN", gauge["value"])
+	assert.Equal(t, "histogram", hist["type"])
+	buckets := hist["value"].(map[string]interface{})["buckets"].([]interface{})
+	assert.Equal(t, "+Inf", buckets[1].(map[string]interface{})["upper_bound"])
+}
+
+func TestStdoutEmitter_Prometheus(t *testing.T) {
+	t.Parallel()
+
+	out := stdoutEmit(t, StdoutFormatPrometheus)
+	assert.Contains(t, out, "# TYPE temperature gauge\n")
+	assert.Contains(t, out, `temperature{room="kitchen"} NaN `)
+	assert.Contains(t, out, "# TYPE http_duration_seconds histogram\n")
+	assert.Contains(t, out, `http_duration_seconds_bucket{targetName="api:8080",le="+Inf"} 6 `)
+	assert.NotContains(t, out, "nrMetricType")
+}
+
+func TestStdoutEmitter_Table(t *testing.T) {
+	t.Parallel()
+
+	lines := strings.Split(strings.TrimSuffix(stdoutEmit(t, StdoutFormatTable), "\n"), "\n")
+	require.Len(t, lines, 3)
+	assert.Equal(t, []string{"NAME", "TYPE", "VALUE", "ATTRIBUTES"}, strings.Fields(lines[0]))
+	assert.Equal(t, []string{"temperature", "gauge", "NaN", "nrMetricType=gauge,room=kitchen"}, strings.Fields(lines[1]))
+	assert.Equal(t, []string{"http_duration_seconds", "histogram", "count=6", "sum=2.5", "le(0.1)=2", "le(+Inf)=6", "targetName=api:8080"}, strings.Fields(lines[2]))
+}
+
+func TestNewStdoutEmitter_UnknownFormat(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewStdoutEmitter("xml")
+	assert.Error(t, err)
+}
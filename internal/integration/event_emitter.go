@@ -0,0 +1,173 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	"github.com/pkg/errors"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+)
+
+const defaultEventType = "PrometheusSample"
+
+// EventEmitterConfig is the configuration of the EventEmitter.
+type EventEmitterConfig struct {
+	// HarvesterOpts configuration functions for the telemetry Harvester.
+	HarvesterOpts []TelemetryHarvesterOpt
+	// EventType of the events. Defaults to PrometheusSample.
+	EventType string
+	// Selectors are the Prometheus series selectors of the metrics sent as
+	// events, e.g. `kube_pod_info` or `{__name__=~"redis_.*_info"}`. At
+	// least one is required.
+	Selectors []string
+}
+
+// eventHarvester is the part of the telemetry.Harvester used by the
+// EventEmitter.
+type eventHarvester interface {
+	RecordEvent(e telemetry.Event) error
+	HarvestNow(ctx context.Context)
+}
+
+// EventEmitter sends the selected metrics of each target as a custom event to
+// the New Relic Event API, with the values of the metrics as attributes.
+type EventEmitter struct {
+	name      string
+	harvester eventHarvester
+	eventType string
+	selectors []*seriesSelector
+}
+
+// NewEventEmitter returns an EventEmitter, or an error if its configuration
+// is not valid.
+func NewEventEmitter(cfg EventEmitterConfig) (*EventEmitter, error) {
+	if len(cfg.Selectors) == 0 {
+		return nil, fmt.Errorf("the event emitter needs at least one selector")
+	}
+	selectors := make([]*seriesSelector, 0, len(cfg.Selectors))
+	for _, s := range cfg.Selectors {
+		selector, err := parseSeriesSelector(s)
+		if err != nil {
+			return nil, err
+		}
+		selectors = append(selectors, selector)
+	}
+
+	eventType := cfg.EventType
+	if eventType == "" {
+		eventType = defaultEventType
+	}
+
+	// The events are harvested after every emit.
+	h, err := telemetry.NewHarvester(append(cfg.HarvesterOpts, telemetryHarvesterZeroPeriod)...)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create new Harvester")
+	}
+
+	return &EventEmitter{
+		name:      "events",
+		harvester: h,
+		eventType: eventType,
+		selectors: selectors,
+	}, nil
+}
+
+// Name is the EventEmitter name.
+func (ee *EventEmitter) Name() string {
+	return ee.name
+}
+
+// Emit sends the metrics matching any of the selectors as a single event.
+// The metrics are emitted once per target, so each event is a snapshot of a
+// target.
+func (ee *EventEmitter) Emit(metrics []Metric) error {
+	var selected []Metric
+	for _, metric := range metrics {
+		name := sanitizePromName(metric.name, true)
+		if matchesAnySelector(ee.selectors, name, prometheusLabels(metric.attributes)) {
+			selected = append(selected, metric)
+		}
+	}
+	if len(selected) == 0 {
+		return nil
+	}
+
+	err := ee.harvester.RecordEvent(telemetry.Event{
+		EventType:  ee.eventType,
+		Timestamp:  time.Now(),
+		Attributes: eventAttributes(selected),
+	})
+	if err != nil {
+		return fmt.Errorf("recording event: %w", err)
+	}
+	ee.harvester.HarvestNow(context.Background())
+	return nil
+}
+
+// eventAttributes returns the attributes of the event of the metrics. The
+// attributes with the same value in all the metrics, like the ones of the
+// target, are added as they are. The value of each metric is added with its
+// name, and its other attributes prefixed with its name, e.g.
+// `redis_instance_info.redis_version`. Summaries and histograms add their
+// count and sum, e.g. `http_duration_seconds.count`. If several metrics have
+// the same name only the first one is added.
+func eventAttributes(metrics []Metric) map[string]interface{} {
+	common := copyAttrs(metrics[0].attributes)
+	for attr := range prometheusDroppedAttributes {
+		delete(common, attr)
+	}
+	for _, metric := range metrics[1:] {
+		for attr, value := range common {
+			if v, ok := metric.attributes[attr]; !ok || fmt.Sprint(v) != fmt.Sprint(value) {
+				delete(common, attr)
+			}
+		}
+	}
+
+	attrs := copyAttrs(common)
+	seen := map[string]bool{}
+	for _, metric := range metrics {
+		if seen[metric.name] {
+			logrus.Debugf("skipping metric %q already added to the event", metric.name)
+			continue
+		}
+		seen[metric.name] = true
+
+		switch value := metric.value.(type) {
+		case float64:
+			addEventValue(attrs, metric.name, value)
+		case *dto.Summary:
+			addEventValue(attrs, metric.name+".count", float64(value.GetSampleCount()))
+			addEventValue(attrs, metric.name+".sum", value.GetSampleSum())
+		case *dto.Histogram:
+			addEventValue(attrs, metric.name+".count", float64(value.GetSampleCount()))
+			addEventValue(attrs, metric.name+".sum", value.GetSampleSum())
+		}
+		for attr, value := range metric.attributes {
+			if _, ok := common[attr]; ok {
+				continue
+			}
+			if _, ok := prometheusDroppedAttributes[attr]; ok {
+				continue
+			}
+			attrs[metric.name+"."+attr] = value
+		}
+	}
+	return attrs
+}
+
+// addEventValue adds the value to the attributes, unless it's NaN or
+// infinite, which the Event API doesn't accept.
+func addEventValue(attrs map[string]interface{}, name string, value float64) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return
+	}
+	attrs[name] = value
+}
@@ -0,0 +1,203 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+// recordingEventHarvester keeps the recorded events.
+type recordingEventHarvester struct {
+	events    []telemetry.Event
+	harvested int
+}
+
+func (h *recordingEventHarvester) RecordEvent(e telemetry.Event) error {
+	h.events = append(h.events, e)
+	return nil
+}
+
+func (h *recordingEventHarvester) HarvestNow(context.Context) {
+	h.harvested++
+}
+
+func eventTestMetrics() []Metric {
+	target := func(attrs labels.Set) labels.Set {
+		attrs["targetName"] = "redis:9121"
+		attrs["scrapedTargetKind"] = "service"
+		return attrs
+	}
+	return []Metric{
+		{
+			name:       "redis_instance_info",
+			metricType: metricType_GAUGE,
+			value:      1.0,
+			attributes: target(labels.Set{"redis_version": "7.2.4", "role": "master", "nrMetricType": "gauge"}),
+		},
+		{
+			name:       "redis_connected_clients",
+			metricType: metricType_GAUGE,
+			value:      12.0,
+			attributes: target(labels.Set{"nrMetricType": "gauge"}),
+		},
+		{
+			name:       "redis_commands_duration_seconds",
+			metricType: metricType_SUMMARY,
+			value:      &dto.Summary{SampleCount: proto.Uint64(10), SampleSum: proto.Float64(3.5)},
+			attributes: target(labels.Set{}),
+		},
+		{
+			name:       "redis_memory_fragmentation_ratio",
+			metricType: metricType_GAUGE,
+			value:      math.NaN(),
+			attributes: target(labels.Set{}),
+		},
+		{
+			name:       "redis_commands_total",
+			metricType: metricType_COUNTER,
+			value:      42.0,
+			attributes: target(labels.Set{"cmd": "get"}),
+		},
+	}
+}
+
+func TestEventEmitter(t *testing.T) {
+	t.Parallel()
+
+	ee, err := NewEventEmitter(EventEmitterConfig{
+		HarvesterOpts: []TelemetryHarvesterOpt{telemetry.ConfigAPIKey("api key")},
+		Selectors:     []string{`{__name__=~"redis_(instance_info|connected_clients|commands_duration_seconds|memory_.*)"}`},
+	})
+	require.NoError(t, err)
+	h := &recordingEventHarvester{}
+	ee.harvester = h
+
+	require.NoError(t, ee.Emit(eventTestMetrics()))
+	require.Len(t, h.events, 1)
+	assert.Equal(t, 1, h.harvested)
+	assert.Equal(t, "PrometheusSample", h.events[0].EventType)
+	assert.False(t, h.events[0].Timestamp.IsZero())
+	assert.Equal(t, map[string]interface{}{
+		"targetName":                            "redis:9121",
+		"scrapedTargetKind":                     "service",
+		"redis_instance_info":                   1.0,
+		"redis_instance_info.redis_version":     "7.2.4",
+		"redis_instance_info.role":              "master",
+		"redis_connected_clients":               12.0,
+		"redis_commands_duration_seconds.count": 10.0,
+		"redis_commands_duration_seconds.sum":   3.5,
+	}, h.events[0].Attributes)
+}
+
+func TestEventEmitter_SingleMetric(t *testing.T) {
+	t.Parallel()
+
+	ee, err := NewEventEmitter(EventEmitterConfig{
+		HarvesterOpts: []TelemetryHarvesterOpt{telemetry.ConfigAPIKey("api key")},
+		EventType:     "RedisInfo",
+		Selectors:     []string{"redis_instance_info"},
+	})
+	require.NoError(t, err)
+	h := &recordingEventHarvester{}
+	ee.harvester = h
+
+	require.NoError(t, ee.Emit(eventTestMetrics()))
+	require.Len(t, h.events, 1)
+	assert.Equal(t, "RedisInfo", h.events[0].EventType)
+	// All the attributes of a single metric are common.
+	assert.Equal(t, map[string]interface{}{
+		"targetName":          "redis:9121",
+		"scrapedTargetKind":   "service",
+		"redis_version":       "7.2.4",
+		"role":                "master",
+		"redis_instance_info": 1.0,
+	}, h.events[0].Attributes)
+}
+
+func TestEventEmitter_NoMatches(t *testing.T) {
+	t.Parallel()
+
+	ee, err := NewEventEmitter(EventEmitterConfig{
+		HarvesterOpts: []TelemetryHarvesterOpt{telemetry.ConfigAPIKey("api key")},
+		Selectors:     []string{"kube_pod_info"},
+	})
+	require.NoError(t, err)
+	h := &recordingEventHarvester{}
+	ee.harvester = h
+
+	require.NoError(t, ee.Emit(eventTestMetrics()))
+	assert.Empty(t, h.events)
+	assert.Zero(t, h.harvested)
+}
+
+func TestEventEmitter_EventAPI(t *testing.T) {
+	t.Parallel()
+
+	var lock sync.Mutex
+	var licenseKeys []string
+	var events []map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var body []map[string]interface{}
+		if err := json.NewDecoder(zr).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		licenseKeys = append(licenseKeys, r.Header.Get("X-License-Key"))
+		events = append(events, body...)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	ee, err := NewEventEmitter(EventEmitterConfig{
+		HarvesterOpts: []TelemetryHarvesterOpt{
+			telemetry.ConfigAPIKey("license key"),
+			telemetry.ConfigEventsURLOverride(srv.URL),
+			TelemetryHarvesterWithLicenseKeyRoundTripper("license key"),
+		},
+		Selectors: []string{"redis_connected_clients"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, ee.Emit(eventTestMetrics()))
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, []string{"license key"}, licenseKeys)
+	require.Len(t, events, 1)
+	assert.Equal(t, "PrometheusSample", events[0]["eventType"])
+	assert.Equal(t, 12.0, events[0]["redis_connected_clients"])
+	assert.Equal(t, "redis:9121", events[0]["targetName"])
+}
+
+func TestNewEventEmitter_InvalidConfig(t *testing.T) {
+	t.Parallel()
+
+	opts := []TelemetryHarvesterOpt{telemetry.ConfigAPIKey("api key")}
+	_, err := NewEventEmitter(EventEmitterConfig{HarvesterOpts: opts})
+	assert.Error(t, err)
+	_, err = NewEventEmitter(EventEmitterConfig{HarvesterOpts: opts, Selectors: []string{`{job=~"("}`}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,139 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"sync"
+	"time"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	"github.com/sirupsen/logrus"
+)
+
+const exemplarEventType = "PrometheusExemplar"
+
+// exemplarTraceLabels and exemplarSpanLabels are the usual names of the
+// exemplar labels holding the trace and span IDs.
+var (
+	exemplarTraceLabels = []string{"trace_id", "traceID", "traceId", "trace.id"}
+	exemplarSpanLabels  = []string{"span_id", "spanID", "spanId", "span.id"}
+)
+
+// exemplarRecorder is the part of the telemetry.Harvester recording the
+// exemplar events. They are sent with the metrics on every harvest.
+type exemplarRecorder interface {
+	RecordEvent(e telemetry.Event) error
+}
+
+// exemplarEvents sends the exemplars of the counters and histogram buckets as
+// events, instead of adding their trace and span IDs to the metrics, which
+// would split the series by every trace. The targets expose the last
+// exemplar of a series until a new one is sampled, so each exemplar is sent
+// only once.
+type exemplarEvents struct {
+	recorder      exemplarRecorder
+	lock          sync.Mutex
+	sent          map[string]sentExemplar
+	expirationAge time.Duration
+	lastClean     time.Time
+}
+
+// sentExemplar identifies the last exemplar sent for a series.
+type sentExemplar struct {
+	timestamp time.Time
+	traceID   string
+	value     float64
+	seen      time.Time
+}
+
+func newExemplarEvents(recorder exemplarRecorder, expirationAge time.Duration) *exemplarEvents {
+	return &exemplarEvents{recorder: recorder, sent: map[string]sentExemplar{}, expirationAge: expirationAge}
+}
+
+// record sends the exemplar of the series as an event, unless it has no trace
+// or span ID, or it was already sent. An exemplar with a timestamp is sent
+// only if it's newer than the last one sent; one without a timestamp, only
+// if its trace ID or value changed. It's a no-op if the exemplars are
+// disabled.
+func (ee *exemplarEvents) record(name string, attributes map[string]interface{}, exemplar *Exemplar, now time.Time) {
+	if ee == nil || exemplar == nil {
+		return
+	}
+	attrs := map[string]interface{}{}
+	for attr, names := range map[string][]string{"trace.id": exemplarTraceLabels, "span.id": exemplarSpanLabels} {
+		for _, label := range names {
+			if id, ok := exemplar.Labels[label]; ok {
+				attrs[attr] = id
+				break
+			}
+		}
+	}
+	if len(attrs) == 0 {
+		return
+	}
+	key, err := deltaSeriesKey(name, attributes)
+	if err != nil {
+		return
+	}
+	traceID, _ := attrs["trace.id"].(string)
+	if !ee.swap(key, sentExemplar{timestamp: exemplar.Timestamp, traceID: traceID, value: exemplar.Value, seen: now}) {
+		return
+	}
+
+	for attr, value := range attributes {
+		if _, ok := attrs[attr]; !ok {
+			attrs[attr] = value
+		}
+	}
+	attrs["metricName"] = name
+	attrs["value"] = exemplar.Value
+	timestamp := exemplar.Timestamp
+	if timestamp.IsZero() {
+		timestamp = now
+	}
+	err = ee.recorder.RecordEvent(telemetry.Event{
+		EventType:  exemplarEventType,
+		Timestamp:  timestamp,
+		Attributes: attrs,
+	})
+	if err != nil {
+		logrus.WithError(err).Debugf("recording exemplar of %q", name)
+	}
+}
+
+// swap records the exemplar as the last one sent for the series, and returns
+// whether it's a new one. The series not seen for longer than the expiration
+// age are forgotten, like in the DeltaCalculator.
+func (ee *exemplarEvents) swap(key string, exemplar sentExemplar) bool {
+	ee.lock.Lock()
+	defer ee.lock.Unlock()
+
+	if exemplar.seen.Sub(ee.lastClean) > ee.expirationAge {
+		cutoff := exemplar.seen.Add(-ee.expirationAge)
+		for k, e := range ee.sent {
+			if e.seen.Before(cutoff) {
+				delete(ee.sent, k)
+			}
+		}
+		ee.lastClean = exemplar.seen
+	}
+
+	last, ok := ee.sent[key]
+	var isNew bool
+	switch {
+	case !ok:
+		isNew = true
+	case !exemplar.timestamp.IsZero():
+		isNew = exemplar.timestamp.After(last.timestamp)
+	default:
+		isNew = exemplar.traceID != last.traceID || exemplar.value != last.value
+	}
+	if isNew {
+		ee.sent[key] = exemplar
+	} else {
+		last.seen = exemplar.seen
+		ee.sent[key] = last
+	}
+	return isNew
+}
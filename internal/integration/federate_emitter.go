@@ -0,0 +1,359 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/proto"
+)
+
+// FederatePath is the path where the FederateEmitter is served on the
+// self-metrics server.
+const FederatePath = "/federate"
+
+const defaultFederateExpiration = 5 * time.Minute
+
+// FederateEmitter keeps the last metrics emitted for each target, after the
+// transformations, and serves them in the Prometheus text or OpenMetrics
+// formats so they can be scraped by a Prometheus server.
+type FederateEmitter struct {
+	name string
+	// expiration is how long the metrics of a target are served after they
+	// are emitted, so targets that are not scraped anymore are removed.
+	expiration time.Duration
+
+	lock    sync.Mutex
+	targets map[string]federatedTarget
+}
+
+type federatedTarget struct {
+	metrics []Metric
+	emitted time.Time
+}
+
+// NewFederateEmitter returns a FederateEmitter serving the metrics of each
+// target for the expiration time after they are emitted. It defaults to 5
+// minutes.
+func NewFederateEmitter(expiration time.Duration) *FederateEmitter {
+	if expiration <= 0 {
+		expiration = defaultFederateExpiration
+	}
+	return &FederateEmitter{
+		name:       "federate",
+		expiration: expiration,
+		targets:    map[string]federatedTarget{},
+	}
+}
+
+// Name is the FederateEmitter name.
+func (fe *FederateEmitter) Name() string {
+	return fe.name
+}
+
+// EmitTarget replaces the metrics served for the target, identified by its
+// URL, so the targets sharing a name don't replace each other's metrics.
+func (fe *FederateEmitter) EmitTarget(pair TargetMetrics) error {
+	fe.replace(pair.Target.URL.String(), pair.Metrics)
+	return nil
+}
+
+// Emit replaces the metrics served for the target the metrics belong to. It's
+// only used when the target is unknown, so the target is identified by the
+// name in the attributes of the metrics.
+func (fe *FederateEmitter) Emit(metrics []Metric) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+	// The metrics are emitted once per target, and all of them have the
+	// name of their target.
+	fe.replace("targetName="+fmt.Sprint(metrics[0].attributes["targetName"]), metrics)
+	return nil
+}
+
+func (fe *FederateEmitter) replace(target string, metrics []Metric) {
+	fe.lock.Lock()
+	defer fe.lock.Unlock()
+	fe.targets[target] = federatedTarget{metrics: metrics, emitted: time.Now()}
+}
+
+// ServeHTTP writes the metrics matching any of the `match[]` selectors of
+// the request, or all of them if there is none, in the format negotiated
+// with the Accept header.
+func (fe *FederateEmitter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, fmt.Sprintf("parsing form: %v", err), http.StatusBadRequest)
+		return
+	}
+	var selectors []*seriesSelector
+	for _, s := range r.Form["match[]"] {
+		selector, err := parseSeriesSelector(s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		selectors = append(selectors, selector)
+	}
+
+	families := fe.families(selectors, time.Now())
+
+	format := expfmt.NegotiateIncludingOpenMetrics(r.Header)
+	w.Header().Set("Content-Type", string(format))
+	enc := expfmt.NewEncoder(w, format)
+	for _, mf := range families {
+		if err := enc.Encode(mf); err != nil {
+			logrus.WithError(err).WithField("metric", mf.GetName()).Warn("encoding federated metrics")
+			return
+		}
+	}
+	if closer, ok := enc.(expfmt.Closer); ok {
+		_ = closer.Close()
+	}
+}
+
+// families returns the metric families of the metrics matching the
+// selectors, sorted by name. The expired targets are removed.
+func (fe *FederateEmitter) families(selectors []*seriesSelector, now time.Time) []*dto.MetricFamily {
+	fe.lock.Lock()
+	for target, t := range fe.targets {
+		if now.Sub(t.emitted) > fe.expiration {
+			delete(fe.targets, target)
+		}
+	}
+	targets := make([]federatedTarget, 0, len(fe.targets))
+	for _, t := range fe.targets {
+		targets = append(targets, t)
+	}
+	fe.lock.Unlock()
+
+	byName := map[string]*dto.MetricFamily{}
+	for _, t := range targets {
+		addMetricFamilies(byName, t.metrics, selectors, t.emitted)
+	}
+	return sortedMetricFamilies(byName)
+}
+
+// addMetricFamilies adds the metrics matching the selectors to the metric
+// families by name, with the timestamp. Metrics with a type conflicting with
+// their family are skipped.
+func addMetricFamilies(byName map[string]*dto.MetricFamily, metrics []Metric, selectors []*seriesSelector, timestamp time.Time) {
+	for _, metric := range metrics {
+		name := sanitizePromName(metric.name, true)
+		seriesLabels := prometheusLabels(metric.attributes)
+		if !matchesAnySelector(selectors, name, seriesLabels) {
+			continue
+		}
+
+		m, mt, ok := federatedMetric(metric)
+		if !ok {
+			continue
+		}
+		mf, ok := byName[name]
+		if !ok {
+			mf = &dto.MetricFamily{Name: proto.String(name), Type: mt.Enum()}
+			byName[name] = mf
+		} else if mf.GetType() != mt {
+			// A family can only have metrics of a single type, so the
+			// metrics with a conflicting type are skipped.
+			continue
+		}
+		for _, l := range seriesLabels {
+			m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(l.name), Value: proto.String(l.value)})
+		}
+		m.TimestampMs = proto.Int64(timestamp.UnixMilli())
+		mf.Metric = append(mf.Metric, m)
+	}
+}
+
+// sortedMetricFamilies returns the metric families sorted by name.
+func sortedMetricFamilies(byName map[string]*dto.MetricFamily) []*dto.MetricFamily {
+	families := make([]*dto.MetricFamily, 0, len(byName))
+	for _, mf := range byName {
+		families = append(families, mf)
+	}
+	sort.Slice(families, func(i, j int) bool { return families[i].GetName() < families[j].GetName() })
+	return families
+}
+
+// federatedMetric returns the Prometheus metric of the value of the metric,
+// and its type.
+func federatedMetric(metric Metric) (*dto.Metric, dto.MetricType, bool) {
+	switch metric.metricType {
+	case metricType_GAUGE:
+		if value, ok := metric.value.(float64); ok {
+			return &dto.Metric{Gauge: &dto.Gauge{Value: proto.Float64(value)}}, dto.MetricType_GAUGE, true
+		}
+	case metricType_COUNTER:
+		if value, ok := metric.value.(float64); ok {
+			return &dto.Metric{Counter: &dto.Counter{Value: proto.Float64(value)}}, dto.MetricType_COUNTER, true
+		}
+	case metricType_SUMMARY:
+		if summary, ok := metric.value.(*dto.Summary); ok {
+			return &dto.Metric{Summary: summary}, dto.MetricType_SUMMARY, true
+		}
+	case metricType_HISTOGRAM:
+		if hist, ok := metric.value.(*dto.Histogram); ok {
+			return &dto.Metric{Histogram: hist}, dto.MetricType_HISTOGRAM, true
+		}
+	}
+	return nil, dto.MetricType_UNTYPED, false
+}
+
+// prometheusLabels returns the attributes as labels sorted by name, with
+// their names sanitized so they are valid Prometheus label names. The
+// attributes with the New Relic types of the metrics are dropped.
+//
+// When several attributes get the same label name, e.g. `a.b` and `a_b`,
+// only one is kept, so the series has no duplicate labels: the attribute
+// whose name is already a valid label name, or else the first one by name.
+func prometheusLabels(attrs map[string]interface{}) []promLabel {
+	result := make([]promLabel, 0, len(attrs))
+	// sources holds the attribute of each label, to resolve the collisions.
+	sources := make(map[string]string, len(attrs))
+	index := make(map[string]int, len(attrs))
+	for attr, value := range attrs {
+		if _, ok := prometheusDroppedAttributes[attr]; ok {
+			continue
+		}
+		name := sanitizePromName(attr, false)
+		i, collides := index[name]
+		if !collides {
+			index[name] = len(result)
+			sources[name] = attr
+			result = append(result, promLabel{name, fmt.Sprint(value)})
+			continue
+		}
+		if kept := sources[name]; kept == name || (attr != name && kept < attr) {
+			continue
+		}
+		sources[name] = attr
+		result[i].value = fmt.Sprint(value)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].name < result[j].name })
+	return result
+}
+
+// seriesSelector is a Prometheus series selector, e.g.
+// `http_requests_total{code=~"5.."}`.
+type seriesSelector struct {
+	matchers []labelMatcher
+}
+
+type labelMatcher struct {
+	name  string
+	op    string
+	value string
+	re    *regexp.Regexp
+}
+
+func (m *labelMatcher) matches(value string) bool {
+	switch m.op {
+	case "=":
+		return value == m.value
+	case "!=":
+		return value != m.value
+	case "=~":
+		return m.re.MatchString(value)
+	default: // "!~"
+		return !m.re.MatchString(value)
+	}
+}
+
+var (
+	selectorNameRegex    = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*`)
+	selectorMatcherRegex = regexp.MustCompile(`^\s*([a-zA-Z_][a-zA-Z0-9_]*)\s*(=~|!~|!=|=)\s*("(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.)*'|` + "`[^`]*`" + `)\s*,?`)
+)
+
+// parseSeriesSelector parses a series selector made of an optional metric
+// name and label matchers.
+func parseSeriesSelector(s string) (*seriesSelector, error) {
+	selector := &seriesSelector{}
+	rest := strings.TrimSpace(s)
+	if name := selectorNameRegex.FindString(rest); name != "" {
+		selector.matchers = append(selector.matchers, labelMatcher{name: "__name__", op: "=", value: name})
+		rest = strings.TrimSpace(rest[len(name):])
+	}
+
+	if rest != "" {
+		if !strings.HasPrefix(rest, "{") || !strings.HasSuffix(rest, "}") {
+			return nil, fmt.Errorf("invalid series selector %q", s)
+		}
+		rest = rest[1 : len(rest)-1]
+		for strings.TrimSpace(rest) != "" {
+			m := selectorMatcherRegex.FindStringSubmatch(rest)
+			if m == nil {
+				return nil, fmt.Errorf("invalid label matcher in series selector %q", s)
+			}
+			rest = rest[len(m[0]):]
+
+			value := m[3]
+			if value[0] == '\'' {
+				// strconv only unquotes single-quoted runes.
+				value = `"` + strings.ReplaceAll(strings.ReplaceAll(value[1:len(value)-1], `\'`, `'`), `"`, `\"`) + `"`
+			}
+			value, err := strconv.Unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid label value in series selector %q: %w", s, err)
+			}
+			matcher := labelMatcher{name: m[1], op: m[2], value: value}
+			if matcher.op == "=~" || matcher.op == "!~" {
+				if matcher.re, err = regexp.Compile("^(?:" + value + ")$"); err != nil {
+					return nil, fmt.Errorf("invalid regular expression in series selector %q: %w", s, err)
+				}
+			}
+			selector.matchers = append(selector.matchers, matcher)
+		}
+	}
+
+	if len(selector.matchers) == 0 {
+		return nil, fmt.Errorf("series selector %q must have a metric name or a label matcher", s)
+	}
+	return selector, nil
+}
+
+// matches returns whether the series with the name and labels matches all
+// the label matchers. Missing labels match as empty values, as in
+// Prometheus.
+func (s *seriesSelector) matches(name string, seriesLabels []promLabel) bool {
+	for i := range s.matchers {
+		m := &s.matchers[i]
+		value := ""
+		if m.name == "__name__" {
+			value = name
+		} else {
+			for _, l := range seriesLabels {
+				if l.name == m.name {
+					value = l.value
+					break
+				}
+			}
+		}
+		if !m.matches(value) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchesAnySelector(selectors []*seriesSelector, name string, seriesLabels []promLabel) bool {
+	if len(selectors) == 0 {
+		return true
+	}
+	for _, s := range selectors {
+		if s.matches(name, seriesLabels) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,250 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+func federateTestEmitter(t *testing.T) *FederateEmitter {
+	t.Helper()
+
+	fe := NewFederateEmitter(0)
+	require.NoError(t, fe.Emit([]Metric{
+		{
+			name:       "redis_connected_clients",
+			metricType: metricType_GAUGE,
+			value:      12.0,
+			attributes: labels.Set{"targetName": "redis:9121", "label.app": "redis", "nrMetricType": "gauge"},
+		},
+		{
+			name:       "redis_commands_total",
+			metricType: metricType_COUNTER,
+			value:      42.0,
+			attributes: labels.Set{"targetName": "redis:9121", "cmd": "get"},
+		},
+	}))
+	require.NoError(t, fe.Emit([]Metric{
+		{
+			name:       "http_duration_seconds",
+			metricType: metricType_HISTOGRAM,
+			value: &dto.Histogram{
+				SampleCount: proto.Uint64(6),
+				SampleSum:   proto.Float64(2.5),
+				Bucket: []*dto.Bucket{
+					{UpperBound: proto.Float64(0.1), CumulativeCount: proto.Uint64(2)},
+					{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(5)},
+				},
+			},
+			attributes: labels.Set{"targetName": "api:8080"},
+		},
+	}))
+	return fe
+}
+
+func federate(t *testing.T, fe *FederateEmitter, accept string, selectors ...string) (string, *http.Response) {
+	t.Helper()
+
+	query := url.Values{"match[]": selectors}
+	req := httptest.NewRequest(http.MethodGet, FederatePath+"?"+query.Encode(), nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	rec := httptest.NewRecorder()
+	fe.ServeHTTP(rec, req)
+	body, err := io.ReadAll(rec.Result().Body)
+	require.NoError(t, err)
+	return string(body), rec.Result()
+}
+
+func TestFederateEmitter(t *testing.T) {
+	t.Parallel()
+
+	fe := federateTestEmitter(t)
+	body, resp := federate(t, fe, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("Content-Type"), "text/plain")
+
+	assert.Contains(t, body, "# TYPE redis_connected_clients gauge\n")
+	assert.Contains(t, body, `redis_connected_clients{label_app="redis",targetName="redis:9121"} 12 `)
+	assert.Contains(t, body, "# TYPE redis_commands_total counter\n")
+	assert.Contains(t, body, `redis_commands_total{cmd="get",targetName="redis:9121"} 42 `)
+	assert.Contains(t, body, `http_duration_seconds_bucket{targetName="api:8080",le="0.1"} 2 `)
+	assert.Contains(t, body, `http_duration_seconds_count{targetName="api:8080"} 6 `)
+	assert.NotContains(t, body, "nrMetricType")
+}
+
+func TestPrometheusLabels_Collisions(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name     string
+		attrs    map[string]interface{}
+		expected []promLabel
+	}{
+		{
+			name:     "valid name wins",
+			attrs:    map[string]interface{}{"a.b": "dotted", "a_b": "valid", "a-b": "dashed"},
+			expected: []promLabel{{"a_b", "valid"}},
+		},
+		{
+			name:     "first name wins",
+			attrs:    map[string]interface{}{"a.b": "dotted", "a-b": "dashed"},
+			expected: []promLabel{{"a_b", "dashed"}},
+		},
+		{
+			name:     "no collision",
+			attrs:    map[string]interface{}{"a.b": "dotted", "c": "valid", "nrMetricType": "gauge"},
+			expected: []promLabel{{"a_b", "dotted"}, {"c", "valid"}},
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			// The map order is random, so the result must not depend on it.
+			for i := 0; i < 20; i++ {
+				assert.Equal(t, tc.expected, prometheusLabels(tc.attrs))
+			}
+		})
+	}
+}
+
+func TestFederateEmitter_OpenMetrics(t *testing.T) {
+	t.Parallel()
+
+	fe := federateTestEmitter(t)
+	body, resp := federate(t, fe, "application/openmetrics-text;version=1.0.0")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("Content-Type"), "application/openmetrics-text")
+
+	assert.Contains(t, body, "# TYPE redis_commands counter\n")
+	assert.Contains(t, body, `redis_commands_total{cmd="get",targetName="redis:9121"} 42.0 `)
+	assert.True(t, strings.HasSuffix(body, "# EOF\n"))
+}
+
+func TestFederateEmitter_Match(t *testing.T) {
+	t.Parallel()
+
+	fe := federateTestEmitter(t)
+
+	testCases := []struct {
+		name      string
+		selectors []string
+		expected  []string
+		missing   []string
+	}{
+		{
+			name:      "metric name",
+			selectors: []string{"redis_commands_total"},
+			expected:  []string{"redis_commands_total"},
+			missing:   []string{"redis_connected_clients", "http_duration_seconds"},
+		},
+		{
+			name:      "label regex",
+			selectors: []string{`{targetName=~"redis:.*"}`},
+			expected:  []string{"redis_commands_total", "redis_connected_clients"},
+			missing:   []string{"http_duration_seconds"},
+		},
+		{
+			name:      "any of the selectors",
+			selectors: []string{`{__name__="http_duration_seconds"}`, `redis_connected_clients{label_app!='nginx'}`},
+			expected:  []string{"redis_connected_clients", "http_duration_seconds"},
+			missing:   []string{"redis_commands_total"},
+		},
+		{
+			name:      "missing label matches empty value",
+			selectors: []string{`{cmd=""}`},
+			expected:  []string{"redis_connected_clients", "http_duration_seconds"},
+			missing:   []string{"redis_commands_total"},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			body, resp := federate(t, fe, "", tc.selectors...)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			for _, name := range tc.expected {
+				assert.Contains(t, body, "# TYPE "+name+" ")
+			}
+			for _, name := range tc.missing {
+				assert.NotContains(t, body, "# TYPE "+name+" ")
+			}
+		})
+	}
+}
+
+func TestFederateEmitter_InvalidSelector(t *testing.T) {
+	t.Parallel()
+
+	fe := federateTestEmitter(t)
+	for _, selector := range []string{"{}", `up{job="a"`, `{job=~"("}`, `up{job}`} {
+		_, resp := federate(t, fe, "", selector)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, selector)
+	}
+}
+
+func TestFederateEmitter_ReplacesAndExpiresTargets(t *testing.T) {
+	t.Parallel()
+
+	fe := NewFederateEmitter(time.Minute)
+	emit := func(value float64, target string) {
+		require.NoError(t, fe.Emit([]Metric{{name: "up", metricType: metricType_GAUGE, value: value, attributes: labels.Set{"targetName": target}}}))
+	}
+	emit(0, "a")
+	emit(1, "a")
+	emit(1, "b")
+
+	families := fe.families(nil, time.Now())
+	require.Len(t, families, 1)
+	require.Len(t, families[0].GetMetric(), 2)
+	for _, m := range families[0].GetMetric() {
+		assert.Equal(t, 1.0, m.GetGauge().GetValue())
+	}
+
+	assert.Empty(t, fe.families(nil, time.Now().Add(2*time.Minute)))
+}
+
+func TestFederateEmitter_EmitTarget(t *testing.T) {
+	t.Parallel()
+
+	fe := NewFederateEmitter(time.Minute)
+	emit := func(value float64, rawURL string) {
+		u, err := url.Parse(rawURL)
+		require.NoError(t, err)
+		// The targets exposing several endpoints share their name.
+		require.NoError(t, emitTarget(fe, TargetMetrics{
+			Target:  endpoints.Target{Name: "redis", URL: *u},
+			Metrics: []Metric{{name: "up", metricType: metricType_GAUGE, value: value, attributes: labels.Set{"targetName": "redis"}}},
+		}))
+	}
+	emit(0, "http://redis:9121/metrics")
+	emit(1, "http://redis:9121/metrics")
+	emit(1, "http://redis:9122/metrics")
+
+	families := fe.families(nil, time.Now())
+	require.Len(t, families, 1)
+	require.Len(t, families[0].GetMetric(), 2)
+	for _, m := range families[0].GetMetric() {
+		assert.Equal(t, 1.0, m.GetGauge().GetValue())
+	}
+}
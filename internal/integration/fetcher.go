@@ -19,6 +19,7 @@ import (
 
 	promcli "github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
 	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
 	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
@@ -321,6 +322,86 @@ type Metric struct {
 	value      metricValue
 	metricType metricType
 	attributes labels.Set
+	// exemplar is the last exemplar of a counter, if the target exposes it.
+	// The exemplars of the histogram buckets are kept in the value.
+	exemplar *Exemplar
+	// created is when a counter was created or last reset, if the target
+	// exposes it. The ones of the histograms and summaries are kept in the
+	// value.
+	created time.Time
+}
+
+// Exemplar is a sample of a metric that links it to a trace, as exposed in
+// the OpenMetrics and protobuf formats.
+type Exemplar struct {
+	Labels labels.Set
+	Value  float64
+	// Timestamp is zero if the target doesn't expose it.
+	Timestamp time.Time
+}
+
+// newExemplar returns the Exemplar of a Prometheus exemplar, or nil if there
+// is none.
+func newExemplar(e *dto.Exemplar) *Exemplar {
+	if e == nil {
+		return nil
+	}
+	exemplar := &Exemplar{
+		Labels: labels.Set{},
+		Value:  e.GetValue(),
+	}
+	for _, l := range e.GetLabel() {
+		exemplar.Labels[l.GetName()] = l.GetValue()
+	}
+	if e.GetTimestamp() != nil {
+		exemplar.Timestamp = e.GetTimestamp().AsTime()
+	}
+	return exemplar
+}
+
+// Name returns the name of the metric.
+func (m *Metric) Name() string {
+	return m.name
+}
+
+// Type returns the New Relic type of the metric: count, gauge, summary or
+// histogram.
+func (m *Metric) Type() string {
+	return string(m.metricType)
+}
+
+// Value returns the value of the metric. It is a float64 for counts and
+// gauges, and a *dto.Summary or *dto.Histogram for summaries and histograms.
+func (m *Metric) Value() interface{} {
+	return m.value
+}
+
+// Attributes returns the attributes of the metric.
+func (m *Metric) Attributes() labels.Set {
+	return m.attributes
+}
+
+// Exemplar returns the last exemplar of a counter, or nil if it has none.
+func (m *Metric) Exemplar() *Exemplar {
+	return m.exemplar
+}
+
+// createdTime returns the time of a created timestamp, or the zero time if
+// there is none.
+func createdTime(ts *timestamppb.Timestamp) time.Time {
+	if ts == nil {
+		return time.Time{}
+	}
+	return ts.AsTime()
+}
+
+// NewTargetMetrics returns the TargetMetrics of a target from its already
+// fetched metric families.
+func NewTargetMetrics(target endpoints.Target, mfs prometheus.MetricFamiliesByName) TargetMetrics {
+	return TargetMetrics{
+		Metrics: convertPromMetrics(logrus.WithField("component", "Fetcher"), target.Name, mfs),
+		Target:  target,
+	}
 }
 
 var supportedMetricTypes = map[dto.MetricType]string{
@@ -355,6 +436,8 @@ func convertPromMetrics(log *logrus.Entry, targetName string, mfs prometheus.Met
 		for _, m := range mf.GetMetric() {
 			var value interface{}
 			var nrType metricType
+			var exemplar *Exemplar
+			var created time.Time
 			switch ntype {
 			case dto.MetricType_UNTYPED:
 				value = m.GetUntyped().GetValue()
@@ -362,6 +445,8 @@ func convertPromMetrics(log *logrus.Entry, targetName string, mfs prometheus.Met
 			case dto.MetricType_COUNTER:
 				value = m.GetCounter().GetValue()
 				nrType = metricType_COUNTER
+				exemplar = newExemplar(m.GetCounter().GetExemplar())
+				created = createdTime(m.GetCounter().GetCreatedTimestamp())
 			case dto.MetricType_GAUGE:
 				value = m.GetGauge().GetValue()
 				nrType = metricType_GAUGE
@@ -392,6 +477,8 @@ func convertPromMetrics(log *logrus.Entry, targetName string, mfs prometheus.Met
 					metricType: nrType,
 					value:      value,
 					attributes: attrs,
+					exemplar:   exemplar,
+					created:    created,
 				},
 			)
 		}
@@ -81,7 +81,7 @@ func TestFetcher(t *testing.T) {
 	fetcher.(*prometheusFetcher).getMetrics = func(client prometheus.HTTPDoer, url string, _ string, _ string) (names prometheus.MetricFamiliesByName, e error) {
 		invokedURL = url
 		return prometheus.MetricFamiliesByName{
-			"some-name": dto.MetricFamily{},
+			"some-name": &dto.MetricFamily{},
 		}, nil
 	}
 
@@ -123,7 +123,7 @@ func TestFetcher_Error(t *testing.T) {
 		}
 		invokedURLs = append(invokedURLs, url)
 		return prometheus.MetricFamiliesByName{
-			"some-name": dto.MetricFamily{},
+			"some-name": &dto.MetricFamily{},
 		}, nil
 	}
 
@@ -174,7 +174,7 @@ func TestFetcher_ConcurrencyLimit(t *testing.T) {
 		atomic.AddInt32(&parallelTasks, 1)
 		reportedParallel <- atomic.LoadInt32(&parallelTasks)
 		time.Sleep(10 * time.Millisecond)
-		return prometheus.MetricFamiliesByName{"some-name": dto.MetricFamily{}}, nil
+		return prometheus.MetricFamiliesByName{"some-name": &dto.MetricFamily{}}, nil
 	}
 
 	// WHEN it fetches data from a big number of targets
@@ -213,7 +213,7 @@ func TestConvertPromMetrics(t *testing.T) {
 		{
 			"hotdog-stand",
 			prometheus.MetricFamiliesByName{
-				"sales": dto.MetricFamily{
+				"sales": &dto.MetricFamily{
 					// use anonymous struct to return *dto.MetricType literal.
 					Type: &(&struct{ x dto.MetricType }{dto.MetricType_COUNTER}).x,
 					Metric: []*dto.Metric{
@@ -232,7 +232,7 @@ func TestConvertPromMetrics(t *testing.T) {
 						},
 					},
 				},
-				"temperature": dto.MetricFamily{
+				"temperature": &dto.MetricFamily{
 					Type: &(&struct{ x dto.MetricType }{dto.MetricType_GAUGE}).x,
 					Metric: []*dto.Metric{
 						{
@@ -248,7 +248,7 @@ func TestConvertPromMetrics(t *testing.T) {
 						},
 					},
 				},
-				"histogram_example": dto.MetricFamily{
+				"histogram_example": &dto.MetricFamily{
 					// use anonymous struct to return *dto.MetricType literal.
 					Type: &(&struct{ x dto.MetricType }{dto.MetricType_HISTOGRAM}).x,
 					Metric: []*dto.Metric{
@@ -278,7 +278,7 @@ func TestConvertPromMetrics(t *testing.T) {
 						},
 					},
 				},
-				"summary_example": dto.MetricFamily{
+				"summary_example": &dto.MetricFamily{
 					// use anonymous struct to return *dto.MetricType literal.
 					Type: &(&struct{ x dto.MetricType }{dto.MetricType_SUMMARY}).x,
 					Metric: []*dto.Metric{
@@ -387,7 +387,7 @@ func TestConvertPromMetrics(t *testing.T) {
 		{
 			"hotdog-stand",
 			prometheus.MetricFamiliesByName{
-				"sales": dto.MetricFamily{
+				"sales": &dto.MetricFamily{
 					// use anonymous struct to return *dto.MetricType literal.
 					Type: &(&struct{ x dto.MetricType }{dto.MetricType_COUNTER}).x,
 					Metric: []*dto.Metric{
@@ -404,7 +404,7 @@ func TestConvertPromMetrics(t *testing.T) {
 						},
 					},
 				},
-				"temperature": dto.MetricFamily{
+				"temperature": &dto.MetricFamily{
 					Type: &(&struct{ x dto.MetricType }{dto.MetricType_GAUGE}).x,
 					Metric: []*dto.Metric{
 						{
@@ -420,7 +420,7 @@ func TestConvertPromMetrics(t *testing.T) {
 						},
 					},
 				},
-				"histogram_example": dto.MetricFamily{
+				"histogram_example": &dto.MetricFamily{
 					// use anonymous struct to return *dto.MetricType literal.
 					Type: &(&struct{ x dto.MetricType }{dto.MetricType_HISTOGRAM}).x,
 					Metric: []*dto.Metric{
@@ -450,7 +450,7 @@ func TestConvertPromMetrics(t *testing.T) {
 						},
 					},
 				},
-				"summary_example": dto.MetricFamily{
+				"summary_example": &dto.MetricFamily{
 					// use anonymous struct to return *dto.MetricType literal.
 					Type: &(&struct{ x dto.MetricType }{dto.MetricType_SUMMARY}).x,
 					Metric: []*dto.Metric{
@@ -587,7 +587,7 @@ func TestConvertPromMetricsMultiTargetCollisions(t *testing.T) {
 	}
 
 	mfbn := prometheus.MetricFamiliesByName{
-		"common-name": dto.MetricFamily{
+		"common-name": &dto.MetricFamily{
 			// use anonymous struct to return *dto.MetricType literal.
 			Type:   &(&struct{ x dto.MetricType }{dto.MetricType_COUNTER}).x,
 			Metric: []*dto.Metric{&metric},
@@ -625,3 +625,27 @@ func TestConvertPromMetricsMultiTargetCollisions(t *testing.T) {
 	}
 	assert.Equal(t, nrMetrics[0], want)
 }
+
+func TestConvertPromMetrics_Exemplars(t *testing.T) {
+	t.Parallel()
+
+	mfs, err := prometheus.DecodeOpenMetrics([]byte(`# TYPE http_requests counter
+http_requests_total{code="200"} 10 # {trace_id="0af7651916cd43dd8448eb211c80319c"} 1 1520879607.789
+http_requests_total{code="500"} 2
+# EOF
+`))
+	require.NoError(t, err)
+
+	metrics := convertPromMetrics(nil, "target", mfs)
+	require.Len(t, metrics, 2)
+	for _, m := range metrics {
+		if m.attributes["code"] != "200" {
+			assert.Nil(t, m.Exemplar())
+			continue
+		}
+		require.NotNil(t, m.Exemplar())
+		assert.Equal(t, labels.Set{"trace_id": "0af7651916cd43dd8448eb211c80319c"}, m.Exemplar().Labels)
+		assert.Equal(t, 1.0, m.Exemplar().Value)
+		assert.Equal(t, time.UnixMilli(1520879607789).UTC(), m.Exemplar().Timestamp)
+	}
+}
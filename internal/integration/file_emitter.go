@@ -0,0 +1,363 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+const (
+	defaultFileEmitterMaxSize  = 100 * 1024 * 1024
+	defaultFileEmitterMaxFiles = 5
+	// rotatedFileTimeFormat is the format of the time added to the names of
+	// the rotated files. It sorts in chronological order.
+	rotatedFileTimeFormat = "20060102T150405.000"
+)
+
+// FileEmitterConfig is the configuration of the FileEmitter.
+type FileEmitterConfig struct {
+	// Path of the file the metrics are written to. Its directory is created
+	// if it doesn't exist.
+	Path string
+	// MaxSize is the size in bytes the file can reach before it's rotated.
+	// Defaults to 100MB.
+	MaxSize int64
+	// RotationInterval rotates the file when it's older than the interval,
+	// if set.
+	RotationInterval time.Duration
+	// Compress compresses the rotated files with gzip.
+	Compress bool
+	// MaxFiles is the number of rotated files kept. Defaults to 5.
+	MaxFiles int
+}
+
+// FileEmitter writes each metric as a JSON line to a file, which is rotated
+// by size or age.
+type FileEmitter struct {
+	name string
+	cfg  FileEmitterConfig
+
+	lock   sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+	// lastRotated is the time in the name of the last rotated file.
+	lastRotated time.Time
+}
+
+// NewFileEmitter returns a FileEmitter, or an error if the file can't be
+// opened.
+func NewFileEmitter(cfg FileEmitterConfig) (*FileEmitter, error) {
+	if cfg.Path == "" {
+		return nil, fmt.Errorf("the file emitter path is required")
+	}
+	if cfg.MaxSize <= 0 {
+		cfg.MaxSize = defaultFileEmitterMaxSize
+	}
+	if cfg.MaxFiles <= 0 {
+		cfg.MaxFiles = defaultFileEmitterMaxFiles
+	}
+
+	fe := &FileEmitter{name: "file", cfg: cfg}
+	if err := os.MkdirAll(filepath.Dir(cfg.Path), 0o755); err != nil {
+		return nil, fmt.Errorf("creating the file emitter directory: %w", err)
+	}
+	if err := fe.open(time.Now()); err != nil {
+		return nil, err
+	}
+	return fe, nil
+}
+
+// Name is the FileEmitter name.
+func (fe *FileEmitter) Name() string {
+	return fe.name
+}
+
+// Emit writes the metrics to the file, one JSON object per line, rotating
+// it before if needed.
+func (fe *FileEmitter) Emit(metrics []Metric) error {
+	fe.lock.Lock()
+	defer fe.lock.Unlock()
+
+	// The same time is written in every line and decides whether the file
+	// is rotated by age.
+	now := time.Now()
+	var results error
+	w := bufio.NewWriter(fe.file)
+	for i := range metrics {
+		line, err := marshalMetricLine(&metrics[i], now)
+		if err != nil {
+			results = appendError(results, err)
+			continue
+		}
+		line = append(line, '\n')
+
+		if fe.size > 0 && (fe.size+int64(len(line)) > fe.cfg.MaxSize || fe.expired(now)) {
+			if err := w.Flush(); err != nil {
+				return appendError(results, fmt.Errorf("writing metrics: %w", err))
+			}
+			if err := fe.rotate(now); err != nil {
+				return appendError(results, err)
+			}
+			w.Reset(fe.file)
+		}
+		if _, err := w.Write(line); err != nil {
+			return appendError(results, fmt.Errorf("writing metrics: %w", err))
+		}
+		fe.size += int64(len(line))
+	}
+	if err := w.Flush(); err != nil {
+		return appendError(results, fmt.Errorf("writing metrics: %w", err))
+	}
+	return results
+}
+
+// Close closes the file.
+func (fe *FileEmitter) Close() error {
+	fe.lock.Lock()
+	defer fe.lock.Unlock()
+	return fe.file.Close()
+}
+
+func (fe *FileEmitter) expired(now time.Time) bool {
+	return fe.cfg.RotationInterval > 0 && now.Sub(fe.opened) >= fe.cfg.RotationInterval
+}
+
+// open opens the file for appending.
+func (fe *FileEmitter) open(now time.Time) error {
+	f, err := os.OpenFile(fe.cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return fmt.Errorf("opening the file emitter file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("opening the file emitter file: %w", err)
+	}
+	fe.file, fe.size, fe.opened = f, info.Size(), now
+	return nil
+}
+
+// rotate renames the current file adding the time to its name, compressing
+// it if configured, opens a new one and removes the oldest rotated files.
+func (fe *FileEmitter) rotate(now time.Time) error {
+	if err := fe.file.Close(); err != nil {
+		return fmt.Errorf("closing the file emitter file: %w", err)
+	}
+
+	dir, prefix, ext := fe.rotatedNameParts()
+	// The time is moved forward if there is already a file rotated at the
+	// same millisecond, so it's not overwritten, or if it's not after the
+	// last rotated one, which may have been moved forward, so the names keep
+	// the order of the rotations.
+	t := now.Truncate(time.Millisecond)
+	if !t.After(fe.lastRotated) {
+		t = fe.lastRotated.Add(time.Millisecond)
+	}
+	rotated := filepath.Join(dir, prefix+t.UTC().Format(rotatedFileTimeFormat)+ext)
+	for fileExists(rotated) || fileExists(rotated+".gz") {
+		t = t.Add(time.Millisecond)
+		rotated = filepath.Join(dir, prefix+t.UTC().Format(rotatedFileTimeFormat)+ext)
+	}
+	fe.lastRotated = t
+	if err := os.Rename(fe.cfg.Path, rotated); err != nil {
+		return fmt.Errorf("rotating the file emitter file: %w", err)
+	}
+	if err := fe.open(now); err != nil {
+		return err
+	}
+
+	if fe.cfg.Compress {
+		if err := compressFile(rotated); err != nil {
+			// The rotated file is kept uncompressed.
+			logrus.WithError(err).WithField("file", rotated).Warn("compressing rotated file")
+		}
+	}
+	fe.removeOldFiles()
+	return nil
+}
+
+// rotatedNameParts returns the directory of the rotated files, and the prefix
+// and extension of their names. For `/var/log/metrics.ndjson` the rotated
+// files are named like `/var/log/metrics-20240101T120000.000.ndjson`.
+func (fe *FileEmitter) rotatedNameParts() (dir, prefix, ext string) {
+	dir = filepath.Dir(fe.cfg.Path)
+	base := filepath.Base(fe.cfg.Path)
+	ext = filepath.Ext(base)
+	return dir, strings.TrimSuffix(base, ext) + "-", ext
+}
+
+// removeOldFiles removes the oldest rotated files, keeping MaxFiles of them.
+func (fe *FileEmitter) removeOldFiles() {
+	dir, prefix, ext := fe.rotatedNameParts()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		logrus.WithError(err).Warn("listing rotated files")
+		return
+	}
+
+	var rotated []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		timestamp := strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".gz"), ext)
+		if _, err := time.Parse(rotatedFileTimeFormat, timestamp); err == nil {
+			rotated = append(rotated, name)
+		}
+	}
+	if len(rotated) <= fe.cfg.MaxFiles {
+		return
+	}
+
+	// The names sort in chronological order.
+	sort.Strings(rotated)
+	for _, name := range rotated[:len(rotated)-fe.cfg.MaxFiles] {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			logrus.WithError(err).WithField("file", name).Warn("removing rotated file")
+		}
+	}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// compressFile compresses the file with gzip, replacing it with the
+// compressed one.
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	if _, err := io.Copy(zw, src); err != nil {
+		_ = dst.Close()
+		_ = os.Remove(path + ".gz")
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		_ = dst.Close()
+		_ = os.Remove(path + ".gz")
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		_ = os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+// jsonFloat is a float that is marshaled as a JSON number if it's finite,
+// and as the "NaN", "+Inf" or "-Inf" strings otherwise, which JSON numbers
+// can't represent.
+type jsonFloat float64
+
+func (f jsonFloat) MarshalJSON() ([]byte, error) {
+	v := float64(f)
+	switch {
+	case math.IsNaN(v):
+		return []byte(`"NaN"`), nil
+	case math.IsInf(v, 1):
+		return []byte(`"+Inf"`), nil
+	case math.IsInf(v, -1):
+		return []byte(`"-Inf"`), nil
+	}
+	return strconv.AppendFloat(nil, v, 'g', -1, 64), nil
+}
+
+type jsonQuantile struct {
+	Quantile jsonFloat `json:"quantile"`
+	Value    jsonFloat `json:"value"`
+}
+
+type jsonBucket struct {
+	UpperBound      jsonFloat `json:"upper_bound"`
+	CumulativeCount uint64    `json:"cumulative_count"`
+}
+
+// jsonMetricValue is the value of a summary or a histogram.
+type jsonMetricValue struct {
+	SampleCount uint64         `json:"sample_count"`
+	SampleSum   jsonFloat      `json:"sample_sum"`
+	Quantiles   []jsonQuantile `json:"quantiles,omitempty"`
+	Buckets     []jsonBucket   `json:"buckets,omitempty"`
+}
+
+// jsonMetric is a metric with all its values, including the non-finite
+// ones.
+type jsonMetric struct {
+	Timestamp  int64       `json:"timestamp"`
+	Name       string      `json:"name"`
+	Type       metricType  `json:"type"`
+	Value      interface{} `json:"value"`
+	Attributes labels.Set  `json:"attributes"`
+}
+
+// marshalMetricLine marshals the metric as a single JSON line, without
+// losing any of its values.
+func marshalMetricLine(m *Metric, timestamp time.Time) ([]byte, error) {
+	value, err := jsonValue(m)
+	if err != nil {
+		return nil, err
+	}
+	line, err := json.Marshal(jsonMetric{
+		Timestamp:  timestamp.UnixMilli(),
+		Name:       m.name,
+		Type:       m.metricType,
+		Value:      value,
+		Attributes: m.attributes,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("marshaling %q: %w", m.name, err)
+	}
+	return line, nil
+}
+
+// jsonValue returns the value of the metric as a jsonFloat, or as a
+// jsonMetricValue for summaries and histograms.
+func jsonValue(m *Metric) (interface{}, error) {
+	switch value := m.value.(type) {
+	case float64:
+		return jsonFloat(value), nil
+	case *dto.Summary:
+		v := jsonMetricValue{SampleCount: value.GetSampleCount(), SampleSum: jsonFloat(value.GetSampleSum())}
+		for _, q := range value.GetQuantile() {
+			v.Quantiles = append(v.Quantiles, jsonQuantile{Quantile: jsonFloat(q.GetQuantile()), Value: jsonFloat(q.GetValue())})
+		}
+		return v, nil
+	case *dto.Histogram:
+		v := jsonMetricValue{SampleCount: value.GetSampleCount(), SampleSum: jsonFloat(value.GetSampleSum())}
+		for _, b := range value.GetBucket() {
+			v.Buckets = append(v.Buckets, jsonBucket{UpperBound: jsonFloat(b.GetUpperBound()), CumulativeCount: b.GetCumulativeCount()})
+		}
+		return v, nil
+	}
+	return nil, fmt.Errorf("unknown value type for %q: %T", m.name, m.value)
+}
@@ -0,0 +1,189 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+func readLines(t *testing.T, path string) []map[string]interface{} {
+	t.Helper()
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &line))
+		lines = append(lines, line)
+	}
+	require.NoError(t, scanner.Err())
+	return lines
+}
+
+func TestFileEmitter(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "audit", "metrics.ndjson")
+	fe, err := NewFileEmitter(FileEmitterConfig{Path: path})
+	require.NoError(t, err)
+	defer fe.Close()
+
+	err = fe.Emit([]Metric{
+		{
+			name:       "temperature",
+			metricType: metricType_GAUGE,
+			value:      math.NaN(),
+			attributes: labels.Set{"room": "kitchen"},
+		},
+		{
+			name:       "http_duration_seconds",
+			metricType: metricType_HISTOGRAM,
+			value: &dto.Histogram{
+				SampleCount: proto.Uint64(6),
+				SampleSum:   proto.Float64(2.5),
+				Bucket: []*dto.Bucket{
+					{UpperBound: proto.Float64(0.1), CumulativeCount: proto.Uint64(2)},
+					{UpperBound: proto.Float64(math.Inf(1)), CumulativeCount: proto.Uint64(6)},
+				},
+			},
+			attributes: labels.Set{},
+		},
+		{
+			name:       "rpc_duration_seconds",
+			metricType: metricType_SUMMARY,
+			value: &dto.Summary{
+				SampleCount: proto.Uint64(10),
+				SampleSum:   proto.Float64(3.5),
+				Quantile:    []*dto.Quantile{{Quantile: proto.Float64(0.99), Value: proto.Float64(math.Inf(1))}},
+			},
+			attributes: labels.Set{},
+		},
+	})
+	require.NoError(t, err)
+
+	lines := readLines(t, path)
+	require.Len(t, lines, 3)
+
+	assert.Equal(t, "temperature", lines[0]["name"])
+	assert.Equal(t, "gauge", lines[0]["type"])
+	assert.Equal(t, "NaN", lines[0]["value"])
+	assert.Equal(t, map[string]interface{}{"room": "kitchen"}, lines[0]["attributes"])
+	assert.NotZero(t, lines[0]["timestamp"])
+
+	hist := lines[1]["value"].(map[string]interface{})
+	assert.Equal(t, 6.0, hist["sample_count"])
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"upper_bound": 0.1, "cumulative_count": 2.0},
+		map[string]interface{}{"upper_bound": "+Inf", "cumulative_count": 6.0},
+	}, hist["buckets"])
+
+	summary := lines[2]["value"].(map[string]interface{})
+	assert.Equal(t, []interface{}{map[string]interface{}{"quantile": 0.99, "value": "+Inf"}}, summary["quantiles"])
+}
+
+func TestFileEmitter_AppendsToExistingFile(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "metrics.ndjson")
+	for i := 0; i < 2; i++ {
+		fe, err := NewFileEmitter(FileEmitterConfig{Path: path})
+		require.NoError(t, err)
+		require.NoError(t, fe.Emit([]Metric{{name: "up", metricType: metricType_GAUGE, value: 1.0, attributes: labels.Set{}}}))
+		require.NoError(t, fe.Close())
+	}
+	assert.Len(t, readLines(t, path), 2)
+}
+
+func TestFileEmitter_RotatesBySize(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "metrics.ndjson")
+	fe, err := NewFileEmitter(FileEmitterConfig{Path: path, MaxSize: 200, MaxFiles: 3, Compress: true})
+	require.NoError(t, err)
+	defer fe.Close()
+
+	for i := 0; i < 20; i++ {
+		require.NoError(t, fe.Emit([]Metric{{name: "up", metricType: metricType_GAUGE, value: float64(i), attributes: labels.Set{"target": "redis"}}}))
+	}
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	var rotated []string
+	for _, e := range entries {
+		if e.Name() != "metrics.ndjson" {
+			rotated = append(rotated, e.Name())
+		}
+	}
+	require.Len(t, rotated, 3)
+	for _, name := range rotated {
+		assert.True(t, strings.HasPrefix(name, "metrics-"), name)
+		assert.True(t, strings.HasSuffix(name, ".ndjson.gz"), name)
+	}
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, info.Size(), int64(200))
+
+	// The newest rotated file has the lines written before the current file.
+	f, err := os.Open(filepath.Join(dir, rotated[len(rotated)-1]))
+	require.NoError(t, err)
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	var last map[string]interface{}
+	scanner := bufio.NewScanner(zr)
+	for scanner.Scan() {
+		last = map[string]interface{}{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &last))
+	}
+	current := readLines(t, path)
+	assert.Equal(t, current[0]["value"].(float64)-1, last["value"])
+}
+
+func TestFileEmitter_RotatesByTime(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "metrics.ndjson")
+	fe, err := NewFileEmitter(FileEmitterConfig{Path: path, RotationInterval: time.Millisecond})
+	require.NoError(t, err)
+	defer fe.Close()
+
+	metrics := []Metric{{name: "up", metricType: metricType_GAUGE, value: 1.0, attributes: labels.Set{}}}
+	require.NoError(t, fe.Emit(metrics))
+	time.Sleep(5 * time.Millisecond)
+	require.NoError(t, fe.Emit(metrics))
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Len(t, readLines(t, path), 1)
+}
+
+func TestNewFileEmitter_RequiresPath(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewFileEmitter(FileEmitterConfig{})
+	assert.Error(t, err)
+}
@@ -37,11 +37,13 @@ func (ha harvesterDecorator) HarvestNow(ctx context.Context) {
 func (ha harvesterDecorator) processMetric(f float64, m telemetry.Metric) {
 	if math.IsNaN(f) {
 		logrus.Debugf("Ignoring NaN float value for metric: %v", m)
+		droppedMetricsTotalMetric.WithLabelValues("nan").Inc()
 		return
 	}
 
 	if math.IsInf(f, 0) {
 		logrus.Debugf("Ignoring Infinite float value for metric: %v", m)
+		droppedMetricsTotalMetric.WithLabelValues("inf").Inc()
 		return
 	}
 
@@ -0,0 +1,184 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+const (
+	defaultSenderTimeout      = 10 * time.Second
+	defaultSenderMaxRetries   = 3
+	defaultSenderRetryBackoff = time.Second
+	// maxSenderRetryBackoff bounds the time waited between retries, even if
+	// the server asks for a longer one.
+	maxSenderRetryBackoff = 30 * time.Second
+
+	encodingGzip   = "gzip"
+	encodingSnappy = "snappy"
+)
+
+// newHTTPClient returns the client used by the emitters sending the metrics
+// over HTTP.
+func newHTTPClient(timeout time.Duration, tlsConfig *tls.Config, proxyURL *url.URL) *http.Client {
+	if timeout <= 0 {
+		timeout = defaultSenderTimeout
+	}
+	t := newDefaultRoundTripper(tlsConfig).(*http.Transport)
+	t.Proxy = http.ProxyFromEnvironment
+	if proxyURL != nil {
+		t.Proxy = http.ProxyURL(proxyURL)
+	}
+	return &http.Client{Transport: t, Timeout: timeout}
+}
+
+// senderRetries returns the configured number of retries, where zero means
+// the default and a negative value disables them.
+func senderRetries(maxRetries int) int {
+	switch {
+	case maxRetries == 0:
+		return defaultSenderMaxRetries
+	case maxRetries < 0:
+		return 0
+	}
+	return maxRetries
+}
+
+// senderRetryBackoff returns the configured backoff, or the default one.
+func senderRetryBackoff(backoff time.Duration) time.Duration {
+	if backoff <= 0 {
+		return defaultSenderRetryBackoff
+	}
+	return backoff
+}
+
+// httpSender posts payloads to an HTTP endpoint, compressing them and
+// retrying the requests that fail temporarily.
+type httpSender struct {
+	client  *http.Client
+	url     string
+	headers map[string]string
+	// encoding compresses the payloads, either with gzip or snappy. They
+	// are sent uncompressed if it's empty.
+	encoding string
+	// retryServerErrors retries all the 5xx responses, not only the 502, 503
+	// and 504 ones.
+	retryServerErrors bool
+	// maxRetries is the number of times a request is retried after the
+	// first attempt.
+	maxRetries int
+	// retryBackoff is the time waited before the first retry. It's doubled
+	// on every retry.
+	retryBackoff time.Duration
+}
+
+// retryableStatusError is returned for the responses whose requests can be
+// retried.
+type retryableStatusError struct {
+	status     int
+	retryAfter time.Duration
+}
+
+func (e *retryableStatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d", e.status)
+}
+
+// send posts the body, retrying it on network errors and on the responses
+// that indicate a temporary failure.
+func (s *httpSender) send(body []byte, contentType string) error {
+	switch s.encoding {
+	case encodingGzip:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(body); err != nil {
+			return fmt.Errorf("compressing payload: %w", err)
+		}
+		if err := zw.Close(); err != nil {
+			return fmt.Errorf("compressing payload: %w", err)
+		}
+		body = buf.Bytes()
+	case encodingSnappy:
+		body = snappy.Encode(nil, body)
+	}
+
+	backoff := s.retryBackoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = s.post(body, contentType)
+		if err == nil {
+			return nil
+		}
+		if attempt >= s.maxRetries {
+			break
+		}
+
+		wait := backoff
+		if statusErr, ok := err.(*retryableStatusError); ok {
+			if statusErr.retryAfter > 0 {
+				wait = statusErr.retryAfter
+			}
+		} else if _, ok := err.(*url.Error); !ok {
+			// Only network errors and the retryable status codes are retried.
+			break
+		}
+		if wait > maxSenderRetryBackoff {
+			wait = maxSenderRetryBackoff
+		}
+		time.Sleep(wait)
+		backoff *= 2
+	}
+	return fmt.Errorf("posting to %s: %w", s.url, err)
+}
+
+func (s *httpSender) post(body []byte, contentType string) error {
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	if s.encoding != "" {
+		req.Header.Set("Content-Encoding", s.encoding)
+	}
+	for name, value := range s.headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// The body is read so the connection can be reused.
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4*1024))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	if s.retryable(resp.StatusCode) {
+		statusErr := &retryableStatusError{status: resp.StatusCode}
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			statusErr.retryAfter = time.Duration(seconds) * time.Second
+		}
+		return statusErr
+	}
+	return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, bytes.TrimSpace(respBody))
+}
+
+func (s *httpSender) retryable(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return s.retryServerErrors && status >= 500
+}
@@ -0,0 +1,317 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"crypto/tls"
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+// Encodings of the quantiles and buckets by the InfluxDBEmitter.
+const (
+	// InfluxDBEncodingFields writes the quantiles and buckets as fields of
+	// the line of the summary or histogram, named after the quantile or the
+	// upper bound, e.g. `rpc_duration_seconds count=10,sum=3.5,0.99=0.8`.
+	InfluxDBEncodingFields = "fields"
+	// InfluxDBEncodingTags writes the quantiles and buckets as their own
+	// lines, tagged with the quantile or the upper bound, e.g.
+	// `rpc_duration_seconds,quantile=0.99 value=0.8`.
+	InfluxDBEncodingTags = "tags"
+)
+
+const (
+	defaultInfluxDBURL       = "http://localhost:8086"
+	defaultInfluxDBPrecision = "ms"
+	// defaultInfluxDBBatchSize is the batch size recommended by InfluxDB.
+	defaultInfluxDBBatchSize = 5000
+	influxDBWritePath        = "/api/v2/write"
+	influxDBContentType      = "text/plain; charset=utf-8"
+)
+
+// influxDBPrecisions are the units of the timestamps supported by InfluxDB.
+var influxDBPrecisions = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+}
+
+// InfluxDBEmitterConfig is the configuration of the InfluxDBEmitter.
+type InfluxDBEmitterConfig struct {
+	// URL of the InfluxDB server, without the path of the write API.
+	// Defaults to http://localhost:8086.
+	URL string
+	// Org and Bucket the metrics are written to. The bucket is required.
+	Org    string
+	Bucket string
+	// Token is the API token used to authenticate the requests.
+	Token string
+	// Precision of the timestamps, "ns", "us", "ms" or "s". Defaults to ms.
+	Precision string
+	// Encoding of the quantiles and buckets, InfluxDBEncodingFields or
+	// InfluxDBEncodingTags. Defaults to fields.
+	Encoding string
+	// BatchSize is the maximum number of lines sent in each request.
+	// Defaults to 5000.
+	BatchSize int
+	// DisableCompression sends the requests without compressing them with
+	// gzip.
+	DisableCompression bool
+	// Timeout of each request. Defaults to 10s.
+	Timeout time.Duration
+	// MaxRetries is the number of times a failed request is retried.
+	// Defaults to 3, and a negative value disables the retries.
+	MaxRetries int
+	// RetryBackoff is the time waited before the first retry, which is
+	// doubled on every retry. Defaults to 1s.
+	RetryBackoff time.Duration
+	TLSConfig    *tls.Config
+	ProxyURL     *url.URL
+}
+
+// InfluxDBEmitter writes the metrics to the InfluxDB v2 write API using the
+// line protocol. The attributes are written as tags.
+type InfluxDBEmitter struct {
+	name      string
+	sender    *httpSender
+	precision time.Duration
+	tagged    bool
+	batchSize int
+}
+
+// NewInfluxDBEmitter returns an InfluxDBEmitter, or an error if its
+// configuration is not valid.
+func NewInfluxDBEmitter(cfg InfluxDBEmitterConfig) (*InfluxDBEmitter, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("the InfluxDB bucket is required")
+	}
+	base := cfg.URL
+	if base == "" {
+		base = defaultInfluxDBURL
+	}
+	writeURL, err := url.ParseRequestURI(strings.TrimSuffix(base, "/") + influxDBWritePath)
+	if err != nil {
+		return nil, fmt.Errorf("invalid InfluxDB URL %q: %w", base, err)
+	}
+
+	precisionName := cfg.Precision
+	if precisionName == "" {
+		precisionName = defaultInfluxDBPrecision
+	}
+	precision, ok := influxDBPrecisions[precisionName]
+	if !ok {
+		return nil, fmt.Errorf("invalid InfluxDB precision %q, must be \"ns\", \"us\", \"ms\" or \"s\"", cfg.Precision)
+	}
+
+	var tagged bool
+	switch cfg.Encoding {
+	case "", InfluxDBEncodingFields:
+	case InfluxDBEncodingTags:
+		tagged = true
+	default:
+		return nil, fmt.Errorf("invalid InfluxDB encoding %q, must be %q or %q", cfg.Encoding, InfluxDBEncodingFields, InfluxDBEncodingTags)
+	}
+
+	query := url.Values{"bucket": {cfg.Bucket}, "precision": {precisionName}}
+	if cfg.Org != "" {
+		query.Set("org", cfg.Org)
+	}
+	writeURL.RawQuery = query.Encode()
+
+	headers := map[string]string{}
+	if cfg.Token != "" {
+		headers["Authorization"] = "Token " + cfg.Token
+	}
+	batchSize := cfg.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultInfluxDBBatchSize
+	}
+	encoding := encodingGzip
+	if cfg.DisableCompression {
+		encoding = ""
+	}
+
+	return &InfluxDBEmitter{
+		name: "influxdb",
+		sender: &httpSender{
+			client:       newHTTPClient(cfg.Timeout, cfg.TLSConfig, cfg.ProxyURL),
+			url:          writeURL.String(),
+			headers:      headers,
+			encoding:     encoding,
+			maxRetries:   senderRetries(cfg.MaxRetries),
+			retryBackoff: senderRetryBackoff(cfg.RetryBackoff),
+		},
+		precision: precision,
+		tagged:    tagged,
+		batchSize: batchSize,
+	}, nil
+}
+
+// Name is the InfluxDBEmitter name.
+func (ie *InfluxDBEmitter) Name() string {
+	return ie.name
+}
+
+// Emit writes the metrics in batches of up to BatchSize lines.
+func (ie *InfluxDBEmitter) Emit(metrics []Metric) error {
+	// The lines of all the metrics get the same timestamp, since the scraped
+	// metrics have none.
+	timestamp := strconv.FormatInt(time.Now().UnixNano()/int64(ie.precision), 10)
+
+	var results error
+	var body []byte
+	var lines int
+	flush := func() {
+		if lines > 0 {
+			results = appendError(results, ie.sender.send(body, influxDBContentType))
+			body, lines = nil, 0
+		}
+	}
+	for _, metric := range metrics {
+		points, err := ie.points(metric)
+		if err != nil {
+			results = appendError(results, err)
+			continue
+		}
+		for _, p := range points {
+			var ok bool
+			if body, ok = p.appendLine(body, timestamp); !ok {
+				continue
+			}
+			lines++
+			if lines >= ie.batchSize {
+				flush()
+			}
+		}
+	}
+	flush()
+	return results
+}
+
+// influxDBPoint is a line of the line protocol, without its timestamp.
+type influxDBPoint struct {
+	measurement string
+	tags        []promLabel
+	fields      []influxDBField
+}
+
+type influxDBField struct {
+	key   string
+	value float64
+}
+
+// points returns the points of the metric. Summaries and histograms have a
+// point with their count and sum, and either the quantiles and buckets as
+// fields of that point or a point per quantile or bucket.
+func (ie *InfluxDBEmitter) points(metric Metric) ([]influxDBPoint, error) {
+	tags := influxDBTags(metric.attributes)
+	point := influxDBPoint{measurement: metric.name, tags: tags}
+
+	switch value := metric.value.(type) {
+	case float64:
+		point.fields = []influxDBField{{"value", value}}
+		return []influxDBPoint{point}, nil
+	case *dto.Summary:
+		point.fields = []influxDBField{{"count", float64(value.GetSampleCount())}, {"sum", value.GetSampleSum()}}
+		points := []influxDBPoint{point}
+		for _, q := range value.GetQuantile() {
+			quantile, v := formatFloat(q.GetQuantile()), q.GetValue()
+			if ie.tagged {
+				points = append(points, influxDBPoint{metric.name, influxDBWithTag(tags, "quantile", quantile), []influxDBField{{"value", v}}})
+			} else {
+				points[0].fields = append(points[0].fields, influxDBField{quantile, v})
+			}
+		}
+		return points, nil
+	case *dto.Histogram:
+		point.fields = []influxDBField{{"count", float64(value.GetSampleCount())}, {"sum", value.GetSampleSum()}}
+		points := []influxDBPoint{point}
+		for _, b := range value.GetBucket() {
+			le, v := formatFloat(b.GetUpperBound()), float64(b.GetCumulativeCount())
+			if ie.tagged {
+				points = append(points, influxDBPoint{metric.name, influxDBWithTag(tags, "le", le), []influxDBField{{"value", v}}})
+			} else {
+				points[0].fields = append(points[0].fields, influxDBField{le, v})
+			}
+		}
+		return points, nil
+	}
+	return nil, fmt.Errorf("unknown value type for %q: %T", metric.name, metric.value)
+}
+
+// influxDBTags returns the attributes as tags sorted by name, as InfluxDB
+// recommends. The attributes with the New Relic types of the metrics and the
+// empty ones, which InfluxDB doesn't support, are dropped.
+func influxDBTags(attrs labels.Set) []promLabel {
+	tags := make([]promLabel, 0, len(attrs))
+	for name, value := range attrs {
+		if _, ok := prometheusDroppedAttributes[name]; ok {
+			continue
+		}
+		if v := fmt.Sprint(value); v != "" {
+			tags = append(tags, promLabel{name, v})
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].name < tags[j].name })
+	return tags
+}
+
+// influxDBWithTag returns a copy of the tags with the tag added, replacing
+// an attribute with the same name.
+func influxDBWithTag(tags []promLabel, name, value string) []promLabel {
+	result := make([]promLabel, 0, len(tags)+1)
+	for _, t := range tags {
+		if t.name != name {
+			result = append(result, t)
+		}
+	}
+	result = append(result, promLabel{name, value})
+	sort.Slice(result, func(i, j int) bool { return result[i].name < result[j].name })
+	return result
+}
+
+var (
+	influxDBMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	influxDBKeyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+)
+
+// appendLine appends the line of the point to the body, e.g.
+// `http_requests_total,code=200,method=get value=1027 1700000000000`.
+// NaN and infinite values are not supported by InfluxDB, so their fields
+// are skipped, and the point if it has no other fields.
+func (p *influxDBPoint) appendLine(body []byte, timestamp string) ([]byte, bool) {
+	var fields []string
+	for _, f := range p.fields {
+		if math.IsNaN(f.value) || math.IsInf(f.value, 0) {
+			continue
+		}
+		fields = append(fields, influxDBKeyEscaper.Replace(f.key)+"="+strconv.FormatFloat(f.value, 'g', -1, 64))
+	}
+	if len(fields) == 0 {
+		return body, false
+	}
+
+	body = append(body, influxDBMeasurementEscaper.Replace(p.measurement)...)
+	for _, t := range p.tags {
+		body = append(body, ',')
+		body = append(body, influxDBKeyEscaper.Replace(t.name)...)
+		body = append(body, '=')
+		body = append(body, influxDBKeyEscaper.Replace(t.value)...)
+	}
+	body = append(body, ' ')
+	body = append(body, strings.Join(fields, ",")...)
+	body = append(body, ' ')
+	body = append(body, timestamp...)
+	return append(body, '\n'), true
+}
@@ -0,0 +1,200 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"compress/gzip"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+// influxDBReceiver is a stand-in of the InfluxDB v2 write API.
+type influxDBReceiver struct {
+	lock     sync.Mutex
+	requests []*http.Request
+	bodies   []string
+}
+
+func newInfluxDBReceiver(t *testing.T) (*influxDBReceiver, *httptest.Server) {
+	t.Helper()
+
+	receiver := &influxDBReceiver{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/write" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			body = zr
+		}
+		b, err := io.ReadAll(body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		receiver.lock.Lock()
+		defer receiver.lock.Unlock()
+		receiver.requests = append(receiver.requests, r)
+		receiver.bodies = append(receiver.bodies, string(b))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(srv.Close)
+	return receiver, srv
+}
+
+// influxDBTimestamps matches the timestamps at the end of the lines.
+var influxDBTimestamps = regexp.MustCompile(` \d+\n`)
+
+func influxDBLines(body string) []string {
+	return strings.Split(strings.TrimSuffix(influxDBTimestamps.ReplaceAllString(body, "\n"), "\n"), "\n")
+}
+
+func influxDBTestMetrics() []Metric {
+	return []Metric{
+		{
+			name:       "http_requests_total",
+			metricType: metricType_COUNTER,
+			value:      1027.0,
+			attributes: labels.Set{"method": "get", "path": "/api v1", "empty": "", "nrMetricType": "count"},
+		},
+		{
+			name:       "temperature",
+			metricType: metricType_GAUGE,
+			value:      math.NaN(),
+			attributes: labels.Set{},
+		},
+		{
+			name:       "rpc_duration_seconds",
+			metricType: metricType_SUMMARY,
+			value: &dto.Summary{
+				SampleCount: proto.Uint64(10),
+				SampleSum:   proto.Float64(3.5),
+				Quantile:    []*dto.Quantile{{Quantile: proto.Float64(0.99), Value: proto.Float64(0.8)}},
+			},
+			attributes: labels.Set{"service": "api"},
+		},
+		{
+			name:       "http_duration_seconds",
+			metricType: metricType_HISTOGRAM,
+			value: &dto.Histogram{
+				SampleCount: proto.Uint64(6),
+				SampleSum:   proto.Float64(2.5),
+				Bucket: []*dto.Bucket{
+					{UpperBound: proto.Float64(0.1), CumulativeCount: proto.Uint64(2)},
+					{UpperBound: proto.Float64(math.Inf(1)), CumulativeCount: proto.Uint64(6)},
+				},
+			},
+			attributes: labels.Set{},
+		},
+	}
+}
+
+func TestInfluxDBEmitter(t *testing.T) {
+	t.Parallel()
+
+	receiver, srv := newInfluxDBReceiver(t)
+	ie, err := NewInfluxDBEmitter(InfluxDBEmitterConfig{URL: srv.URL, Org: "iot", Bucket: "fleet", Token: "secret", Precision: "s"})
+	require.NoError(t, err)
+	require.NoError(t, ie.Emit(influxDBTestMetrics()))
+
+	require.Len(t, receiver.requests, 1)
+	req := receiver.requests[0]
+	assert.Equal(t, url.Values{"org": {"iot"}, "bucket": {"fleet"}, "precision": {"s"}}, req.URL.Query())
+	assert.Equal(t, "Token secret", req.Header.Get("Authorization"))
+	assert.Equal(t, "gzip", req.Header.Get("Content-Encoding"))
+
+	assert.Regexp(t, `^http_requests_total,method=get,path=/api\\ v1 value=1027 \d{10}\n`, receiver.bodies[0])
+	assert.Equal(t, []string{
+		`http_requests_total,method=get,path=/api\ v1 value=1027`,
+		`rpc_duration_seconds,service=api count=10,sum=3.5,0.99=0.8`,
+		`http_duration_seconds count=6,sum=2.5,0.1=2,+Inf=6`,
+	}, influxDBLines(receiver.bodies[0]))
+}
+
+func TestInfluxDBEmitter_TagsEncoding(t *testing.T) {
+	t.Parallel()
+
+	receiver, srv := newInfluxDBReceiver(t)
+	ie, err := NewInfluxDBEmitter(InfluxDBEmitterConfig{URL: srv.URL, Bucket: "fleet", Encoding: InfluxDBEncodingTags, DisableCompression: true})
+	require.NoError(t, err)
+	require.NoError(t, ie.Emit(influxDBTestMetrics()[2:]))
+
+	require.Len(t, receiver.requests, 1)
+	assert.Empty(t, receiver.requests[0].Header.Get("Content-Encoding"))
+	assert.Equal(t, url.Values{"bucket": {"fleet"}, "precision": {"ms"}}, receiver.requests[0].URL.Query())
+	assert.Equal(t, []string{
+		`rpc_duration_seconds,service=api count=10,sum=3.5`,
+		`rpc_duration_seconds,quantile=0.99,service=api value=0.8`,
+		`http_duration_seconds count=6,sum=2.5`,
+		`http_duration_seconds,le=0.1 value=2`,
+		`http_duration_seconds,le=+Inf value=6`,
+	}, influxDBLines(receiver.bodies[0]))
+}
+
+func TestInfluxDBEmitter_Batches(t *testing.T) {
+	t.Parallel()
+
+	receiver, srv := newInfluxDBReceiver(t)
+	ie, err := NewInfluxDBEmitter(InfluxDBEmitterConfig{URL: srv.URL, Bucket: "fleet", BatchSize: 2})
+	require.NoError(t, err)
+
+	var metrics []Metric
+	for i := 0; i < 5; i++ {
+		metrics = append(metrics, Metric{name: "up", metricType: metricType_GAUGE, value: float64(i), attributes: labels.Set{}})
+	}
+	require.NoError(t, ie.Emit(metrics))
+
+	require.Len(t, receiver.bodies, 3)
+	assert.Equal(t, []string{"up value=0", "up value=1"}, influxDBLines(receiver.bodies[0]))
+	assert.Equal(t, []string{"up value=4"}, influxDBLines(receiver.bodies[2]))
+}
+
+func TestInfluxDBPoint_Escaping(t *testing.T) {
+	t.Parallel()
+
+	p := influxDBPoint{
+		measurement: "my metric,total",
+		tags:        []promLabel{{"tag key", "a=b,c"}},
+		fields:      []influxDBField{{"field key", 1}},
+	}
+	line, ok := p.appendLine(nil, "1")
+	require.True(t, ok)
+	assert.Equal(t, "my\\ metric\\,total,tag\\ key=a\\=b\\,c field\\ key=1 1\n", string(line))
+}
+
+func TestNewInfluxDBEmitter_InvalidConfig(t *testing.T) {
+	t.Parallel()
+
+	testCases := map[string]InfluxDBEmitterConfig{
+		"missing bucket": {},
+		"invalid URL":    {URL: "not a url", Bucket: "fleet"},
+		"precision":      {Bucket: "fleet", Precision: "m"},
+		"encoding":       {Bucket: "fleet", Encoding: "columns"},
+	}
+	for name, cfg := range testCases {
+		_, err := NewInfluxDBEmitter(cfg)
+		assert.Error(t, err, name)
+	}
+}
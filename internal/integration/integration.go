@@ -5,6 +5,7 @@
 package integration
 
 import (
+	"context"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -27,10 +28,13 @@ var ilog = logrus.WithField("component", "integration.Execute")
 // Execute the integration loop. It sets the retrievers to start watching for
 // new targets and starts the processing pipeline. The pipeline fetches
 // metrics from the registered targets, transforms them according to a set
-// of rules and emits them.
+// of rules and emits them. It returns when the context is canceled, once the
+// metrics being processed have been passed to the emitters, so no metric is
+// emitted afterwards.
 //
 // with first-class functions
 func Execute(
+	ctx context.Context,
 	scrapeDuration time.Duration,
 	selfRetriever endpoints.TargetRetriever,
 	retrievers []endpoints.TargetRetriever,
@@ -45,12 +49,13 @@ func Execute(
 		}
 	}
 
-	for {
+	for ctx.Err() == nil {
 		totalTimeseriesMetric.Set(0)
 		totalTimeseriesByTargetMetric.Reset()
 		totalTimeseriesByTargetAndTypeMetric.Reset()
 		totalTimeseriesByTypeMetric.Reset()
 		fetchTargetDurationMetric.Reset()
+		processTargetDurationMetric.Reset()
 		fetchesTotalMetric.Reset()
 		fetchErrorsTotalMetric.Reset()
 		nrprom.ResetTargetSize()
@@ -59,7 +64,11 @@ func Execute(
 		process(retrievers, fetcher, processor, emitters)
 		totalExecutionsMetric.Inc()
 		if duration := time.Since(startTime); duration < scrapeDuration {
-			time.Sleep(scrapeDuration - duration)
+			select {
+			case <-time.After(scrapeDuration - duration):
+			case <-ctx.Done():
+				return
+			}
 		}
 		processWithoutTelemetry(selfRetriever, fetcher, processor, emitters)
 	}
@@ -79,6 +88,7 @@ func ExecuteOnce(retrievers []endpoints.TargetRetriever, fetcher Fetcher, proces
 	for _, retriever := range retrievers {
 		processWithoutTelemetry(retriever, fetcher, processor, emitters)
 	}
+	flushEmitters(emitters)
 }
 
 // processWithoutTelemetry processes a target retriever without doing any
@@ -98,7 +108,7 @@ func processWithoutTelemetry(
 	processed := processor(pairs)
 	for pair := range processed {
 		for _, e := range emitters {
-			err := e.Emit(pair.Metrics)
+			err := emitTarget(e, pair)
 			if err != nil {
 				ilog.WithField("emitter", e.Name()).WithError(err).Warn("error emitting metrics")
 			}
@@ -124,12 +134,14 @@ func process(retrievers []endpoints.TargetRetriever, fetcher Fetcher, processor
 	pairs := fetcher.Fetch(targets) // fetch metrics from /metrics endpoints
 	processed := processor(pairs)   // apply processing
 
-	emittedMetrics := 0
+	// The emitters may queue the metrics, so they are counted once
+	// processed rather than once emitted.
+	processedMetrics := 0
 	for pair := range processed {
-		emittedMetrics += len(pair.Metrics)
+		processedMetrics += len(pair.Metrics)
 
 		for _, e := range emitters {
-			err := e.Emit(pair.Metrics)
+			err := emitTarget(e, pair)
 			if err != nil {
 				ilog.WithField("emitter", e.Name()).WithError(err).Warn("error emitting metrics")
 			}
@@ -139,9 +151,9 @@ func process(retrievers []endpoints.TargetRetriever, fetcher Fetcher, processor
 	duration := ptimer.ObserveDuration()
 
 	logrus.WithFields(logrus.Fields{
-		"duration":            duration.Round(time.Second),
-		"targetCount":         len(targets),
-		"emitterCount":        len(emitters),
-		"emittedMetricsCount": emittedMetrics,
+		"duration":              duration.Round(time.Second),
+		"targetCount":           len(targets),
+		"emitterCount":          len(emitters),
+		"processedMetricsCount": processedMetrics,
 	}).Debug("Processing metrics finished.")
 }
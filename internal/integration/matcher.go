@@ -0,0 +1,274 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+// maxCachedDecisions bounds the number of metric names whose matching rules
+// are cached. When it's reached the cache is emptied, which only costs
+// matching the rules again for the names that are still being scraped.
+const maxCachedDecisions = 100000
+
+// prefixTrie finds all the prefixes of a string from a set of prefixes
+// walking the string only once, instead of comparing it with every prefix.
+type prefixTrie struct {
+	children map[byte]*prefixTrie
+	// values are the indexes of the rules whose prefix ends at this node.
+	values []int
+}
+
+func (t *prefixTrie) insert(prefix string, value int) {
+	node := t
+	for i := 0; i < len(prefix); i++ {
+		if node.children == nil {
+			node.children = map[byte]*prefixTrie{}
+		}
+		child, ok := node.children[prefix[i]]
+		if !ok {
+			child = &prefixTrie{}
+			node.children[prefix[i]] = child
+		}
+		node = child
+	}
+	node.values = append(node.values, value)
+}
+
+// match returns the values of all the prefixes of name, sorted in ascending
+// order so the rules are applied in the same order they are defined.
+func (t *prefixTrie) match(name string) []int {
+	var values []int
+	node := t
+	for i := 0; ; i++ {
+		values = append(values, node.values...)
+		if i == len(name) {
+			break
+		}
+		if node = node.children[name[i]]; node == nil {
+			break
+		}
+	}
+	sort.Ints(values)
+	return values
+}
+
+// matchesAny returns whether any of the prefixes of the trie is a prefix of
+// name.
+func (t *prefixTrie) matchesAny(name string) bool {
+	node := t
+	for i := 0; ; i++ {
+		if len(node.values) > 0 {
+			return true
+		}
+		if i == len(name) {
+			return false
+		}
+		if node = node.children[name[i]]; node == nil {
+			return false
+		}
+	}
+}
+
+// metricDecision holds the rules that match a metric name.
+type metricDecision struct {
+	// excepted is true if the metric matches an Except prefix, so it must
+	// never be ignored.
+	excepted bool
+	// ignored is true if the metric matches an ignore prefix. It can still
+	// be ignored by its type.
+	ignored       bool
+	rename        []int
+	addAttributes []int
+	redact        []int
+}
+
+// ruleMatcher applies the rename, add attributes, redact and ignore rules using
+// prefix tries. The rules matching each metric name are cached across
+// cycles, since targets usually expose the same metrics on every scrape.
+type ruleMatcher struct {
+	rename        []RenameRule
+	addAttributes []AddAttributesRule
+	redact        []redactRule
+
+	renameTrie        prefixTrie
+	addAttributesTrie prefixTrie
+	redactTrie        prefixTrie
+	ignoreTrie        prefixTrie
+	exceptTrie        prefixTrie
+	// ignoreAll is true if there is a rule with Except but no Prefixes nor
+	// MetricTypes, so all the metrics not excepted must be ignored.
+	ignoreAll   bool
+	ignoreTypes map[string]struct{}
+	hasIgnore   bool
+
+	// lock protects the decisions, since targets can be processed in
+	// parallel.
+	lock      sync.RWMutex
+	decisions map[string]*metricDecision
+}
+
+func newRuleMatcher(rename []RenameRule, addAttributes []AddAttributesRule, ignore []IgnoreRule, redact []redactRule) *ruleMatcher {
+	m := &ruleMatcher{
+		rename:        rename,
+		addAttributes: addAttributes,
+		redact:        redact,
+		ignoreTypes:   map[string]struct{}{},
+		hasIgnore:     len(ignore) > 0,
+		decisions:     map[string]*metricDecision{},
+	}
+	for i, rr := range rename {
+		m.renameTrie.insert(rr.MetricPrefix, i)
+	}
+	for i, ar := range addAttributes {
+		m.addAttributesTrie.insert(ar.MetricPrefix, i)
+	}
+	for i, rr := range redact {
+		m.redactTrie.insert(rr.metricPrefix, i)
+	}
+	for _, ir := range ignore {
+		if len(ir.MetricTypes)+len(ir.Prefixes) == 0 && len(ir.Except) != 0 {
+			m.ignoreAll = true
+		}
+		for _, mt := range ir.MetricTypes {
+			m.ignoreTypes[strings.ToLower(mt)] = struct{}{}
+		}
+		for _, prefix := range ir.Prefixes {
+			m.ignoreTrie.insert(prefix, 0)
+		}
+		for _, prefix := range ir.Except {
+			m.exceptTrie.insert(prefix, 0)
+		}
+	}
+	return m
+}
+
+// decision returns the rules that match the metric name, from the cache if
+// the name has been seen before.
+func (m *ruleMatcher) decision(name string) *metricDecision {
+	m.lock.RLock()
+	d, ok := m.decisions[name]
+	m.lock.RUnlock()
+	if ok {
+		return d
+	}
+
+	d = &metricDecision{
+		excepted:      m.exceptTrie.matchesAny(name),
+		ignored:       m.ignoreTrie.matchesAny(name),
+		rename:        m.renameTrie.match(name),
+		addAttributes: m.addAttributesTrie.match(name),
+		redact:        m.redactTrie.match(name),
+	}
+
+	m.lock.Lock()
+	if len(m.decisions) >= maxCachedDecisions {
+		m.decisions = map[string]*metricDecision{}
+	}
+	m.decisions[name] = d
+	m.lock.Unlock()
+	return d
+}
+
+// shouldIgnore returns whether the metric must be dropped. If any of the
+// rules has an Except prefix matching the metric, it's always kept.
+func (m *ruleMatcher) shouldIgnore(name string, metricType metricType) bool {
+	if !m.hasIgnore {
+		return false
+	}
+	d := m.decision(name)
+	if d.excepted {
+		return false
+	}
+	if m.ignoreAll || d.ignored {
+		return true
+	}
+	_, ok := m.ignoreTypes[strings.ToLower(string(metricType))]
+	return ok
+}
+
+// filter removes the metrics that must be ignored.
+func (m *ruleMatcher) filter(targetMetrics *TargetMetrics) {
+	// Fast path, quickly exit if there are no rules defined.
+	if !m.hasIgnore {
+		return
+	}
+
+	copied := make([]Metric, 0, len(targetMetrics.Metrics))
+	for _, metric := range targetMetrics.Metrics {
+		if !m.shouldIgnore(metric.name, metric.metricType) {
+			copied = append(copied, metric)
+		}
+	}
+	targetMetrics.Metrics = copied
+}
+
+// applyAddAttributes adds the attributes of the matching rules to the
+// metrics.
+func (m *ruleMatcher) applyAddAttributes(targetMetrics *TargetMetrics) {
+	// Fast path, quickly exit if there are no rules defined.
+	if len(m.addAttributes) == 0 {
+		return
+	}
+
+	for mi := range targetMetrics.Metrics {
+		for _, i := range m.decision(targetMetrics.Metrics[mi].name).addAttributes {
+			labels.Accumulate(targetMetrics.Metrics[mi].attributes, m.addAttributes[i].Attributes)
+		}
+	}
+}
+
+// applyRename renames the attributes of the metrics according to the
+// matching rules.
+func (m *ruleMatcher) applyRename(targetMetrics *TargetMetrics) {
+	// Fast path, quickly exit if there are no rules defined.
+	if len(m.rename) == 0 {
+		return
+	}
+
+	for mi := range targetMetrics.Metrics {
+		attributes := targetMetrics.Metrics[mi].attributes
+		for _, i := range m.decision(targetMetrics.Metrics[mi].name).rename {
+			for current, updated := range m.rename[i].Attributes {
+				if value, ok := attributes[current]; ok {
+					attributes[updated.(string)] = value
+				}
+			}
+		}
+	}
+}
+
+// applyRedact replaces the sensitive values of the attributes of the metrics
+// according to the matching rules.
+func (m *ruleMatcher) applyRedact(targetMetrics *TargetMetrics) {
+	// Fast path, quickly exit if there are no rules defined.
+	if len(m.redact) == 0 {
+		return
+	}
+
+	for mi := range targetMetrics.Metrics {
+		m.redactAttributes(targetMetrics.Metrics[mi].name, targetMetrics.Metrics[mi].attributes)
+	}
+}
+
+// redactAttributes replaces the sensitive values of the attributes of a
+// metric according to the rules matching its name.
+func (m *ruleMatcher) redactAttributes(name string, attributes labels.Set) {
+	if len(m.redact) == 0 {
+		return
+	}
+	for _, i := range m.decision(name).redact {
+		rule := &m.redact[i]
+		for _, attr := range rule.attributes {
+			if value, ok := attributes[attr]; ok {
+				attributes[attr] = rule.redact(fmt.Sprint(value))
+			}
+		}
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+func TestPrefixTrie(t *testing.T) {
+	t.Parallel()
+
+	trie := prefixTrie{}
+	trie.insert("redis_", 2)
+	trie.insert("", 0)
+	trie.insert("redis_exporter_", 1)
+	trie.insert("redis_exporter_build", 3)
+	trie.insert("go_", 4)
+
+	assert.Equal(t, []int{0, 1, 2, 3}, trie.match("redis_exporter_build_info"))
+	assert.Equal(t, []int{0, 2}, trie.match("redis_up"))
+	assert.Equal(t, []int{0}, trie.match("process_cpu_seconds_total"))
+	assert.Equal(t, []int{0, 1, 2}, trie.match("redis_exporter_"))
+
+	assert.True(t, trie.matchesAny("anything"))
+	assert.False(t, (&prefixTrie{}).matchesAny("anything"))
+}
+
+func TestRuleMatcher_ManyPrefixes(t *testing.T) {
+	t.Parallel()
+
+	var prefixes []string
+	for i := 0; i < 400; i++ {
+		prefixes = append(prefixes, fmt.Sprintf("app_%d_", i))
+	}
+	m := newRuleMatcher(nil, nil, []IgnoreRule{
+		{Prefixes: prefixes, Except: []string{"app_10_kept"}},
+	}, nil)
+
+	assert.True(t, m.shouldIgnore("app_10_dropped", metricType_GAUGE))
+	assert.True(t, m.shouldIgnore("app_399_requests_total", metricType_COUNTER))
+	assert.False(t, m.shouldIgnore("app_10_kept_total", metricType_COUNTER))
+	assert.False(t, m.shouldIgnore("app_400_requests_total", metricType_COUNTER))
+	assert.False(t, m.shouldIgnore("app_", metricType_COUNTER))
+
+	// The decisions are cached by metric name.
+	assert.Len(t, m.decisions, 5)
+	assert.True(t, m.shouldIgnore("app_10_dropped", metricType_GAUGE))
+	assert.Len(t, m.decisions, 5)
+}
+
+func TestRuleMatcher_MetricTypes(t *testing.T) {
+	t.Parallel()
+
+	m := newRuleMatcher(nil, nil, []IgnoreRule{{MetricTypes: []string{"Summary"}}}, nil)
+
+	// The metric type doesn't take part in the cached decision.
+	assert.True(t, m.shouldIgnore("latency", metricType_SUMMARY))
+	assert.False(t, m.shouldIgnore("latency", metricType_GAUGE))
+}
+
+func TestRuleMatcher_RulesAreAppliedInOrder(t *testing.T) {
+	t.Parallel()
+
+	m := newRuleMatcher(
+		[]RenameRule{
+			{MetricPrefix: "redis_exporter_", Attributes: map[string]interface{}{"a": "b"}},
+			{MetricPrefix: "redis_", Attributes: map[string]interface{}{"b": "c"}},
+		},
+		[]AddAttributesRule{
+			{MetricPrefix: "redis_exporter_", Attributes: map[string]interface{}{"owner": "exporter"}},
+			{MetricPrefix: "redis_", Attributes: map[string]interface{}{"owner": "redis"}},
+		},
+		nil,
+		nil,
+	)
+
+	tm := TargetMetrics{Metrics: []Metric{
+		{name: "redis_exporter_build_info", attributes: labels.Set{"a": "value"}},
+	}}
+	m.applyAddAttributes(&tm)
+	m.applyRename(&tm)
+
+	assert.Equal(t, labels.Set{"a": "value", "b": "value", "c": "value", "owner": "exporter"}, tm.Metrics[0].attributes)
+}
+
+func TestRuleMatcher_DecisionsCacheIsBounded(t *testing.T) {
+	t.Parallel()
+
+	m := newRuleMatcher(nil, nil, []IgnoreRule{{Prefixes: []string{"dropped_"}}}, nil)
+	for i := 0; i <= maxCachedDecisions; i++ {
+		m.shouldIgnore(fmt.Sprintf("metric_%d", i), metricType_GAUGE)
+	}
+
+	assert.Len(t, m.decisions, 1)
+}
+
+func BenchmarkRuleMatcher(b *testing.B) {
+	var prefixes []string
+	for i := 0; i < 400; i++ {
+		prefixes = append(prefixes, fmt.Sprintf("app_%d_", i))
+	}
+	m := newRuleMatcher(nil, nil, []IgnoreRule{{Prefixes: prefixes}}, nil)
+
+	var metrics []Metric
+	for i := 0; i < 1000; i++ {
+		metrics = append(metrics, Metric{name: fmt.Sprintf("metric_%d_total", i%100), metricType: metricType_COUNTER})
+	}
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		tm := TargetMetrics{Metrics: metrics}
+		m.filter(&tm)
+	}
+}
@@ -97,6 +97,99 @@ var (
 			"target",
 		},
 	)
+	processTargetDurationMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nr_stats",
+		Subsystem: "integration",
+		Name:      "process_target_duration_seconds",
+		Help:      "The total time in seconds to apply the processing rules to the metrics of a target",
+	},
+		[]string{
+			"target",
+		},
+	)
+	processingQueueDepthMetric = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "nr_stats",
+		Subsystem: "integration",
+		Name:      "processing_queue_depth",
+		Help:      "The number of fetched targets waiting to be processed",
+	})
+	emitterQueueDepthMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nr_stats",
+		Subsystem: "integration",
+		Name:      "emitter_queue_depth",
+		Help:      "The number of batches of metrics waiting to be emitted, by emitter",
+	},
+		[]string{
+			"emitter",
+		},
+	)
+	emitterDroppedBatchesMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nr_stats",
+		Subsystem: "integration",
+		Name:      "emitter_dropped_batches_total",
+		Help:      "The number of batches of metrics dropped because the queue of the emitter was full, by emitter",
+	},
+		[]string{
+			"emitter",
+		},
+	)
+	harvestsTotalMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nr_stats",
+		Subsystem: "integration",
+		Name:      "harvests_total",
+		Help:      "The number of harvests of the telemetry emitter, by what triggered them",
+	},
+		[]string{
+			"trigger",
+		},
+	)
+	harvestRequestsTotalMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nr_stats",
+		Subsystem: "integration",
+		Name:      "harvest_requests_total",
+		Help:      "The number of requests posted by the harvesters, by emitter and response status code, or error if there was no response",
+	},
+		[]string{
+			"emitter",
+			"status",
+		},
+	)
+	harvestRequestBytesTotalMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nr_stats",
+		Subsystem: "integration",
+		Name:      "harvest_request_bytes_total",
+		Help:      "The number of compressed bytes of the payloads posted by the harvesters, by emitter",
+	},
+		[]string{
+			"emitter",
+		},
+	)
+	harvestLastSuccessMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nr_stats",
+		Subsystem: "integration",
+		Name:      "harvest_last_success_timestamp_seconds",
+		Help:      "Timestamp of the last request of the harvesters accepted by New Relic, by emitter",
+	},
+		[]string{
+			"emitter",
+		},
+	)
+	droppedMetricsTotalMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nr_stats",
+		Subsystem: "integration",
+		Name:      "dropped_metrics_total",
+		Help:      "The number of metrics dropped by the telemetry emitter because New Relic doesn't accept their value, by reason",
+	},
+		[]string{
+			"reason",
+		},
+	)
+	counterResetsTotalMetric = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "nr_stats",
+		Subsystem: "integration",
+		Name:      "counter_resets_total",
+		Help:      "The number of counter resets detected by the telemetry emitter from the created timestamps of the counters",
+	})
 	processDurationMetric = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace: "nr_stats",
 		Subsystem: "integration",
@@ -109,6 +202,22 @@ var (
 		Name:      "total_executions",
 		Help:      "The number of times the integration is executed",
 	})
+	rulesReloadsTotalMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nr_stats",
+		Subsystem: "integration",
+		Name:      "rules_reloads_total",
+		Help:      "The number of attempts to reload the processing rules, by result",
+	},
+		[]string{
+			"result",
+		},
+	)
+	rulesLastReloadSuccessMetric = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "nr_stats",
+		Subsystem: "integration",
+		Name:      "rules_last_reload_success_timestamp_seconds",
+		Help:      "Timestamp of the last successful reload of the processing rules",
+	})
 )
 
 func init() {
@@ -122,6 +231,18 @@ func init() {
 	prometheus.MustRegister(totalTimeseriesMetric)
 	prometheus.MustRegister(totalTimeseriesByTargetMetric)
 	prometheus.MustRegister(fetchTargetDurationMetric)
+	prometheus.MustRegister(processTargetDurationMetric)
+	prometheus.MustRegister(processingQueueDepthMetric)
+	prometheus.MustRegister(emitterQueueDepthMetric)
+	prometheus.MustRegister(emitterDroppedBatchesMetric)
+	prometheus.MustRegister(harvestsTotalMetric)
+	prometheus.MustRegister(harvestRequestsTotalMetric)
+	prometheus.MustRegister(harvestRequestBytesTotalMetric)
+	prometheus.MustRegister(harvestLastSuccessMetric)
+	prometheus.MustRegister(droppedMetricsTotalMetric)
+	prometheus.MustRegister(counterResetsTotalMetric)
 	prometheus.MustRegister(processDurationMetric)
 	prometheus.MustRegister(totalExecutionsMetric)
+	prometheus.MustRegister(rulesReloadsTotalMetric)
+	prometheus.MustRegister(rulesLastReloadSuccessMetric)
 }
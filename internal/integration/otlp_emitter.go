@@ -0,0 +1,532 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/cumulative"
+	dto "github.com/prometheus/client_model/go"
+	commonv1 "go.opentelemetry.io/proto/otlp/common/v1"
+	metricsv1 "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcev1 "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+const (
+	// OTLPTemporalityCumulative sends the counters and histograms with their
+	// cumulative values.
+	OTLPTemporalityCumulative = "cumulative"
+	// OTLPTemporalityDelta sends the counters and histograms with the
+	// difference from their previous values.
+	OTLPTemporalityDelta = "delta"
+
+	defaultOTLPEndpoint  = "http://localhost:4318/v1/metrics"
+	defaultOTLPBatchSize = 1000
+	otlpScopeName        = "github.com/newrelic/nri-prometheus"
+	otlpContentType      = "application/x-protobuf"
+)
+
+// OTLPEmitterConfig is the configuration of the OTLPEmitter.
+type OTLPEmitterConfig struct {
+	// Endpoint is the URL of the OTLP/HTTP metrics receiver, including its
+	// path. Defaults to http://localhost:4318/v1/metrics.
+	Endpoint string
+	// Headers are added to every request, e.g. for authentication.
+	Headers map[string]string
+	// ResourceAttributes are added to the resource of the metrics, along with
+	// `service.name`.
+	ResourceAttributes map[string]string
+	// Temporality of the counters and histograms, either "cumulative" or
+	// "delta". Defaults to cumulative.
+	Temporality string
+	// DisableCompression sends the requests without compressing them with
+	// gzip.
+	DisableCompression bool
+	// BatchSize is the maximum number of data points sent in each request.
+	// Defaults to 1000.
+	BatchSize int
+	// Timeout of each request. Defaults to 10s.
+	Timeout time.Duration
+	// MaxRetries is the number of times a failed request is retried.
+	// Defaults to 3, and a negative value disables the retries.
+	MaxRetries int
+	// RetryBackoff is the time waited before the first retry, which is
+	// doubled on every retry. Defaults to 1s.
+	RetryBackoff time.Duration
+	TLSConfig    *tls.Config
+	ProxyURL     *url.URL
+	// DeltaExpirationAge is how long the previous values of a series are
+	// kept after it's not seen anymore. Defaults to 5m.
+	DeltaExpirationAge time.Duration
+}
+
+// OTLPEmitter sends the metrics to an OpenTelemetry collector using OTLP
+// over HTTP with protobuf payloads.
+type OTLPEmitter struct {
+	name      string
+	sender    *httpSender
+	resource  *resourcev1.Resource
+	delta     bool
+	batchSize int
+	// deltaCalculator calculates the deltas of the counters and histograms
+	// when the delta temporality is used.
+	deltaCalculator *cumulative.DeltaCalculator
+	// startTimes tracks the start time of the cumulative series.
+	startTimes *startTimes
+}
+
+// NewOTLPEmitter returns an OTLPEmitter, or an error if its configuration is
+// not valid.
+func NewOTLPEmitter(cfg OTLPEmitterConfig) (*OTLPEmitter, error) {
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = defaultOTLPEndpoint
+	}
+	if _, err := url.ParseRequestURI(endpoint); err != nil {
+		return nil, fmt.Errorf("invalid OTLP endpoint %q: %w", endpoint, err)
+	}
+
+	var delta bool
+	switch strings.ToLower(cfg.Temporality) {
+	case "", OTLPTemporalityCumulative:
+	case OTLPTemporalityDelta:
+		delta = true
+	default:
+		return nil, fmt.Errorf("invalid OTLP temporality %q, must be %q or %q", cfg.Temporality, OTLPTemporalityCumulative, OTLPTemporalityDelta)
+	}
+
+	batchSize := cfg.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultOTLPBatchSize
+	}
+	expirationAge := cfg.DeltaExpirationAge
+	if expirationAge <= 0 {
+		expirationAge = defaultDeltaExpirationAge
+	}
+
+	encoding := encodingGzip
+	if cfg.DisableCompression {
+		encoding = ""
+	}
+
+	resourceAttrs := labels.Set{"service.name": "nri-prometheus"}
+	for name, value := range cfg.ResourceAttributes {
+		resourceAttrs[name] = value
+	}
+
+	return &OTLPEmitter{
+		name: "otlp",
+		sender: &httpSender{
+			client:       newHTTPClient(cfg.Timeout, cfg.TLSConfig, cfg.ProxyURL),
+			url:          endpoint,
+			headers:      cfg.Headers,
+			encoding:     encoding,
+			maxRetries:   senderRetries(cfg.MaxRetries),
+			retryBackoff: senderRetryBackoff(cfg.RetryBackoff),
+		},
+		resource:        &resourcev1.Resource{Attributes: otlpAttributes(resourceAttrs)},
+		delta:           delta,
+		batchSize:       batchSize,
+		deltaCalculator: cumulative.NewDeltaCalculator().SetExpirationAge(expirationAge).SetExpirationCheckInterval(defaultDeltaExpirationCheckInterval),
+		startTimes:      newStartTimes(expirationAge),
+	}, nil
+}
+
+// Name is the OTLPEmitter name.
+func (oe *OTLPEmitter) Name() string {
+	return oe.name
+}
+
+// Emit converts the metrics into OTLP metrics and sends them in batches of
+// at most BatchSize data points.
+func (oe *OTLPEmitter) Emit(metrics []Metric) error {
+	var results error
+
+	// The metrics have no timestamps, so their data points are timestamped
+	// with the emission time, which also ends the delta intervals.
+	now := time.Now()
+	batch := newOTLPBatch()
+	for _, metric := range metrics {
+		if err := oe.add(batch, metric, now); err != nil {
+			results = appendError(results, err)
+			continue
+		}
+		if batch.dataPoints >= oe.batchSize {
+			results = appendError(results, oe.send(batch))
+			batch = newOTLPBatch()
+		}
+	}
+	if batch.dataPoints > 0 {
+		results = appendError(results, oe.send(batch))
+	}
+	return results
+}
+
+// appendError wraps the previous errors with the new one, if any.
+func appendError(results, err error) error {
+	if err == nil {
+		return results
+	}
+	if results == nil {
+		return err
+	}
+	return fmt.Errorf("%v: %w", err, results)
+}
+
+func (oe *OTLPEmitter) send(batch *otlpBatch) error {
+	payload, err := proto.Marshal(&metricsv1.MetricsData{
+		ResourceMetrics: []*metricsv1.ResourceMetrics{{
+			Resource: oe.resource,
+			ScopeMetrics: []*metricsv1.ScopeMetrics{{
+				Scope:   &commonv1.InstrumentationScope{Name: otlpScopeName},
+				Metrics: batch.metrics,
+			}},
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("marshaling OTLP metrics: %w", err)
+	}
+	// MetricsData has the same wire format as the ExportMetricsServiceRequest
+	// expected by the receivers.
+	return oe.sender.send(payload, otlpContentType)
+}
+
+// add converts the metric and adds its data points to the batch.
+func (oe *OTLPEmitter) add(batch *otlpBatch, metric Metric, now time.Time) error {
+	attrs := otlpAttributes(metric.attributes)
+	nowNano := uint64(now.UnixNano())
+
+	switch metric.metricType {
+	case metricType_GAUGE:
+		value, ok := metric.value.(float64)
+		if !ok {
+			return fmt.Errorf("unknown gauge metric type for %q: %T", metric.name, metric.value)
+		}
+		batch.gauge(metric.name).DataPoints = append(batch.gauge(metric.name).DataPoints, &metricsv1.NumberDataPoint{
+			Attributes:   attrs,
+			TimeUnixNano: nowNano,
+			Value:        &metricsv1.NumberDataPoint_AsDouble{AsDouble: value},
+		})
+	case metricType_COUNTER:
+		value, ok := metric.value.(float64)
+		if !ok {
+			return fmt.Errorf("unknown counter metric type for %q: %T", metric.name, metric.value)
+		}
+		start := oe.startTimes.start(metric.name, metric.attributes, value, now)
+		if oe.delta {
+			count, ok := oe.deltaCalculator.CountMetric(metric.name, metric.attributes, value, now)
+			if !ok {
+				return nil
+			}
+			value, start = count.Value, count.Timestamp
+		}
+		sum := batch.sum(metric.name, oe.temporality())
+		sum.DataPoints = append(sum.DataPoints, &metricsv1.NumberDataPoint{
+			Attributes:        attrs,
+			StartTimeUnixNano: uint64(start.UnixNano()),
+			TimeUnixNano:      nowNano,
+			Value:             &metricsv1.NumberDataPoint_AsDouble{AsDouble: value},
+			Exemplars:         otlpExemplars(metric.exemplar),
+		})
+	case metricType_SUMMARY:
+		summary, ok := metric.value.(*dto.Summary)
+		if !ok {
+			return fmt.Errorf("unknown summary metric type for %q: %T", metric.name, metric.value)
+		}
+		// OTLP summaries are always cumulative.
+		start := oe.startTimes.start(metric.name, metric.attributes, float64(summary.GetSampleCount()), now)
+		dp := &metricsv1.SummaryDataPoint{
+			Attributes:        attrs,
+			StartTimeUnixNano: uint64(start.UnixNano()),
+			TimeUnixNano:      nowNano,
+			Count:             summary.GetSampleCount(),
+			Sum:               summary.GetSampleSum(),
+		}
+		for _, q := range summary.GetQuantile() {
+			dp.QuantileValues = append(dp.QuantileValues, &metricsv1.SummaryDataPoint_ValueAtQuantile{
+				Quantile: q.GetQuantile(),
+				Value:    q.GetValue(),
+			})
+		}
+		s := batch.summary(metric.name)
+		s.DataPoints = append(s.DataPoints, dp)
+	case metricType_HISTOGRAM:
+		hist, ok := metric.value.(*dto.Histogram)
+		if !ok {
+			return fmt.Errorf("unknown histogram metric type for %q: %T", metric.name, metric.value)
+		}
+		dp, ok := oe.histogramDataPoint(metric, hist, now)
+		if !ok {
+			return nil
+		}
+		dp.Attributes = attrs
+		dp.TimeUnixNano = nowNano
+		h := batch.histogram(metric.name, oe.temporality())
+		h.DataPoints = append(h.DataPoints, dp)
+	default:
+		return fmt.Errorf("unknown metric type %q", metric.metricType)
+	}
+
+	batch.dataPoints++
+	return nil
+}
+
+func (oe *OTLPEmitter) temporality() metricsv1.AggregationTemporality {
+	if oe.delta {
+		return metricsv1.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA
+	}
+	return metricsv1.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE
+}
+
+// histogramDataPoint converts the cumulative buckets of a Prometheus
+// histogram into the bucket counts of an OTLP histogram. It returns false if
+// the delta temporality is used and there are no previous values yet.
+func (oe *OTLPEmitter) histogramDataPoint(metric Metric, hist *dto.Histogram, now time.Time) (*metricsv1.HistogramDataPoint, bool) {
+	count, sum := float64(hist.GetSampleCount()), hist.GetSampleSum()
+	start := oe.startTimes.start(metric.name, metric.attributes, count, now)
+
+	cumulativeCounts := make([]float64, 0, len(hist.GetBucket()))
+	bounds := make([]float64, 0, len(hist.GetBucket()))
+	var exemplars []*metricsv1.Exemplar
+	for _, b := range hist.GetBucket() {
+		if math.IsInf(b.GetUpperBound(), 1) {
+			continue
+		}
+		bounds = append(bounds, b.GetUpperBound())
+		cumulativeCounts = append(cumulativeCounts, float64(b.GetCumulativeCount()))
+		exemplars = append(exemplars, otlpExemplars(newExemplar(b.GetExemplar()))...)
+	}
+
+	if oe.delta {
+		countDelta, ok := oe.deltaCalculator.CountMetric(metric.name+"_count", metric.attributes, count, now)
+		sumDelta, sumOk := oe.deltaCalculator.CountMetric(metric.name+"_sum", metric.attributes, sum, now)
+		ok = ok && sumOk
+		for i, bound := range bounds {
+			bucketAttrs := copyAttrs(metric.attributes)
+			bucketAttrs["le"] = fmt.Sprintf("%g", bound)
+			bucketDelta, bucketOk := oe.deltaCalculator.CountMetric(metric.name+"_bucket", bucketAttrs, cumulativeCounts[i], now)
+			ok = ok && bucketOk
+			cumulativeCounts[i] = bucketDelta.Value
+		}
+		if !ok {
+			return nil, false
+		}
+		count, sum, start = countDelta.Value, sumDelta.Value, countDelta.Timestamp
+	}
+
+	// OTLP buckets hold the count of their own range, and the last one is
+	// the overflow bucket.
+	bucketCounts := make([]uint64, len(bounds)+1)
+	previous := 0.0
+	for i, c := range cumulativeCounts {
+		bucketCounts[i] = uint64(math.Max(c-previous, 0))
+		previous = c
+	}
+	bucketCounts[len(bounds)] = uint64(math.Max(count-previous, 0))
+
+	return &metricsv1.HistogramDataPoint{
+		StartTimeUnixNano: uint64(start.UnixNano()),
+		Count:             uint64(count),
+		Sum:               proto.Float64(sum),
+		BucketCounts:      bucketCounts,
+		ExplicitBounds:    bounds,
+		Exemplars:         exemplars,
+	}, true
+}
+
+// otlpBatch groups the data points of the metrics with the same name and
+// type sent in a request.
+type otlpBatch struct {
+	metrics    []*metricsv1.Metric
+	byName     map[string]*metricsv1.Metric
+	dataPoints int
+}
+
+func newOTLPBatch() *otlpBatch {
+	return &otlpBatch{byName: map[string]*metricsv1.Metric{}}
+}
+
+// metric returns the metric with the name and kind of data, creating it
+// with newData if it's not in the batch yet.
+func (b *otlpBatch) metric(name, kind string, newData func() *metricsv1.Metric) *metricsv1.Metric {
+	key := kind + ":" + name
+	m, ok := b.byName[key]
+	if !ok {
+		m = newData()
+		m.Name = name
+		b.byName[key] = m
+		b.metrics = append(b.metrics, m)
+	}
+	return m
+}
+
+func (b *otlpBatch) gauge(name string) *metricsv1.Gauge {
+	return b.metric(name, "gauge", func() *metricsv1.Metric {
+		return &metricsv1.Metric{Data: &metricsv1.Metric_Gauge{Gauge: &metricsv1.Gauge{}}}
+	}).GetGauge()
+}
+
+func (b *otlpBatch) sum(name string, temporality metricsv1.AggregationTemporality) *metricsv1.Sum {
+	return b.metric(name, "sum", func() *metricsv1.Metric {
+		return &metricsv1.Metric{Data: &metricsv1.Metric_Sum{Sum: &metricsv1.Sum{
+			AggregationTemporality: temporality,
+			IsMonotonic:            true,
+		}}}
+	}).GetSum()
+}
+
+func (b *otlpBatch) summary(name string) *metricsv1.Summary {
+	return b.metric(name, "summary", func() *metricsv1.Metric {
+		return &metricsv1.Metric{Data: &metricsv1.Metric_Summary{Summary: &metricsv1.Summary{}}}
+	}).GetSummary()
+}
+
+func (b *otlpBatch) histogram(name string, temporality metricsv1.AggregationTemporality) *metricsv1.Histogram {
+	return b.metric(name, "histogram", func() *metricsv1.Metric {
+		return &metricsv1.Metric{Data: &metricsv1.Metric_Histogram{Histogram: &metricsv1.Histogram{
+			AggregationTemporality: temporality,
+		}}}
+	}).GetHistogram()
+}
+
+// otlpAttributes converts the attributes into OTLP key-values, sorted by
+// their names.
+func otlpAttributes(attrs labels.Set) []*commonv1.KeyValue {
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	kvs := make([]*commonv1.KeyValue, 0, len(names))
+	for _, name := range names {
+		kvs = append(kvs, &commonv1.KeyValue{Key: name, Value: otlpValue(attrs[name])})
+	}
+	return kvs
+}
+
+func otlpValue(v interface{}) *commonv1.AnyValue {
+	switch value := v.(type) {
+	case string:
+		return &commonv1.AnyValue{Value: &commonv1.AnyValue_StringValue{StringValue: value}}
+	case bool:
+		return &commonv1.AnyValue{Value: &commonv1.AnyValue_BoolValue{BoolValue: value}}
+	case int:
+		return &commonv1.AnyValue{Value: &commonv1.AnyValue_IntValue{IntValue: int64(value)}}
+	case int64:
+		return &commonv1.AnyValue{Value: &commonv1.AnyValue_IntValue{IntValue: value}}
+	case float64:
+		return &commonv1.AnyValue{Value: &commonv1.AnyValue_DoubleValue{DoubleValue: value}}
+	default:
+		return &commonv1.AnyValue{Value: &commonv1.AnyValue_StringValue{StringValue: fmt.Sprint(value)}}
+	}
+}
+
+// otlpExemplars converts the exemplar, taking the trace and span IDs from
+// its labels when they are valid hexadecimal IDs.
+func otlpExemplars(exemplar *Exemplar) []*metricsv1.Exemplar {
+	if exemplar == nil {
+		return nil
+	}
+
+	e := &metricsv1.Exemplar{Value: &metricsv1.Exemplar_AsDouble{AsDouble: exemplar.Value}}
+	if !exemplar.Timestamp.IsZero() {
+		e.TimeUnixNano = uint64(exemplar.Timestamp.UnixNano())
+	}
+	filtered := labels.Set{}
+	for name, value := range exemplar.Labels {
+		filtered[name] = value
+	}
+	if traceID, name, ok := exemplarID(exemplar.Labels, exemplarTraceLabels, 16); ok {
+		e.TraceId = traceID
+		delete(filtered, name)
+	}
+	if spanID, name, ok := exemplarID(exemplar.Labels, exemplarSpanLabels, 8); ok {
+		e.SpanId = spanID
+		delete(filtered, name)
+	}
+	e.FilteredAttributes = otlpAttributes(filtered)
+	return []*metricsv1.Exemplar{e}
+}
+
+// exemplarID returns the decoded ID from the first of the labels the
+// exemplar has, and the name of that label.
+func exemplarID(exemplarLabels labels.Set, names []string, size int) ([]byte, string, bool) {
+	for _, name := range names {
+		value, ok := exemplarLabels[name]
+		if !ok {
+			continue
+		}
+		id, err := hex.DecodeString(fmt.Sprint(value))
+		if err != nil || len(id) != size {
+			return nil, "", false
+		}
+		return id, name, true
+	}
+	return nil, "", false
+}
+
+// startTimes tracks when the cumulative series started, which is the first
+// time they are seen or the last time their value decreased.
+type startTimes struct {
+	lock          sync.Mutex
+	series        map[string]seriesStart
+	expirationAge time.Duration
+	lastClean     time.Time
+}
+
+type seriesStart struct {
+	start time.Time
+	seen  time.Time
+	value float64
+}
+
+func newStartTimes(expirationAge time.Duration) *startTimes {
+	return &startTimes{
+		series:        map[string]seriesStart{},
+		expirationAge: expirationAge,
+	}
+}
+
+// start returns the start time of the series, and records its value.
+func (s *startTimes) start(name string, attrs labels.Set, value float64, now time.Time) time.Time {
+	// encoding/json sorts the keys of the maps, so the same attributes always
+	// give the same key.
+	attrsJSON, _ := json.Marshal(attrs)
+	key := name + "\x00" + string(attrsJSON)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if now.Sub(s.lastClean) > s.expirationAge {
+		cutoff := now.Add(-s.expirationAge)
+		for k, v := range s.series {
+			if v.seen.Before(cutoff) {
+				delete(s.series, k)
+			}
+		}
+		s.lastClean = now
+	}
+
+	series, ok := s.series[key]
+	if !ok || value < series.value {
+		series.start = now
+	}
+	series.seen = now
+	series.value = value
+	s.series[key] = series
+	return series.start
+}
@@ -0,0 +1,291 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"compress/gzip"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	commonv1 "go.opentelemetry.io/proto/otlp/common/v1"
+	metricsv1 "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+// otlpReceiver is an OTLP/HTTP receiver keeping the received requests.
+type otlpReceiver struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	requests []*metricsv1.MetricsData
+	headers  []http.Header
+	// statuses are returned to the first requests, before responding 200.
+	statuses []int
+}
+
+func newOTLPReceiver(t *testing.T, statuses ...int) *otlpReceiver {
+	t.Helper()
+
+	r := &otlpReceiver{statuses: statuses}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+
+		r.headers = append(r.headers, req.Header.Clone())
+		if len(r.statuses) > 0 {
+			status := r.statuses[0]
+			r.statuses = r.statuses[1:]
+			w.WriteHeader(status)
+			return
+		}
+
+		var body io.Reader = req.Body
+		if req.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(req.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			body = zr
+		}
+		payload, err := io.ReadAll(body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		md := &metricsv1.MetricsData{}
+		if err := proto.Unmarshal(payload, md); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.requests = append(r.requests, md)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+// received returns the metrics of all the received requests by name.
+func (r *otlpReceiver) received() map[string]*metricsv1.Metric {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	metrics := map[string]*metricsv1.Metric{}
+	for _, md := range r.requests {
+		for _, rm := range md.GetResourceMetrics() {
+			for _, sm := range rm.GetScopeMetrics() {
+				for _, m := range sm.GetMetrics() {
+					metrics[m.GetName()] = m
+				}
+			}
+		}
+	}
+	return metrics
+}
+
+func otlpTestMetrics(requests float64, bucketCounts ...uint64) []Metric {
+	return []Metric{
+		{
+			name:       "temperature",
+			metricType: metricType_GAUGE,
+			value:      21.5,
+			attributes: labels.Set{"room": "kitchen"},
+		},
+		{
+			name:       "http_requests_total",
+			metricType: metricType_COUNTER,
+			value:      requests,
+			attributes: labels.Set{"code": "200"},
+			exemplar: &Exemplar{
+				Labels: labels.Set{"trace_id": "4bf92f3577b34da6a3ce929d0e0e4736", "user": "john"},
+				Value:  1,
+			},
+		},
+		{
+			name:       "rpc_duration_seconds",
+			metricType: metricType_SUMMARY,
+			value: &dto.Summary{
+				SampleCount: proto.Uint64(10),
+				SampleSum:   proto.Float64(3.5),
+				Quantile:    []*dto.Quantile{{Quantile: proto.Float64(0.5), Value: proto.Float64(0.2)}},
+			},
+			attributes: labels.Set{},
+		},
+		{
+			name:       "http_duration_seconds",
+			metricType: metricType_HISTOGRAM,
+			value: &dto.Histogram{
+				SampleCount: proto.Uint64(bucketCounts[2]),
+				SampleSum:   proto.Float64(float64(bucketCounts[2])),
+				Bucket: []*dto.Bucket{
+					{UpperBound: proto.Float64(0.1), CumulativeCount: proto.Uint64(bucketCounts[0])},
+					{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(bucketCounts[1])},
+					{UpperBound: proto.Float64(math.Inf(1)), CumulativeCount: proto.Uint64(bucketCounts[2])},
+				},
+			},
+			attributes: labels.Set{},
+		},
+	}
+}
+
+func TestOTLPEmitter_Cumulative(t *testing.T) {
+	t.Parallel()
+
+	receiver := newOTLPReceiver(t)
+	emitter, err := NewOTLPEmitter(OTLPEmitterConfig{
+		Endpoint:           receiver.URL + "/v1/metrics",
+		Headers:            map[string]string{"Authorization": "Bearer token"},
+		ResourceAttributes: map[string]string{"k8s.cluster.name": "production"},
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, emitter.Emit(otlpTestMetrics(10, 2, 5, 6)))
+	time.Sleep(time.Millisecond)
+	require.NoError(t, emitter.Emit(otlpTestMetrics(15, 3, 7, 9)))
+
+	require.Len(t, receiver.requests, 2)
+	assert.Equal(t, "Bearer token", receiver.headers[0].Get("Authorization"))
+	assert.Equal(t, "application/x-protobuf", receiver.headers[0].Get("Content-Type"))
+	assert.Equal(t, "gzip", receiver.headers[0].Get("Content-Encoding"))
+
+	resource := receiver.requests[0].GetResourceMetrics()[0].GetResource()
+	assert.Equal(t, labels.Set{"service.name": "nri-prometheus", "k8s.cluster.name": "production"}, otlpTestAttributes(resource.GetAttributes()))
+
+	metrics := receiver.received()
+
+	gauge := metrics["temperature"].GetGauge().GetDataPoints()[0]
+	assert.Equal(t, 21.5, gauge.GetAsDouble())
+	assert.Equal(t, labels.Set{"room": "kitchen"}, otlpTestAttributes(gauge.GetAttributes()))
+
+	sum := metrics["http_requests_total"].GetSum()
+	assert.Equal(t, metricsv1.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE, sum.GetAggregationTemporality())
+	assert.True(t, sum.GetIsMonotonic())
+	counter := sum.GetDataPoints()[0]
+	assert.Equal(t, 15.0, counter.GetAsDouble())
+	assert.Less(t, counter.GetStartTimeUnixNano(), counter.GetTimeUnixNano())
+	require.Len(t, counter.GetExemplars(), 1)
+	assert.Len(t, counter.GetExemplars()[0].GetTraceId(), 16)
+	assert.Equal(t, labels.Set{"user": "john"}, otlpTestAttributes(counter.GetExemplars()[0].GetFilteredAttributes()))
+
+	summary := metrics["rpc_duration_seconds"].GetSummary().GetDataPoints()[0]
+	assert.Equal(t, uint64(10), summary.GetCount())
+	assert.Equal(t, 3.5, summary.GetSum())
+	assert.Equal(t, 0.2, summary.GetQuantileValues()[0].GetValue())
+
+	hist := metrics["http_duration_seconds"].GetHistogram()
+	assert.Equal(t, metricsv1.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE, hist.GetAggregationTemporality())
+	assert.Equal(t, []float64{0.1, 1}, hist.GetDataPoints()[0].GetExplicitBounds())
+	assert.Equal(t, []uint64{3, 4, 2}, hist.GetDataPoints()[0].GetBucketCounts())
+	assert.Equal(t, uint64(9), hist.GetDataPoints()[0].GetCount())
+}
+
+func TestOTLPEmitter_Delta(t *testing.T) {
+	t.Parallel()
+
+	receiver := newOTLPReceiver(t)
+	emitter, err := NewOTLPEmitter(OTLPEmitterConfig{
+		Endpoint:           receiver.URL,
+		Temporality:        OTLPTemporalityDelta,
+		DisableCompression: true,
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, emitter.Emit(otlpTestMetrics(10, 2, 5, 6)))
+	// The counters and histograms need a previous value to calculate the
+	// deltas.
+	metrics := receiver.received()
+	assert.Contains(t, metrics, "temperature")
+	assert.NotContains(t, metrics, "http_requests_total")
+	assert.NotContains(t, metrics, "http_duration_seconds")
+	assert.Empty(t, receiver.headers[0].Get("Content-Encoding"))
+
+	time.Sleep(time.Millisecond)
+	require.NoError(t, emitter.Emit(otlpTestMetrics(15, 3, 7, 9)))
+	metrics = receiver.received()
+
+	sum := metrics["http_requests_total"].GetSum()
+	assert.Equal(t, metricsv1.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA, sum.GetAggregationTemporality())
+	assert.Equal(t, 5.0, sum.GetDataPoints()[0].GetAsDouble())
+
+	hist := metrics["http_duration_seconds"].GetHistogram()
+	assert.Equal(t, metricsv1.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA, hist.GetAggregationTemporality())
+	assert.Equal(t, []uint64{1, 1, 1}, hist.GetDataPoints()[0].GetBucketCounts())
+	assert.Equal(t, uint64(3), hist.GetDataPoints()[0].GetCount())
+	assert.Equal(t, 3.0, hist.GetDataPoints()[0].GetSum())
+}
+
+func TestOTLPEmitter_Batches(t *testing.T) {
+	t.Parallel()
+
+	receiver := newOTLPReceiver(t)
+	emitter, err := NewOTLPEmitter(OTLPEmitterConfig{Endpoint: receiver.URL, BatchSize: 2})
+	require.NoError(t, err)
+
+	var metrics []Metric
+	for i := 0; i < 5; i++ {
+		metrics = append(metrics, Metric{name: "up", metricType: metricType_GAUGE, value: 1.0, attributes: labels.Set{"i": i}})
+	}
+	require.NoError(t, emitter.Emit(metrics))
+
+	require.Len(t, receiver.requests, 3)
+	dataPoints := 0
+	for _, md := range receiver.requests {
+		// The data points of the same metric are grouped.
+		ms := md.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()
+		require.Len(t, ms, 1)
+		dataPoints += len(ms[0].GetGauge().GetDataPoints())
+	}
+	assert.Equal(t, 5, dataPoints)
+}
+
+func TestOTLPEmitter_Retries(t *testing.T) {
+	t.Parallel()
+
+	receiver := newOTLPReceiver(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	emitter, err := NewOTLPEmitter(OTLPEmitterConfig{Endpoint: receiver.URL, RetryBackoff: time.Millisecond})
+	require.NoError(t, err)
+
+	require.NoError(t, emitter.Emit([]Metric{{name: "up", metricType: metricType_GAUGE, value: 1.0, attributes: labels.Set{}}}))
+	assert.Len(t, receiver.headers, 3)
+	assert.Len(t, receiver.requests, 1)
+}
+
+func TestOTLPEmitter_DoesNotRetryPermanentErrors(t *testing.T) {
+	t.Parallel()
+
+	receiver := newOTLPReceiver(t, http.StatusBadRequest)
+	emitter, err := NewOTLPEmitter(OTLPEmitterConfig{Endpoint: receiver.URL, RetryBackoff: time.Millisecond})
+	require.NoError(t, err)
+
+	err = emitter.Emit([]Metric{{name: "up", metricType: metricType_GAUGE, value: 1.0, attributes: labels.Set{}}})
+	assert.Error(t, err)
+	assert.Len(t, receiver.headers, 1)
+}
+
+func TestNewOTLPEmitter_InvalidConfig(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewOTLPEmitter(OTLPEmitterConfig{Temporality: "sometimes"})
+	assert.Error(t, err)
+
+	_, err = NewOTLPEmitter(OTLPEmitterConfig{Endpoint: "not a url"})
+	assert.Error(t, err)
+}
+
+func otlpTestAttributes(kvs []*commonv1.KeyValue) labels.Set {
+	attrs := labels.Set{}
+	for _, kv := range kvs {
+		attrs[kv.GetKey()] = kv.GetValue().GetStringValue()
+	}
+	return attrs
+}
@@ -0,0 +1,244 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Overflow policies of the QueuedEmitter, applied when its queue is full.
+const (
+	// QueueOverflowBlock waits until there is room in the queue, which
+	// slows down the pipeline as before the queues were added.
+	QueueOverflowBlock = "block"
+	// QueueOverflowDropOldest drops the oldest batch of the queue.
+	QueueOverflowDropOldest = "drop_oldest"
+	// QueueOverflowDropNewest drops the batch being queued.
+	QueueOverflowDropNewest = "drop_newest"
+)
+
+const defaultEmitterQueueCapacity = 100
+
+// EmitterQueueConfig is the configuration of the queue of an emitter.
+type EmitterQueueConfig struct {
+	// Capacity is the number of batches of metrics, one per target, that
+	// can wait to be emitted. Defaults to 100.
+	Capacity int `mapstructure:"capacity"`
+	// Overflow is the policy applied when the queue is full,
+	// QueueOverflowBlock, QueueOverflowDropOldest or QueueOverflowDropNewest.
+	// Defaults to block.
+	Overflow string `mapstructure:"overflow"`
+}
+
+// queuedBatch is a batch of metrics waiting to be emitted.
+type queuedBatch struct {
+	pair TargetMetrics
+	// withTarget is false for the batches queued by Emit, whose target is
+	// unknown.
+	withTarget bool
+}
+
+// QueuedEmitter emits the metrics with its own worker, so a slow emitter
+// doesn't stall the fetching and processing of the metrics or the other
+// emitters. The metrics wait in a bounded queue, and the batches that can't
+// be queued are dropped according to the overflow policy. The errors of the
+// emitter are logged by the worker.
+type QueuedEmitter struct {
+	Emitter
+	instance string
+	overflow string
+	queue    chan queuedBatch
+	// pending counts the queued batches that haven't been emitted or
+	// dropped yet.
+	pending sync.WaitGroup
+	// lock guards the queue from being closed while a batch is queued, and
+	// closed drops the batches queued after closing it.
+	lock    sync.RWMutex
+	closed  bool
+	stopped chan struct{}
+	depth   prometheus.Gauge
+	dropped prometheus.Counter
+}
+
+// NewQueuedEmitter returns the emitter wrapped in a QueuedEmitter and starts
+// its worker, or an error if the overflow policy is not valid. The instance
+// is the unique name of the emitter labelling the queue metrics and logs,
+// which defaults to its name.
+func NewQueuedEmitter(e Emitter, instance string, cfg EmitterQueueConfig) (*QueuedEmitter, error) {
+	if instance == "" {
+		instance = e.Name()
+	}
+	overflow := cfg.Overflow
+	switch overflow {
+	case "":
+		overflow = QueueOverflowBlock
+	case QueueOverflowBlock, QueueOverflowDropOldest, QueueOverflowDropNewest:
+	default:
+		return nil, fmt.Errorf("invalid queue overflow policy %q of the %s emitter, must be %q, %q or %q",
+			cfg.Overflow, instance, QueueOverflowBlock, QueueOverflowDropOldest, QueueOverflowDropNewest)
+	}
+	capacity := cfg.Capacity
+	if capacity <= 0 {
+		capacity = defaultEmitterQueueCapacity
+	}
+
+	qe := &QueuedEmitter{
+		Emitter:  e,
+		instance: instance,
+		overflow: overflow,
+		queue:    make(chan queuedBatch, capacity),
+		stopped:  make(chan struct{}),
+		depth:    emitterQueueDepthMetric.WithLabelValues(instance),
+		dropped:  emitterDroppedBatchesMetric.WithLabelValues(instance),
+	}
+	go qe.run()
+	return qe, nil
+}
+
+// Unwrap returns the queued emitter.
+func (qe *QueuedEmitter) Unwrap() Emitter {
+	return qe.Emitter
+}
+
+// Emit queues the metrics. It never fails, the errors are logged when the
+// metrics are emitted.
+func (qe *QueuedEmitter) Emit(metrics []Metric) error {
+	qe.enqueue(queuedBatch{pair: TargetMetrics{Metrics: metrics}})
+	return nil
+}
+
+// EmitTarget queues the metrics of the target.
+func (qe *QueuedEmitter) EmitTarget(pair TargetMetrics) error {
+	qe.enqueue(queuedBatch{pair: pair, withTarget: true})
+	return nil
+}
+
+// Flush waits until the queued metrics are emitted. It must not be called
+// while other goroutines are queueing metrics.
+func (qe *QueuedEmitter) Flush() {
+	qe.pending.Wait()
+}
+
+// Close closes the queue, waits until the worker emits the queued metrics,
+// and closes the queued emitter if it needs it. The batches queued
+// afterwards are dropped, so the metrics producers should be stopped first.
+func (qe *QueuedEmitter) Close() error {
+	qe.lock.Lock()
+	if !qe.closed {
+		qe.closed = true
+		close(qe.queue)
+	}
+	qe.lock.Unlock()
+	<-qe.stopped
+	return closeEmitter(qe.Emitter)
+}
+
+func (qe *QueuedEmitter) enqueue(b queuedBatch) {
+	qe.lock.RLock()
+	defer qe.lock.RUnlock()
+	qe.pending.Add(1)
+	if qe.closed {
+		ilog.WithField("emitter", qe.instance).Warn("dropping metrics queued after closing the emitter")
+		qe.drop()
+		return
+	}
+	switch qe.overflow {
+	case QueueOverflowBlock:
+		qe.queue <- b
+	case QueueOverflowDropNewest:
+		select {
+		case qe.queue <- b:
+		default:
+			qe.drop()
+		}
+	case QueueOverflowDropOldest:
+	enqueue:
+		for {
+			select {
+			case qe.queue <- b:
+				break enqueue
+			default:
+			}
+			// The worker may have taken the oldest batch in the meantime.
+			select {
+			case <-qe.queue:
+				qe.drop()
+			default:
+			}
+		}
+	}
+	qe.depth.Set(float64(len(qe.queue)))
+}
+
+func (qe *QueuedEmitter) drop() {
+	qe.dropped.Inc()
+	qe.pending.Done()
+}
+
+func (qe *QueuedEmitter) run() {
+	defer close(qe.stopped)
+	for b := range qe.queue {
+		qe.depth.Set(float64(len(qe.queue)))
+		var err error
+		if b.withTarget {
+			err = emitTarget(qe.Emitter, b.pair)
+		} else {
+			err = qe.Emitter.Emit(b.pair.Metrics)
+		}
+		if err != nil {
+			ilog.WithField("emitter", qe.instance).WithError(err).Warn("error emitting metrics")
+		}
+		qe.pending.Done()
+	}
+}
+
+// flushEmitters waits until the queued emitters emit their queued metrics.
+func flushEmitters(emitters []Emitter) {
+	for _, e := range emitters {
+		for {
+			if qe, ok := e.(*QueuedEmitter); ok {
+				qe.Flush()
+				break
+			}
+			u, ok := e.(interface{ Unwrap() Emitter })
+			if !ok {
+				break
+			}
+			e = u.Unwrap()
+		}
+	}
+}
+
+// CloseEmitters closes the queues of the queued emitters once their metrics
+// are emitted, and closes the emitters that need it, e.g. to save their
+// state before exiting. The emitters can't be used afterwards, so it must be
+// called once Execute returns.
+func CloseEmitters(emitters []Emitter) error {
+	var results error
+	for _, e := range emitters {
+		if err := closeEmitter(e); err != nil {
+			results = appendError(results, fmt.Errorf("%s: %w", e.Name(), err))
+		}
+	}
+	return results
+}
+
+// closeEmitter closes the emitter, or the one it wraps, if it needs to be
+// closed.
+func closeEmitter(e Emitter) error {
+	for {
+		if c, ok := e.(io.Closer); ok {
+			return c.Close()
+		}
+		u, ok := e.(interface{ Unwrap() Emitter })
+		if !ok {
+			return nil
+		}
+		e = u.Unwrap()
+	}
+}
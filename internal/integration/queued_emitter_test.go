@@ -0,0 +1,264 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+// gatedEmitter blocks every emit until it's released.
+type gatedEmitter struct {
+	name    string
+	started chan struct{}
+	release chan struct{}
+	lock    sync.Mutex
+	emitted []string
+}
+
+func newGatedEmitter(name string) *gatedEmitter {
+	return &gatedEmitter{name: name, started: make(chan struct{}, 100), release: make(chan struct{})}
+}
+
+func (ge *gatedEmitter) Name() string {
+	return ge.name
+}
+
+func (ge *gatedEmitter) Emit(metrics []Metric) error {
+	ge.started <- struct{}{}
+	<-ge.release
+	ge.lock.Lock()
+	defer ge.lock.Unlock()
+	for _, m := range metrics {
+		ge.emitted = append(ge.emitted, m.name)
+	}
+	return nil
+}
+
+func queuedTestMetrics(name string) []Metric {
+	return []Metric{{name: name, metricType: metricType_GAUGE, value: 1.0, attributes: labels.Set{}}}
+}
+
+// fillQueue emits the batches while the first one is being emitted, so the
+// others wait in the queue.
+func fillQueue(t *testing.T, ge *gatedEmitter, qe *QueuedEmitter, names ...string) {
+	t.Helper()
+
+	require.NoError(t, qe.Emit(queuedTestMetrics(names[0])))
+	<-ge.started
+	for _, name := range names[1:] {
+		require.NoError(t, qe.Emit(queuedTestMetrics(name)))
+	}
+}
+
+func TestQueuedEmitter_Overflow(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		overflow string
+		expected []string
+		dropped  float64
+	}{
+		{overflow: QueueOverflowDropOldest, expected: []string{"a", "d", "e"}, dropped: 2},
+		{overflow: QueueOverflowDropNewest, expected: []string{"a", "b", "c"}, dropped: 2},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.overflow, func(t *testing.T) {
+			t.Parallel()
+
+			ge := newGatedEmitter("queued-" + tc.overflow)
+			dropped := testutil.ToFloat64(emitterDroppedBatchesMetric.WithLabelValues(ge.name))
+			qe, err := NewQueuedEmitter(ge, "", EmitterQueueConfig{Capacity: 2, Overflow: tc.overflow})
+			require.NoError(t, err)
+
+			fillQueue(t, ge, qe, "a", "b", "c", "d", "e")
+			assert.Equal(t, 2.0, testutil.ToFloat64(emitterQueueDepthMetric.WithLabelValues(ge.name)))
+			assert.Equal(t, dropped+tc.dropped, testutil.ToFloat64(emitterDroppedBatchesMetric.WithLabelValues(ge.name)))
+
+			close(ge.release)
+			qe.Flush()
+			assert.Equal(t, tc.expected, ge.emitted)
+			assert.Equal(t, 0.0, testutil.ToFloat64(emitterQueueDepthMetric.WithLabelValues(ge.name)))
+		})
+	}
+}
+
+func TestQueuedEmitter_Block(t *testing.T) {
+	t.Parallel()
+
+	ge := newGatedEmitter("queued-block")
+	dropped := testutil.ToFloat64(emitterDroppedBatchesMetric.WithLabelValues(ge.name))
+	qe, err := NewQueuedEmitter(ge, "", EmitterQueueConfig{Capacity: 1})
+	require.NoError(t, err)
+
+	fillQueue(t, ge, qe, "a", "b")
+	queued := make(chan struct{})
+	go func() {
+		require.NoError(t, qe.Emit(queuedTestMetrics("c")))
+		close(queued)
+	}()
+	select {
+	case <-queued:
+		t.Fatal("emit should block while the queue is full")
+	default:
+	}
+
+	close(ge.release)
+	<-queued
+	qe.Flush()
+	assert.Equal(t, []string{"a", "b", "c"}, ge.emitted)
+	assert.Equal(t, dropped, testutil.ToFloat64(emitterDroppedBatchesMetric.WithLabelValues(ge.name)))
+}
+
+func TestQueuedEmitter_Instances(t *testing.T) {
+	t.Parallel()
+
+	// Two emitters of the same type are told apart by their instances.
+	first := newGatedEmitter("queued-instances")
+	second := newGatedEmitter("queued-instances")
+	dropped := testutil.ToFloat64(emitterDroppedBatchesMetric.WithLabelValues("queued-instances-2"))
+	qe, err := NewQueuedEmitter(first, "", EmitterQueueConfig{Capacity: 1})
+	require.NoError(t, err)
+	qe2, err := NewQueuedEmitter(second, "queued-instances-2", EmitterQueueConfig{Capacity: 1, Overflow: QueueOverflowDropNewest})
+	require.NoError(t, err)
+
+	fillQueue(t, second, qe2, "a", "b", "c")
+	assert.Equal(t, 0.0, testutil.ToFloat64(emitterQueueDepthMetric.WithLabelValues("queued-instances")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(emitterQueueDepthMetric.WithLabelValues("queued-instances-2")))
+	assert.Equal(t, dropped+1, testutil.ToFloat64(emitterDroppedBatchesMetric.WithLabelValues("queued-instances-2")))
+
+	close(first.release)
+	close(second.release)
+	qe.Flush()
+	qe2.Flush()
+}
+
+func TestQueuedEmitter_EmitTarget(t *testing.T) {
+	t.Parallel()
+
+	re := &recordingEmitter{}
+	fe, err := NewFilteredEmitter(re, EmitterFilter{Include: &EmitterSelector{MetricNames: []string{"redis_up"}}})
+	require.NoError(t, err)
+	qe, err := NewQueuedEmitter(fe, "", EmitterQueueConfig{})
+	require.NoError(t, err)
+
+	// The target of the metrics is kept in the queue.
+	require.NoError(t, emitTarget(qe, filterTestMetrics(t)))
+	flushEmitters([]Emitter{qe})
+	assert.Equal(t, [][]string{{"redis_up"}}, re.emits)
+	assert.Same(t, re, UnwrapEmitter(qe))
+}
+
+func TestNewQueuedEmitter_InvalidOverflow(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewQueuedEmitter(&recordingEmitter{}, "", EmitterQueueConfig{Overflow: "drop_all"})
+	assert.Error(t, err)
+}
+
+// countingFetcher returns a gauge for every target, and counts them.
+type countingFetcher struct {
+	fetched atomic.Int64
+}
+
+func (cf *countingFetcher) Fetch(targets []endpoints.Target) <-chan TargetMetrics {
+	pairs := make(chan TargetMetrics, len(targets))
+	for _, target := range targets {
+		cf.fetched.Add(1)
+		pairs <- TargetMetrics{Target: target, Metrics: queuedTestMetrics("up")}
+	}
+	close(pairs)
+	return pairs
+}
+
+// shutdownEmitter counts the emits, and the ones after being closed.
+type shutdownEmitter struct {
+	lock        sync.Mutex
+	emits       int
+	afterClose  int
+	closed      bool
+	firstEmits  chan struct{}
+	signalEmits int
+}
+
+func (*shutdownEmitter) Name() string {
+	return "shutdown"
+}
+
+func (se *shutdownEmitter) Emit([]Metric) error {
+	// Emitting slowly keeps the queue busy while shutting down.
+	time.Sleep(time.Millisecond)
+	se.lock.Lock()
+	defer se.lock.Unlock()
+	se.emits++
+	if se.closed {
+		se.afterClose++
+	}
+	if se.emits == se.signalEmits {
+		close(se.firstEmits)
+	}
+	return nil
+}
+
+func (se *shutdownEmitter) Close() error {
+	se.lock.Lock()
+	defer se.lock.Unlock()
+	se.closed = true
+	return nil
+}
+
+func TestExecute_CloseEmittersOnShutdown(t *testing.T) {
+	t.Parallel()
+
+	var urls []string
+	for i := 0; i < 20; i++ {
+		urls = append(urls, "http://localhost:"+strconv.Itoa(9000+i)+"/metrics")
+	}
+	retriever, err := endpoints.FixedRetriever(endpoints.TargetConfig{URLs: urls})
+	require.NoError(t, err)
+	selfRetriever, err := endpoints.FixedRetriever(endpoints.TargetConfig{URLs: []string{"http://localhost:8080/metrics"}})
+	require.NoError(t, err)
+
+	se := &shutdownEmitter{firstEmits: make(chan struct{}), signalEmits: 30}
+	qe, err := NewQueuedEmitter(se, "", EmitterQueueConfig{Capacity: 5})
+	require.NoError(t, err)
+	fetcher := &countingFetcher{}
+
+	ctx, stop := context.WithCancel(context.Background())
+	executed := make(chan struct{})
+	go func() {
+		defer close(executed)
+		Execute(ctx, time.Millisecond, selfRetriever, []endpoints.TargetRetriever{retriever}, fetcher, RuleProcessor(nil, queueLength), []Emitter{qe})
+	}()
+
+	// The integration is stopped while the metrics are being queued.
+	<-se.firstEmits
+	stop()
+	<-executed
+	require.NoError(t, CloseEmitters([]Emitter{qe}))
+
+	se.lock.Lock()
+	defer se.lock.Unlock()
+	assert.True(t, se.closed)
+	assert.Zero(t, se.afterClose)
+	// All the fetched metrics are emitted before closing the emitter.
+	assert.Equal(t, int(fetcher.fetched.Load()), se.emits)
+
+	// The metrics queued after closing the emitter are dropped.
+	require.NoError(t, qe.Emit(queuedTestMetrics("late")))
+	qe.Flush()
+	assert.Equal(t, int(fetcher.fetched.Load()), se.emits)
+}
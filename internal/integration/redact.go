@@ -0,0 +1,69 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+)
+
+// defaultRedactReplacement replaces the redacted values when a
+// RedactAttributesRule has no Replacement.
+const defaultRedactReplacement = "xxxxx"
+
+// redactRule is the compiled form of a RedactAttributesRule.
+type redactRule struct {
+	metricPrefix string
+	attributes   []string
+	// pattern is nil if the whole value must be replaced.
+	pattern     *regexp.Regexp
+	hash        bool
+	salt        string
+	replacement string
+}
+
+// compileRedactRule returns the compiled rule, or an error if its pattern is
+// not valid.
+func compileRedactRule(rr RedactAttributesRule) (redactRule, error) {
+	rule := redactRule{
+		metricPrefix: rr.MetricPrefix,
+		attributes:   rr.Attributes,
+		hash:         rr.Hash,
+		salt:         rr.Salt,
+		replacement:  rr.Replacement,
+	}
+	if rule.replacement == "" {
+		rule.replacement = defaultRedactReplacement
+	}
+	if rr.Pattern != "" {
+		re, err := regexp.Compile(rr.Pattern)
+		if err != nil {
+			return rule, fmt.Errorf("invalid redact pattern %q: %w", rr.Pattern, err)
+		}
+		rule.pattern = re
+	}
+	return rule, nil
+}
+
+// redact returns the value with the sensitive parts replaced.
+func (r *redactRule) redact(value string) string {
+	if r.pattern == nil {
+		return r.replace(value)
+	}
+	if r.hash {
+		return r.pattern.ReplaceAllStringFunc(value, r.replace)
+	}
+	return r.pattern.ReplaceAllString(value, r.replacement)
+}
+
+// replace returns the salted hash of the value, or the replacement.
+func (r *redactRule) replace(value string) string {
+	if !r.hash {
+		return r.replacement
+	}
+	sum := sha256.Sum256([]byte(r.salt + value))
+	return hex.EncodeToString(sum[:])
+}
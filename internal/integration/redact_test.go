@@ -0,0 +1,143 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+func saltedHash(salt, value string) string {
+	sum := sha256.Sum256([]byte(salt + value))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestRedactRule(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name     string
+		rule     RedactAttributesRule
+		value    string
+		expected string
+	}{
+		{
+			name:     "whole value",
+			rule:     RedactAttributesRule{},
+			value:    "john@example.com",
+			expected: "xxxxx",
+		},
+		{
+			name:     "whole value with replacement",
+			rule:     RedactAttributesRule{Replacement: "<redacted>"},
+			value:    "john@example.com",
+			expected: "<redacted>",
+		},
+		{
+			name:     "pattern",
+			rule:     RedactAttributesRule{Pattern: `token=[^&]+`, Replacement: "token=xxxxx"},
+			value:    "/api?user=1&token=abc123&page=2",
+			expected: "/api?user=1&token=xxxxx&page=2",
+		},
+		{
+			name:     "pattern with groups",
+			rule:     RedactAttributesRule{Pattern: `([a-z]+)@[a-z.]+`, Replacement: "$1@xxxxx"},
+			value:    "john@example.com",
+			expected: "john@xxxxx",
+		},
+		{
+			name:     "hash",
+			rule:     RedactAttributesRule{Hash: true, Salt: "pepper"},
+			value:    "customer-42",
+			expected: saltedHash("pepper", "customer-42"),
+		},
+		{
+			name:     "hash matching parts",
+			rule:     RedactAttributesRule{Hash: true, Salt: "pepper", Pattern: `customer-\d+`},
+			value:    "orders of customer-42",
+			expected: "orders of " + saltedHash("pepper", "customer-42"),
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			rule, err := compileRedactRule(tc.rule)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, rule.redact(tc.value))
+		})
+	}
+}
+
+func TestRuleProcessor_RedactAttributes(t *testing.T) {
+	t.Parallel()
+
+	processor := RuleProcessor([]ProcessingRule{
+		{
+			RenameAttributes: []RenameRule{{MetricPrefix: "", Attributes: map[string]interface{}{"user": "userEmail"}}},
+			RedactAttributes: []RedactAttributesRule{
+				{MetricPrefix: "http_", Attributes: []string{"user"}, Hash: true, Salt: "pepper"},
+				{MetricPrefix: "", Attributes: []string{"scrapedTargetURL"}, Pattern: `key=[^&]+`, Replacement: "key=xxxxx"},
+			},
+		},
+	}, queueLength)
+
+	u, err := url.Parse("http://localhost:8080/metrics?key=secret")
+	require.NoError(t, err)
+	processed := processTargets(processor, TargetMetrics{
+		Target: endpoints.Target{Name: "app", URL: *u},
+		Metrics: []Metric{
+			{name: "http_requests_total", metricType: metricType_COUNTER, value: 1.0, attributes: labels.Set{"user": "john@example.com"}},
+			{name: "logins_total", metricType: metricType_COUNTER, value: 1.0, attributes: labels.Set{"user": "john@example.com"}},
+		},
+	})
+	require.Len(t, processed, 1)
+
+	redacted := processed[0].Metrics[0].attributes
+	assert.Equal(t, saltedHash("pepper", "john@example.com"), redacted["user"])
+	// The renamed attributes are redacted as well.
+	assert.Equal(t, saltedHash("pepper", "john@example.com"), redacted["userEmail"])
+	assert.Equal(t, "http://localhost:8080/metrics?key=xxxxx", redacted["scrapedTargetURL"])
+
+	// Metrics not matching the prefix are not redacted.
+	assert.Equal(t, "john@example.com", processed[0].Metrics[1].attributes["user"])
+}
+
+func TestValidateProcessingRules_RedactAttributes(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name  string
+		rule  RedactAttributesRule
+		valid bool
+	}{
+		{name: "valid", rule: RedactAttributesRule{Attributes: []string{"user"}, Pattern: "@.*"}, valid: true},
+		{name: "without attributes", rule: RedactAttributesRule{}},
+		{name: "invalid pattern", rule: RedactAttributesRule{Attributes: []string{"user"}, Pattern: "(["}},
+		{name: "hash without salt", rule: RedactAttributesRule{Attributes: []string{"user"}, Hash: true}},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			err := ValidateProcessingRules([]ProcessingRule{{RedactAttributes: []RedactAttributesRule{tc.rule}}})
+			if tc.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
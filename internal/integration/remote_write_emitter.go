@@ -0,0 +1,410 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+const (
+	defaultRemoteWriteShards            = 4
+	defaultRemoteWriteMaxSamplesPerSend = 2000
+	defaultRemoteWriteQueueCapacity     = 10
+	remoteWriteContentType              = "application/x-protobuf"
+	remoteWriteVersion                  = "0.1.0"
+)
+
+// prometheusDroppedAttributes are the attributes with the New Relic type of
+// the metrics, which are redundant in Prometheus.
+var prometheusDroppedAttributes = map[string]struct{}{
+	"nrMetricType":   {},
+	"promMetricType": {},
+}
+
+// RemoteWriteEmitterConfig is the configuration of the RemoteWriteEmitter.
+type RemoteWriteEmitterConfig struct {
+	// URL of the remote write endpoint, e.g.
+	// http://mimir:9009/api/v1/push.
+	URL string
+	// Headers are added to every request, e.g. `X-Scope-OrgID` for
+	// multi-tenant endpoints.
+	Headers map[string]string
+	// Username and Password are sent using basic authentication if Username
+	// is set.
+	Username string
+	Password string
+	// BearerToken is sent in the Authorization header if set.
+	BearerToken string
+	// BearerTokenFile is read on every request and sent in the
+	// Authorization header if set.
+	BearerTokenFile string
+	// Shards is the number of requests sent in parallel. The samples of a
+	// series are always sent by the same shard, so they stay in order.
+	// Defaults to 4.
+	Shards int
+	// MaxSamplesPerSend is the maximum number of samples in each request.
+	// Defaults to 2000.
+	MaxSamplesPerSend int
+	// QueueCapacity is the number of requests each shard queues. Emit
+	// returns once the requests are queued, and it only waits for them to
+	// be sent when the queue of a shard is full. Defaults to 10.
+	QueueCapacity int
+	// Timeout of each request. Defaults to 10s.
+	Timeout time.Duration
+	// MaxRetries is the number of times a request failed with a 5xx or 429
+	// status is retried. Defaults to 3, and a negative value disables the
+	// retries.
+	MaxRetries int
+	// RetryBackoff is the time waited before the first retry, which is
+	// doubled on every retry. Defaults to 1s.
+	RetryBackoff time.Duration
+	TLSConfig    *tls.Config
+	ProxyURL     *url.URL
+}
+
+// RemoteWriteEmitter sends the metrics to a Prometheus remote write 1.0
+// endpoint. Counters and histograms are sent with their cumulative values.
+type RemoteWriteEmitter struct {
+	name              string
+	sender            *httpSender
+	maxSamplesPerSend int
+	shards            []chan remoteWriteRequest
+	// lock guards the shards from being closed while requests are queued,
+	// and running waits for the shards to send the queued requests.
+	lock    sync.RWMutex
+	closed  bool
+	running sync.WaitGroup
+}
+
+// remoteWriteRequest is a request queued in a shard.
+type remoteWriteRequest struct {
+	series []remoteWriteSeries
+}
+
+// remoteWriteSeries is a series with its labels sorted by name, and a single
+// sample.
+type remoteWriteSeries struct {
+	labels    []promLabel
+	value     float64
+	timestamp int64
+}
+
+type promLabel struct {
+	name, value string
+}
+
+// NewRemoteWriteEmitter returns a RemoteWriteEmitter, or an error if its
+// configuration is not valid.
+func NewRemoteWriteEmitter(cfg RemoteWriteEmitterConfig) (*RemoteWriteEmitter, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("the remote write URL is required")
+	}
+	if _, err := url.ParseRequestURI(cfg.URL); err != nil {
+		return nil, fmt.Errorf("invalid remote write URL %q: %w", cfg.URL, err)
+	}
+	auths := 0
+	for _, set := range []bool{cfg.Username != "", cfg.BearerToken != "", cfg.BearerTokenFile != ""} {
+		if set {
+			auths++
+		}
+	}
+	if auths > 1 {
+		return nil, fmt.Errorf("only one of the remote write basic authentication, bearer token and bearer token file can be set")
+	}
+
+	headers := map[string]string{
+		"X-Prometheus-Remote-Write-Version": remoteWriteVersion,
+		"User-Agent":                        "nri-prometheus",
+	}
+	for name, value := range cfg.Headers {
+		headers[name] = value
+	}
+	if cfg.Username != "" {
+		headers["Authorization"] = "Basic " + base64.StdEncoding.EncodeToString([]byte(cfg.Username+":"+cfg.Password))
+	}
+	if cfg.BearerToken != "" {
+		headers["Authorization"] = "Bearer " + cfg.BearerToken
+	}
+
+	client := newHTTPClient(cfg.Timeout, cfg.TLSConfig, cfg.ProxyURL)
+	if cfg.BearerTokenFile != "" {
+		client.Transport = NewBearerAuthFileRoundTripper(cfg.BearerTokenFile, client.Transport)
+	}
+
+	shards := cfg.Shards
+	if shards <= 0 {
+		shards = defaultRemoteWriteShards
+	}
+	maxSamples := cfg.MaxSamplesPerSend
+	if maxSamples <= 0 {
+		maxSamples = defaultRemoteWriteMaxSamplesPerSend
+	}
+	capacity := cfg.QueueCapacity
+	if capacity <= 0 {
+		capacity = defaultRemoteWriteQueueCapacity
+	}
+
+	e := &RemoteWriteEmitter{
+		name: "remote_write",
+		sender: &httpSender{
+			client:            client,
+			url:               cfg.URL,
+			headers:           headers,
+			encoding:          encodingSnappy,
+			retryServerErrors: true,
+			maxRetries:        senderRetries(cfg.MaxRetries),
+			retryBackoff:      senderRetryBackoff(cfg.RetryBackoff),
+		},
+		maxSamplesPerSend: maxSamples,
+		shards:            make([]chan remoteWriteRequest, shards),
+	}
+	e.running.Add(shards)
+	for i := range e.shards {
+		e.shards[i] = make(chan remoteWriteRequest, capacity)
+		go e.runShard(e.shards[i])
+	}
+	return e, nil
+}
+
+// Name is the RemoteWriteEmitter name.
+func (re *RemoteWriteEmitter) Name() string {
+	return re.name
+}
+
+// runShard sends the requests queued in the shard, one at a time, and logs
+// the errors.
+func (re *RemoteWriteEmitter) runShard(queue <-chan remoteWriteRequest) {
+	defer re.running.Done()
+	for req := range queue {
+		if err := re.sender.send(encodeWriteRequest(req.series), remoteWriteContentType); err != nil {
+			ilog.WithField("emitter", re.name).WithError(err).Warn("error sending metrics")
+		}
+	}
+}
+
+// Close waits until the shards send the queued requests. The metrics
+// emitted afterwards are discarded.
+func (re *RemoteWriteEmitter) Close() error {
+	re.lock.Lock()
+	if !re.closed {
+		re.closed = true
+		for _, shard := range re.shards {
+			close(shard)
+		}
+	}
+	re.lock.Unlock()
+	re.running.Wait()
+	return nil
+}
+
+// Emit converts the metrics into series and queues them in the shards, which
+// send them in the background. It only returns the errors converting the
+// metrics, the errors sending them are logged.
+func (re *RemoteWriteEmitter) Emit(metrics []Metric) error {
+	var results error
+
+	// The samples of all the metrics get the same timestamp, since the
+	// scraped metrics have none.
+	timestamp := time.Now().UnixMilli()
+	perShard := make([][]remoteWriteSeries, len(re.shards))
+	for _, metric := range metrics {
+		series, err := remoteWriteSeriesOf(metric, timestamp)
+		if err != nil {
+			results = appendError(results, err)
+			continue
+		}
+		for _, s := range series {
+			shard := s.shard(len(re.shards))
+			perShard[shard] = append(perShard[shard], s)
+		}
+	}
+
+	re.lock.RLock()
+	defer re.lock.RUnlock()
+	if re.closed {
+		return appendError(results, fmt.Errorf("the %s emitter is closed", re.name))
+	}
+	for shard, series := range perShard {
+		for start := 0; start < len(series); start += re.maxSamplesPerSend {
+			end := start + re.maxSamplesPerSend
+			if end > len(series) {
+				end = len(series)
+			}
+			re.shards[shard] <- remoteWriteRequest{series: series[start:end]}
+		}
+	}
+	return results
+}
+
+// shard returns the shard sending the series, from the hash of its labels.
+func (s *remoteWriteSeries) shard(shards int) int {
+	h := fnv.New32a()
+	for _, l := range s.labels {
+		_, _ = h.Write([]byte(l.name))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(l.value))
+		_, _ = h.Write([]byte{0})
+	}
+	return int(h.Sum32() % uint32(shards))
+}
+
+// remoteWriteSeriesOf returns the series of the metric, following the
+// Prometheus naming of the summary and histogram series.
+func remoteWriteSeriesOf(metric Metric, timestamp int64) ([]remoteWriteSeries, error) {
+	newSeries := func(name string, value float64, extra ...promLabel) remoteWriteSeries {
+		return remoteWriteSeries{
+			labels:    remoteWriteLabels(name, metric.attributes, extra...),
+			value:     value,
+			timestamp: timestamp,
+		}
+	}
+
+	switch metric.metricType {
+	case metricType_GAUGE, metricType_COUNTER:
+		value, ok := metric.value.(float64)
+		if !ok {
+			return nil, fmt.Errorf("unknown %s metric type for %q: %T", metric.metricType, metric.name, metric.value)
+		}
+		return []remoteWriteSeries{newSeries(metric.name, value)}, nil
+	case metricType_SUMMARY:
+		summary, ok := metric.value.(*dto.Summary)
+		if !ok {
+			return nil, fmt.Errorf("unknown summary metric type for %q: %T", metric.name, metric.value)
+		}
+		series := []remoteWriteSeries{
+			newSeries(metric.name+"_sum", summary.GetSampleSum()),
+			newSeries(metric.name+"_count", float64(summary.GetSampleCount())),
+		}
+		for _, q := range summary.GetQuantile() {
+			series = append(series, newSeries(metric.name, q.GetValue(), promLabel{"quantile", formatFloat(q.GetQuantile())}))
+		}
+		return series, nil
+	case metricType_HISTOGRAM:
+		hist, ok := metric.value.(*dto.Histogram)
+		if !ok {
+			return nil, fmt.Errorf("unknown histogram metric type for %q: %T", metric.name, metric.value)
+		}
+		series := []remoteWriteSeries{
+			newSeries(metric.name+"_sum", hist.GetSampleSum()),
+			newSeries(metric.name+"_count", float64(hist.GetSampleCount())),
+		}
+		hasInf := false
+		for _, b := range hist.GetBucket() {
+			hasInf = hasInf || math.IsInf(b.GetUpperBound(), 1)
+			series = append(series, newSeries(metric.name+"_bucket", float64(b.GetCumulativeCount()), promLabel{"le", formatFloat(b.GetUpperBound())}))
+		}
+		if !hasInf {
+			series = append(series, newSeries(metric.name+"_bucket", float64(hist.GetSampleCount()), promLabel{"le", "+Inf"}))
+		}
+		return series, nil
+	}
+	return nil, fmt.Errorf("unknown metric type %q", metric.metricType)
+}
+
+// formatFloat formats the quantiles and bucket bounds as Prometheus does.
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// remoteWriteLabels returns the labels of a series sorted by name, including
+// its name and the extra labels, which replace the attributes with the same
+// label name.
+func remoteWriteLabels(name string, attrs labels.Set, extra ...promLabel) []promLabel {
+	extra = append(extra, promLabel{"__name__", sanitizePromName(name, true)})
+	result := prometheusLabels(attrs)
+	kept := result[:0]
+	for _, l := range result {
+		reserved := false
+		for _, e := range extra {
+			reserved = reserved || l.name == e.name
+		}
+		if !reserved {
+			kept = append(kept, l)
+		}
+	}
+	result = append(kept, extra...)
+	sort.Slice(result, func(i, j int) bool { return result[i].name < result[j].name })
+	return result
+}
+
+// sanitizePromName replaces the characters that are not valid in Prometheus
+// metric or label names with underscores. Colons are only valid in metric
+// names.
+func sanitizePromName(name string, metricName bool) string {
+	valid := func(i int, r rune) bool {
+		return r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') ||
+			(i > 0 && r >= '0' && r <= '9') || (metricName && r == ':')
+	}
+	for i, r := range name {
+		if !valid(i, r) {
+			var sb strings.Builder
+			for j, r := range name {
+				switch {
+				case valid(j, r):
+					sb.WriteRune(r)
+				case j == 0 && r >= '0' && r <= '9':
+					// Names can't start with a digit, so it's prefixed.
+					sb.WriteByte('_')
+					sb.WriteRune(r)
+				default:
+					sb.WriteByte('_')
+				}
+			}
+			return sb.String()
+		}
+	}
+	return name
+}
+
+// encodeWriteRequest encodes the series as a remote write 1.0 WriteRequest
+// protobuf message:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(series []remoteWriteSeries) []byte {
+	var buf, ts, msg []byte
+	for _, s := range series {
+		ts = ts[:0]
+		for _, l := range s.labels {
+			msg = msg[:0]
+			msg = protowire.AppendTag(msg, 1, protowire.BytesType)
+			msg = protowire.AppendString(msg, l.name)
+			msg = protowire.AppendTag(msg, 2, protowire.BytesType)
+			msg = protowire.AppendString(msg, l.value)
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, msg)
+		}
+		msg = msg[:0]
+		msg = protowire.AppendTag(msg, 1, protowire.Fixed64Type)
+		msg = protowire.AppendFixed64(msg, math.Float64bits(s.value))
+		msg = protowire.AppendTag(msg, 2, protowire.VarintType)
+		msg = protowire.AppendVarint(msg, uint64(s.timestamp))
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, msg)
+
+		buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, ts)
+	}
+	return buf
+}
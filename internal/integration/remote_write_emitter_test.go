@@ -0,0 +1,348 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+// remoteWriteReceiver is a remote write endpoint keeping the received
+// samples, by their series in the Prometheus text format.
+type remoteWriteReceiver struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	samples  map[string]float64
+	requests int
+	headers  []http.Header
+	// statuses are returned to the first requests, before responding 204.
+	statuses []int
+}
+
+func newRemoteWriteReceiver(t *testing.T, statuses ...int) *remoteWriteReceiver {
+	t.Helper()
+
+	r := &remoteWriteReceiver{samples: map[string]float64{}, statuses: statuses}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+
+		r.headers = append(r.headers, req.Header.Clone())
+		if len(r.statuses) > 0 {
+			status := r.statuses[0]
+			r.statuses = r.statuses[1:]
+			w.WriteHeader(status)
+			return
+		}
+
+		compressed, _ := io.ReadAll(req.Body)
+		payload, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := decodeWriteRequest(payload, r.samples); err != nil {
+			t.Errorf("decoding write request: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.requests++
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+// decodeWriteRequest decodes the series of a WriteRequest into samples.
+func decodeWriteRequest(b []byte, samples map[string]float64) error {
+	return forEachField(b, func(_ protowire.Number, ts []byte) error {
+		var name string
+		var seriesLabels []string
+		var value float64
+		seen := map[string]bool{}
+		err := forEachField(ts, func(num protowire.Number, msg []byte) error {
+			fields := map[protowire.Number][]byte{}
+			if err := forEachField(msg, func(num protowire.Number, v []byte) error {
+				fields[num] = v
+				return nil
+			}); err != nil {
+				return err
+			}
+			if num == 1 {
+				if seen[string(fields[1])] {
+					return fmt.Errorf("duplicate label %q", fields[1])
+				}
+				seen[string(fields[1])] = true
+				if string(fields[1]) == "__name__" {
+					name = string(fields[2])
+				} else {
+					seriesLabels = append(seriesLabels, string(fields[1])+`="`+string(fields[2])+`"`)
+				}
+				return nil
+			}
+			bits, _ := protowire.ConsumeFixed64(fields[1])
+			value = math.Float64frombits(bits)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		sort.Strings(seriesLabels)
+		samples[name+"{"+strings.Join(seriesLabels, ",")+"}"] = value
+		return nil
+	})
+}
+
+// forEachField calls fn with the number and raw value of each field of a
+// protobuf message.
+func forEachField(b []byte, fn func(protowire.Number, []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		var v []byte
+		switch typ {
+		case protowire.BytesType:
+			v, n = protowire.ConsumeBytes(b)
+		case protowire.Fixed64Type:
+			v, n = b[:8], 8
+		default:
+			v, n = b, protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		if err := fn(num, v); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func TestRemoteWriteEmitter(t *testing.T) {
+	t.Parallel()
+
+	receiver := newRemoteWriteReceiver(t)
+	emitter, err := NewRemoteWriteEmitter(RemoteWriteEmitterConfig{
+		URL:      receiver.URL + "/api/v1/push",
+		Headers:  map[string]string{"X-Scope-OrgID": "team-a"},
+		Username: "user",
+		Password: "secret",
+	})
+	require.NoError(t, err)
+
+	err = emitter.Emit([]Metric{
+		{
+			name:       "redis_connected_clients",
+			metricType: metricType_GAUGE,
+			value:      12.0,
+			attributes: labels.Set{"label.app": "redis", "nrMetricType": "gauge", "promMetricType": "gauge"},
+		},
+		{
+			name:       "http_requests_total",
+			metricType: metricType_COUNTER,
+			value:      42.0,
+			attributes: labels.Set{"code": "200"},
+		},
+		{
+			name:       "rpc_duration_seconds",
+			metricType: metricType_SUMMARY,
+			value: &dto.Summary{
+				SampleCount: proto.Uint64(10),
+				SampleSum:   proto.Float64(3.5),
+				Quantile:    []*dto.Quantile{{Quantile: proto.Float64(0.5), Value: proto.Float64(0.2)}},
+			},
+			attributes: labels.Set{},
+		},
+		{
+			name:       "http_duration_seconds",
+			metricType: metricType_HISTOGRAM,
+			value: &dto.Histogram{
+				SampleCount: proto.Uint64(6),
+				SampleSum:   proto.Float64(2.5),
+				Bucket: []*dto.Bucket{
+					{UpperBound: proto.Float64(0.1), CumulativeCount: proto.Uint64(2)},
+					{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(5)},
+				},
+			},
+			attributes: labels.Set{},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, emitter.Close())
+
+	assert.Equal(t, map[string]float64{
+		`redis_connected_clients{label_app="redis"}`: 12,
+		`http_requests_total{code="200"}`:            42,
+		`rpc_duration_seconds_sum{}`:                 3.5,
+		`rpc_duration_seconds_count{}`:               10,
+		`rpc_duration_seconds{quantile="0.5"}`:       0.2,
+		`http_duration_seconds_sum{}`:                2.5,
+		`http_duration_seconds_count{}`:              6,
+		`http_duration_seconds_bucket{le="0.1"}`:     2,
+		`http_duration_seconds_bucket{le="1"}`:       5,
+		`http_duration_seconds_bucket{le="+Inf"}`:    6,
+	}, receiver.samples)
+
+	h := receiver.headers[0]
+	assert.Equal(t, "snappy", h.Get("Content-Encoding"))
+	assert.Equal(t, "application/x-protobuf", h.Get("Content-Type"))
+	assert.Equal(t, "0.1.0", h.Get("X-Prometheus-Remote-Write-Version"))
+	assert.Equal(t, "team-a", h.Get("X-Scope-OrgID"))
+	user, password, ok := (&http.Request{Header: h}).BasicAuth()
+	assert.True(t, ok)
+	assert.Equal(t, "user", user)
+	assert.Equal(t, "secret", password)
+}
+
+func TestRemoteWriteEmitter_Shards(t *testing.T) {
+	t.Parallel()
+
+	receiver := newRemoteWriteReceiver(t)
+	emitter, err := NewRemoteWriteEmitter(RemoteWriteEmitterConfig{URL: receiver.URL, Shards: 3, MaxSamplesPerSend: 10})
+	require.NoError(t, err)
+
+	var metrics []Metric
+	for i := 0; i < 100; i++ {
+		metrics = append(metrics, Metric{name: "up", metricType: metricType_GAUGE, value: 1.0, attributes: labels.Set{"i": i}})
+	}
+	require.NoError(t, emitter.Emit(metrics))
+	require.NoError(t, emitter.Close())
+
+	assert.Len(t, receiver.samples, 100)
+	// Each shard sends its series in requests of at most 10 samples.
+	assert.GreaterOrEqual(t, receiver.requests, 10)
+	assert.LessOrEqual(t, receiver.requests, 12)
+}
+
+func TestRemoteWriteEmitter_Retries(t *testing.T) {
+	t.Parallel()
+
+	receiver := newRemoteWriteReceiver(t, http.StatusInternalServerError, http.StatusTooManyRequests)
+	emitter, err := NewRemoteWriteEmitter(RemoteWriteEmitterConfig{URL: receiver.URL, RetryBackoff: time.Millisecond})
+	require.NoError(t, err)
+
+	require.NoError(t, emitter.Emit([]Metric{{name: "up", metricType: metricType_GAUGE, value: 1.0, attributes: labels.Set{}}}))
+	require.NoError(t, emitter.Close())
+	assert.Len(t, receiver.headers, 3)
+	assert.Len(t, receiver.samples, 1)
+
+	// Client errors are not retried.
+	receiver = newRemoteWriteReceiver(t, http.StatusBadRequest)
+	emitter, err = NewRemoteWriteEmitter(RemoteWriteEmitterConfig{URL: receiver.URL, RetryBackoff: time.Millisecond})
+	require.NoError(t, err)
+	require.NoError(t, emitter.Emit([]Metric{{name: "up", metricType: metricType_GAUGE, value: 1.0, attributes: labels.Set{}}}))
+	require.NoError(t, emitter.Close())
+	assert.Len(t, receiver.headers, 1)
+	assert.Empty(t, receiver.samples)
+}
+
+func TestRemoteWriteEmitter_Async(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	receiver := newRemoteWriteReceiver(t)
+	blocked := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+		receiver.Config.Handler.ServeHTTP(w, req)
+	}))
+	defer blocked.Close()
+	emitter, err := NewRemoteWriteEmitter(RemoteWriteEmitterConfig{URL: blocked.URL, Shards: 1})
+	require.NoError(t, err)
+
+	// Emit doesn't wait for the requests to be sent.
+	require.NoError(t, emitter.Emit([]Metric{{name: "up", metricType: metricType_GAUGE, value: 1.0, attributes: labels.Set{}}}))
+	close(release)
+	require.NoError(t, emitter.Close())
+	assert.Len(t, receiver.samples, 1)
+
+	// The metrics emitted after closing it are discarded.
+	assert.Error(t, emitter.Emit([]Metric{{name: "up", metricType: metricType_GAUGE, value: 1.0, attributes: labels.Set{}}}))
+}
+
+func TestRemoteWriteEmitter_LabelCollisions(t *testing.T) {
+	t.Parallel()
+
+	receiver := newRemoteWriteReceiver(t)
+	emitter, err := NewRemoteWriteEmitter(RemoteWriteEmitterConfig{URL: receiver.URL})
+	require.NoError(t, err)
+
+	require.NoError(t, emitter.Emit([]Metric{{
+		name:       "http_duration_seconds",
+		metricType: metricType_HISTOGRAM,
+		value: &dto.Histogram{
+			SampleCount: proto.Uint64(1),
+			SampleSum:   proto.Float64(0.5),
+			Bucket:      []*dto.Bucket{{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(1)}},
+		},
+		attributes: labels.Set{"app.name": "dotted", "app_name": "valid", "le": "attribute", "__name__": "attribute"},
+	}}))
+	require.NoError(t, emitter.Close())
+
+	// The series get a single label of each name. The `le` attribute is
+	// only replaced in the buckets.
+	assert.Equal(t, map[string]float64{
+		`http_duration_seconds_sum{app_name="valid",le="attribute"}`:   0.5,
+		`http_duration_seconds_count{app_name="valid",le="attribute"}`: 1,
+		`http_duration_seconds_bucket{app_name="valid",le="1"}`:        1,
+		`http_duration_seconds_bucket{app_name="valid",le="+Inf"}`:     1,
+	}, receiver.samples)
+}
+
+func TestRemoteWriteEmitter_BearerTokenFile(t *testing.T) {
+	t.Parallel()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("my-token"), 0o600))
+
+	receiver := newRemoteWriteReceiver(t)
+	emitter, err := NewRemoteWriteEmitter(RemoteWriteEmitterConfig{URL: receiver.URL, BearerTokenFile: tokenFile})
+	require.NoError(t, err)
+
+	require.NoError(t, emitter.Emit([]Metric{{name: "up", metricType: metricType_GAUGE, value: 1.0, attributes: labels.Set{}}}))
+	require.NoError(t, emitter.Close())
+	assert.Equal(t, "Bearer my-token", receiver.headers[0].Get("Authorization"))
+}
+
+func TestNewRemoteWriteEmitter_InvalidConfig(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewRemoteWriteEmitter(RemoteWriteEmitterConfig{})
+	assert.Error(t, err)
+
+	_, err = NewRemoteWriteEmitter(RemoteWriteEmitterConfig{URL: "http://mimir/api/v1/push", Username: "user", BearerToken: "token"})
+	assert.Error(t, err)
+}
+
+func TestSanitizePromName(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "label_app", sanitizePromName("label.app", false))
+	assert.Equal(t, "_2xx", sanitizePromName("2xx", false))
+	assert.Equal(t, "job:requests:rate5m", sanitizePromName("job:requests:rate5m", true))
+	assert.Equal(t, "job_requests", sanitizePromName("job:requests", false))
+}
@@ -3,7 +3,12 @@
 
 package integration
 
-import "net/http"
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+)
 
 // licenseKeyRoundTripper adds the infra license key to every request.
 type licenseKeyRoundTripper struct {
@@ -34,3 +39,44 @@ func newLicenseKeyRoundTripper(
 		rt:         rt,
 	}
 }
+
+// harvestMetricsRoundTripper records the outcome of the requests of a
+// harvester as self-metrics.
+type harvestMetricsRoundTripper struct {
+	emitter string
+	rt      http.RoundTripper
+}
+
+// RoundTrip records the status code of the response, or an error if there
+// was none, and the size of the payload.
+func (t harvestMetricsRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.rt.RoundTrip(req)
+	if req.ContentLength > 0 {
+		harvestRequestBytesTotalMetric.WithLabelValues(t.emitter).Add(float64(req.ContentLength))
+	}
+	if err != nil {
+		harvestRequestsTotalMetric.WithLabelValues(t.emitter, "error").Inc()
+		return resp, err
+	}
+	harvestRequestsTotalMetric.WithLabelValues(t.emitter, strconv.Itoa(resp.StatusCode)).Inc()
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusAccepted {
+		harvestLastSuccessMetric.WithLabelValues(t.emitter).SetToCurrentTime()
+	}
+	return resp, nil
+}
+
+// TelemetryHarvesterWithHarvestMetrics records the outcome of the requests
+// of the harvester as self-metrics, labeled with the emitter.
+//
+// It should be set after the options modifying the underlying http.Transport
+// and before TelemetryHarvesterWithLicenseKeyRoundTripper, so it records the
+// requests actually sent.
+func TelemetryHarvesterWithHarvestMetrics(emitter string) TelemetryHarvesterOpt {
+	return func(cfg *telemetry.Config) {
+		rt := cfg.Client.Transport
+		if rt == nil {
+			rt = http.DefaultTransport
+		}
+		cfg.Client.Transport = harvestMetricsRoundTripper{emitter: emitter, rt: rt}
+	}
+}
@@ -5,10 +5,15 @@ package integration
 
 import (
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 type mockedRoundTripper struct {
@@ -38,3 +43,43 @@ func TestRoundTripHeaderDecoration(t *testing.T) {
 	_, _ = tr.RoundTrip(req)
 	rt.AssertExpectations(t)
 }
+
+func TestTelemetryHarvesterWithHarvestMetrics(t *testing.T) {
+	t.Parallel()
+
+	status := http.StatusAccepted
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	cfg := &telemetry.Config{Client: &http.Client{}}
+	TelemetryHarvesterWithHarvestMetrics("telemetry/harvest-metrics")(cfg)
+	post := func(url string) {
+		req, err := http.NewRequest(http.MethodPost, url, strings.NewReader("payload"))
+		require.NoError(t, err)
+		resp, err := cfg.Client.Do(req)
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+	}
+
+	requests := func(status string) float64 {
+		return testutil.ToFloat64(harvestRequestsTotalMetric.WithLabelValues("telemetry/harvest-metrics", status))
+	}
+	bytes := func() float64 {
+		return testutil.ToFloat64(harvestRequestBytesTotalMetric.WithLabelValues("telemetry/harvest-metrics"))
+	}
+	accepted, unavailable, failed, sent := requests("202"), requests("503"), requests("error"), bytes()
+
+	post(srv.URL)
+	status = http.StatusServiceUnavailable
+	post(srv.URL)
+	post("http://127.0.0.1:1")
+
+	assert.Equal(t, accepted+1, requests("202"))
+	assert.Equal(t, unavailable+1, requests("503"))
+	assert.Equal(t, failed+1, requests("error"))
+	assert.Equal(t, sent+21, bytes())
+	assert.NotZero(t, testutil.ToFloat64(harvestLastSuccessMetric.WithLabelValues("telemetry/harvest-metrics")))
+}
@@ -0,0 +1,124 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"fmt"
+)
+
+// EmitterRoute sends the metrics matching any of its selectors to its
+// emitter.
+type EmitterRoute struct {
+	// Name of the route, used in the errors of its emitter.
+	Name      string
+	Emitter   Emitter
+	Selectors []EmitterSelector
+}
+
+type emitterRoute struct {
+	name      string
+	emitter   Emitter
+	selectors []*emitterSelector
+}
+
+// matches returns whether the metric of the target matches any of the
+// selectors of the route.
+func (r *emitterRoute) matches(pair *TargetMetrics, name string) bool {
+	for _, s := range r.selectors {
+		if s.matchesTarget(&pair.Target) && s.matchesMetric(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// RoutingEmitter sends each metric to the emitter of the first route
+// matching it, or to the default emitter if none does. It's used to send
+// the metrics of different namespaces or targets to different New Relic
+// accounts.
+type RoutingEmitter struct {
+	name     string
+	routes   []emitterRoute
+	fallback Emitter
+}
+
+// NewRoutingEmitter returns a RoutingEmitter, or an error if the selectors
+// of a route are not valid. The routes are matched in order.
+func NewRoutingEmitter(name string, routes []EmitterRoute, fallback Emitter) (*RoutingEmitter, error) {
+	re := &RoutingEmitter{name: name, fallback: fallback}
+	for _, r := range routes {
+		if len(r.Selectors) == 0 {
+			return nil, fmt.Errorf("the %s route needs at least one selector", r.Name)
+		}
+		route := emitterRoute{name: r.Name, emitter: r.Emitter}
+		for i := range r.Selectors {
+			s, err := compileEmitterSelector(&r.Selectors[i])
+			if err != nil {
+				return nil, fmt.Errorf("invalid selector of the %s route: %w", r.Name, err)
+			}
+			route.selectors = append(route.selectors, s)
+		}
+		re.routes = append(re.routes, route)
+	}
+	return re, nil
+}
+
+// Name is the RoutingEmitter name.
+func (re *RoutingEmitter) Name() string {
+	return re.name
+}
+
+// Emit sends the metrics to the default emitter, since the routes can't be
+// matched without the target of the metrics.
+func (re *RoutingEmitter) Emit(metrics []Metric) error {
+	return re.fallback.Emit(metrics)
+}
+
+// EmitTarget sends each metric of the target to the emitter of its route.
+func (re *RoutingEmitter) EmitTarget(pair TargetMetrics) error {
+	routed := make([][]Metric, len(re.routes))
+	var unrouted []Metric
+	for _, m := range pair.Metrics {
+		i := re.route(&pair, m.name)
+		if i < 0 {
+			unrouted = append(unrouted, m)
+			continue
+		}
+		routed[i] = append(routed[i], m)
+	}
+
+	var results error
+	for i, metrics := range routed {
+		if len(metrics) == 0 {
+			continue
+		}
+		if err := re.routes[i].emitter.Emit(metrics); err != nil {
+			results = appendError(results, fmt.Errorf("%s: %w", re.routes[i].name, err))
+		}
+	}
+	if len(unrouted) > 0 {
+		results = appendError(results, re.fallback.Emit(unrouted))
+	}
+	return results
+}
+
+// Close closes the emitters of the routes and the default emitter.
+func (re *RoutingEmitter) Close() error {
+	var results error
+	for _, r := range re.routes {
+		if err := closeEmitter(r.emitter); err != nil {
+			results = appendError(results, fmt.Errorf("%s: %w", r.name, err))
+		}
+	}
+	return appendError(results, closeEmitter(re.fallback))
+}
+
+func (re *RoutingEmitter) route(pair *TargetMetrics, name string) int {
+	for i := range re.routes {
+		if re.routes[i].matches(pair, name) {
+			return i
+		}
+	}
+	return -1
+}
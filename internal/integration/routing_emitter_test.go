@@ -0,0 +1,123 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingEmitter fails every emit.
+type failingEmitter struct{}
+
+func (*failingEmitter) Name() string {
+	return "failing"
+}
+
+func (*failingEmitter) Emit([]Metric) error {
+	return fmt.Errorf("account unavailable")
+}
+
+func TestRoutingEmitter(t *testing.T) {
+	t.Parallel()
+
+	teamA, teamB, fallback := &recordingEmitter{}, &recordingEmitter{}, &recordingEmitter{}
+	re, err := NewRoutingEmitter("telemetry", []EmitterRoute{
+		{Name: "team-a", Emitter: teamA, Selectors: []EmitterSelector{
+			{Namespaces: []string{"finops"}},
+			{Namespaces: []string{"cache"}, MetricNames: []string{"redis_.*"}},
+		}},
+		{Name: "team-b", Emitter: teamB, Selectors: []EmitterSelector{
+			{Namespaces: []string{"cache"}},
+		}},
+	}, fallback)
+	require.NoError(t, err)
+	assert.Equal(t, "telemetry", re.Name())
+
+	require.NoError(t, emitTarget(re, filterTestMetrics(t)))
+	// The routes are matched in order.
+	assert.Equal(t, [][]string{{"redis_up", "redis_connected_clients"}}, teamA.emits)
+	assert.Equal(t, [][]string{{"process_cpu_seconds_total"}}, teamB.emits)
+	assert.Empty(t, fallback.emits)
+}
+
+func TestRoutingEmitter_Fallback(t *testing.T) {
+	t.Parallel()
+
+	teamA, fallback := &recordingEmitter{}, &recordingEmitter{}
+	re, err := NewRoutingEmitter("telemetry", []EmitterRoute{
+		{Name: "team-a", Emitter: teamA, Selectors: []EmitterSelector{{Namespaces: []string{"cache"}, MetricNames: []string{"redis_up"}}}},
+	}, fallback)
+	require.NoError(t, err)
+
+	require.NoError(t, emitTarget(re, filterTestMetrics(t)))
+	assert.Equal(t, [][]string{{"redis_up"}}, teamA.emits)
+	assert.Equal(t, [][]string{{"redis_connected_clients", "process_cpu_seconds_total"}}, fallback.emits)
+
+	// Without the target the metrics can't be routed.
+	require.NoError(t, re.Emit(filterTestMetrics(t).Metrics))
+	assert.Len(t, teamA.emits, 1)
+	assert.Len(t, fallback.emits, 2)
+}
+
+func TestRoutingEmitter_Errors(t *testing.T) {
+	t.Parallel()
+
+	fallback := &recordingEmitter{}
+	re, err := NewRoutingEmitter("telemetry", []EmitterRoute{
+		{Name: "team-a", Emitter: &failingEmitter{}, Selectors: []EmitterSelector{{MetricNames: []string{"redis_.*"}}}},
+	}, fallback)
+	require.NoError(t, err)
+
+	err = emitTarget(re, filterTestMetrics(t))
+	assert.EqualError(t, err, "team-a: account unavailable")
+	// The other routes are still emitted.
+	assert.Equal(t, [][]string{{"process_cpu_seconds_total"}}, fallback.emits)
+}
+
+func TestNewRoutingEmitter_InvalidRoutes(t *testing.T) {
+	t.Parallel()
+
+	fallback := &recordingEmitter{}
+	_, err := NewRoutingEmitter("telemetry", []EmitterRoute{{Name: "team-a", Emitter: &recordingEmitter{}}}, fallback)
+	assert.Error(t, err)
+	_, err = NewRoutingEmitter("telemetry", []EmitterRoute{
+		{Name: "team-a", Emitter: &recordingEmitter{}, Selectors: []EmitterSelector{{MetricNames: []string{"("}}}},
+	}, fallback)
+	assert.Error(t, err)
+}
+
+// closingEmitter records whether it was closed.
+type closingEmitter struct {
+	recordingEmitter
+	closed bool
+}
+
+func (ce *closingEmitter) Close() error {
+	ce.closed = true
+	return nil
+}
+
+func TestCloseEmitters(t *testing.T) {
+	t.Parallel()
+
+	teamA, fallback := &closingEmitter{}, &closingEmitter{}
+	re, err := NewRoutingEmitter("telemetry", []EmitterRoute{
+		{Name: "team-a", Emitter: teamA, Selectors: []EmitterSelector{{MetricNames: []string{"redis_.*"}}}},
+	}, fallback)
+	require.NoError(t, err)
+	qe, err := NewQueuedEmitter(re, "", EmitterQueueConfig{})
+	require.NoError(t, err)
+
+	// The queued metrics are emitted before closing the emitters.
+	require.NoError(t, emitTarget(qe, filterTestMetrics(t)))
+	require.NoError(t, CloseEmitters([]Emitter{qe, &recordingEmitter{}}))
+	assert.Len(t, teamA.emits, 1)
+	assert.Len(t, fallback.emits, 1)
+	assert.True(t, teamA.closed)
+	assert.True(t, fallback.closed)
+}
@@ -4,19 +4,35 @@
 package integration
 
 import (
+	"fmt"
+	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/sirupsen/logrus"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
 	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
 )
 
+var rlog = logrus.WithField("component", "integration.RuleSet")
+
 // ProcessingRule is a bundle of multiple rules of different types to
 // be applied to metrics.
 type ProcessingRule struct {
 	Description      string
-	AddAttributes    []AddAttributesRule  `mapstructure:"add_attributes"`
-	RenameAttributes []RenameRule         `mapstructure:"rename_attributes"`
-	IgnoreMetrics    []IgnoreRule         `mapstructure:"ignore_metrics"`
-	CopyAttributes   []CopyAttributesRule `mapstructure:"copy_attributes"`
+	AddAttributes    []AddAttributesRule    `mapstructure:"add_attributes"`
+	RenameAttributes []RenameRule           `mapstructure:"rename_attributes"`
+	IgnoreMetrics    []IgnoreRule           `mapstructure:"ignore_metrics"`
+	CopyAttributes   []CopyAttributesRule   `mapstructure:"copy_attributes"`
+	SampleMetrics    []SampleRule           `mapstructure:"sample_metrics"`
+	RedactAttributes []RedactAttributesRule `mapstructure:"redact_attributes"`
+	// TargetSelector restricts the rules to the matching targets. If it's not
+	// set, the rules apply to all the targets. For cross-target
+	// copy_attributes it only restricts the targets to decorate.
+	TargetSelector *TargetSelector `mapstructure:"target_selector"`
 }
 
 // RenameRule is a rule for changing the name of attributes of metrics that
@@ -40,11 +56,22 @@ type IgnoreRule struct {
 // CopyAttributesRule is a rule that copies the Attributes from the metric that
 // matches FromMetric to the metrics that matches (as prefix) with ToMetrics
 // only if both have the same values for all the labels defined in MatchBy.
+//
+// By default, the metrics must belong to the same target. If CrossTarget is
+// set, the FromMetric series of any target decorate the ToMetrics of all the
+// targets. Their label sets are cached for CacheTTL, so they also decorate the
+// targets processed before the source target in the following cycles. In this
+// mode ToMatchBy can name the destination labels matched against MatchBy, in
+// the same order, when they are different, e.g. `namespaceName` and `podName`
+// from the target metadata.
 type CopyAttributesRule struct {
-	FromMetric string   `mapstructure:"from_metric"`
-	ToMetrics  []string `mapstructure:"to_metrics"`
-	MatchBy    []string `mapstructure:"match_by"`
-	Attributes []string `mapstructure:"attributes"`
+	FromMetric  string        `mapstructure:"from_metric"`
+	ToMetrics   []string      `mapstructure:"to_metrics"`
+	MatchBy     []string      `mapstructure:"match_by"`
+	Attributes  []string      `mapstructure:"attributes"`
+	CrossTarget bool          `mapstructure:"cross_target"`
+	ToMatchBy   []string      `mapstructure:"to_match_by"`
+	CacheTTL    time.Duration `mapstructure:"cache_ttl"`
 }
 
 // AddAttributesRule adds the Attributes to the metrics that match with
@@ -54,6 +81,35 @@ type AddAttributesRule struct {
 	Attributes   map[string]interface{} `mapstructure:"attributes"`
 }
 
+// RedactAttributesRule replaces the values of the Attributes of the metrics
+// that match MetricPrefix, so sensitive data never reaches the emitters. If
+// Pattern is set, only the parts of the values matching the regular
+// expression are replaced. With Hash, they are replaced by their SHA-256 hash
+// salted with Salt, so the metrics can still be grouped by them. Otherwise
+// they are replaced by Replacement, which can refer to the Pattern groups.
+//
+// The rules are applied after all the attributes have been added, and before
+// they are renamed, so the renamed attributes are redacted as well.
+type RedactAttributesRule struct {
+	MetricPrefix string   `mapstructure:"metric_prefix"`
+	Attributes   []string `mapstructure:"attributes"`
+	Pattern      string   `mapstructure:"pattern"`
+	Hash         bool     `mapstructure:"hash"`
+	Salt         string   `mapstructure:"salt"`
+	Replacement  string   `mapstructure:"replacement"`
+}
+
+// SampleRule reduces the emission frequency of the metrics whose name
+// matches any of the Prefixes. A matching metric is emitted only once every
+// EveryNCycles scrapes of its target, or at most once per MinInterval. If
+// both are set, the metric is emitted only when both conditions are met.
+// Metrics that don't match any SampleRule keep the normal cadence.
+type SampleRule struct {
+	Prefixes     []string      `mapstructure:"prefixes"`
+	EveryNCycles int           `mapstructure:"every_n_cycles"`
+	MinInterval  time.Duration `mapstructure:"min_interval"`
+}
+
 // DecorateRule specifies a label decoration rule: a Source metric may decorate a set of Dest metrics if they have in common
 // the labels that are named in the Join keyset
 type DecorateRule struct {
@@ -170,121 +226,122 @@ func decorate(targetMetrics *TargetMetrics, decorateRules []DecorateRule) {
 
 // Rename apply the given rename rules to the entities metrics
 func Rename(targetMetrics *TargetMetrics, rules []RenameRule) {
-	// Fast path, quickly exit if there are no rules defined.
-	if len(rules) == 0 {
-		return
-	}
-
-	for mi := range targetMetrics.Metrics {
-		// processing rules into it
-		for _, rr := range rules {
-			if strings.HasPrefix(targetMetrics.Metrics[mi].name, rr.MetricPrefix) {
-				for current, updated := range rr.Attributes {
-					if value, ok := targetMetrics.Metrics[mi].attributes[current]; ok {
-						targetMetrics.Metrics[mi].attributes[updated.(string)] = value
-					}
-				}
-			}
-		}
-	}
+	newRuleMatcher(rules, nil, nil, nil).applyRename(targetMetrics)
 }
 
 // addAttributes applies the AddAttributeRule. It adds the attributes defined
 // in the rules to the metrics that match.
 func addAttributes(targetMetrics *TargetMetrics, rules []AddAttributesRule) {
-	// Fast path, quickly exit if there are no rules defined.
-	if len(rules) == 0 {
-		return
-	}
+	newRuleMatcher(nil, rules, nil, nil).applyAddAttributes(targetMetrics)
+}
 
-	for mi := range targetMetrics.Metrics {
-		for _, rr := range rules {
-			if strings.HasPrefix(targetMetrics.Metrics[mi].name, rr.MetricPrefix) {
-				labels.Accumulate(targetMetrics.Metrics[mi].attributes, rr.Attributes)
-			}
-		}
-	}
+// filter removes the metrics whose name matches the prefixes in the given ignore rules
+func filter(targetMetrics *TargetMetrics, rules []IgnoreRule) {
+	newRuleMatcher(nil, nil, rules, nil).filter(targetMetrics)
 }
 
-type ignoreRules []IgnoreRule
+// A Processor is something that transform the metrics of a target that are received by a channel, and submits them
+// by another channel
+type Processor func(pairs <-chan TargetMetrics) <-chan TargetMetrics
 
-func (rules ignoreRules) shouldIgnore(name string, metricType metricType) bool {
-	// If the user specified ,in any set of rules, an except rule that is matching the metric name, we should keep the metric
-	if rules.isMetricExcepted(name) {
-		return false
-	}
+// compiledRules holds the processing rules ready to be applied to the
+// metrics of the targets.
+type compiledRules struct {
+	processingRules []ProcessingRule
+	// selectors holds the target selector of each processing rule, or nil
+	// if it applies to all the targets.
+	selectors   []*targetSelector
+	crossTarget *crossTargetDecorator
+	// crossTargetConfig holds the configuration of the cross-target rules,
+	// to tell whether they changed after a reload.
+	crossTargetConfig []crossTargetConfig
+
+	// lock protects the scopes, since targets can be processed in parallel.
+	lock sync.Mutex
+	// scopes holds the rules grouped by type for each set of processing
+	// rules that apply to a target, keyed by the indexes of those rules.
+	scopes map[string]*scopedRules
+	// inherited holds the scopes of the rules replaced by a reload, which
+	// are reused by the scopes selecting the same processing rules.
+	inherited []*scopedRules
+}
 
-	for _, rule := range rules {
-		// if metricTypesLen or prefixesLen are not defined and exceptRulesLen
-		// is not empty then all not previously excepted metric should be dropped
-		totalDroppingRules := len(rule.MetricTypes) + len(rule.Prefixes)
-		if totalDroppingRules == 0 && len(rule.Except) != 0 {
-			return true
-		}
+// crossTargetConfig is a cross-target CopyAttributesRule and the target
+// selector of its processing rule.
+type crossTargetConfig struct {
+	rule     CopyAttributesRule
+	selector *TargetSelector
+}
 
-		// MetricTypes
-		for _, rMetricType := range rule.MetricTypes {
-			if strings.EqualFold(rMetricType, string(metricType)) {
-				return true
-			}
-		}
+// scopedRules holds the processing rules that apply to a set of targets
+// grouped by type.
+type scopedRules struct {
+	processingRules []ProcessingRule
+	// matcher applies the rename, add attributes and ignore rules.
+	matcher  *ruleMatcher
+	decorate []DecorateRule
+	sampler  *sampler
+}
 
-		// Prefixes
-		for _, prefix := range rule.Prefixes {
-			if strings.HasPrefix(name, prefix) {
-				return true
-			}
-		}
+func compileRules(processingRules []ProcessingRule) *compiledRules {
+	rules := &compiledRules{
+		processingRules: processingRules,
+		selectors:       make([]*targetSelector, len(processingRules)),
+		scopes:          map[string]*scopedRules{},
 	}
 
-	return false
-}
+	var crossTargetRules []CopyAttributesRule
+	var crossTargetSelectors []*targetSelector
+	for i, pr := range processingRules {
+		selector, err := compileTargetSelector(pr.TargetSelector)
+		if err != nil {
+			// Validated rules never get here. Otherwise the rule is applied to
+			// no target, instead of to all of them.
+			rlog.WithError(err).WithField("transformation", i).Error("invalid target selector, the transformation won't be applied")
+			selector = &targetSelector{invalid: true}
+		}
+		rules.selectors[i] = selector
 
-// When matching an except rule we do not drop the metric, no matter if a rule is dropping it after
-func (rules ignoreRules) isMetricExcepted(name string) bool {
-	for _, rule := range rules {
-		for _, prefix := range rule.Except {
-			if strings.HasPrefix(name, prefix) {
-				return true
+		for _, car := range pr.CopyAttributes {
+			if car.CrossTarget {
+				crossTargetRules = append(crossTargetRules, car)
+				crossTargetSelectors = append(crossTargetSelectors, selector)
+				rules.crossTargetConfig = append(rules.crossTargetConfig, crossTargetConfig{rule: car, selector: pr.TargetSelector})
 			}
 		}
 	}
+	// The cross-target decorator is shared by all the targets, and it caches
+	// the source label sets between cycles.
+	rules.crossTarget = newCrossTargetDecorator(crossTargetRules, crossTargetSelectors)
 
-	return false
-}
-
-// filter removes the metrics whose name matches the prefixes in the given ignore rules
-func filter(targetMetrics *TargetMetrics, rules ignoreRules) {
-	// Fast path, quickly exit if there are no rules defined.
-	if len(rules) == 0 {
-		return
-	}
-
-	copied := make([]Metric, 0, len(targetMetrics.Metrics))
-	for _, m := range targetMetrics.Metrics {
-		if !rules.shouldIgnore(m.name, m.metricType) {
-			copied = append(copied, m)
-		}
-	}
-	targetMetrics.Metrics = copied
+	return rules
 }
 
-// A Processor is something that transform the metrics of a target that are received by a channel, and submits them
-// by another channel
-type Processor func(pairs <-chan TargetMetrics) <-chan TargetMetrics
-
-// RuleProcessor process apply the Rename, Decorate and Filter metrics
-// processing and returns them through a channel.
-func RuleProcessor(processingRules []ProcessingRule, queueLength int) Processor {
+func compileScopedRules(processingRules []ProcessingRule) *scopedRules {
 	var renameRules []RenameRule
 	var ignoreRules []IgnoreRule
-	var decorateRules []DecorateRule
 	var addAttributesRules []AddAttributesRule
+	var sampleRules []SampleRule
+	var redactRules []redactRule
+	rules := &scopedRules{processingRules: processingRules}
 	for _, pr := range processingRules {
 		renameRules = append(renameRules, pr.RenameAttributes...)
 		ignoreRules = append(ignoreRules, pr.IgnoreMetrics...)
 		addAttributesRules = append(addAttributesRules, pr.AddAttributes...)
+		sampleRules = append(sampleRules, pr.SampleMetrics...)
+		for _, rr := range pr.RedactAttributes {
+			rule, err := compileRedactRule(rr)
+			if err != nil {
+				// Validated rules never get here. Otherwise the whole values
+				// are redacted, instead of none of them.
+				rlog.WithError(err).Error("invalid redact rule, the whole values will be redacted")
+			}
+			redactRules = append(redactRules, rule)
+		}
 		for _, car := range pr.CopyAttributes {
+			if car.CrossTarget {
+				continue
+			}
 			join := labels.Set{}
 			for _, mk := range car.MatchBy {
 				join[mk] = struct{}{}
@@ -293,7 +350,7 @@ func RuleProcessor(processingRules []ProcessingRule, queueLength int) Processor
 			for _, mk := range car.Attributes {
 				attrs[mk] = struct{}{}
 			}
-			decorateRules = append(decorateRules, DecorateRule{
+			rules.decorate = append(rules.decorate, DecorateRule{
 				Source:     car.FromMetric,
 				Dest:       car.ToMetrics,
 				Join:       join,
@@ -301,26 +358,240 @@ func RuleProcessor(processingRules []ProcessingRule, queueLength int) Processor
 			})
 		}
 	}
+	// The matcher caches the rules matching each metric name across cycles.
+	rules.matcher = newRuleMatcher(renameRules, addAttributesRules, ignoreRules, redactRules)
+	// The sampler is shared by all the cycles, as it needs to remember when
+	// each metric was emitted for the last time.
+	rules.sampler = newSampler(sampleRules)
+
+	return rules
+}
 
+// inherit keeps the state of the rules that didn't change from the rules
+// replaced by a reload: the label sets cached by the cross-target rules, and
+// the matcher cache and the sampler of each scope. The state of the rules
+// that changed is reset.
+func (rules *compiledRules) inherit(previous *compiledRules) {
+	if reflect.DeepEqual(rules.crossTargetConfig, previous.crossTargetConfig) {
+		rules.crossTarget = previous.crossTarget
+	}
+
+	previous.lock.Lock()
+	defer previous.lock.Unlock()
+	for _, scope := range previous.scopes {
+		rules.inherited = append(rules.inherited, scope)
+	}
+}
+
+// scope returns the rules that apply to the target. They are compiled the
+// first time that a set of rules is selected, and reused afterwards by all
+// the targets selecting the same ones.
+func (rules *compiledRules) scope(target *endpoints.Target) *scopedRules {
+	key := make([]byte, len(rules.selectors))
+	for i, selector := range rules.selectors {
+		key[i] = '0'
+		if selector.matches(target) {
+			key[i] = '1'
+		}
+	}
+
+	rules.lock.Lock()
+	defer rules.lock.Unlock()
+
+	scope, ok := rules.scopes[string(key)]
+	if !ok {
+		selected := make([]ProcessingRule, 0, len(rules.processingRules))
+		for i, pr := range rules.processingRules {
+			if key[i] == '1' {
+				selected = append(selected, pr)
+			}
+		}
+		scope = rules.inheritedScope(selected)
+		if scope == nil {
+			scope = compileScopedRules(selected)
+		}
+		rules.scopes[string(key)] = scope
+	}
+	return scope
+}
+
+// inheritedScope returns the scope of the rules replaced by a reload that
+// has the same processing rules, or nil if there is none.
+func (rules *compiledRules) inheritedScope(processingRules []ProcessingRule) *scopedRules {
+	for _, scope := range rules.inherited {
+		if reflect.DeepEqual(scope.processingRules, processingRules) {
+			return scope
+		}
+	}
+	return nil
+}
+
+// apply runs all the processing steps over the metrics of a target.
+func (rules *compiledRules) apply(pair *TargetMetrics, now time.Time) {
+	scope := rules.scope(&pair.Target)
+
+	scope.matcher.filter(pair)
+	scope.matcher.applyAddAttributes(pair)
+	rules.crossTarget.harvest(pair, now, scope.matcher.redactAttributes)
+	decorate(pair, scope.decorate)
+	rules.crossTarget.decorate(pair, now)
+	scope.matcher.applyRedact(pair)
+	scope.matcher.applyRename(pair)
+	scope.sampler.sample(pair, now)
+}
+
+// ValidateProcessingRules returns an error if any of the processing rules
+// can't be applied.
+func ValidateProcessingRules(processingRules []ProcessingRule) error {
+	for i, pr := range processingRules {
+		if _, err := compileTargetSelector(pr.TargetSelector); err != nil {
+			return fmt.Errorf("transformation %d: %w", i, err)
+		}
+		for _, rr := range pr.RenameAttributes {
+			for current, updated := range rr.Attributes {
+				if _, ok := updated.(string); !ok {
+					return fmt.Errorf("transformation %d: attribute %q must be renamed to a string, got %v", i, current, updated)
+				}
+			}
+		}
+		for _, rr := range pr.RedactAttributes {
+			if len(rr.Attributes) == 0 {
+				return fmt.Errorf("transformation %d: redact_attributes requires some attributes", i)
+			}
+			if rr.Hash && rr.Salt == "" {
+				return fmt.Errorf("transformation %d: redact_attributes requires a salt to hash the values", i)
+			}
+			if _, err := compileRedactRule(rr); err != nil {
+				return fmt.Errorf("transformation %d: %w", i, err)
+			}
+		}
+		for _, car := range pr.CopyAttributes {
+			if car.FromMetric == "" {
+				return fmt.Errorf("transformation %d: copy_attributes requires a from_metric", i)
+			}
+			if !car.CrossTarget {
+				if len(car.ToMatchBy) > 0 || car.CacheTTL != 0 {
+					return fmt.Errorf("transformation %d: copy_attributes to_match_by and cache_ttl require cross_target", i)
+				}
+				continue
+			}
+			if len(car.MatchBy) == 0 {
+				return fmt.Errorf("transformation %d: cross_target copy_attributes requires match_by", i)
+			}
+			if len(car.ToMatchBy) > 0 && len(car.ToMatchBy) != len(car.MatchBy) {
+				return fmt.Errorf("transformation %d: copy_attributes to_match_by must have as many labels as match_by", i)
+			}
+			if car.CacheTTL < 0 {
+				return fmt.Errorf("transformation %d: copy_attributes cache_ttl can't be negative", i)
+			}
+		}
+		for _, sr := range pr.SampleMetrics {
+			if sr.EveryNCycles < 0 || sr.MinInterval < 0 {
+				return fmt.Errorf("transformation %d: sample_metrics every_n_cycles and min_interval can't be negative", i)
+			}
+			if sr.EveryNCycles == 0 && sr.MinInterval == 0 {
+				return fmt.Errorf("transformation %d: sample_metrics requires every_n_cycles or min_interval", i)
+			}
+		}
+	}
+	return nil
+}
+
+// RuleSet holds the processing rules used by a RuleSetProcessor. The rules
+// can be replaced at any time by calling Reload, and the new ones are applied
+// from the next scrape cycle on.
+type RuleSet struct {
+	rules atomic.Pointer[compiledRules]
+}
+
+// NewRuleSet returns a RuleSet with the given processing rules, or an error if
+// they are not valid.
+func NewRuleSet(processingRules []ProcessingRule) (*RuleSet, error) {
+	if err := ValidateProcessingRules(processingRules); err != nil {
+		return nil, err
+	}
+	rs := &RuleSet{}
+	rs.rules.Store(compileRules(processingRules))
+	return rs, nil
+}
+
+// Reload atomically replaces the processing rules of the RuleSet. If the new
+// rules are not valid, the current ones stay in effect and an error is
+// returned. The state of the rules that didn't change, like the cached
+// cross-target label sets and the last time each metric was sampled, is
+// kept.
+func (rs *RuleSet) Reload(processingRules []ProcessingRule) error {
+	if err := ValidateProcessingRules(processingRules); err != nil {
+		rs.ReloadFailed(fmt.Errorf("invalid processing rules: %w", err))
+		return err
+	}
+
+	rules := compileRules(processingRules)
+	rules.inherit(rs.rules.Load())
+	rs.rules.Store(rules)
+	rulesReloadsTotalMetric.WithLabelValues("success").Inc()
+	rulesLastReloadSuccessMetric.SetToCurrentTime()
+	rlog.WithField("transformations", len(processingRules)).Info("processing rules reloaded")
+	return nil
+}
+
+// ReloadFailed records a reload that failed before the new rules could be
+// passed to Reload, e.g. because they couldn't be read. The current rules
+// stay in effect.
+func (rs *RuleSet) ReloadFailed(err error) {
+	rulesReloadsTotalMetric.WithLabelValues("failure").Inc()
+	rlog.WithError(err).Error("reloading processing rules, keeping the current ones")
+}
+
+// RuleSetProcessor applies the Rename, Decorate, Filter and Sample metrics
+// processing of the current rules in the RuleSet, and returns them through a
+// channel. The rules are read once per invocation, so a reload never takes
+// effect in the middle of a scrape cycle.
+//
+// The targets are processed by the given number of workers in parallel. Each
+// target is processed by a single worker, so the rules see all its metrics at
+// once, but the targets may be returned in a different order than received.
+func RuleSetProcessor(rs *RuleSet, queueLength int, workers int) Processor {
+	if workers < 1 {
+		workers = 1
+	}
 	return func(targetMetrics <-chan TargetMetrics) <-chan TargetMetrics {
 		processedPairs := make(chan TargetMetrics, queueLength)
+		rules := rs.rules.Load()
+
+		wg := sync.WaitGroup{}
+		wg.Add(workers)
+		for i := 0; i < workers; i++ {
+			go func() {
+				defer wg.Done()
+				for pair := range targetMetrics {
+					processingQueueDepthMetric.Set(float64(len(targetMetrics)))
+					start := time.Now()
+					rules.apply(&pair, start)
+					processTargetDurationMetric.WithLabelValues(pair.Target.Name).Set(time.Since(start).Seconds())
+
+					processedPairs <- pair
+				}
+			}()
+		}
 
 		go func() {
 			// After finished reading everything from the input target metrics
 			// we need to close the result channel to let the emitters know
 			// when to stop reading from it.
-			defer close(processedPairs)
-
-			for pair := range targetMetrics {
-				filter(&pair, ignoreRules)
-				addAttributes(&pair, addAttributesRules)
-				decorate(&pair, decorateRules)
-				Rename(&pair, renameRules)
-
-				processedPairs <- pair
-			}
+			wg.Wait()
+			processingQueueDepthMetric.Set(0)
+			close(processedPairs)
 		}()
 
 		return processedPairs
 	}
 }
+
+// RuleProcessor process apply the Rename, Decorate, Filter and Sample metrics
+// processing and returns them through a channel.
+func RuleProcessor(processingRules []ProcessingRule, queueLength int) Processor {
+	rs := &RuleSet{}
+	rs.rules.Store(compileRules(processingRules))
+	return RuleSetProcessor(rs, queueLength, 1)
+}
@@ -613,3 +613,173 @@ func TestIgnoreRules_MatchingExceptRulesTakesPriorityOverOtherRules(t *testing.T
 	assert.Len(t, actual, 1)
 	assert.Contains(t, actual, "redis_instance_info")
 }
+
+func TestValidateProcessingRules(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name  string
+		rules []ProcessingRule
+		valid bool
+	}{
+		{
+			name:  "no rules",
+			valid: true,
+		},
+		{
+			name: "valid rules",
+			rules: []ProcessingRule{{
+				RenameAttributes: []RenameRule{{MetricPrefix: "a", Attributes: map[string]interface{}{"b": "c"}}},
+				CopyAttributes:   []CopyAttributesRule{{FromMetric: "info", ToMetrics: []string{"a"}}},
+				SampleMetrics:    []SampleRule{{Prefixes: []string{"a"}, EveryNCycles: 2}},
+			}},
+			valid: true,
+		},
+		{
+			name: "rename to a non-string attribute",
+			rules: []ProcessingRule{{
+				RenameAttributes: []RenameRule{{MetricPrefix: "a", Attributes: map[string]interface{}{"b": 3}}},
+			}},
+		},
+		{
+			name: "copy attributes without source metric",
+			rules: []ProcessingRule{{
+				CopyAttributes: []CopyAttributesRule{{ToMetrics: []string{"a"}}},
+			}},
+		},
+		{
+			name: "sample metrics without frequency",
+			rules: []ProcessingRule{{
+				SampleMetrics: []SampleRule{{Prefixes: []string{"a"}}},
+			}},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := ValidateProcessingRules(tc.rules)
+			if tc.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestRuleSetProcessor_Reload(t *testing.T) {
+	t.Parallel()
+
+	process := func(p Processor) []Metric {
+		pairs := make(chan TargetMetrics, 1)
+		pairs <- TargetMetrics{Metrics: []Metric{
+			{name: "dropped_metric", attributes: labels.Set{}},
+			{name: "kept_metric", attributes: labels.Set{}},
+		}}
+		close(pairs)
+		return (<-p(pairs)).Metrics
+	}
+
+	rs, err := NewRuleSet([]ProcessingRule{{IgnoreMetrics: []IgnoreRule{{Prefixes: []string{"dropped_"}}}}})
+	require.NoError(t, err)
+	p := RuleSetProcessor(rs, queueLength, 1)
+	assert.Len(t, process(p), 1)
+
+	// Invalid rules are discarded and the current ones stay in effect.
+	err = rs.Reload([]ProcessingRule{{RenameAttributes: []RenameRule{{Attributes: map[string]interface{}{"a": 1}}}}})
+	assert.Error(t, err)
+	assert.Len(t, process(p), 1)
+
+	err = rs.Reload([]ProcessingRule{})
+	assert.NoError(t, err)
+	assert.Len(t, process(p), 2)
+}
+
+func TestRuleSetProcessor_ReloadKeepsState(t *testing.T) {
+	t.Parallel()
+
+	process := func(p Processor) []string {
+		pairs := make(chan TargetMetrics, 1)
+		pairs <- TargetMetrics{Metrics: []Metric{
+			{name: "sampled_metric", attributes: labels.Set{}},
+		}}
+		close(pairs)
+		var names []string
+		for _, m := range (<-p(pairs)).Metrics {
+			names = append(names, m.name)
+		}
+		return names
+	}
+
+	sampled := ProcessingRule{SampleMetrics: []SampleRule{{Prefixes: []string{"sampled_"}, EveryNCycles: 3}}}
+	rs, err := NewRuleSet([]ProcessingRule{sampled})
+	require.NoError(t, err)
+	p := RuleSetProcessor(rs, queueLength, 1)
+	assert.Equal(t, []string{"sampled_metric"}, process(p))
+
+	// The sampler of the unchanged rules keeps counting the cycles.
+	require.NoError(t, rs.Reload([]ProcessingRule{sampled}))
+	assert.Empty(t, process(p))
+	assert.Empty(t, process(p))
+	assert.Equal(t, []string{"sampled_metric"}, process(p))
+	assert.Empty(t, process(p))
+
+	// The sampler of the changed rules starts over.
+	require.NoError(t, rs.Reload([]ProcessingRule{
+		{SampleMetrics: []SampleRule{{Prefixes: []string{"sampled_"}, EveryNCycles: 2}}},
+	}))
+	assert.Equal(t, []string{"sampled_metric"}, process(p))
+	assert.Empty(t, process(p))
+}
+
+func TestRuleSetProcessor_Workers(t *testing.T) {
+	t.Parallel()
+
+	rs, err := NewRuleSet([]ProcessingRule{
+		{
+			IgnoreMetrics:  []IgnoreRule{{Prefixes: []string{"dropped_"}}},
+			SampleMetrics:  []SampleRule{{Prefixes: []string{"sampled_"}, EveryNCycles: 2}},
+			AddAttributes:  []AddAttributesRule{{MetricPrefix: "kept_", Attributes: map[string]interface{}{"processed": true}}},
+			CopyAttributes: []CopyAttributesRule{{FromMetric: "info", ToMetrics: []string{"kept_"}, MatchBy: []string{"id"}}},
+		},
+	})
+	require.NoError(t, err)
+	p := RuleSetProcessor(rs, queueLength, 8)
+
+	const targets = 100
+	for cycle := 0; cycle < 2; cycle++ {
+		pairs := make(chan TargetMetrics, targets)
+		for i := 0; i < targets; i++ {
+			name := fmt.Sprintf("target-%d", i)
+			pairs <- TargetMetrics{
+				Target: endpoints.Target{Name: name},
+				Metrics: []Metric{
+					{name: "info", attributes: labels.Set{"id": name, "owner": name}},
+					{name: "dropped_metric", attributes: labels.Set{}},
+					{name: "sampled_metric", attributes: labels.Set{}},
+					{name: "kept_metric", attributes: labels.Set{"id": name}},
+				},
+			}
+		}
+		close(pairs)
+
+		seen := map[string]bool{}
+		for pair := range p(pairs) {
+			seen[pair.Target.Name] = true
+			// Every target is processed as a whole by a single worker.
+			names := metricNames(pair.Metrics)
+			if cycle == 0 {
+				assert.Equal(t, []string{"info", "sampled_metric", "kept_metric"}, names)
+			} else {
+				assert.Equal(t, []string{"info", "kept_metric"}, names)
+			}
+			kept := pair.Metrics[len(pair.Metrics)-1]
+			assert.Equal(t, true, kept.attributes["processed"])
+			assert.Equal(t, pair.Target.Name, kept.attributes["owner"])
+		}
+		assert.Len(t, seen, targets)
+	}
+}
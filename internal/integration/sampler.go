@@ -0,0 +1,126 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// samplerStateExpirationAge is how long the sampler remembers a metric of a
+// target that is not being scraped anymore.
+const samplerStateExpirationAge = 10 * time.Minute
+
+// sampler drops the metrics matching a SampleRule on the cycles they must not
+// be emitted. Counters are still valid after being skipped, since emitters
+// calculate the delta against the last value they received, which covers
+// all the skipped cycles.
+type sampler struct {
+	rules []SampleRule
+	// lock protects the states, since targets can be processed in parallel.
+	lock           sync.Mutex
+	states         map[string]*sampleState
+	lastExpiration time.Time
+}
+
+// sampleState keeps track of the emissions of a metric name from a target.
+type sampleState struct {
+	cycles      int
+	lastEmitted time.Time
+	lastSeen    time.Time
+}
+
+func newSampler(rules []SampleRule) *sampler {
+	return &sampler{
+		rules:  rules,
+		states: map[string]*sampleState{},
+	}
+}
+
+// sample removes from the target metrics the ones that must be skipped in the
+// current cycle. All the series of a metric share the same decision.
+func (s *sampler) sample(targetMetrics *TargetMetrics, now time.Time) {
+	// Fast path, quickly exit if there are no rules defined.
+	if len(s.rules) == 0 {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.expire(now)
+
+	decisions := map[string]bool{}
+	copied := make([]Metric, 0, len(targetMetrics.Metrics))
+	for _, m := range targetMetrics.Metrics {
+		emit, ok := decisions[m.name]
+		if !ok {
+			emit = s.shouldEmit(targetMetrics.Target.Name, m.name, now)
+			decisions[m.name] = emit
+		}
+		if emit {
+			copied = append(copied, m)
+		}
+	}
+	targetMetrics.Metrics = copied
+}
+
+// shouldEmit returns whether the metric with the given name must be emitted
+// for the given target. It must be called once per target and cycle.
+func (s *sampler) shouldEmit(targetName, metricName string, now time.Time) bool {
+	rule, ok := s.matchingRule(metricName)
+	if !ok {
+		return true
+	}
+
+	key := targetName + "\x00" + metricName
+	state, ok := s.states[key]
+	if !ok {
+		state = &sampleState{}
+		s.states[key] = state
+	}
+	state.lastSeen = now
+	state.cycles++
+
+	emit := true
+	if rule.EveryNCycles > 1 {
+		emit = (state.cycles-1)%rule.EveryNCycles == 0
+	}
+	if rule.MinInterval > 0 && !state.lastEmitted.IsZero() {
+		emit = emit && now.Sub(state.lastEmitted) >= rule.MinInterval
+	}
+
+	if emit {
+		state.lastEmitted = now
+	}
+	return emit
+}
+
+// matchingRule returns the first rule whose prefixes match the metric name.
+func (s *sampler) matchingRule(name string) (SampleRule, bool) {
+	for _, rule := range s.rules {
+		for _, prefix := range rule.Prefixes {
+			if strings.HasPrefix(name, prefix) {
+				return rule, true
+			}
+		}
+	}
+	return SampleRule{}, false
+}
+
+// expire forgets the metrics that haven't been seen for a while, e.g. because
+// their target has disappeared.
+func (s *sampler) expire(now time.Time) {
+	if now.Sub(s.lastExpiration) < samplerStateExpirationAge {
+		return
+	}
+	s.lastExpiration = now
+
+	for k, state := range s.states {
+		if now.Sub(state.lastSeen) > samplerStateExpirationAge {
+			delete(s.states, k)
+		}
+	}
+}
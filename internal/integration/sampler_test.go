@@ -0,0 +1,121 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+func sampledTargetMetrics(targetName string) TargetMetrics {
+	return TargetMetrics{
+		Target: endpoints.Target{Name: targetName},
+		Metrics: []Metric{
+			{name: "build_info", metricType: metricType_GAUGE, value: 1.0, attributes: labels.Set{"version": "1"}},
+			{name: "build_info", metricType: metricType_GAUGE, value: 1.0, attributes: labels.Set{"version": "2"}},
+			{name: "requests_total", metricType: metricType_COUNTER, value: 10.0, attributes: labels.Set{}},
+		},
+	}
+}
+
+func metricNames(metrics []Metric) []string {
+	names := make([]string, 0, len(metrics))
+	for _, m := range metrics {
+		names = append(names, m.name)
+	}
+	return names
+}
+
+func TestSampler_EveryNCycles(t *testing.T) {
+	t.Parallel()
+
+	s := newSampler([]SampleRule{{Prefixes: []string{"build_"}, EveryNCycles: 3}})
+	now := time.Now()
+
+	var emitted [][]string
+	for i := 0; i < 7; i++ {
+		tm := sampledTargetMetrics("target")
+		s.sample(&tm, now.Add(time.Duration(i)*30*time.Second))
+		emitted = append(emitted, metricNames(tm.Metrics))
+	}
+
+	all := []string{"build_info", "build_info", "requests_total"}
+	skipped := []string{"requests_total"}
+	assert.Equal(t, [][]string{all, skipped, skipped, all, skipped, skipped, all}, emitted)
+}
+
+func TestSampler_MinInterval(t *testing.T) {
+	t.Parallel()
+
+	s := newSampler([]SampleRule{{Prefixes: []string{"build_"}, MinInterval: time.Minute}})
+	now := time.Now()
+
+	var emitted []int
+	for i := 0; i < 5; i++ {
+		tm := sampledTargetMetrics("target")
+		s.sample(&tm, now.Add(time.Duration(i)*30*time.Second))
+		emitted = append(emitted, len(tm.Metrics))
+	}
+
+	assert.Equal(t, []int{3, 1, 3, 1, 3}, emitted)
+}
+
+func TestSampler_TargetsAreSampledIndependently(t *testing.T) {
+	t.Parallel()
+
+	s := newSampler([]SampleRule{{Prefixes: []string{"build_"}, EveryNCycles: 2}})
+	now := time.Now()
+
+	a := sampledTargetMetrics("target-a")
+	s.sample(&a, now)
+	assert.Len(t, a.Metrics, 3)
+
+	a = sampledTargetMetrics("target-a")
+	s.sample(&a, now.Add(30*time.Second))
+	assert.Len(t, a.Metrics, 1)
+
+	// The first time that target-b is seen its metrics must be emitted.
+	b := sampledTargetMetrics("target-b")
+	s.sample(&b, now.Add(30*time.Second))
+	assert.Len(t, b.Metrics, 3)
+}
+
+func TestSampler_ExpiredStatesAreForgotten(t *testing.T) {
+	t.Parallel()
+
+	s := newSampler([]SampleRule{{Prefixes: []string{"build_"}, EveryNCycles: 10}})
+	now := time.Now()
+
+	tm := sampledTargetMetrics("target")
+	s.sample(&tm, now)
+	assert.Len(t, s.states, 1)
+
+	tm = sampledTargetMetrics("other-target")
+	s.sample(&tm, now.Add(2*samplerStateExpirationAge))
+	assert.Len(t, s.states, 1)
+	assert.Contains(t, s.states, "other-target\x00build_info")
+}
+
+func TestRuleProcessor_SampleMetrics(t *testing.T) {
+	t.Parallel()
+
+	processor := RuleProcessor([]ProcessingRule{
+		{SampleMetrics: []SampleRule{{Prefixes: []string{"redis_exporter_build"}, EveryNCycles: 2}}},
+	}, queueLength)
+
+	entity := scrapeString(t, prometheusInput)
+	for cycle, expected := range []int{6, 5, 6} {
+		pairs := make(chan TargetMetrics, 1)
+		pairs <- TargetMetrics{Target: entity.Target, Metrics: append([]Metric{}, entity.Metrics...)}
+		close(pairs)
+
+		processed := <-processor(pairs)
+		assert.Len(t, processed.Metrics, expected, "cycle %d", cycle)
+	}
+}
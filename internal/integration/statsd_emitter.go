@@ -0,0 +1,361 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/cumulative"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+// Aggregates of the summaries and histograms sent by the StatsDEmitter.
+const (
+	StatsDAggregateCount     = "count"
+	StatsDAggregateSum       = "sum"
+	StatsDAggregateQuantiles = "quantiles"
+	StatsDAggregateBuckets   = "buckets"
+)
+
+const (
+	defaultStatsDAddress = "localhost:8125"
+	defaultStatsDNetwork = "udp"
+	// defaultStatsDUDPPacketSize fits in the MTU of most networks without
+	// fragmenting the packets.
+	defaultStatsDUDPPacketSize = 1432
+	defaultStatsDUDSPacketSize = 8192
+)
+
+var defaultStatsDAggregates = []string{StatsDAggregateCount, StatsDAggregateSum, StatsDAggregateQuantiles}
+
+// StatsDEmitterConfig is the configuration of the StatsDEmitter.
+type StatsDEmitterConfig struct {
+	// Address of the StatsD server, a `host:port` for UDP or the path of the
+	// socket for UDS. Defaults to localhost:8125.
+	Address string
+	// Network is either "udp" or "unixgram" for Unix domain sockets.
+	// Defaults to udp.
+	Network string
+	// Prefix is added to the names of the metrics, e.g. `prometheus.`.
+	Prefix string
+	// DogStatsD sends the attributes as DogStatsD tags. Otherwise the
+	// attributes are not sent.
+	DogStatsD bool
+	// MaxPacketSize is the maximum size of the packets, which can have
+	// several metrics. Defaults to 1432 bytes for UDP and 8192 for UDS.
+	MaxPacketSize int
+	// Aggregates are the gauges summaries and histograms are flattened into:
+	// "count", "sum", "quantiles" for summaries and "buckets" for histograms.
+	// Defaults to count, sum and quantiles.
+	Aggregates []string
+	// DeltaExpirationAge is how long the previous values of a counter are
+	// kept after it's not seen anymore. Defaults to 5m.
+	DeltaExpirationAge time.Duration
+}
+
+// StatsDEmitter sends the metrics to a StatsD or DogStatsD server. Gauges are
+// sent as gauges and counters as the counts since their previous values.
+// Summaries and histograms are flattened into gauges.
+type StatsDEmitter struct {
+	name          string
+	network       string
+	address       string
+	prefix        string
+	dogStatsD     bool
+	maxPacketSize int
+	aggregates    map[string]bool
+	// deltaCalculator calculates the counts sent for the counters.
+	deltaCalculator *cumulative.DeltaCalculator
+
+	lock sync.Mutex
+	// conn is opened when the metrics are emitted, and reopened after a
+	// write fails, e.g. if the server of a Unix socket is restarted.
+	conn net.Conn
+}
+
+// NewStatsDEmitter returns a StatsDEmitter, or an error if its configuration
+// is not valid.
+func NewStatsDEmitter(cfg StatsDEmitterConfig) (*StatsDEmitter, error) {
+	network := cfg.Network
+	if network == "" {
+		network = defaultStatsDNetwork
+	}
+	maxPacketSize := cfg.MaxPacketSize
+	switch network {
+	case "udp":
+		if maxPacketSize <= 0 {
+			maxPacketSize = defaultStatsDUDPPacketSize
+		}
+	case "unixgram":
+		if maxPacketSize <= 0 {
+			maxPacketSize = defaultStatsDUDSPacketSize
+		}
+	default:
+		return nil, fmt.Errorf("invalid StatsD network %q, must be \"udp\" or \"unixgram\"", network)
+	}
+
+	address := cfg.Address
+	if address == "" {
+		address = defaultStatsDAddress
+	}
+	if network == "udp" {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return nil, fmt.Errorf("invalid StatsD address %q: %w", address, err)
+		}
+	}
+
+	aggregates := cfg.Aggregates
+	if len(aggregates) == 0 {
+		aggregates = defaultStatsDAggregates
+	}
+	enabled := map[string]bool{}
+	for _, a := range aggregates {
+		switch a {
+		case StatsDAggregateCount, StatsDAggregateSum, StatsDAggregateQuantiles, StatsDAggregateBuckets:
+			enabled[a] = true
+		default:
+			return nil, fmt.Errorf("invalid StatsD aggregate %q", a)
+		}
+	}
+
+	expirationAge := cfg.DeltaExpirationAge
+	if expirationAge <= 0 {
+		expirationAge = defaultDeltaExpirationAge
+	}
+
+	return &StatsDEmitter{
+		name:            "statsd",
+		network:         network,
+		address:         address,
+		prefix:          cfg.Prefix,
+		dogStatsD:       cfg.DogStatsD,
+		maxPacketSize:   maxPacketSize,
+		aggregates:      enabled,
+		deltaCalculator: cumulative.NewDeltaCalculator().SetExpirationAge(expirationAge).SetExpirationCheckInterval(defaultDeltaExpirationCheckInterval),
+	}, nil
+}
+
+// Name is the StatsDEmitter name.
+func (se *StatsDEmitter) Name() string {
+	return se.name
+}
+
+// Emit sends the metrics, with as many of them in each packet as fit in the
+// maximum packet size.
+func (se *StatsDEmitter) Emit(metrics []Metric) error {
+	now := time.Now()
+
+	var results error
+	var lines [][]byte
+	for _, metric := range metrics {
+		metricLines, err := se.lines(metric, now)
+		if err != nil {
+			results = appendError(results, err)
+			continue
+		}
+		lines = append(lines, metricLines...)
+	}
+	if len(lines) == 0 {
+		return results
+	}
+
+	se.lock.Lock()
+	defer se.lock.Unlock()
+	for _, packet := range statsDPackets(lines, se.maxPacketSize) {
+		if err := se.write(packet); err != nil {
+			return appendError(results, err)
+		}
+	}
+	return results
+}
+
+func (se *StatsDEmitter) write(packet []byte) error {
+	if se.conn == nil {
+		conn, err := net.Dial(se.network, se.address)
+		if err != nil {
+			return fmt.Errorf("connecting to StatsD at %s: %w", se.address, err)
+		}
+		se.conn = conn
+	}
+	if _, err := se.conn.Write(packet); err != nil {
+		_ = se.conn.Close()
+		se.conn = nil
+		return fmt.Errorf("sending metrics to StatsD at %s: %w", se.address, err)
+	}
+	return nil
+}
+
+// Close closes the connection to the StatsD server.
+func (se *StatsDEmitter) Close() error {
+	se.lock.Lock()
+	defer se.lock.Unlock()
+	if se.conn == nil {
+		return nil
+	}
+	err := se.conn.Close()
+	se.conn = nil
+	return err
+}
+
+// lines returns the StatsD lines of the metric.
+func (se *StatsDEmitter) lines(metric Metric, now time.Time) ([][]byte, error) {
+	var lines [][]byte
+	add := func(name string, value float64, statsDType string, extra ...promLabel) {
+		// StatsD can't represent NaN nor infinite values.
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			logrus.Debugf("skipping non-finite StatsD value of %q", name)
+			return
+		}
+		lines = append(lines, se.line(name, value, statsDType, metric.attributes, extra...))
+	}
+
+	switch metric.metricType {
+	case metricType_GAUGE:
+		value, ok := metric.value.(float64)
+		if !ok {
+			return nil, fmt.Errorf("unknown gauge metric type for %q: %T", metric.name, metric.value)
+		}
+		add(metric.name, value, "g")
+	case metricType_COUNTER:
+		value, ok := metric.value.(float64)
+		if !ok {
+			return nil, fmt.Errorf("unknown counter metric type for %q: %T", metric.name, metric.value)
+		}
+		// The first value of a counter is only used to calculate the next
+		// delta.
+		if count, ok := se.deltaCalculator.CountMetric(metric.name, metric.attributes, value, now); ok {
+			add(metric.name, count.Value, "c")
+		}
+	case metricType_SUMMARY:
+		summary, ok := metric.value.(*dto.Summary)
+		if !ok {
+			return nil, fmt.Errorf("unknown summary metric type for %q: %T", metric.name, metric.value)
+		}
+		if se.aggregates[StatsDAggregateCount] {
+			add(metric.name+".count", float64(summary.GetSampleCount()), "g")
+		}
+		if se.aggregates[StatsDAggregateSum] {
+			add(metric.name+".sum", summary.GetSampleSum(), "g")
+		}
+		if se.aggregates[StatsDAggregateQuantiles] {
+			for _, q := range summary.GetQuantile() {
+				add(metric.name+".quantile", q.GetValue(), "g", promLabel{"quantile", formatFloat(q.GetQuantile())})
+			}
+		}
+	case metricType_HISTOGRAM:
+		hist, ok := metric.value.(*dto.Histogram)
+		if !ok {
+			return nil, fmt.Errorf("unknown histogram metric type for %q: %T", metric.name, metric.value)
+		}
+		if se.aggregates[StatsDAggregateCount] {
+			add(metric.name+".count", float64(hist.GetSampleCount()), "g")
+		}
+		if se.aggregates[StatsDAggregateSum] {
+			add(metric.name+".sum", hist.GetSampleSum(), "g")
+		}
+		if se.aggregates[StatsDAggregateBuckets] {
+			for _, b := range hist.GetBucket() {
+				add(metric.name+".bucket", float64(b.GetCumulativeCount()), "g", promLabel{"le", formatFloat(b.GetUpperBound())})
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown metric type for %q: %s", metric.name, metric.metricType)
+	}
+	return lines, nil
+}
+
+// statsDNameReplacer replaces the characters with a meaning in the StatsD
+// protocol, and the DogStatsD tags separators.
+var statsDNameReplacer = strings.NewReplacer(":", "_", "|", "_", "@", "_", ",", "_", "#", "_", "\n", "_")
+
+// line returns a StatsD line like `name:value|type`. With DogStatsD the
+// attributes and the extra labels are added as tags, like
+// `name:value|type|#attr:value`. Otherwise the values of the extra labels are
+// added to the name, like `name.0_99:value|type`.
+func (se *StatsDEmitter) line(name string, value float64, statsDType string, attrs labels.Set, extra ...promLabel) []byte {
+	name = statsDNameReplacer.Replace(se.prefix + name)
+	if !se.dogStatsD {
+		for _, l := range extra {
+			name += "." + strings.ReplaceAll(statsDNameReplacer.Replace(l.value), ".", "_")
+		}
+	}
+
+	var buf bytes.Buffer
+	// StatsD takes signed gauge values as changes of the previous value, so
+	// negative gauges are set to zero first. DogStatsD doesn't.
+	if !se.dogStatsD && statsDType == "g" && value < 0 {
+		buf.WriteString(name + ":0|g\n")
+	}
+	buf.WriteString(name)
+	buf.WriteByte(':')
+	buf.WriteString(formatFloat(value))
+	buf.WriteByte('|')
+	buf.WriteString(statsDType)
+
+	if se.dogStatsD {
+		tags := statsDTags(attrs, extra)
+		if len(tags) > 0 {
+			buf.WriteString("|#")
+			buf.WriteString(strings.Join(tags, ","))
+		}
+	}
+	return buf.Bytes()
+}
+
+// statsDTags returns the attributes and extra labels as DogStatsD tags sorted
+// by name. The attributes with the New Relic types of the metrics are
+// dropped.
+func statsDTags(attrs labels.Set, extra []promLabel) []string {
+	tags := make([]string, 0, len(attrs)+len(extra))
+	for name, value := range attrs {
+		if _, ok := prometheusDroppedAttributes[name]; ok {
+			continue
+		}
+		tags = append(tags, statsDNameReplacer.Replace(name)+":"+statsDTagValue(fmt.Sprint(value)))
+	}
+	sort.Strings(tags)
+	for _, l := range extra {
+		tags = append(tags, l.name+":"+statsDTagValue(l.value))
+	}
+	return tags
+}
+
+// statsDTagValueReplacer replaces the separators of the DogStatsD tags.
+// Colons are allowed in the values.
+var statsDTagValueReplacer = strings.NewReplacer("|", "_", ",", "_", "\n", "_")
+
+func statsDTagValue(value string) string {
+	return statsDTagValueReplacer.Replace(value)
+}
+
+// statsDPackets joins the lines with newlines into packets of up to the
+// maximum size. Lines over the size are sent in their own packets.
+func statsDPackets(lines [][]byte, maxSize int) [][]byte {
+	var packets [][]byte
+	var packet []byte
+	for _, line := range lines {
+		if len(packet) > 0 && len(packet)+1+len(line) > maxSize {
+			packets = append(packets, packet)
+			packet = nil
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	if len(packet) > 0 {
+		packets = append(packets, packet)
+	}
+	return packets
+}
@@ -0,0 +1,214 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+// statsDListener listens for StatsD packets on a local UDP port.
+func statsDListener(t *testing.T) net.PacketConn {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+// readStatsDPackets reads the packets received until none arrives for a
+// while.
+func readStatsDPackets(t *testing.T, conn net.PacketConn) []string {
+	t.Helper()
+
+	var packets []string
+	buf := make([]byte, 65536)
+	for {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(200*time.Millisecond)))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return packets
+		}
+		packets = append(packets, string(buf[:n]))
+	}
+}
+
+func statsDLines(packets []string) []string {
+	var lines []string
+	for _, p := range packets {
+		lines = append(lines, strings.Split(p, "\n")...)
+	}
+	return lines
+}
+
+func statsDTestMetrics(counter float64) []Metric {
+	return []Metric{
+		{
+			name:       "redis_connected_clients",
+			metricType: metricType_GAUGE,
+			value:      12.0,
+			attributes: labels.Set{"targetName": "redis:9121", "nrMetricType": "gauge"},
+		},
+		{
+			name:       "redis_commands_total",
+			metricType: metricType_COUNTER,
+			value:      counter,
+			attributes: labels.Set{"cmd": "get"},
+		},
+		{
+			name:       "rpc_duration_seconds",
+			metricType: metricType_SUMMARY,
+			value: &dto.Summary{
+				SampleCount: proto.Uint64(10),
+				SampleSum:   proto.Float64(3.5),
+				Quantile:    []*dto.Quantile{{Quantile: proto.Float64(0.99), Value: proto.Float64(0.8)}},
+			},
+			attributes: labels.Set{},
+		},
+		{
+			name:       "http_duration_seconds",
+			metricType: metricType_HISTOGRAM,
+			value: &dto.Histogram{
+				SampleCount: proto.Uint64(6),
+				SampleSum:   proto.Float64(2.5),
+				Bucket: []*dto.Bucket{
+					{UpperBound: proto.Float64(0.1), CumulativeCount: proto.Uint64(2)},
+				},
+			},
+			attributes: labels.Set{},
+		},
+	}
+}
+
+func TestStatsDEmitter(t *testing.T) {
+	t.Parallel()
+
+	conn := statsDListener(t)
+	se, err := NewStatsDEmitter(StatsDEmitterConfig{Address: conn.LocalAddr().String(), Prefix: "prom."})
+	require.NoError(t, err)
+	defer se.Close()
+
+	require.NoError(t, se.Emit(statsDTestMetrics(40)))
+	require.NoError(t, se.Emit(statsDTestMetrics(42)))
+
+	lines := statsDLines(readStatsDPackets(t, conn))
+	assert.Equal(t, []string{
+		"prom.redis_connected_clients:12|g",
+		"prom.rpc_duration_seconds.count:10|g",
+		"prom.rpc_duration_seconds.sum:3.5|g",
+		"prom.rpc_duration_seconds.quantile.0_99:0.8|g",
+		"prom.http_duration_seconds.count:6|g",
+		"prom.http_duration_seconds.sum:2.5|g",
+		// The counter is only sent with the delta of the second emit.
+		"prom.redis_connected_clients:12|g",
+		"prom.redis_commands_total:2|c",
+		"prom.rpc_duration_seconds.count:10|g",
+		"prom.rpc_duration_seconds.sum:3.5|g",
+		"prom.rpc_duration_seconds.quantile.0_99:0.8|g",
+		"prom.http_duration_seconds.count:6|g",
+		"prom.http_duration_seconds.sum:2.5|g",
+	}, lines)
+}
+
+func TestStatsDEmitter_DogStatsD(t *testing.T) {
+	t.Parallel()
+
+	conn := statsDListener(t)
+	se, err := NewStatsDEmitter(StatsDEmitterConfig{
+		Address:    conn.LocalAddr().String(),
+		DogStatsD:  true,
+		Aggregates: []string{StatsDAggregateQuantiles, StatsDAggregateBuckets},
+	})
+	require.NoError(t, err)
+	defer se.Close()
+
+	require.NoError(t, se.Emit(statsDTestMetrics(40)))
+	lines := statsDLines(readStatsDPackets(t, conn))
+	assert.Equal(t, []string{
+		"redis_connected_clients:12|g|#targetName:redis:9121",
+		"rpc_duration_seconds.quantile:0.8|g|#quantile:0.99",
+		"http_duration_seconds.bucket:2|g|#le:0.1",
+	}, lines)
+}
+
+func TestStatsDEmitter_NegativeGauges(t *testing.T) {
+	t.Parallel()
+
+	metrics := []Metric{{name: "temperature", metricType: metricType_GAUGE, value: -5.0, attributes: labels.Set{}}}
+
+	se, err := NewStatsDEmitter(StatsDEmitterConfig{})
+	require.NoError(t, err)
+	lines, err := se.lines(metrics[0], time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, "temperature:0|g\ntemperature:-5|g", string(lines[0]))
+
+	se, err = NewStatsDEmitter(StatsDEmitterConfig{DogStatsD: true})
+	require.NoError(t, err)
+	lines, err = se.lines(metrics[0], time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, "temperature:-5|g", string(lines[0]))
+}
+
+func TestStatsDEmitter_MaxPacketSize(t *testing.T) {
+	t.Parallel()
+
+	conn := statsDListener(t)
+	se, err := NewStatsDEmitter(StatsDEmitterConfig{Address: conn.LocalAddr().String(), MaxPacketSize: 64})
+	require.NoError(t, err)
+	defer se.Close()
+
+	var metrics []Metric
+	for i := 0; i < 20; i++ {
+		metrics = append(metrics, Metric{name: "up", metricType: metricType_GAUGE, value: 1.0, attributes: labels.Set{}})
+	}
+	require.NoError(t, se.Emit(metrics))
+
+	packets := readStatsDPackets(t, conn)
+	assert.Greater(t, len(packets), 1)
+	for _, p := range packets {
+		assert.LessOrEqual(t, len(p), 64)
+	}
+	assert.Len(t, statsDLines(packets), 20)
+}
+
+func TestStatsDEmitter_UnixSocket(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "dsd.socket")
+	conn, err := net.ListenPacket("unixgram", path)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	se, err := NewStatsDEmitter(StatsDEmitterConfig{Network: "unixgram", Address: path})
+	require.NoError(t, err)
+	defer se.Close()
+
+	require.NoError(t, se.Emit([]Metric{{name: "up", metricType: metricType_GAUGE, value: 1.0, attributes: labels.Set{}}}))
+	assert.Equal(t, []string{"up:1|g"}, readStatsDPackets(t, conn))
+}
+
+func TestNewStatsDEmitter_InvalidConfig(t *testing.T) {
+	t.Parallel()
+
+	testCases := map[string]StatsDEmitterConfig{
+		"network":   {Network: "tcp"},
+		"address":   {Address: "localhost"},
+		"aggregate": {Aggregates: []string{"p99"}},
+	}
+	for name, cfg := range testCases {
+		_, err := NewStatsDEmitter(cfg)
+		assert.Error(t, err, name)
+	}
+}
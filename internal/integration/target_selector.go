@@ -0,0 +1,125 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+)
+
+// TargetSelector restricts a ProcessingRule to the targets that match all
+// its non-empty fields. A field with several values matches if any of them
+// does.
+type TargetSelector struct {
+	// Names are regular expressions matching the whole name of the target.
+	Names []string `mapstructure:"names"`
+	// Kinds are the kinds of the object exposing the target, e.g. `pod`,
+	// `service` or `user_provided`.
+	Kinds []string `mapstructure:"kinds"`
+	// URLs are regular expressions matching the whole URL of the target.
+	URLs []string `mapstructure:"urls"`
+	// Labels are the values that the labels of the object exposing the
+	// target must have, e.g. `namespaceName` or `label.app`. The label names
+	// are matched case-insensitively, since the configuration keys are
+	// lowercased when loaded.
+	Labels map[string]string `mapstructure:"labels"`
+}
+
+// targetSelector is the compiled form of a TargetSelector.
+type targetSelector struct {
+	names  []*regexp.Regexp
+	kinds  []string
+	urls   []*regexp.Regexp
+	labels map[string]string
+	// invalid selectors match no target.
+	invalid bool
+}
+
+// compileTargetSelector returns nil if the selector is nil, so the rule
+// applies to all the targets.
+func compileTargetSelector(ts *TargetSelector) (*targetSelector, error) {
+	if ts == nil {
+		return nil, nil
+	}
+
+	s := &targetSelector{
+		kinds:  ts.Kinds,
+		labels: map[string]string{},
+	}
+	for name, value := range ts.Labels {
+		s.labels[strings.ToLower(name)] = value
+	}
+	for _, expr := range ts.Names {
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid target name expression %q: %w", expr, err)
+		}
+		s.names = append(s.names, re)
+	}
+	for _, expr := range ts.URLs {
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid target URL expression %q: %w", expr, err)
+		}
+		s.urls = append(s.urls, re)
+	}
+	return s, nil
+}
+
+// matches returns whether the selector matches the target. A nil selector
+// matches all the targets.
+func (s *targetSelector) matches(t *endpoints.Target) bool {
+	if s == nil {
+		return true
+	}
+	if s.invalid {
+		return false
+	}
+
+	if len(s.names) > 0 && !anyRegexpMatches(s.names, t.Name) {
+		return false
+	}
+	if len(s.kinds) > 0 && !anyEqualFold(s.kinds, t.Object.Kind) {
+		return false
+	}
+	if len(s.urls) > 0 && !anyRegexpMatches(s.urls, t.URL.String()) {
+		return false
+	}
+	if len(s.labels) == 0 {
+		return true
+	}
+	matched := 0
+	for name, v := range t.Object.Labels {
+		value, ok := s.labels[strings.ToLower(name)]
+		if !ok {
+			continue
+		}
+		if fmt.Sprint(v) != value {
+			return false
+		}
+		matched++
+	}
+	return matched == len(s.labels)
+}
+
+func anyRegexpMatches(expressions []*regexp.Regexp, s string) bool {
+	for _, re := range expressions {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+func anyEqualFold(values []string, s string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+func selectorTarget(t *testing.T) endpoints.Target {
+	t.Helper()
+
+	u, err := url.Parse("http://10.0.0.12:9121/metrics")
+	require.NoError(t, err)
+	return endpoints.Target{
+		Name: "redis-exporter-0",
+		URL:  *u,
+		Object: endpoints.Object{
+			Name: "redis-exporter-0",
+			Kind: "pod",
+			Labels: labels.Set{
+				"namespaceName": "cache",
+				"label.app":     "redis",
+			},
+		},
+	}
+}
+
+func TestTargetSelector_Matches(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name     string
+		selector *TargetSelector
+		matches  bool
+	}{
+		{name: "nil selector", selector: nil, matches: true},
+		{name: "empty selector", selector: &TargetSelector{}, matches: true},
+		{name: "name", selector: &TargetSelector{Names: []string{"redis-.*"}}, matches: true},
+		{name: "partial name", selector: &TargetSelector{Names: []string{"redis"}}, matches: false},
+		{name: "any name", selector: &TargetSelector{Names: []string{"nginx-.*", "redis-.*"}}, matches: true},
+		{name: "kind", selector: &TargetSelector{Kinds: []string{"Pod"}}, matches: true},
+		{name: "other kind", selector: &TargetSelector{Kinds: []string{"service"}}, matches: false},
+		{name: "url", selector: &TargetSelector{URLs: []string{`http://10\.0\.0\.\d+:9121/metrics`}}, matches: true},
+		{name: "labels", selector: &TargetSelector{Labels: map[string]string{"namespaceName": "cache", "label.app": "redis"}}, matches: true},
+		{name: "other label value", selector: &TargetSelector{Labels: map[string]string{"namespaceName": "default"}}, matches: false},
+		{name: "missing label", selector: &TargetSelector{Labels: map[string]string{"label.team": ""}}, matches: false},
+		{
+			name:     "all fields must match",
+			selector: &TargetSelector{Names: []string{"redis-.*"}, Kinds: []string{"service"}},
+			matches:  false,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			selector, err := compileTargetSelector(tc.selector)
+			require.NoError(t, err)
+			target := selectorTarget(t)
+			assert.Equal(t, tc.matches, selector.matches(&target))
+		})
+	}
+}
+
+func TestRuleProcessor_TargetSelector(t *testing.T) {
+	t.Parallel()
+
+	processor := RuleProcessor([]ProcessingRule{
+		{
+			TargetSelector: &TargetSelector{Labels: map[string]string{"namespaceName": "cache"}},
+			IgnoreMetrics:  []IgnoreRule{{Prefixes: []string{"redis_"}}},
+		},
+		{
+			AddAttributes: []AddAttributesRule{{MetricPrefix: "redis_", Attributes: map[string]interface{}{"team": "any"}}},
+		},
+	}, queueLength)
+
+	selected := selectorTarget(t)
+	other := selectorTarget(t)
+	other.Name = "redis-exporter-1"
+	other.Object.Labels = labels.Set{"namespaceName": "default"}
+
+	newMetrics := func() []Metric {
+		return []Metric{
+			{name: "redis_up", metricType: metricType_GAUGE, value: 1.0, attributes: labels.Set{}},
+			{name: "go_goroutines", metricType: metricType_GAUGE, value: 10.0, attributes: labels.Set{}},
+		}
+	}
+	processed := processTargets(processor,
+		TargetMetrics{Target: selected, Metrics: newMetrics()},
+		TargetMetrics{Target: other, Metrics: newMetrics()},
+	)
+	require.Len(t, processed, 2)
+
+	assert.Equal(t, []string{"go_goroutines"}, metricNames(processed[0].Metrics))
+	assert.Equal(t, []string{"redis_up", "go_goroutines"}, metricNames(processed[1].Metrics))
+	assert.Equal(t, "any", processed[1].Metrics[0].attributes["team"])
+}
+
+func TestValidateProcessingRules_TargetSelector(t *testing.T) {
+	t.Parallel()
+
+	err := ValidateProcessingRules([]ProcessingRule{{TargetSelector: &TargetSelector{Names: []string{"redis-("}}}})
+	assert.Error(t, err)
+
+	err = ValidateProcessingRules([]ProcessingRule{{TargetSelector: &TargetSelector{URLs: []string{"http://[a-z"}}}})
+	assert.Error(t, err)
+
+	err = ValidateProcessingRules([]ProcessingRule{{TargetSelector: &TargetSelector{Names: []string{"redis-.*"}}}})
+	assert.NoError(t, err)
+}
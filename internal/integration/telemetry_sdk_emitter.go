@@ -10,6 +10,7 @@ import (
 	"math"
 	"net/http"
 	"net/url"
+	"sync"
 	"time"
 
 	"github.com/newrelic/newrelic-telemetry-sdk-go/cumulative"
@@ -19,6 +20,10 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// telemetryEmitterCloseTimeout is how long the emitter waits to send the
+// recorded metrics when it's closed.
+const telemetryEmitterCloseTimeout = 10 * time.Second
+
 // Harvester aggregates and reports metrics and spans
 type harvester interface {
 	RecordMetric(m telemetry.Metric)
@@ -29,7 +34,19 @@ type harvester interface {
 type TelemetryEmitter struct {
 	name            string
 	harvester       harvester
-	deltaCalculator *cumulative.DeltaCalculator
+	deltaCalculator deltaCalculator
+	// exemplars sends the exemplars as events, if they are enabled.
+	exemplars *exemplarEvents
+	// creations and started detect the resets of the counters exposing
+	// their created timestamp.
+	creations *counterCreations
+	started   time.Time
+
+	// deltaState saves the state of the deltaCalculator, if it's persisted.
+	deltaState         *persistentDeltaCalculator
+	deltaStateInterval time.Duration
+	done               chan struct{}
+	closeOnce          sync.Once
 }
 
 // TelemetryEmitterConfig is the configuration required for the
@@ -46,6 +63,23 @@ type TelemetryEmitterConfig struct {
 	// duration between checking for expirations. Defaults to 30s.
 	DeltaExpirationCheckInternval time.Duration
 
+	// Exemplars sends the last exemplar of the counters and histogram
+	// buckets as an event with its `trace.id` and `span.id`, so the metrics
+	// can be linked to the traces. Each exemplar is sent once. The events
+	// are sent to the Event API, whose URL can be set with the
+	// telemetry.ConfigEventsURLOverride harvester option.
+	Exemplars bool
+
+	// DeltaStateStore persists the state of the DeltaCalculator, so the
+	// counters keep their continuity across restarts. Disabled if nil.
+	DeltaStateStore DeltaStateStore
+	// DeltaStateInterval is how often the state is saved, besides when the
+	// emitter is closed. Defaults to 1m.
+	DeltaStateInterval time.Duration
+	// DeltaStateMaxAge is how old the saved state can be to be loaded.
+	// Defaults to the DeltaExpirationAge.
+	DeltaStateMaxAge time.Duration
+
 	// boundedHarvester configuration
 	DisableBoundedHarvester bool
 	BoundedHarvesterCfg
@@ -157,11 +191,11 @@ func NewTelemetryEmitter(cfg TelemetryEmitterConfig) (*TelemetryEmitter, error)
 		deltaExpirationCheckInterval,
 	)
 
-	var h harvester
-	h, err := telemetry.NewHarvester(append(cfg.HarvesterOpts, telemetryHarvesterZeroPeriod)...)
+	th, err := telemetry.NewHarvester(append(cfg.HarvesterOpts, telemetryHarvesterZeroPeriod)...)
 	if err != nil {
 		return nil, errors.Wrap(err, "could not create new Harvester")
 	}
+	var h harvester = th
 
 	if !cfg.DisableBoundedHarvester {
 		// Create a bound harvester based on passed configuration if going to run in a loop
@@ -172,11 +206,80 @@ func NewTelemetryEmitter(cfg TelemetryEmitterConfig) (*TelemetryEmitter, error)
 	// If we do send them, the harvester will always output these as errors
 	h = harvesterDecorator{h}
 
-	return &TelemetryEmitter{
+	te := &TelemetryEmitter{
 		name:            "telemetry",
 		harvester:       h,
 		deltaCalculator: dc,
-	}, nil
+		creations:       newCounterCreations(deltaExpirationAge),
+		started:         time.Now(),
+		done:            make(chan struct{}),
+	}
+	if cfg.Exemplars {
+		// The events are recorded in the same harvester, so they are sent
+		// with the metrics.
+		te.exemplars = newExemplarEvents(th, deltaExpirationAge)
+	}
+	if cfg.DeltaStateStore != nil {
+		te.loadDeltaState(dc, cfg, deltaExpirationAge)
+		go te.saveDeltaStatePeriodically()
+	}
+	return te, nil
+}
+
+// loadDeltaState restores the saved state of the DeltaCalculator. The
+// emitter starts without it if it can't be loaded.
+func (te *TelemetryEmitter) loadDeltaState(dc *cumulative.DeltaCalculator, cfg TelemetryEmitterConfig, expirationAge time.Duration) {
+	te.deltaState = newPersistentDeltaCalculator(dc, cfg.DeltaStateStore, expirationAge)
+	te.deltaCalculator = te.deltaState
+	te.deltaStateInterval = cfg.DeltaStateInterval
+	if te.deltaStateInterval <= 0 {
+		te.deltaStateInterval = defaultDeltaStateInterval
+	}
+	maxAge := cfg.DeltaStateMaxAge
+	if maxAge <= 0 {
+		maxAge = expirationAge
+	}
+
+	restored, err := te.deltaState.load(time.Now(), maxAge)
+	if err != nil {
+		logrus.WithError(err).Warn("the telemetry emitter starts without the saved delta state")
+		return
+	}
+	logrus.Debugf("telemetry emitter restored the delta state of %d series", restored)
+}
+
+func (te *TelemetryEmitter) saveDeltaStatePeriodically() {
+	ticker := time.NewTicker(te.deltaStateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-te.done:
+			return
+		case now := <-ticker.C:
+			if err := te.deltaState.save(now); err != nil {
+				logrus.WithError(err).Warn("telemetry emitter couldn't save the delta state")
+			}
+		}
+	}
+}
+
+// Close sends the recorded metrics and saves the delta state, if it's
+// persisted. The deltas emitted after the last save are emitted again after
+// a restart if the emitter is not closed.
+func (te *TelemetryEmitter) Close() error {
+	var err error
+	te.closeOnce.Do(func() {
+		close(te.done)
+		if te.deltaState == nil {
+			return
+		}
+		// The deltas in the saved state must have been sent.
+		ctx, cancel := context.WithTimeout(context.Background(), telemetryEmitterCloseTimeout)
+		defer cancel()
+		te.harvester.HarvestNow(ctx)
+		err = te.deltaState.save(time.Now())
+	})
+	return err
 }
 
 // Name returns the emitter name.
@@ -202,15 +305,17 @@ func (te *TelemetryEmitter) Emit(metrics []Metric) error {
 				Timestamp:  now,
 			})
 		case metricType_COUNTER:
-			m, ok := te.deltaCalculator.CountMetric(
+			m, ok := te.countMetric(
 				metric.name,
 				metric.attributes,
 				metric.value.(float64),
+				metric.created,
 				now,
 			)
 			if ok {
 				te.harvester.RecordMetric(m)
 			}
+			te.exemplars.record(metric.name, metric.attributes, metric.exemplar, now)
 		case metricType_SUMMARY:
 			if err := te.emitSummary(metric, now); err != nil {
 				if results == nil {
@@ -246,7 +351,8 @@ func (te *TelemetryEmitter) emitSummary(metric Metric, timestamp time.Time) erro
 		return fmt.Errorf("unknown summary metric type for %q: %T", metric.name, metric.value)
 	}
 
-	if sumCount, ok := te.deltaCalculator.CountMetric(metric.name+"_sum", metric.attributes, float64(summary.GetSampleSum()), timestamp); ok {
+	created := createdTime(summary.GetCreatedTimestamp())
+	if sumCount, ok := te.countMetric(metric.name+"_sum", metric.attributes, float64(summary.GetSampleSum()), created, timestamp); ok {
 		te.harvester.RecordMetric(telemetry.Summary{
 			Name:       metric.name + "_sum",
 			Attributes: metric.attributes,
@@ -258,7 +364,7 @@ func (te *TelemetryEmitter) emitSummary(metric Metric, timestamp time.Time) erro
 		})
 	}
 
-	if count, ok := te.deltaCalculator.CountMetric(metric.name+"_count", metric.attributes, float64(summary.GetSampleCount()), timestamp); ok {
+	if count, ok := te.countMetric(metric.name+"_count", metric.attributes, float64(summary.GetSampleCount()), created, timestamp); ok {
 		te.harvester.RecordMetric(count)
 	}
 
@@ -282,7 +388,8 @@ func (te *TelemetryEmitter) emitHistogram(metric Metric, timestamp time.Time) er
 		return fmt.Errorf("unknown histogram metric type for %q: %T", metric.name, metric.value)
 	}
 
-	if sumCount, ok := te.deltaCalculator.CountMetric(metric.name+"_sum", metric.attributes, float64(hist.GetSampleSum()), timestamp); ok {
+	created := createdTime(hist.GetCreatedTimestamp())
+	if sumCount, ok := te.countMetric(metric.name+"_sum", metric.attributes, float64(hist.GetSampleSum()), created, timestamp); ok {
 		te.harvester.RecordMetric(telemetry.Summary{
 			Name:       metric.name + "_sum",
 			Attributes: metric.attributes,
@@ -294,7 +401,7 @@ func (te *TelemetryEmitter) emitHistogram(metric Metric, timestamp time.Time) er
 		})
 	}
 
-	if count, ok := te.deltaCalculator.CountMetric(metric.name+"_count", metric.attributes, float64(hist.GetSampleCount()), timestamp); ok {
+	if count, ok := te.countMetric(metric.name+"_count", metric.attributes, float64(hist.GetSampleCount()), created, timestamp); ok {
 		te.harvester.RecordMetric(count)
 	}
 
@@ -303,15 +410,17 @@ func (te *TelemetryEmitter) emitHistogram(metric Metric, timestamp time.Time) er
 		bucketAttrs := copyAttrs(metric.attributes)
 		bucketAttrs["le"] = fmt.Sprintf("%g", b.GetUpperBound())
 
-		bucketCount, ok := te.deltaCalculator.CountMetric(
+		bucketCount, ok := te.countMetric(
 			metricName,
 			bucketAttrs,
 			float64(b.GetCumulativeCount()),
+			created,
 			timestamp,
 		)
 		if ok {
 			te.harvester.RecordMetric(bucketCount)
 		}
+		te.exemplars.record(metricName, bucketAttrs, newExemplar(b.GetExemplar()), timestamp)
 	}
 
 	return nil
@@ -25,8 +25,11 @@ import (
 	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
 	"github.com/newrelic/nri-prometheus/internal/pkg/prometheus"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
 	assert "github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -415,8 +418,8 @@ func decodePromMetrics(src io.Reader) (*prometheus.MetricFamiliesByName, error)
 	mfs := prometheus.MetricFamiliesByName{}
 	d := expfmt.NewDecoder(src, expfmt.FmtText)
 	for {
-		var mf dto.MetricFamily
-		if err := d.Decode(&mf); err != nil {
+		mf := &dto.MetricFamily{}
+		if err := d.Decode(mf); err != nil {
 			if err == io.EOF {
 				break
 			}
@@ -501,3 +504,240 @@ func purgeTimestamps(metrics []interface{}) {
 		delete(assertedM, "interval.ms")
 	}
 }
+
+// recordingHarvester keeps the recorded metrics.
+type recordingHarvester struct {
+	metrics []telemetry.Metric
+}
+
+func (h *recordingHarvester) RecordMetric(m telemetry.Metric) {
+	h.metrics = append(h.metrics, m)
+}
+
+func (h *recordingHarvester) HarvestNow(context.Context) {}
+
+// newRecordingTelemetryEmitter returns a TelemetryEmitter recording its
+// metrics in the returned harvester, which keeps the state of the deltas in
+// the store, if any.
+func newRecordingTelemetryEmitter(t *testing.T, store DeltaStateStore) (*TelemetryEmitter, *recordingHarvester) {
+	t.Helper()
+
+	emitter, err := NewTelemetryEmitter(TelemetryEmitterConfig{
+		HarvesterOpts:           []TelemetryHarvesterOpt{telemetry.ConfigAPIKey("api key")},
+		DisableBoundedHarvester: true,
+		DeltaStateStore:         store,
+	})
+	require.NoError(t, err)
+	h := &recordingHarvester{}
+	emitter.harvester = h
+	return emitter, h
+}
+
+// emitTestCounter emits a value of the http_requests_total counter, with its
+// created timestamp if it's not zero.
+func emitTestCounter(t *testing.T, emitter *TelemetryEmitter, value float64, created time.Time) {
+	t.Helper()
+
+	require.NoError(t, emitter.Emit([]Metric{{
+		name:       "http_requests_total",
+		metricType: metricType_COUNTER,
+		value:      value,
+		attributes: labels.Set{"code": "200"},
+		created:    created,
+	}}))
+}
+
+func countValues(metrics []telemetry.Metric) []float64 {
+	var values []float64
+	for _, m := range metrics {
+		if c, ok := m.(telemetry.Count); ok {
+			values = append(values, c.Value)
+		}
+	}
+	return values
+}
+
+func TestTelemetryEmitterEmit_Exemplars(t *testing.T) {
+	t.Parallel()
+
+	// The exemplar of the counter has a timestamp, the one of the bucket
+	// doesn't.
+	payload := func(requests int, timestamp float64, traceID string) []byte {
+		return []byte(fmt.Sprintf(`# TYPE http_requests counter
+http_requests_total{code="200"} %d # {trace_id="%s",span_id="b7ad6b7169203331"} 1 %g
+# TYPE http_duration_seconds histogram
+http_duration_seconds_bucket{le="0.5"} %d # {traceID="%s"} 0.3
+http_duration_seconds_bucket{le="+Inf"} %d
+http_duration_seconds_sum 10
+http_duration_seconds_count %d
+# EOF
+`, requests, traceID, timestamp, requests, traceID, requests, requests))
+	}
+	traceA := "0af7651916cd43dd8448eb211c80319c"
+	traceB := "4bf92f3577b34da6a3ce929d0e0e4736"
+	scrapes := []struct {
+		timestamp float64
+		traceID   string
+	}{
+		{timestamp: 1520879607, traceID: traceA},
+		// The same exemplars are exposed until new ones are sampled.
+		{timestamp: 1520879607, traceID: traceA},
+		{timestamp: 1520879608, traceID: traceB},
+		// A stale exemplar of the counter is not sent.
+		{timestamp: 1520879606, traceID: traceA},
+	}
+
+	emit := func(t *testing.T, exemplars bool) (*recordingHarvester, *recordingEventHarvester) {
+		t.Helper()
+
+		emitter, err := NewTelemetryEmitter(TelemetryEmitterConfig{
+			HarvesterOpts:           []TelemetryHarvesterOpt{telemetry.ConfigAPIKey("api key")},
+			DisableBoundedHarvester: true,
+			Exemplars:               exemplars,
+		})
+		require.NoError(t, err)
+		h := &recordingHarvester{}
+		emitter.harvester = h
+		events := &recordingEventHarvester{}
+		if emitter.exemplars != nil {
+			emitter.exemplars.recorder = events
+		}
+
+		for i, scrape := range scrapes {
+			mfs, err := prometheus.DecodeOpenMetrics(payload(10*(i+1), scrape.timestamp, scrape.traceID))
+			require.NoError(t, err)
+			require.NoError(t, emitter.Emit(convertPromMetrics(nil, "target", mfs)))
+		}
+		return h, events
+	}
+
+	h, events := emit(t, true)
+	// The exemplars don't split the series.
+	for _, m := range h.metrics {
+		if c, ok := m.(telemetry.Count); ok {
+			assert.NotContains(t, c.Attributes, "trace.id", c.Name)
+		}
+	}
+
+	// The events are grouped by metric, since the order of the metrics of
+	// a scrape is not deterministic.
+	type sent struct {
+		traceID, spanID string
+		timestamp       int64
+	}
+	got := map[string][]sent{}
+	now := time.Now().Unix()
+	for _, e := range events.events {
+		assert.Equal(t, "PrometheusExemplar", e.EventType)
+		assert.Equal(t, "target", e.Attributes["targetName"])
+		metric := e.Attributes["metricName"].(string)
+		spanID, _ := e.Attributes["span.id"].(string)
+		timestamp := e.Timestamp.Unix()
+		if metric == "http_duration_seconds_bucket" {
+			assert.Equal(t, "0.5", e.Attributes["le"])
+			assert.Equal(t, 0.3, e.Attributes["value"])
+			// The exemplars without a timestamp are sent at the emit time.
+			assert.InDelta(t, now, timestamp, 60)
+			timestamp = 0
+		}
+		got[metric] = append(got[metric], sent{traceID: e.Attributes["trace.id"].(string), spanID: spanID, timestamp: timestamp})
+	}
+	assert.Equal(t, map[string][]sent{
+		"http_requests_total": {
+			{traceID: traceA, spanID: "b7ad6b7169203331", timestamp: 1520879607},
+			{traceID: traceB, spanID: "b7ad6b7169203331", timestamp: 1520879608},
+		},
+		// The exemplar of the bucket has no timestamp, so every change of
+		// its trace is sent.
+		"http_duration_seconds_bucket": {{traceID: traceA}, {traceID: traceB}, {traceID: traceA}},
+	}, got)
+
+	_, events = emit(t, false)
+	assert.Empty(t, events.events)
+}
+
+// The tests are not parallel, since they assert the global count of resets.
+func TestTelemetryEmitter_CounterResets(t *testing.T) {
+	longAgo := time.Now().Add(-time.Hour)
+
+	testCases := []struct {
+		name     string
+		values   []float64
+		reset    bool
+		expected []float64
+		resets   float64
+	}{
+		{name: "no reset", values: []float64{10, 15, 22}, expected: []float64{5, 7}},
+		// Without the created timestamp the reset would be reported as an
+		// increment of 5.
+		{name: "reset to a higher value", values: []float64{10, 15, 20}, reset: true, expected: []float64{5, 20}, resets: 1},
+		{name: "reset to a lower value", values: []float64{10, 15, 3}, reset: true, expected: []float64{5, 3}, resets: 1},
+		// A lower value with the same created timestamp is not a reset.
+		{name: "stale value", values: []float64{10, 15, 3}, expected: []float64{5}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resets := testutil.ToFloat64(counterResetsTotalMetric)
+			emitter, h := newRecordingTelemetryEmitter(t, nil)
+
+			created := longAgo
+			for i, value := range tc.values {
+				if tc.reset && i == len(tc.values)-1 {
+					created = time.Now()
+				}
+				emitTestCounter(t, emitter, value, created)
+			}
+			assert.Equal(t, tc.expected, countValues(h.metrics))
+			assert.Equal(t, resets+tc.resets, testutil.ToFloat64(counterResetsTotalMetric))
+		})
+	}
+}
+
+func TestTelemetryEmitter_NewCounters(t *testing.T) {
+	t.Parallel()
+
+	emitter, h := newRecordingTelemetryEmitter(t, nil)
+	// The first value of a counter created before the emitter started can't
+	// be told apart from the increments already reported.
+	emitTestCounter(t, emitter, 10, time.Now().Add(-time.Hour))
+	assert.Empty(t, h.metrics)
+
+	// The first value of a counter created afterwards is its first delta.
+	created := time.Now()
+	require.NoError(t, emitter.Emit([]Metric{{
+		name:       "http_errors_total",
+		metricType: metricType_COUNTER,
+		value:      4.0,
+		attributes: labels.Set{"code": "500"},
+		created:    created,
+	}, {
+		name:       "http_duration_seconds",
+		metricType: metricType_HISTOGRAM,
+		value: &dto.Histogram{
+			SampleCount: proto.Uint64(3),
+			SampleSum:   proto.Float64(1.5),
+			Bucket: []*dto.Bucket{
+				{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(2)},
+			},
+			CreatedTimestamp: timestamppb.New(created),
+		},
+		attributes: labels.Set{},
+	}}))
+
+	first := map[string]float64{}
+	for _, m := range h.metrics {
+		switch m := m.(type) {
+		case telemetry.Count:
+			first[m.Name] = m.Value
+			assert.True(t, created.Equal(m.Timestamp), m.Name)
+		case telemetry.Summary:
+			first[m.Name] = m.Sum
+		}
+	}
+	assert.Equal(t, map[string]float64{
+		"http_errors_total":            4,
+		"http_duration_seconds_count":  3,
+		"http_duration_seconds_sum":    1.5,
+		"http_duration_seconds_bucket": 2,
+	}, first)
+}
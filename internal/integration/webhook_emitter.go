@@ -0,0 +1,263 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"text/template"
+	"time"
+)
+
+const (
+	defaultWebhookBatchSize     = 1000
+	defaultWebhookMaxBatchBytes = 1024 * 1024
+	defaultWebhookContentType   = "application/json"
+)
+
+// WebhookEmitterConfig is the configuration of the WebhookEmitter.
+type WebhookEmitterConfig struct {
+	// URL the batches of metrics are posted to.
+	URL string
+	// Headers are added to every request.
+	Headers map[string]string
+	// Template is a Go template rendering the body of the requests. It's
+	// executed with a WebhookBatch. If empty, the body is a JSON object with
+	// the metrics in the `metrics` array.
+	Template string
+	// TemplateFile is the path of a file with the Template. Only one of them
+	// can be set.
+	TemplateFile string
+	// ContentType of the bodies rendered by the Template. Defaults to
+	// application/json.
+	ContentType string
+	// BatchSize is the maximum number of metrics sent in each request.
+	// Defaults to 1000.
+	BatchSize int
+	// MaxBatchBytes is the maximum size of the uncompressed body of each
+	// request. Batches over it are split, unless they have a single metric.
+	// Defaults to 1MB.
+	MaxBatchBytes int
+	// DisableCompression sends the requests without compressing them with
+	// gzip.
+	DisableCompression bool
+	// Timeout of each request. Defaults to 10 seconds.
+	Timeout time.Duration
+	// MaxRetries is the number of times a request is retried on network
+	// errors or 429, 502, 503 and 504 responses. Zero means the default of 3,
+	// and a negative value disables the retries.
+	MaxRetries int
+	// RetryBackoff is the time waited before the first retry, which is
+	// doubled on every retry. Defaults to 1 second.
+	RetryBackoff time.Duration
+	TLSConfig    *tls.Config
+	ProxyURL     *url.URL
+}
+
+// WebhookBatch is the data the template of the WebhookEmitter is executed
+// with.
+type WebhookBatch struct {
+	// Timestamp of the batch, in milliseconds since the epoch.
+	Timestamp int64
+	Metrics   []WebhookMetric
+}
+
+// WebhookMetric is a metric in a WebhookBatch. The Value is a float, or an
+// object with the sample count and sum, and the quantiles of the summaries
+// or the buckets of the histograms.
+type WebhookMetric struct {
+	Name       string
+	Type       string
+	Value      interface{}
+	Attributes map[string]interface{}
+}
+
+// WebhookEmitter posts batches of metrics to an HTTP endpoint, with a body
+// rendered from a template or with a fixed JSON schema.
+type WebhookEmitter struct {
+	name          string
+	sender        *httpSender
+	template      *template.Template
+	contentType   string
+	batchSize     int
+	maxBatchBytes int
+}
+
+// NewWebhookEmitter returns a WebhookEmitter, or an error if the URL or the
+// template are not valid.
+func NewWebhookEmitter(cfg WebhookEmitterConfig) (*WebhookEmitter, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("the webhook emitter URL is required")
+	}
+	if _, err := url.ParseRequestURI(cfg.URL); err != nil {
+		return nil, fmt.Errorf("invalid webhook URL %q: %w", cfg.URL, err)
+	}
+
+	text := cfg.Template
+	if cfg.TemplateFile != "" {
+		if text != "" {
+			return nil, fmt.Errorf("only one of the webhook template and template file can be set")
+		}
+		b, err := os.ReadFile(cfg.TemplateFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading the webhook template file: %w", err)
+		}
+		text = string(b)
+	}
+	var tmpl *template.Template
+	if text != "" {
+		var err error
+		tmpl, err = template.New("webhook").Funcs(webhookTemplateFuncs).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("parsing the webhook template: %w", err)
+		}
+	}
+
+	contentType := cfg.ContentType
+	if contentType == "" {
+		contentType = defaultWebhookContentType
+	}
+	batchSize := cfg.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultWebhookBatchSize
+	}
+	maxBatchBytes := cfg.MaxBatchBytes
+	if maxBatchBytes <= 0 {
+		maxBatchBytes = defaultWebhookMaxBatchBytes
+	}
+	encoding := encodingGzip
+	if cfg.DisableCompression {
+		encoding = ""
+	}
+
+	return &WebhookEmitter{
+		name: "webhook",
+		sender: &httpSender{
+			client:       newHTTPClient(cfg.Timeout, cfg.TLSConfig, cfg.ProxyURL),
+			url:          cfg.URL,
+			headers:      cfg.Headers,
+			encoding:     encoding,
+			maxRetries:   senderRetries(cfg.MaxRetries),
+			retryBackoff: senderRetryBackoff(cfg.RetryBackoff),
+		},
+		template:      tmpl,
+		contentType:   contentType,
+		batchSize:     batchSize,
+		maxBatchBytes: maxBatchBytes,
+	}, nil
+}
+
+// webhookTemplateFuncs are the functions available in the webhook templates.
+var webhookTemplateFuncs = template.FuncMap{
+	// json marshals the value, e.g. `{{ json .Attributes }}`. NaN and
+	// infinite values are marshaled as strings.
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// Name is the WebhookEmitter name.
+func (we *WebhookEmitter) Name() string {
+	return we.name
+}
+
+// Emit posts the metrics in batches of up to BatchSize metrics and
+// MaxBatchBytes bytes.
+func (we *WebhookEmitter) Emit(metrics []Metric) error {
+	// Each batch of the request carries the time of the emission.
+	timestamp := time.Now().UnixMilli()
+
+	var results error
+	batch := make([]WebhookMetric, 0, we.batchSize)
+	flush := func() {
+		if len(batch) > 0 {
+			results = appendError(results, we.send(WebhookBatch{Timestamp: timestamp, Metrics: batch}))
+			batch = make([]WebhookMetric, 0, we.batchSize)
+		}
+	}
+	for i := range metrics {
+		m, err := webhookMetric(&metrics[i])
+		if err != nil {
+			results = appendError(results, err)
+			continue
+		}
+		batch = append(batch, m)
+		if len(batch) >= we.batchSize {
+			flush()
+		}
+	}
+	flush()
+	return results
+}
+
+// send renders and posts the batch, splitting it in halves while its body
+// is over the maximum size.
+func (we *WebhookEmitter) send(batch WebhookBatch) error {
+	body, err := we.render(batch)
+	if err != nil {
+		return err
+	}
+	if len(body) > we.maxBatchBytes && len(batch.Metrics) > 1 {
+		half := len(batch.Metrics) / 2
+		first := WebhookBatch{Timestamp: batch.Timestamp, Metrics: batch.Metrics[:half]}
+		second := WebhookBatch{Timestamp: batch.Timestamp, Metrics: batch.Metrics[half:]}
+		return appendError(we.send(first), we.send(second))
+	}
+	return we.sender.send(body, we.contentType)
+}
+
+func (we *WebhookEmitter) render(batch WebhookBatch) ([]byte, error) {
+	if we.template == nil {
+		body, err := json.Marshal(webhookJSONBatch(batch))
+		if err != nil {
+			return nil, fmt.Errorf("marshaling webhook batch: %w", err)
+		}
+		return body, nil
+	}
+
+	var buf bytes.Buffer
+	if err := we.template.Execute(&buf, batch); err != nil {
+		return nil, fmt.Errorf("rendering webhook template: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// webhookJSONBatch returns the body of the requests when there is no
+// template, e.g. `{"metrics":[{"timestamp":1700000000000,"name":"up",
+// "type":"gauge","value":1,"attributes":{"targetName":"redis"}}]}`.
+func webhookJSONBatch(batch WebhookBatch) interface{} {
+	metrics := make([]jsonMetric, 0, len(batch.Metrics))
+	for _, m := range batch.Metrics {
+		metrics = append(metrics, jsonMetric{
+			Timestamp:  batch.Timestamp,
+			Name:       m.Name,
+			Type:       metricType(m.Type),
+			Value:      m.Value,
+			Attributes: m.Attributes,
+		})
+	}
+	return struct {
+		Metrics []jsonMetric `json:"metrics"`
+	}{metrics}
+}
+
+// webhookMetric returns the metric with its value in the same form as the
+// JSON lines of the file emitter.
+func webhookMetric(m *Metric) (WebhookMetric, error) {
+	value, err := jsonValue(m)
+	if err != nil {
+		return WebhookMetric{}, err
+	}
+	return WebhookMetric{
+		Name:       m.name,
+		Type:       string(m.metricType),
+		Value:      value,
+		Attributes: m.attributes,
+	}, nil
+}
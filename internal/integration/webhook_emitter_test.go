@@ -0,0 +1,198 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+type webhookReceiver struct {
+	lock    sync.Mutex
+	bodies  []string
+	headers []http.Header
+}
+
+func newWebhookReceiver(t *testing.T) (*webhookReceiver, *httptest.Server) {
+	t.Helper()
+
+	receiver := &webhookReceiver{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			body = zr
+		}
+		b, err := io.ReadAll(body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		receiver.lock.Lock()
+		defer receiver.lock.Unlock()
+		receiver.bodies = append(receiver.bodies, string(b))
+		receiver.headers = append(receiver.headers, r.Header.Clone())
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(srv.Close)
+	return receiver, srv
+}
+
+func webhookTestMetrics(n int) []Metric {
+	metrics := make([]Metric, 0, n)
+	for i := 0; i < n; i++ {
+		metrics = append(metrics, Metric{
+			name:       fmt.Sprintf("metric_%d", i),
+			metricType: metricType_GAUGE,
+			value:      float64(i),
+			attributes: labels.Set{"targetName": "redis:9121"},
+		})
+	}
+	return metrics
+}
+
+func TestWebhookEmitter_JSON(t *testing.T) {
+	t.Parallel()
+
+	receiver, srv := newWebhookReceiver(t)
+	we, err := NewWebhookEmitter(WebhookEmitterConfig{URL: srv.URL, Headers: map[string]string{"X-Team": "finops"}})
+	require.NoError(t, err)
+
+	metrics := webhookTestMetrics(1)
+	metrics = append(metrics, Metric{
+		name:       "temperature",
+		metricType: metricType_GAUGE,
+		value:      math.Inf(-1),
+		attributes: labels.Set{},
+	})
+	require.NoError(t, we.Emit(metrics))
+
+	require.Len(t, receiver.bodies, 1)
+	assert.Equal(t, "gzip", receiver.headers[0].Get("Content-Encoding"))
+	assert.Equal(t, "application/json", receiver.headers[0].Get("Content-Type"))
+	assert.Equal(t, "finops", receiver.headers[0].Get("X-Team"))
+
+	var body struct {
+		Metrics []map[string]interface{} `json:"metrics"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(receiver.bodies[0]), &body))
+	require.Len(t, body.Metrics, 2)
+	assert.Equal(t, "metric_0", body.Metrics[0]["name"])
+	assert.Equal(t, "gauge", body.Metrics[0]["type"])
+	assert.Equal(t, 0.0, body.Metrics[0]["value"])
+	assert.Equal(t, map[string]interface{}{"targetName": "redis:9121"}, body.Metrics[0]["attributes"])
+	assert.NotZero(t, body.Metrics[0]["timestamp"])
+	assert.Equal(t, "-Inf", body.Metrics[1]["value"])
+}
+
+func TestWebhookEmitter_Template(t *testing.T) {
+	t.Parallel()
+
+	receiver, srv := newWebhookReceiver(t)
+	we, err := NewWebhookEmitter(WebhookEmitterConfig{
+		URL:                srv.URL,
+		Template:           `{{ range .Metrics }}{{ .Name }}={{ .Value }} {{ json .Attributes }}{{ "\n" }}{{ end }}`,
+		ContentType:        "text/plain",
+		DisableCompression: true,
+	})
+	require.NoError(t, err)
+	require.NoError(t, we.Emit(webhookTestMetrics(2)))
+
+	require.Len(t, receiver.bodies, 1)
+	assert.Empty(t, receiver.headers[0].Get("Content-Encoding"))
+	assert.Equal(t, "text/plain", receiver.headers[0].Get("Content-Type"))
+	assert.Equal(t, "metric_0=0 {\"targetName\":\"redis:9121\"}\nmetric_1=1 {\"targetName\":\"redis:9121\"}\n", receiver.bodies[0])
+}
+
+func TestWebhookEmitter_TemplateFile(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "webhook.tmpl")
+	require.NoError(t, os.WriteFile(path, []byte(`{{ len .Metrics }}`), 0o600))
+
+	receiver, srv := newWebhookReceiver(t)
+	we, err := NewWebhookEmitter(WebhookEmitterConfig{URL: srv.URL, TemplateFile: path})
+	require.NoError(t, err)
+	require.NoError(t, we.Emit(webhookTestMetrics(3)))
+	assert.Equal(t, []string{"3"}, receiver.bodies)
+}
+
+func TestWebhookEmitter_Batches(t *testing.T) {
+	t.Parallel()
+
+	t.Run("by count", func(t *testing.T) {
+		t.Parallel()
+
+		receiver, srv := newWebhookReceiver(t)
+		we, err := NewWebhookEmitter(WebhookEmitterConfig{URL: srv.URL, Template: `{{ len .Metrics }}`, BatchSize: 2})
+		require.NoError(t, err)
+		require.NoError(t, we.Emit(webhookTestMetrics(5)))
+		assert.Equal(t, []string{"2", "2", "1"}, receiver.bodies)
+	})
+
+	t.Run("by bytes", func(t *testing.T) {
+		t.Parallel()
+
+		receiver, srv := newWebhookReceiver(t)
+		// Each metric is rendered as 10 bytes.
+		we, err := NewWebhookEmitter(WebhookEmitterConfig{URL: srv.URL, Template: `{{ range .Metrics }}0123456789{{ end }}`, MaxBatchBytes: 25})
+		require.NoError(t, err)
+		require.NoError(t, we.Emit(webhookTestMetrics(5)))
+
+		var total int
+		for _, body := range receiver.bodies {
+			assert.LessOrEqual(t, len(body), 25)
+			total += len(body)
+		}
+		assert.Equal(t, 50, total)
+	})
+}
+
+func TestWebhookEmitter_Errors(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	we, err := NewWebhookEmitter(WebhookEmitterConfig{URL: srv.URL})
+	require.NoError(t, err)
+	assert.Error(t, we.Emit(webhookTestMetrics(1)))
+}
+
+func TestNewWebhookEmitter_InvalidConfig(t *testing.T) {
+	t.Parallel()
+
+	testCases := map[string]WebhookEmitterConfig{
+		"missing URL":       {},
+		"invalid URL":       {URL: "not a url"},
+		"invalid template":  {URL: "http://localhost", Template: "{{ .Metrics "},
+		"template and file": {URL: "http://localhost", Template: "{{ .Metrics }}", TemplateFile: "webhook.tmpl"},
+		"missing file":      {URL: "http://localhost", TemplateFile: filepath.Join(t.TempDir(), "missing.tmpl")},
+	}
+	for name, cfg := range testCases {
+		_, err := NewWebhookEmitter(cfg)
+		assert.Error(t, err, name)
+	}
+}
@@ -8,10 +8,30 @@ import (
 	"fmt"
 	"net/url"
 	"strings"
+	"sync/atomic"
 
 	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
 )
 
+// redactedValue replaces the sensitive parts of the target URLs.
+const redactedValue = "xxxxx"
+
+// sensitiveQueryParams holds the lowercased names of the query parameters
+// that are redacted from the target URLs.
+var sensitiveQueryParams atomic.Pointer[map[string]struct{}]
+
+// SetSensitiveQueryParams sets the names of the query parameters whose values
+// are redacted from the `scrapedTargetURL` metadata. Names are matched
+// case-insensitively. It must be called before the targets are retrieved,
+// since their metadata is built only once.
+func SetSensitiveQueryParams(params []string) {
+	set := make(map[string]struct{}, len(params))
+	for _, p := range params {
+		set[strings.ToLower(p)] = struct{}{}
+	}
+	sensitiveQueryParams.Store(&set)
+}
+
 // TargetRetriever is implemented by any type that can return the URL of a set of Prometheus metrics providers
 type TargetRetriever interface {
 	GetTargets() ([]Target, error)
@@ -58,7 +78,8 @@ func (t *Target) Metadata() labels.Set {
 	return t.metadata
 }
 
-// redactedURLString returns the string representation of the URL object while redacting the password that could be present.
+// redactedURLString returns the string representation of the URL object while redacting the password that could be present,
+// and the values of the sensitive query parameters.
 // This code is copied from this commit https://github.com/golang/go/commit/e3323f57df1f4a44093a2d25fee33513325cbb86.
 // The feature is supposed to be added to the net/url.URL type in Golang 1.15.
 func redactedURLString(u *url.URL) string {
@@ -67,11 +88,55 @@ func redactedURLString(u *url.URL) string {
 	}
 	ru := *u
 	if _, has := ru.User.Password(); has {
-		ru.User = url.UserPassword(ru.User.Username(), "xxxxx")
+		ru.User = url.UserPassword(ru.User.Username(), redactedValue)
 	}
+	ru.RawQuery = redactedQuery(ru.RawQuery)
 	return ru.String()
 }
 
+// redactedQuery returns the query with the values of the sensitive
+// parameters redacted. The rest of the query is kept as it is, in the same
+// order and even if it can't be parsed, so the URLs without sensitive
+// parameters don't change.
+func redactedQuery(rawQuery string) string {
+	params := sensitiveQueryParams.Load()
+	if rawQuery == "" || params == nil || len(*params) == 0 {
+		return rawQuery
+	}
+
+	var b strings.Builder
+	start := 0
+	for i := 0; i <= len(rawQuery); i++ {
+		// Some servers accept semicolons as separators too.
+		if i < len(rawQuery) && rawQuery[i] != '&' && rawQuery[i] != ';' {
+			continue
+		}
+		b.WriteString(redactedParam(rawQuery[start:i], *params))
+		if i < len(rawQuery) {
+			b.WriteByte(rawQuery[i])
+		}
+		start = i + 1
+	}
+	return b.String()
+}
+
+// redactedParam returns the name=value query parameter with its value
+// redacted if the name is one of the sensitive ones.
+func redactedParam(param string, sensitive map[string]struct{}) string {
+	rawName, _, found := strings.Cut(param, "=")
+	if !found {
+		return param
+	}
+	name := rawName
+	if unescaped, err := url.QueryUnescape(rawName); err == nil {
+		name = unescaped
+	}
+	if _, ok := sensitive[strings.ToLower(name)]; !ok {
+		return param
+	}
+	return rawName + "=" + redactedValue
+}
+
 // endpointToTarget returns a list of Targets from the provided TargetConfig struct.
 // The URL processing for every Target follows the next conventions:
 // - if no schema is provided, it assumes http
@@ -0,0 +1,459 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package prometheus
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// OpenMetricsContentType is the media type of the OpenMetrics text format.
+const OpenMetricsContentType = "application/openmetrics-text"
+
+// sampleExemplar is an exemplar removed from an OpenMetrics sample, along
+// with the name and labels of the sample it belongs to.
+type sampleExemplar struct {
+	name     string
+	labels   map[string]string
+	exemplar *dto.Exemplar
+}
+
+// sampleCreated is the `_created` sample of a counter, histogram or summary,
+// with the name of the family and the labels of the metric it belongs to.
+type sampleCreated struct {
+	family  string
+	labels  map[string]string
+	created *timestamppb.Timestamp
+}
+
+// DecodeOpenMetrics reads the metric families from a payload in the
+// OpenMetrics text format. The payload is converted into the Prometheus text
+// format, so counters are named after their `_total` samples, and the
+// exemplars of the counters and histogram buckets and the `_created`
+// timestamps of the counters, histograms and summaries are kept.
+func DecodeOpenMetrics(body []byte) (MetricFamiliesByName, error) {
+	text, exemplars, created, err := openMetricsToText(body)
+	if err != nil {
+		return nil, err
+	}
+	mfs, err := Decode(bytes.NewReader(text), expfmt.FmtText)
+	if err != nil {
+		return nil, err
+	}
+	attachExemplars(mfs, exemplars)
+	attachCreated(mfs, created)
+	return mfs, nil
+}
+
+// openMetricsToText converts an OpenMetrics payload into the Prometheus text
+// format, and returns the exemplars and the `_created` samples it removes.
+func openMetricsToText(body []byte) ([]byte, []sampleExemplar, []sampleCreated, error) {
+	// The types are read first, since the HELP of a metric can come before
+	// its TYPE.
+	types := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(body)+1)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) == 4 && fields[0] == "#" && fields[1] == "TYPE" {
+			types[fields[2]] = fields[3]
+		}
+	}
+
+	var out bytes.Buffer
+	out.Grow(len(body))
+	var exemplars []sampleExemplar
+	var created []sampleCreated
+	scanner = bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(body)+1)
+	var eof bool
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Text()
+		if eof {
+			if strings.TrimSpace(line) != "" {
+				return nil, nil, nil, fmt.Errorf("line %d: unexpected data after # EOF", lineNum)
+			}
+			continue
+		}
+		if line == "# EOF" {
+			eof = true
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			if converted, ok := convertOpenMetricsComment(line, types); ok {
+				out.WriteString(converted)
+				out.WriteByte('\n')
+			}
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		if sc, ok, err := parseCreatedSample(line, types); ok {
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+			created = append(created, *sc)
+			continue
+		}
+		sample, exemplar, err := convertOpenMetricsSample(line)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		out.WriteString(sample)
+		out.WriteByte('\n')
+		if exemplar != nil {
+			exemplars = append(exemplars, *exemplar)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, nil, err
+	}
+	return out.Bytes(), exemplars, created, nil
+}
+
+// convertOpenMetricsComment returns the comment line in the text format, or
+// false if it must be dropped.
+func convertOpenMetricsComment(line string, types map[string]string) (string, bool) {
+	fields := strings.SplitN(line, " ", 4)
+	if len(fields) < 3 || fields[0] != "#" {
+		return line, true
+	}
+	name := fields[2]
+
+	switch fields[1] {
+	case "EOF", "UNIT":
+		return "", false
+	case "HELP":
+		switch types[name] {
+		case "counter":
+			fields[2] = counterName(name)
+		case "info", "stateset", "gaugehistogram":
+			return "", false
+		}
+		return strings.Join(fields, " "), true
+	case "TYPE":
+		if len(fields) != 4 {
+			return line, true
+		}
+		switch fields[3] {
+		case "counter":
+			fields[2] = counterName(name)
+		case "unknown":
+			fields[3] = "untyped"
+		case "info", "stateset", "gaugehistogram":
+			// The text format has no equivalent types, so their samples are
+			// parsed as untyped metrics.
+			return "", false
+		}
+		return strings.Join(fields, " "), true
+	}
+	return line, true
+}
+
+// counterName returns the name of the samples of an OpenMetrics counter.
+func counterName(name string) string {
+	if strings.HasSuffix(name, "_total") {
+		return name
+	}
+	return name + "_total"
+}
+
+// parseCreatedSample parses the sample if it's the `_created` sample of a
+// counter, histogram or summary, whose value is the time it was created or
+// reset, and returns false otherwise.
+func parseCreatedSample(line string, types map[string]string) (*sampleCreated, bool, error) {
+	name, rawLabels, rest, err := splitSample(line)
+	if err != nil || !strings.HasSuffix(name, "_created") {
+		return nil, false, nil
+	}
+	family := strings.TrimSuffix(name, "_created")
+	switch types[family] {
+	case "counter":
+		family = counterName(family)
+	case "histogram", "summary":
+	default:
+		return nil, false, nil
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return nil, true, fmt.Errorf("invalid sample %q", line)
+	}
+	created, err := parseTimestamp(fields[0])
+	if err != nil {
+		return nil, true, fmt.Errorf("invalid created timestamp in sample %q: %w", line, err)
+	}
+	sampleLabels, err := parseLabels(rawLabels)
+	if err != nil {
+		return nil, true, fmt.Errorf("invalid labels in sample %q: %w", line, err)
+	}
+	return &sampleCreated{family: family, labels: sampleLabels, created: created}, true, nil
+}
+
+// convertOpenMetricsSample returns the sample line in the text format, and
+// its exemplar if it has one.
+func convertOpenMetricsSample(line string) (string, *sampleExemplar, error) {
+	name, rawLabels, rest, err := splitSample(line)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var exemplarPart string
+	if i := strings.Index(rest, "#"); i >= 0 {
+		rest, exemplarPart = rest[:i], strings.TrimSpace(rest[i+1:])
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) == 0 || len(fields) > 2 {
+		return "", nil, fmt.Errorf("invalid sample %q", line)
+	}
+
+	var sb strings.Builder
+	sb.WriteString(name)
+	if rawLabels != "" {
+		sb.WriteString("{" + rawLabels + "}")
+	}
+	sb.WriteString(" " + fields[0])
+	if len(fields) == 2 {
+		// OpenMetrics timestamps are in seconds, while the text format uses
+		// milliseconds.
+		ts, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid timestamp in sample %q: %w", line, err)
+		}
+		sb.WriteString(" " + strconv.FormatInt(int64(math.Round(ts*1000)), 10))
+	}
+
+	if exemplarPart == "" {
+		return sb.String(), nil, nil
+	}
+
+	exemplar, err := parseExemplar(exemplarPart)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid exemplar in sample %q: %w", line, err)
+	}
+	sampleLabels, err := parseLabels(rawLabels)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid labels in sample %q: %w", line, err)
+	}
+	return sb.String(), &sampleExemplar{name: name, labels: sampleLabels, exemplar: exemplar}, nil
+}
+
+// parseExemplar parses the exemplar of a sample, e.g.
+// `{trace_id="abc"} 0.67 1520879607.789`.
+func parseExemplar(s string) (*dto.Exemplar, error) {
+	if !strings.HasPrefix(s, "{") {
+		return nil, fmt.Errorf("missing labels")
+	}
+	_, rawLabels, rest, err := splitSample(s)
+	if err != nil {
+		return nil, err
+	}
+	exemplarLabels, err := parseLabels(rawLabels)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) == 0 || len(fields) > 2 {
+		return nil, fmt.Errorf("invalid value")
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return nil, err
+	}
+
+	exemplar := &dto.Exemplar{Value: proto.Float64(value)}
+	names := make([]string, 0, len(exemplarLabels))
+	for name := range exemplarLabels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		exemplar.Label = append(exemplar.Label, &dto.LabelPair{Name: proto.String(name), Value: proto.String(exemplarLabels[name])})
+	}
+	if len(fields) == 2 {
+		ts, err := parseTimestamp(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		exemplar.Timestamp = ts
+	}
+	return exemplar, nil
+}
+
+// parseTimestamp parses a timestamp in seconds. The fractional part is parsed
+// separately when possible, so the nanoseconds are not rounded.
+func parseTimestamp(s string) (*timestamppb.Timestamp, error) {
+	if whole, frac, ok := strings.Cut(s, "."); ok && !strings.ContainsAny(s, "eE-") && len(frac) <= 9 {
+		sec, err := strconv.ParseInt(whole, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		nanos := int64(0)
+		if frac != "" {
+			if nanos, err = strconv.ParseInt(frac+strings.Repeat("0", 9-len(frac)), 10, 32); err != nil {
+				return nil, err
+			}
+		}
+		return &timestamppb.Timestamp{Seconds: sec, Nanos: int32(nanos)}, nil
+	}
+
+	ts, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, err
+	}
+	sec, frac := math.Modf(ts)
+	return &timestamppb.Timestamp{Seconds: int64(sec), Nanos: int32(math.Round(frac * 1e9))}, nil
+}
+
+// splitSample splits a sample into its name, the raw content of its labels
+// and the rest of the line.
+func splitSample(line string) (name, rawLabels, rest string, err error) {
+	end := strings.IndexAny(line, "{ ")
+	if end < 0 {
+		return "", "", "", fmt.Errorf("invalid sample %q", line)
+	}
+	name = line[:end]
+	if line[end] != '{' {
+		return name, "", line[end:], nil
+	}
+
+	inQuotes := false
+	for i := end + 1; i < len(line); i++ {
+		switch {
+		case inQuotes && line[i] == '\\':
+			i++
+		case line[i] == '"':
+			inQuotes = !inQuotes
+		case !inQuotes && line[i] == '}':
+			return name, line[end+1 : i], line[i+1:], nil
+		}
+	}
+	return "", "", "", fmt.Errorf("unterminated labels in %q", line)
+}
+
+// parseLabels parses the content of a label set, e.g. `a="1",b="2"`.
+func parseLabels(s string) (map[string]string, error) {
+	labels := map[string]string{}
+	for {
+		s = strings.TrimLeft(s, " ,")
+		if s == "" {
+			return labels, nil
+		}
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 || eq+1 >= len(s) || s[eq+1] != '"' {
+			return nil, fmt.Errorf("invalid label in %q", s)
+		}
+		name := strings.TrimSpace(s[:eq])
+
+		var value strings.Builder
+		i := eq + 2
+		for ; i < len(s) && s[i] != '"'; i++ {
+			if s[i] == '\\' && i+1 < len(s) {
+				i++
+				if s[i] == 'n' {
+					value.WriteByte('\n')
+					continue
+				}
+			}
+			value.WriteByte(s[i])
+		}
+		if i >= len(s) {
+			return nil, fmt.Errorf("unterminated label value in %q", s)
+		}
+		labels[name] = value.String()
+		s = s[i+1:]
+	}
+}
+
+// attachExemplars sets the exemplars to the counters and histogram buckets
+// they belong to.
+func attachExemplars(mfs MetricFamiliesByName, exemplars []sampleExemplar) {
+	for _, se := range exemplars {
+		if mf, ok := mfs[se.name]; ok && mf.GetType() == dto.MetricType_COUNTER {
+			if m := findMetric(mf.GetMetric(), se.labels, ""); m != nil {
+				m.Counter.Exemplar = se.exemplar
+			}
+			continue
+		}
+
+		family := strings.TrimSuffix(se.name, "_bucket")
+		mf, ok := mfs[family]
+		if !ok || family == se.name || mf.GetType() != dto.MetricType_HISTOGRAM {
+			continue
+		}
+		le, err := strconv.ParseFloat(se.labels["le"], 64)
+		if err != nil {
+			continue
+		}
+		m := findMetric(mf.GetMetric(), se.labels, "le")
+		if m == nil {
+			continue
+		}
+		for _, b := range m.GetHistogram().GetBucket() {
+			if b.GetUpperBound() == le {
+				b.Exemplar = se.exemplar
+			}
+		}
+	}
+}
+
+// attachCreated sets the created timestamps to the counters, histograms and
+// summaries they belong to.
+func attachCreated(mfs MetricFamiliesByName, created []sampleCreated) {
+	for _, sc := range created {
+		mf, ok := mfs[sc.family]
+		if !ok {
+			continue
+		}
+		m := findMetric(mf.GetMetric(), sc.labels, "")
+		if m == nil {
+			continue
+		}
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			m.Counter.CreatedTimestamp = sc.created
+		case dto.MetricType_HISTOGRAM:
+			m.Histogram.CreatedTimestamp = sc.created
+		case dto.MetricType_SUMMARY:
+			m.Summary.CreatedTimestamp = sc.created
+		}
+	}
+}
+
+// findMetric returns the metric with the given labels, not taking into
+// account the ignored one.
+func findMetric(metrics []*dto.Metric, labels map[string]string, ignored string) *dto.Metric {
+	expected := len(labels)
+	if _, ok := labels[ignored]; ok {
+		expected--
+	}
+	for _, m := range metrics {
+		if len(m.GetLabel()) != expected {
+			continue
+		}
+		matches := true
+		for _, lp := range m.GetLabel() {
+			if v, ok := labels[lp.GetName()]; !ok || v != lp.GetValue() {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return m
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package prometheus_test
+
+import (
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/prometheus"
+)
+
+func TestDecodeOpenMetrics(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name    string
+		payload string
+		check   func(t *testing.T, mfs prometheus.MetricFamiliesByName)
+	}{
+		{
+			name:    "without EOF",
+			payload: "# TYPE requests counter\nrequests_total 1\n",
+			check: func(t *testing.T, mfs prometheus.MetricFamiliesByName) {
+				assert.Equal(t, 1.0, mfs["requests_total"].GetMetric()[0].GetCounter().GetValue())
+			},
+		},
+		{
+			name:    "blank lines after EOF",
+			payload: "# TYPE requests counter\nrequests_total 1\n# EOF\n\n",
+			check: func(t *testing.T, mfs prometheus.MetricFamiliesByName) {
+				assert.Len(t, mfs["requests_total"].GetMetric(), 1)
+			},
+		},
+		{
+			name:    "escaped label values",
+			payload: "# TYPE path gauge\npath{p=\"a\\\"b\\\\c\\nd\",q=\"{}#,\"} 1\n# EOF\n",
+			check: func(t *testing.T, mfs prometheus.MetricFamiliesByName) {
+				labels := mfs["path"].GetMetric()[0].GetLabel()
+				require.Len(t, labels, 2)
+				assert.Equal(t, "a\"b\\c\nd", labels[0].GetValue())
+				assert.Equal(t, "{}#,", labels[1].GetValue())
+			},
+		},
+		{
+			name:    "escaped exemplar label values",
+			payload: "# TYPE requests counter\nrequests_total 1 # {trace_id=\"a\\\"b\\\\c\"} 1\n# EOF\n",
+			check: func(t *testing.T, mfs prometheus.MetricFamiliesByName) {
+				exemplar := mfs["requests_total"].GetMetric()[0].GetCounter().GetExemplar()
+				require.NotNil(t, exemplar)
+				assert.Equal(t, "a\"b\\c", exemplar.GetLabel()[0].GetValue())
+			},
+		},
+		{
+			name:    "counter declared with its _total suffix",
+			payload: "# TYPE requests_total counter\nrequests_total 1\n# EOF\n",
+			check: func(t *testing.T, mfs prometheus.MetricFamiliesByName) {
+				assert.Equal(t, dto.MetricType_COUNTER, mfs["requests_total"].GetType())
+			},
+		},
+		{
+			name: "created samples",
+			payload: `# TYPE requests counter
+requests_total{code="200"} 1
+requests_created{code="200"} 1520430000.5
+requests_total{code="500"} 2
+requests_created{code="500"} 1520430001
+# TYPE rpc summary
+rpc_count 1
+rpc_sum 2
+rpc_created 1520430002
+# TYPE job_created gauge
+job_created 1520430003
+# EOF
+`,
+			check: func(t *testing.T, mfs prometheus.MetricFamiliesByName) {
+				assert.NotContains(t, mfs, "requests_created")
+				assert.NotContains(t, mfs, "rpc_created")
+				requests := mfs["requests_total"].GetMetric()
+				require.Len(t, requests, 2)
+				assert.Equal(t, int64(1520430000), requests[0].GetCounter().GetCreatedTimestamp().GetSeconds())
+				assert.Equal(t, int32(500000000), requests[0].GetCounter().GetCreatedTimestamp().GetNanos())
+				assert.Equal(t, int64(1520430001), requests[1].GetCounter().GetCreatedTimestamp().GetSeconds())
+				assert.Equal(t, int64(1520430002), mfs["rpc"].GetMetric()[0].GetSummary().GetCreatedTimestamp().GetSeconds())
+				// The gauges ending in _created are kept.
+				assert.Equal(t, 1520430003.0, mfs["job_created"].GetMetric()[0].GetGauge().GetValue())
+			},
+		},
+		{
+			name: "unit and help metadata",
+			payload: `# HELP latency_seconds Latency of the \\ requests.
+# UNIT latency_seconds seconds
+# TYPE latency_seconds gauge
+latency_seconds 0.5
+# HELP requests Requests served.
+# TYPE requests counter
+requests_total 1
+# HELP build Build information.
+# TYPE build info
+build_info{version="1.0"} 1
+# EOF
+`,
+			check: func(t *testing.T, mfs prometheus.MetricFamiliesByName) {
+				assert.Equal(t, "Latency of the \\ requests.", mfs["latency_seconds"].GetHelp())
+				// The help of the counters is moved to their _total samples.
+				assert.Equal(t, "Requests served.", mfs["requests_total"].GetHelp())
+				assert.Equal(t, dto.MetricType_UNTYPED, mfs["build_info"].GetType())
+				assert.Empty(t, mfs["build_info"].GetHelp())
+			},
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			mfs, err := prometheus.DecodeOpenMetrics([]byte(tc.payload))
+			require.NoError(t, err)
+			tc.check(t, mfs)
+		})
+	}
+}
+
+func TestDecodeOpenMetrics_Invalid(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name    string
+		payload string
+	}{
+		{name: "data after EOF", payload: "# TYPE requests counter\nrequests_total 1\n# EOF\nrequests_total 2\n"},
+		{name: "exemplar without labels", payload: "# TYPE requests counter\nrequests_total 1 # 1\n# EOF\n"},
+		{name: "exemplar without value", payload: "# TYPE requests counter\nrequests_total 1 # {trace_id=\"a\"}\n# EOF\n"},
+		{name: "exemplar with invalid value", payload: "# TYPE requests counter\nrequests_total 1 # {trace_id=\"a\"} x\n# EOF\n"},
+		{name: "exemplar with invalid timestamp", payload: "# TYPE requests counter\nrequests_total 1 # {trace_id=\"a\"} 1 x\n# EOF\n"},
+		{name: "exemplar with unterminated labels", payload: "# TYPE requests counter\nrequests_total 1 # {trace_id=\"a} 1\n# EOF\n"},
+		{name: "created sample without value", payload: "# TYPE requests counter\nrequests_total 1\nrequests_created\n# EOF\n"},
+		{name: "unterminated labels", payload: "# TYPE requests counter\nrequests_total{code=\"200} 1\n# EOF\n"},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := prometheus.DecodeOpenMetrics([]byte(tc.payload))
+			assert.Error(t, err)
+		})
+	}
+}
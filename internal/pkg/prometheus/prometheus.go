@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
 
 	prom "github.com/prometheus/client_golang/prometheus"
@@ -17,7 +18,7 @@ import (
 
 // MetricFamiliesByName is a map of Prometheus metrics family names and their
 // representation.
-type MetricFamiliesByName map[string]dto.MetricFamily
+type MetricFamiliesByName map[string]*dto.MetricFamily
 
 // HTTPDoer executes http requests. It is implemented by *http.Client.
 type HTTPDoer interface {
@@ -67,12 +68,49 @@ func Get(client HTTPDoer, url string, acceptHeader string, fetchTimeout string)
 	if err != nil {
 		return mfs, err
 	}
-	r := bytes.NewReader(body)
+	mfs, err = decodeResponse(body, resp.Header)
+	if err != nil {
+		return nil, err
+	}
+
+	bodySize := float64(len(body))
+	targetSize.With(prom.Labels{"target": url}).Set(bodySize)
+	totalScrapedPayload.Add(bodySize)
+	return mfs, nil
+}
+
+// DecodeContent decodes the payload of the given content type like the
+// payloads scraped from the targets, e.g. to test the transformations with a
+// saved payload. An empty content type stands for the text format.
+func DecodeContent(body []byte, contentType string) (MetricFamiliesByName, error) {
+	header := http.Header{}
+	header.Set("Content-Type", contentType)
+	return decodeResponse(body, header)
+}
 
-	d := expfmt.NewDecoder(r, expfmt.FmtText)
+// decodeResponse decodes the payload according to the content type of the
+// response. Protobuf and OpenMetrics payloads carry the exemplars of the
+// metrics, which are lost in the text format. Payloads of any other type are
+// decoded as text, as it has always been done.
+func decodeResponse(body []byte, header http.Header) (MetricFamiliesByName, error) {
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	if mediaType == OpenMetricsContentType {
+		return DecodeOpenMetrics(body)
+	}
+	if format := expfmt.ResponseFormat(header); format == expfmt.FmtProtoDelim {
+		return Decode(bytes.NewReader(body), format)
+	}
+	return Decode(bytes.NewReader(body), expfmt.FmtText)
+}
+
+// Decode reads the metric families from a payload in the given exposition
+// format.
+func Decode(r io.Reader, format expfmt.Format) (MetricFamiliesByName, error) {
+	mfs := MetricFamiliesByName{}
+	d := expfmt.NewDecoder(r, format)
 	for {
-		var mf dto.MetricFamily
-		if err := d.Decode(&mf); err != nil {
+		mf := &dto.MetricFamily{}
+		if err := d.Decode(mf); err != nil {
 			if err == io.EOF {
 				break
 			}
@@ -80,9 +118,5 @@ func Get(client HTTPDoer, url string, acceptHeader string, fetchTimeout string)
 		}
 		mfs[mf.GetName()] = mf
 	}
-
-	bodySize := float64(len(body))
-	targetSize.With(prom.Labels{"target": url}).Set(bodySize)
-	totalScrapedPayload.Add(bodySize)
 	return mfs, nil
 }
@@ -7,7 +7,11 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
 
 	"github.com/newrelic/nri-prometheus/internal/pkg/prometheus"
 )
@@ -42,3 +46,109 @@ func TestGetHeader(t *testing.T) {
 	assert.NoError(t, err)
 	assert.ElementsMatch(t, expected, actual)
 }
+
+const openMetricsPayload = `# HELP http_requests Requests served.
+# TYPE http_requests counter
+http_requests_total{code="200",path="/a{b}#c"} 17 1520879607.789 # {trace_id="KOO5S4vxi0o",span_id="x"} 0.67 1520879602.123
+http_requests_created{code="200",path="/a{b}#c"} 1520430000.123
+http_requests_total{code="500",path="/"} 2
+# TYPE latency_seconds histogram
+# UNIT latency_seconds seconds
+latency_seconds_bucket{le="0.1"} 8
+latency_seconds_bucket{le="1.0"} 10 # {trace_id="oHg5SJYRHA0"} 0.5
+latency_seconds_bucket{le="+Inf"} 11
+latency_seconds_count 11
+latency_seconds_sum 3.5
+latency_seconds_created 1520430000
+# TYPE build info
+build_info{version="1.0"} 1
+# TYPE queue_depth unknown
+queue_depth 3
+# EOF
+`
+
+func TestGet_OpenMetrics(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+		_, _ = w.Write([]byte(openMetricsPayload))
+	}))
+	defer ts.Close()
+
+	mfs, err := prometheus.Get(http.DefaultClient, ts.URL, testHeader, "15")
+	require.NoError(t, err)
+
+	requests := mfs["http_requests_total"]
+	assert.Equal(t, dto.MetricType_COUNTER, requests.GetType())
+	require.Len(t, requests.GetMetric(), 2)
+	for _, m := range requests.GetMetric() {
+		if m.GetLabel()[0].GetValue() != "200" {
+			assert.Nil(t, m.GetCounter().GetExemplar())
+			continue
+		}
+		assert.Equal(t, "/a{b}#c", m.GetLabel()[1].GetValue())
+		assert.Equal(t, 17.0, m.GetCounter().GetValue())
+		assert.Equal(t, int64(1520879607789), m.GetTimestampMs())
+
+		exemplar := m.GetCounter().GetExemplar()
+		require.NotNil(t, exemplar)
+		assert.Equal(t, 0.67, exemplar.GetValue())
+		assert.Equal(t, int64(1520879602), exemplar.GetTimestamp().GetSeconds())
+		assert.Equal(t, "span_id", exemplar.GetLabel()[0].GetName())
+		assert.Equal(t, "trace_id", exemplar.GetLabel()[1].GetName())
+		assert.Equal(t, "KOO5S4vxi0o", exemplar.GetLabel()[1].GetValue())
+
+		created := m.GetCounter().GetCreatedTimestamp()
+		require.NotNil(t, created)
+		assert.Equal(t, int64(1520430000), created.GetSeconds())
+		assert.Equal(t, int32(123000000), created.GetNanos())
+	}
+	// The `_created` samples are not parsed as metrics of their own.
+	assert.NotContains(t, mfs, "http_requests_created")
+	assert.NotContains(t, mfs, "latency_seconds_created")
+
+	latency := mfs["latency_seconds"]
+	assert.Equal(t, dto.MetricType_HISTOGRAM, latency.GetType())
+	buckets := latency.GetMetric()[0].GetHistogram().GetBucket()
+	require.Len(t, buckets, 3)
+	assert.Nil(t, buckets[0].GetExemplar())
+	assert.Equal(t, "oHg5SJYRHA0", buckets[1].GetExemplar().GetLabel()[0].GetValue())
+	assert.Equal(t, int64(1520430000), latency.GetMetric()[0].GetHistogram().GetCreatedTimestamp().GetSeconds())
+
+	buildInfo := mfs["build_info"]
+	assert.Equal(t, dto.MetricType_UNTYPED, buildInfo.GetType())
+	queueDepth := mfs["queue_depth"]
+	assert.Equal(t, dto.MetricType_UNTYPED, queueDepth.GetType())
+}
+
+func TestGet_Protobuf(t *testing.T) {
+	t.Parallel()
+
+	family := &dto.MetricFamily{
+		Name: proto.String("http_requests_total"),
+		Type: dto.MetricType_COUNTER.Enum(),
+		Metric: []*dto.Metric{{
+			Counter: &dto.Counter{
+				Value: proto.Float64(17),
+				Exemplar: &dto.Exemplar{
+					Label: []*dto.LabelPair{{Name: proto.String("trace_id"), Value: proto.String("KOO5S4vxi0o")}},
+					Value: proto.Float64(0.67),
+				},
+			},
+		}},
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", string(expfmt.FmtProtoDelim))
+		require.NoError(t, expfmt.NewEncoder(w, expfmt.FmtProtoDelim).Encode(family))
+	}))
+	defer ts.Close()
+
+	mfs, err := prometheus.Get(http.DefaultClient, ts.URL, testHeader, "15")
+	require.NoError(t, err)
+
+	requests := mfs["http_requests_total"]
+	require.Len(t, requests.GetMetric(), 1)
+	assert.Equal(t, "KOO5S4vxi0o", requests.GetMetric()[0].GetCounter().GetExemplar().GetLabel()[0].GetValue())
+}